@@ -156,7 +156,8 @@ func (c *Client) JobPush(r *JobOptions) (*Job, error) {
 				if err = json.Unmarshal(evt.Payload.Doc, &j.Attrs); err != nil {
 					return nil, err
 				}
-				if j.Attrs.State == "done" || j.Attrs.State == "errored" {
+				switch j.Attrs.State {
+				case "done", "errored", "canceled", "timed_out":
 					return j, nil
 				}
 			case "io.cozy.jobs.logs":
@@ -207,9 +208,24 @@ func (c *Client) GetTriggers(worker string) ([]*Trigger, error) {
 
 // TriggerLaunch launches manually the trigger with the specified ID.
 func (c *Client) TriggerLaunch(triggerID string) (*Job, error) {
+	return c.triggerLaunch(triggerID, false)
+}
+
+// TriggerLaunchForce launches manually the trigger with the specified ID, even
+// if it is paused.
+func (c *Client) TriggerLaunchForce(triggerID string) (*Job, error) {
+	return c.triggerLaunch(triggerID, true)
+}
+
+func (c *Client) triggerLaunch(triggerID string, force bool) (*Job, error) {
+	var q url.Values
+	if force {
+		q = url.Values{"force": {"true"}}
+	}
 	res, err := c.Req(&request.Options{
-		Method: "POST",
-		Path:   fmt.Sprintf("/jobs/triggers/%s/launch", url.PathEscape(triggerID)),
+		Method:  "POST",
+		Path:    fmt.Sprintf("/jobs/triggers/%s/launch", url.PathEscape(triggerID)),
+		Queries: q,
 	})
 	if err != nil {
 		return nil, err
@@ -580,6 +580,8 @@ var listTriggerCmd = &cobra.Command{
 	},
 }
 
+var flagTriggerForce bool
+
 var launchTriggerCmd = &cobra.Command{
 	Use:     "launch [triggerId]",
 	Short:   `Creates a job from a specific trigger`,
@@ -600,7 +602,11 @@ func launchTrigger(cmd *cobra.Command, args []string) error {
 	c := newClient(flagDomain, consts.Triggers)
 
 	// Creates job
-	j, err := c.TriggerLaunch(args[0])
+	launch := c.TriggerLaunch
+	if flagTriggerForce {
+		launch = c.TriggerLaunchForce
+	}
+	j, err := launch(args[0])
 	if err != nil {
 		return err
 	}
@@ -670,6 +676,7 @@ func init() {
 	activateMaintenanceKonnectorsCmd.PersistentFlags().BoolVar(&flagKonnectorsDisallowManualExec, "no-manual-exec", false, "specify a maintenance disallowing manual execution")
 
 	triggersCmdGroup.PersistentFlags().StringVar(&flagDomain, "domain", cozyDomain(), "specify the domain name of the instance")
+	launchTriggerCmd.Flags().BoolVar(&flagTriggerForce, "force", false, "launch the trigger even if it is paused")
 	triggersCmdGroup.AddCommand(launchTriggerCmd)
 	triggersCmdGroup.AddCommand(listTriggerCmd)
 	triggersCmdGroup.AddCommand(showWebappTriggersCmd)
@@ -10,7 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/cozy/cozy-stack/model/stack"
 	build "github.com/cozy/cozy-stack/pkg/config"
@@ -35,8 +35,11 @@ It will accept HTTP requests on localhost:8080 by default.
 Use the --port and --host flags to change the listening option.
 
 The SIGINT signal will trigger a graceful stop of cozy-stack: it will wait that
-current HTTP requests and jobs are finished (in a limit of 2 minutes) before
-exiting.
+current HTTP requests and jobs are finished (in a limit of 30 seconds by
+default, see shutdown.grace_timeout in the configuration) before exiting.
+
+The SIGHUP signal will reload the configuration file. Some parameters, like the
+listening addresses or the redis and CouchDB URLs, still require a restart.
 
 If you are the developer of a client-side app, you can use --appdir
 to mount a directory as the application with the 'app' slug.
@@ -109,19 +112,28 @@ example), you can use the --appdir flag like this:
 
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, os.Interrupt)
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
 
-		select {
-		case err := <-servers.Wait():
-			return err
-		case <-sigs:
-			fmt.Println("\nReceived interrupt signal:")
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-			defer cancel() // make gometalinter happy
-			if err := group.Shutdown(ctx); err != nil {
+		for {
+			select {
+			case err := <-servers.Wait():
 				return err
+			case <-hups:
+				fmt.Println("Received hangup signal: reloading the configuration")
+				if err := config.ReloadFiles(cfgFile); err != nil {
+					errPrintfln("Cannot reload the configuration: %s", err)
+				}
+			case <-sigs:
+				fmt.Println("\nReceived interrupt signal:")
+				ctx, cancel := context.WithTimeout(context.Background(), config.GetConfig().Shutdown.GraceTimeout)
+				defer cancel() // make gometalinter happy
+				if err := group.Shutdown(ctx); err != nil {
+					return err
+				}
+				fmt.Println("All settled, bye bye !")
+				return nil
 			}
-			fmt.Println("All settled, bye bye !")
-			return nil
 		}
 	},
 }
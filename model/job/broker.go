@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
@@ -26,15 +27,30 @@ const (
 	Done State = "done"
 	// Errored state
 	Errored State = "errored"
+	// Canceled state, for the jobs that have been canceled
+	Canceled State = "canceled"
+	// TimedOut state, for the jobs that have failed with ErrTimeout
+	TimedOut State = "timed_out"
+)
+
+const (
+	// PriorityLow is for background maintenance jobs
+	PriorityLow Priority = -1
+	// PriorityNormal is the default priority
+	PriorityNormal Priority = 0
+	// PriorityHigh is for urgent jobs, like the ones triggered by the user
+	PriorityHigh Priority = 1
 )
 
 // defaultMaxLimits defines the maximum limit of how much jobs will be returned
 // for each job state
 var defaultMaxLimits map[State]int = map[State]int{
-	Queued:  50,
-	Running: 50,
-	Done:    50,
-	Errored: 50,
+	Queued:   50,
+	Running:  50,
+	Done:     50,
+	Errored:  50,
+	Canceled: 50,
+	TimedOut: 50,
 }
 
 type (
@@ -60,11 +76,43 @@ type (
 		WorkerIsReserved(workerType string) (bool, error)
 		// WorkersTypes returns the list of registered workers types.
 		WorkersTypes() []string
+
+		// DeadLetters returns the jobs of the given worker type that have
+		// exhausted their retries.
+		DeadLetters(workerType string) ([]*DeadLetter, error)
+		// RequeueDeadLetter removes the job from the dead letters and pushes
+		// it again in its queue.
+		RequeueDeadLetter(workerType, jobID string) (*Job, error)
+
+		// CancelJob removes the job from its queue if it has not started yet,
+		// or cancels the context given to the worker if it is running. The
+		// workers must watch this context to stop.
+		CancelJob(db prefixer.Prefixer, jobID string) error
+
+		// Stats returns the statistics of the queues of the workers.
+		Stats() ([]WorkerStats, error)
+
+		// PushChain pushes the first job of a chain, and returns the chain
+		// ID. The next jobs are pushed when the previous one has succeeded.
+		PushChain(db prefixer.Prefixer, specs []JobSpec) (string, error)
+	}
+
+	// WorkerStats are the statistics of the queue of a worker type. Running
+	// is the number of jobs executed by this stack.
+	WorkerStats struct {
+		WorkerType string        `json:"worker_type"`
+		Queued     int           `json:"queued"`
+		Running    int           `json:"running"`
+		OldestAge  time.Duration `json:"oldest_age"`
 	}
 
 	// State represent the state of a job.
 	State string
 
+	// Priority is the priority of a job in its queue: the jobs with a higher
+	// priority are dequeued first.
+	Priority int
+
 	// Message is a json encoded job message.
 	Message json.RawMessage
 
@@ -89,13 +137,33 @@ type (
 		Payload     Payload     `json:"payload,omitempty"`
 		Manual      bool        `json:"manual_execution,omitempty"`
 		Debounced   bool        `json:"debounced,omitempty"`
+		Priority    Priority    `json:"priority,omitempty"`
 		Options     *JobOptions `json:"options,omitempty"`
 		State       State       `json:"state"`
 		QueuedAt    time.Time   `json:"queued_at"`
+		RunAt       time.Time   `json:"run_at"`
 		StartedAt   time.Time   `json:"started_at"`
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+		Progress    *Progress   `json:"progress,omitempty"`
+		// Result is the JSON-encoded result given by the worker
+		Result json.RawMessage `json:"result,omitempty"`
+		// Logs are the logs emitted by the worker for this job
+		Logs []JobLog `json:"logs,omitempty"`
+		// IdempotencyKey is used to not push twice the same job
+		IdempotencyKey string `json:"idempotency_key,omitempty"`
+		// Chain is set for the jobs pushed via PushChain
+		Chain *JobChain `json:"chain,omitempty"`
+		// DebouncedCount is the number of events combined in a debounced job
+		DebouncedCount int `json:"debounced_count,omitempty"`
+	}
+
+	// Progress is the progress reported by a worker for a long-running job.
+	Progress struct {
+		Fraction  float64   `json:"fraction"`
+		Message   string    `json:"message,omitempty"`
+		UpdatedAt time.Time `json:"updated_at"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -109,7 +177,21 @@ type (
 		Manual      bool
 		Debounced   bool
 		ForwardLogs bool
+		Priority    Priority
 		Options     *JobOptions
+		// RunAt is the time before which the job must not be executed. The
+		// zero value means that the job can be executed immediately.
+		RunAt time.Time
+		// IdempotencyKey is optional. When it is set, pushing a job with the
+		// same key as a job that is still pending or running, or that has
+		// ended recently, returns this job instead of pushing a new one.
+		IdempotencyKey string
+		// Chain is the chain of jobs to which the job belongs, with the steps
+		// to push after it.
+		Chain *JobChain
+		// DebouncedCount is the number of requests that have been combined
+		// when the trigger is debounced.
+		DebouncedCount int
 	}
 
 	// JobOptions struct contains the execution properties of the jobs.
@@ -152,6 +234,10 @@ func (j *Job) Clone() couchdb.Doc {
 		tmp := *j.Options
 		cloned.Options = &tmp
 	}
+	if j.Progress != nil {
+		tmp := *j.Progress
+		cloned.Progress = &tmp
+	}
 	if j.Message != nil {
 		tmp := j.Message
 		j.Message = make([]byte, len(tmp))
@@ -167,6 +253,18 @@ func (j *Job) Clone() couchdb.Doc {
 		j.Payload = make([]byte, len(tmp))
 		copy(j.Payload[:], tmp)
 	}
+	if j.Result != nil {
+		cloned.Result = make(json.RawMessage, len(j.Result))
+		copy(cloned.Result, j.Result)
+	}
+	if j.Logs != nil {
+		cloned.Logs = make([]JobLog, len(j.Logs))
+		copy(cloned.Logs, j.Logs)
+	}
+	if j.Chain != nil {
+		tmp := *j.Chain
+		cloned.Chain = &tmp
+	}
 	return &cloned
 }
 
@@ -211,6 +309,81 @@ func (j *Job) Logger() *logger.Entry {
 	return logger.WithDomain(j.Domain).WithNamespace("jobs")
 }
 
+// Ended returns true for the states of the jobs that have been completed,
+// with success or not.
+func (s State) Ended() bool {
+	switch s {
+	case Done, Errored, Canceled, TimedOut:
+		return true
+	}
+	return false
+}
+
+// Failed returns true for the states of the jobs that have been completed
+// without success.
+func (s State) Failed() bool {
+	switch s {
+	case Errored, Canceled, TimedOut:
+		return true
+	}
+	return false
+}
+
+// failedState returns the state of a job that has failed with the given
+// error.
+func failedState(err error) State {
+	switch {
+	case errors.Is(err, ErrCanceled):
+		return Canceled
+	case errors.Is(err, ErrTimeout):
+		return TimedOut
+	}
+	return Errored
+}
+
+// QueuePriority returns the priority used to dequeue the job. The jobs
+// executed manually have a high priority.
+func (j *Job) QueuePriority() Priority {
+	if j.Manual && j.Priority < PriorityHigh {
+		return PriorityHigh
+	}
+	return j.Priority
+}
+
+// priorityAging returns the time a job must wait in its queue to gain one
+// level of priority, or 0 if the aging is disabled (the default).
+func priorityAging() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil {
+		return cfg.Jobs.PriorityAging
+	}
+	return 0
+}
+
+// agedPriority returns the priority of a queued job, increased by one level
+// for each aging period it has waited in its queue. It avoids the starvation
+// of the low priority jobs.
+func (j *Job) agedPriority(now time.Time, aging time.Duration) Priority {
+	return agePriority(j.QueuePriority(), j.QueuedAt, now, aging)
+}
+
+// agePriority returns the given priority, increased by one level for each
+// aging period since queuedAt.
+func agePriority(priority Priority, queuedAt, now time.Time, aging time.Duration) Priority {
+	if aging <= 0 || queuedAt.IsZero() {
+		return priority
+	}
+	if waited := now.Sub(queuedAt); waited > 0 {
+		priority += Priority(waited / aging)
+	}
+	return priority
+}
+
+// delayed returns true if the job must wait in the delayed set before being
+// put in the queue.
+func (j *Job) delayed() bool {
+	return !j.RunAt.IsZero() && j.RunAt.After(time.Now())
+}
+
 // AckConsumed sets the job infos state to Running an sends the new job infos
 // on the channel.
 func (j *Job) AckConsumed() error {
@@ -234,15 +407,35 @@ func (j *Job) Ack() error {
 // Nack sets the job infos state to Errored, set the specified error has the
 // error field and sends the new job infos on the channel.
 func (j *Job) Nack(errorMessage string) error {
+	return j.fail(Errored, errorMessage)
+}
+
+// fail ends the job with the given state (Errored, Canceled or TimedOut) and
+// error.
+func (j *Job) fail(state State, errorMessage string) error {
 	j.Logger().Debugf("nack %s", j.ID())
 	j.FinishedAt = time.Now()
-	j.State = Errored
+	j.State = state
 	j.Error = errorMessage
 	j.Event = nil
 	j.Payload = nil
 	return j.Update()
 }
 
+// requeueAbandonedJob puts back in the queued state a job that has been
+// abandoned by its worker on shutdown. The job is reloaded, as the worker may
+// still be using the abandoned job.
+func requeueAbandonedJob(job *Job) error {
+	j, err := Get(job, job.ID())
+	if err != nil {
+		return err
+	}
+	j.Logger().Debugf("requeue %s", j.ID())
+	j.State = Queued
+	j.StartedAt = time.Time{}
+	return j.Update()
+}
+
 // Update updates the job in couchdb
 func (j *Job) Update() error {
 	err := couchdb.UpdateDoc(j, j)
@@ -284,7 +477,7 @@ func (j *Job) WaitUntilDone(db prefixer.Prefixer) error {
 			switch state {
 			case Done:
 				return nil
-			case Errored:
+			case Errored, Canceled, TimedOut:
 				return errors.New("The konnector failed on account deletion")
 			}
 		case <-timeout:
@@ -334,15 +527,28 @@ func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 		Manual:      req.Manual,
 		Message:     req.Message,
 		Debounced:   req.Debounced,
+		Priority:    req.Priority,
+		RunAt:       req.RunAt,
 		Event:       req.Event,
 		Payload:     req.Payload,
 		Options:     req.Options,
 		ForwardLogs: req.ForwardLogs,
 		State:       Queued,
 		QueuedAt:    time.Now(),
+
+		IdempotencyKey: req.IdempotencyKey,
+		Chain:          req.Chain,
+		DebouncedCount: req.DebouncedCount,
 	}
 }
 
+// PushAt pushes a job that won't be executed before the given time, without
+// having to create a trigger for it.
+func PushAt(db prefixer.Prefixer, req *JobRequest, runAt time.Time) (*Job, error) {
+	req.RunAt = runAt
+	return System().PushJob(db, req)
+}
+
 // Get returns the informations about a job.
 func Get(db prefixer.Prefixer, jobID string) (*Job, error) {
 	var job Job
@@ -456,7 +662,7 @@ func GetLastsJobs(jobs []*Job, workerType string) ([]*Job, error) {
 	// Ordering by QueuedAt before filtering jobs
 	sort.Slice(jobs, func(i, j int) bool { return jobs[i].QueuedAt.Before(jobs[j].QueuedAt) })
 
-	for _, state := range []State{Queued, Running, Done, Errored} {
+	for _, state := range []State{Queued, Running, Done, Errored, Canceled, TimedOut} {
 		limit := defaultMaxLimits[state]
 
 		filtered := FilterByWorkerAndState(jobs, workerType, state, limit)
@@ -67,3 +67,48 @@ func (m *BrokerMock) WorkersTypes() []string {
 
 	return args.Get(0).([]string)
 }
+
+// DeadLetters mock method.
+func (m *BrokerMock) DeadLetters(workerType string) ([]*DeadLetter, error) {
+	args := m.Called(workerType)
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]*DeadLetter), args.Error(1)
+}
+
+// RequeueDeadLetter mock method.
+func (m *BrokerMock) RequeueDeadLetter(workerType, jobID string) (*Job, error) {
+	args := m.Called(workerType, jobID)
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).(*Job), args.Error(1)
+}
+
+// CancelJob mock method.
+func (m *BrokerMock) CancelJob(db prefixer.Prefixer, jobID string) error {
+	return m.Called(db, jobID).Error(0)
+}
+
+// Stats mock method.
+func (m *BrokerMock) Stats() ([]WorkerStats, error) {
+	args := m.Called()
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+
+	return args.Get(0).([]WorkerStats), args.Error(1)
+}
+
+// PushChain mock method.
+func (m *BrokerMock) PushChain(db prefixer.Prefixer, specs []JobSpec) (string, error) {
+	args := m.Called(db, specs)
+
+	return args.String(0), args.Error(1)
+}
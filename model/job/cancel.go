@@ -0,0 +1,47 @@
+package job
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// runningJobs is used to find the function that cancels the context of a job
+// executed by a worker of this stack, by job key.
+var runningJobs sync.Map
+
+func runningKey(db prefixer.Prefixer, jobID string) string {
+	return db.DBPrefix() + "/" + jobID
+}
+
+func registerRunning(job *Job, cancel context.CancelFunc) {
+	runningJobs.Store(runningKey(job, job.ID()), cancel)
+}
+
+func unregisterRunning(job *Job) {
+	runningJobs.Delete(runningKey(job, job.ID()))
+}
+
+// cancelRunning cancels the context of the job with the given key, if it is
+// executed by a worker of this stack. It returns false if it is not the case.
+func cancelRunning(key string) bool {
+	cancel, ok := runningJobs.LoadAndDelete(key)
+	if ok {
+		cancel.(context.CancelFunc)()
+	}
+	return ok
+}
+
+// cancelableJob loads the job, and returns ErrJobNotCancelable if the job has
+// already been completed.
+func cancelableJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	job, err := Get(db, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.State.Ended() {
+		return nil, ErrJobNotCancelable
+	}
+	return job, nil
+}
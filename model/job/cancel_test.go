@@ -0,0 +1,80 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelRunningTask(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	started := make(chan struct{})
+	calls := 0
+	conf := &WorkerConfig{
+		WorkerType:   "test",
+		MaxExecCount: 3,
+		RetryDelay:   time.Millisecond,
+		WorkerFunc: func(ctx *WorkerContext) error {
+			calls++
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	w := NewWorker(conf)
+	j := &Job{JobID: "canceled", Domain: "cozy.localhost"}
+	ctx := NewWorkerContext("test/0", j, nil)
+	cancelCtx, cancel := context.WithCancel(ctx.Context)
+	ctx.Context = cancelCtx
+	registerRunning(j, cancel)
+	defer unregisterRunning(j)
+
+	task := &task{
+		w:    w,
+		ctx:  ctx,
+		job:  j,
+		conf: w.defaultedConf(nil),
+	}
+	done := make(chan error)
+	go func() { done <- task.run() }()
+
+	<-started
+	assert.True(t, cancelRunning(runningKey(j, j.ID())))
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrCanceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job has not been canceled")
+	}
+	// A canceled job is not retried
+	assert.Equal(t, 1, calls)
+	assert.False(t, cancelRunning(runningKey(j, j.ID())))
+}
+
+func TestFailedState(t *testing.T) {
+	assert.Equal(t, Canceled, failedState(ErrCanceled))
+	assert.Equal(t, TimedOut, failedState(ErrTimeout))
+	assert.Equal(t, TimedOut, failedState(&deadLetteredError{err: ErrTimeout, attempts: 3}))
+	assert.Equal(t, Errored, failedState(errors.New("LOGIN_FAILED")))
+	assert.True(t, unrecoverable(ErrCanceled))
+
+	for _, state := range []State{Done, Errored, Canceled, TimedOut} {
+		assert.True(t, state.Ended(), state)
+	}
+	for _, state := range []State{Queued, Running} {
+		assert.False(t, state.Ended(), state)
+	}
+	for _, state := range []State{Errored, Canceled, TimedOut} {
+		assert.True(t, state.Failed(), state)
+	}
+	for _, state := range []State{Queued, Running, Done} {
+		assert.False(t, state.Failed(), state)
+	}
+}
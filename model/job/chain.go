@@ -0,0 +1,114 @@
+package job
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/gofrs/uuid/v5"
+)
+
+var errEmptyChain = errors.New("jobs: empty chain")
+
+type (
+	// JobSpec is a step of a chain of jobs.
+	JobSpec struct {
+		WorkerType string `json:"worker"`
+		// Message is the message of the job. When it is empty, the result of
+		// the previous step is used as the message.
+		Message Message     `json:"message,omitempty"`
+		Options *JobOptions `json:"options,omitempty"`
+	}
+
+	// JobChain links the jobs of a chain: a job is pushed only when the
+	// previous one has succeeded, and the chain is aborted on failure.
+	JobChain struct {
+		ID   string    `json:"id"`
+		Next []JobSpec `json:"next,omitempty"`
+	}
+)
+
+// pushChain pushes the first job of the chain with the given broker. The
+// chain is kept in the job document, to push the next step when the job ends.
+func pushChain(b Broker, db prefixer.Prefixer, specs []JobSpec) (string, error) {
+	if len(specs) == 0 {
+		return "", errEmptyChain
+	}
+	types := b.WorkersTypes()
+	for _, spec := range specs {
+		found := false
+		for _, typ := range types {
+			if typ == spec.WorkerType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", ErrUnknownWorker
+		}
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	chainID := strings.ReplaceAll(id.String(), "-", "")
+	first := specs[0]
+	_, err = b.PushJob(db, &JobRequest{
+		WorkerType: first.WorkerType,
+		Message:    first.Message,
+		Options:    first.Options,
+		Chain:      &JobChain{ID: chainID, Next: specs[1:]},
+	})
+	if err != nil {
+		return "", err
+	}
+	return chainID, nil
+}
+
+// continueChain pushes the next step of the chain of a job that has
+// succeeded.
+func (w *Worker) continueChain(job *Job) {
+	chain := job.Chain
+	if chain == nil || len(chain.Next) == 0 || w.broker == nil {
+		return
+	}
+	next := chain.Next[0]
+	msg := next.Message
+	if len(msg) == 0 {
+		msg = Message(job.Result)
+	}
+	_, err := w.broker.PushJob(job, &JobRequest{
+		WorkerType: next.WorkerType,
+		Message:    msg,
+		Options:    next.Options,
+		Chain:      &JobChain{ID: chain.ID, Next: chain.Next[1:]},
+	})
+	if err != nil {
+		job.Logger().Errorf("error while pushing the next job of the chain %s: %s",
+			chain.ID, err)
+		abortChain(job, chain.ID, chain.Next)
+	}
+}
+
+// abortChain creates the jobs for the remaining steps of a chain in the
+// errored state, with ErrChainAborted, to make it visible that they won't be
+// executed.
+func abortChain(db prefixer.Prefixer, chainID string, specs []JobSpec) {
+	for _, spec := range specs {
+		j := NewJob(db, &JobRequest{
+			WorkerType: spec.WorkerType,
+			Message:    spec.Message,
+			Options:    spec.Options,
+			Chain:      &JobChain{ID: chainID},
+		})
+		j.State = Errored
+		j.FinishedAt = time.Now()
+		j.Error = ErrChainAborted.Error()
+		if err := j.Create(); err != nil {
+			j.Logger().Errorf("error while aborting the chain %s: %s",
+				chainID, err)
+		}
+	}
+}
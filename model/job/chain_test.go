@@ -0,0 +1,23 @@
+package job
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushChainValidation(t *testing.T) {
+	b := &memBroker{workersTypes: []string{"snapshot", "upload"}}
+	db := prefixer.NewPrefixer(0, "cozy.localhost", "cozy-localhost")
+
+	_, err := pushChain(b, db, nil)
+	assert.ErrorIs(t, err, errEmptyChain)
+
+	// No job is pushed when a step has an unknown worker
+	_, err = pushChain(b, db, []JobSpec{
+		{WorkerType: "snapshot"},
+		{WorkerType: "notify"},
+	})
+	assert.ErrorIs(t, err, ErrUnknownWorker)
+}
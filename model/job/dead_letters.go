@@ -0,0 +1,68 @@
+package job
+
+import (
+	"errors"
+	"time"
+)
+
+// maxDeadLetters is the maximal number of dead letters kept for a worker
+// type. When it is reached, the oldest dead letters are removed.
+var maxDeadLetters = 1000
+
+// DeadLetter is a job that has failed on its last attempt, with the error of
+// this execution. It is kept until an operator requeues it, or until it is
+// removed to make room for the newer dead letters.
+type DeadLetter struct {
+	Job      *Job      `json:"job"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// deadLetterStore is implemented by the brokers to keep the dead letters.
+type deadLetterStore interface {
+	addDeadLetter(dl *DeadLetter) error
+}
+
+// deadLetteredError is the error returned by a task when the last attempt for
+// the job has failed. Its message is the one of the last error, so that
+// the job can still be nacked with it.
+type deadLetteredError struct {
+	err      error
+	attempts int
+}
+
+func (e *deadLetteredError) Error() string        { return e.err.Error() }
+func (e *deadLetteredError) Unwrap() error        { return e.err }
+func (e *deadLetteredError) Is(target error) bool { return target == ErrDeadLettered }
+
+// newDeadLetter returns the dead letter for a job that has failed with the
+// given error.
+func newDeadLetter(job *Job, err error) (*DeadLetter, bool) {
+	var dl *deadLetteredError
+	if !errors.As(err, &dl) {
+		return nil, false
+	}
+	return &DeadLetter{
+		Job:      job,
+		Error:    dl.Error(),
+		Attempts: dl.attempts,
+		FailedAt: time.Now(),
+	}, true
+}
+
+// requeueRequest returns the request to push again the job of a dead letter.
+func (dl *DeadLetter) requeueRequest() *JobRequest {
+	j := dl.Job
+	return &JobRequest{
+		WorkerType:  j.WorkerType,
+		TriggerID:   j.TriggerID,
+		Message:     j.Message,
+		Event:       j.Event,
+		Payload:     j.Payload,
+		Manual:      j.Manual,
+		ForwardLogs: j.ForwardLogs,
+		Priority:    j.Priority,
+		Options:     j.Options,
+	}
+}
@@ -2,6 +2,7 @@ package job
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
@@ -14,12 +15,43 @@ var (
 	ErrNotFoundJob = errors.New("jobs: not found")
 	// ErrQueueClosed is used to indicate the queue is closed
 	ErrQueueClosed = errors.New("jobs: queue is closed")
+	// ErrDraining is used when a job is pushed while the workers are shutting
+	// down
+	ErrDraining = errors.New("jobs: draining")
 	// ErrUnknownWorker the asked worker does not exist
 	ErrUnknownWorker = errors.New("jobs: could not find worker")
 	// ErrMessageNil is used for an nil message
 	ErrMessageNil = errors.New("jobs: message is nil")
 	// ErrMessageUnmarshal is used when unmarshalling a message causes an error
 	ErrMessageUnmarshal = errors.New("jobs: message unmarshal")
+	// ErrMessageInvalid is used when a message is rejected by the validation
+	// of its worker
+	ErrMessageInvalid = errors.New("jobs: message is invalid")
+	// ErrDeadLettered is used when a job has exhausted its retries and has
+	// been put in the dead letters
+	ErrDeadLettered = errors.New("jobs: dead-lettered")
+	// ErrJobNotCancelable is used when a job can't be canceled, as it has
+	// already been completed
+	ErrJobNotCancelable = errors.New("jobs: not cancelable")
+	// ErrResultTooLarge is used when the result of a job is too large to be
+	// kept in the job document
+	ErrResultTooLarge = errors.New("jobs: result is too large")
+	// ErrRetryable is used to mark the errors of the workers that are
+	// transient, like a network error: the job is retried. It is the default
+	// for the errors that are not marked.
+	ErrRetryable = errors.New("jobs: retryable error")
+	// ErrFatal is used to mark the errors of the workers that are permanent,
+	// like an invalid input: the job is not retried.
+	ErrFatal = errors.New("jobs: fatal error")
+	// ErrTimeout is used when a job has been stopped because it has not
+	// finished before its timeout. The job ends in the TimedOut state.
+	ErrTimeout = errors.New("jobs: timeout")
+	// ErrCanceled is used when a job has been canceled. The job ends in the
+	// Canceled state, and it is not retried.
+	ErrCanceled = errors.New("jobs: canceled")
+	// ErrChainAborted is used for the jobs of a chain that have not been
+	// executed because a previous job of the chain has failed
+	ErrChainAborted = errors.New("jobs: chain aborted")
 	// ErrAbort can be used to abort the execution of the job without causing
 	// errors.
 	ErrAbort = errors.New("jobs: abort")
@@ -28,13 +60,73 @@ var (
 	ErrUnknownTrigger = errors.New("Unknown trigger type")
 	// ErrNotFoundTrigger is used when the trigger was not found
 	ErrNotFoundTrigger = errors.New("Trigger with specified ID does not exist")
-	// ErrMalformedTrigger is used to indicate the trigger is unparsable
+	// ErrMalformedTrigger is used to indicate the trigger is unparsable. It
+	// is an HTTP error, as it can be returned as is by the handlers.
 	ErrMalformedTrigger = echo.NewHTTPError(http.StatusBadRequest, "Trigger unparsable")
+	// ErrRateLimited is used when a trigger has already pushed the maximal
+	// number of jobs allowed by its rate-limit
+	ErrRateLimited = errors.New("jobs: trigger is rate-limited")
+	// ErrTriggerPaused is used when a paused trigger is fired
+	ErrTriggerPaused = errors.New("jobs: trigger is paused")
 	// ErrNotCronTrigger is used when a @cron trigger is expected, but it is
 	// not the case
 	ErrNotCronTrigger = errors.New("Invalid type for trigger (@cron expected)")
 )
 
+// httpErrors are the HTTP status and the machine-readable code of the errors
+// of this package that can be returned to a client.
+var httpErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrNotFoundJob, http.StatusNotFound, "job_not_found"},
+	{ErrNotFoundTrigger, http.StatusNotFound, "trigger_not_found"},
+	{ErrUnknownWorker, http.StatusBadRequest, "unknown_worker"},
+	{ErrUnknownTrigger, http.StatusBadRequest, "unknown_trigger_type"},
+	{ErrMalformedTrigger, http.StatusBadRequest, "malformed_trigger"},
+	{ErrNotCronTrigger, http.StatusBadRequest, "not_cron_trigger"},
+	{ErrMessageNil, http.StatusBadRequest, "message_nil"},
+	{ErrMessageUnmarshal, http.StatusBadRequest, "message_unmarshal"},
+	{ErrMessageInvalid, http.StatusUnprocessableEntity, "message_invalid"},
+	{ErrJobNotCancelable, http.StatusConflict, "job_not_cancelable"},
+	{ErrTriggerPaused, http.StatusConflict, "trigger_paused"},
+	{ErrResultTooLarge, http.StatusRequestEntityTooLarge, "result_too_large"},
+	{ErrRateLimited, http.StatusTooManyRequests, "trigger_rate_limited"},
+	{ErrClosed, http.StatusServiceUnavailable, "jobs_closed"},
+	{ErrQueueClosed, http.StatusServiceUnavailable, "queue_closed"},
+	{ErrDraining, http.StatusServiceUnavailable, "jobs_draining"},
+}
+
+// HTTPErrorMessage is the message of the HTTP errors returned by HTTPError.
+type HTTPErrorMessage struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (m *HTTPErrorMessage) String() string { return m.Detail }
+
+// HTTPError returns the HTTP error for an error of this package, with its
+// status, and a message with a machine-readable code. It returns nil for the
+// other errors.
+func HTTPError(err error) *echo.HTTPError {
+	for _, e := range httpErrors {
+		if errors.Is(err, e.err) {
+			detail := err.Error()
+			if he, ok := err.(*echo.HTTPError); ok {
+				detail = fmt.Sprint(he.Message)
+			}
+			he := echo.NewHTTPError(e.status, &HTTPErrorMessage{
+				Code:   e.code,
+				Detail: detail,
+			})
+			he.Internal = err
+			return he
+		}
+	}
+	return nil
+}
+
 // BadTriggerError is an error conveying the information of a trigger that is not
 // valid, and could be deleted.
 type BadTriggerError struct {
@@ -44,3 +136,32 @@ type BadTriggerError struct {
 func (e BadTriggerError) Error() string {
 	return e.Err.Error()
 }
+
+// markedError is an error of a worker marked as retryable or fatal. Its
+// message is the one of the wrapped error.
+type markedError struct {
+	err  error
+	mark error
+}
+
+func (e *markedError) Error() string        { return e.err.Error() }
+func (e *markedError) Unwrap() error        { return e.err }
+func (e *markedError) Is(target error) bool { return target == e.mark }
+
+// Retryable marks the error returned by a worker as transient: the job will
+// be retried if it has not exhausted its attempts.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &markedError{err: err, mark: ErrRetryable}
+}
+
+// Fatal marks the error returned by a worker as permanent: the job won't be
+// retried.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &markedError{err: err, mark: ErrFatal}
+}
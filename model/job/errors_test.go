@@ -0,0 +1,72 @@
+package job_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{job.ErrNotFoundJob, http.StatusNotFound, "job_not_found"},
+		{job.ErrNotFoundTrigger, http.StatusNotFound, "trigger_not_found"},
+		{job.ErrUnknownWorker, http.StatusBadRequest, "unknown_worker"},
+		{job.ErrUnknownTrigger, http.StatusBadRequest, "unknown_trigger_type"},
+		{job.ErrMalformedTrigger, http.StatusBadRequest, "malformed_trigger"},
+		{job.ErrNotCronTrigger, http.StatusBadRequest, "not_cron_trigger"},
+		{job.ErrMessageNil, http.StatusBadRequest, "message_nil"},
+		{job.ErrMessageUnmarshal, http.StatusBadRequest, "message_unmarshal"},
+		{job.ErrMessageInvalid, http.StatusUnprocessableEntity, "message_invalid"},
+		{job.ErrJobNotCancelable, http.StatusConflict, "job_not_cancelable"},
+		{job.ErrTriggerPaused, http.StatusConflict, "trigger_paused"},
+		{job.ErrResultTooLarge, http.StatusRequestEntityTooLarge, "result_too_large"},
+		{job.ErrRateLimited, http.StatusTooManyRequests, "trigger_rate_limited"},
+		{job.ErrClosed, http.StatusServiceUnavailable, "jobs_closed"},
+		{job.ErrQueueClosed, http.StatusServiceUnavailable, "queue_closed"},
+		{job.ErrDraining, http.StatusServiceUnavailable, "jobs_draining"},
+	}
+	for _, test := range tests {
+		he := job.HTTPError(test.err)
+		require.NotNil(t, he, test.err.Error())
+		assert.Equal(t, test.status, he.Code, test.err.Error())
+		msg, ok := he.Message.(*job.HTTPErrorMessage)
+		require.True(t, ok)
+		assert.Equal(t, test.code, msg.Code)
+		if test.err != job.ErrMalformedTrigger {
+			assert.Equal(t, test.err.Error(), msg.Detail)
+		}
+		assert.Equal(t, test.err, he.Internal)
+	}
+
+	// ErrMalformedTrigger is also an HTTP error by itself, for the callers
+	// that return it as is
+	var malformed *echo.HTTPError
+	require.ErrorAs(t, job.ErrMalformedTrigger, &malformed)
+	assert.Equal(t, http.StatusBadRequest, malformed.Code)
+	he := job.HTTPError(job.ErrMalformedTrigger)
+	assert.Equal(t, "Trigger unparsable", he.Message.(*job.HTTPErrorMessage).Detail)
+
+	// The wrapped errors are mapped too
+	wrapped := fmt.Errorf("cannot push: %w", job.ErrUnknownWorker)
+	he = job.HTTPError(wrapped)
+	require.NotNil(t, he)
+	assert.Equal(t, http.StatusBadRequest, he.Code)
+	assert.Equal(t, "cannot push: jobs: could not find worker", fmt.Sprint(he.Message))
+	invalid := &job.InvalidMessageError{Field: "url", Reason: "is required"}
+	he = job.HTTPError(invalid)
+	require.NotNil(t, he)
+	assert.Equal(t, http.StatusUnprocessableEntity, he.Code)
+
+	assert.Nil(t, job.HTTPError(errors.New("other error")))
+	assert.Nil(t, job.HTTPError(nil))
+}
@@ -3,6 +3,7 @@ package job
 import (
 	"context"
 
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/utils"
 )
 
@@ -19,8 +20,16 @@ type jobSystem struct {
 }
 
 // Shutdown shuts down the job system. Implement the utils.Shutdowner
-// interface.
+// interface. When the context has no deadline, the jobs in progress are
+// waited for at most the shutdown.grace_timeout delay of the configuration.
 func (j jobSystem) Shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		if conf := config.GetConfig(); conf != nil && conf.Shutdown.GraceTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, conf.Shutdown.GraceTimeout)
+			defer cancel()
+		}
+	}
 	if err := j.Broker.ShutdownWorkers(ctx); err != nil {
 		return err
 	}
@@ -0,0 +1,66 @@
+package job
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// heartbeatInterval is the time between two heartbeats of a running job.
+	heartbeatInterval = 1 * time.Minute
+
+	// heartbeatTimeout is the age after which the heartbeat of a running job
+	// is considered as stale: the stack that was running it has probably
+	// crashed, and the job is requeued by the reaper of the redis broker.
+	heartbeatTimeout = 5 * heartbeatInterval
+)
+
+// heartbeatStore keeps the last heartbeat of the running jobs. Only the redis
+// broker has one: with the in-memory broker, the queued jobs are lost too
+// when the stack crashes.
+type heartbeatStore interface {
+	// heartbeat records that the job was still running at the given time.
+	heartbeat(job *Job, at time.Time) error
+	// clearHeartbeat forgets the job, when it has ended.
+	clearHeartbeat(job *Job) error
+}
+
+// startHeartbeat regularly writes the heartbeat of the job executed with the
+// given context in the heartbeat store, until the returned function is called.
+// The heartbeats are not written in CouchDB, as it would be too expensive to
+// update every running job every minute.
+func (w *Worker) startHeartbeat(ctx *WorkerContext) (stop func()) {
+	if w.heartbeats == nil {
+		return func() {}
+	}
+	if err := w.heartbeats.heartbeat(ctx.job, ctx.job.StartedAt); err != nil {
+		ctx.Logger().Warnf("error while writing the heartbeat: %s", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := w.heartbeats.heartbeat(ctx.job, now); err != nil {
+					ctx.Logger().Warnf("error while writing the heartbeat: %s", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		if err := w.heartbeats.clearHeartbeat(ctx.job); err != nil {
+			ctx.Logger().Warnf("error while clearing the heartbeat: %s", err)
+		}
+	}
+}
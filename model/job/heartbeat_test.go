@@ -0,0 +1,86 @@
+package job
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeHeartbeatStore struct {
+	mu   sync.Mutex
+	jobs map[string]time.Time
+}
+
+func (s *fakeHeartbeatStore) heartbeat(job *Job, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID()] = at
+	return nil
+}
+
+func (s *fakeHeartbeatStore) clearHeartbeat(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, job.ID())
+	return nil
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	store := &fakeHeartbeatStore{jobs: make(map[string]time.Time)}
+	w := NewWorker(&WorkerConfig{WorkerType: "test"})
+	w.heartbeats = store
+	j := &Job{JobID: "job-1", Domain: "cozy.localhost", WorkerType: "test", StartedAt: time.Now()}
+
+	stop := w.startHeartbeat(NewWorkerContext("test/0", j, nil))
+	assert.Len(t, store.jobs, 1)
+	stop()
+	assert.Len(t, store.jobs, 0)
+
+	// Without a store, there is no heartbeat
+	w.heartbeats = nil
+	stop = w.startHeartbeat(NewWorkerContext("test/0", j, nil))
+	stop()
+}
+
+func TestRedisReapStaleJobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("a redis is required for this test: test skipped due to the use of --short flag")
+	}
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	opts, _ := redis.ParseURL("redis://localhost:6379/0")
+	client := redis.NewClient(opts)
+	ctx := context.Background()
+	keys := []string{"j/reap", "{j/reap}/heartbeats", "{j/reap}/enqueued"}
+	require.NoError(t, client.Del(ctx, keys...).Err())
+	defer client.Del(ctx, keys...)
+
+	b := NewRedisBroker(client).(*redisBroker)
+	b.workersTypes = []string{"reap"}
+	now := time.Now()
+	stale := &Job{JobID: "stale", Domain: "cozy.localhost", WorkerType: "reap", State: Running}
+	alive := &Job{JobID: "alive", Domain: "cozy.localhost", WorkerType: "reap", State: Running}
+	require.NoError(t, b.heartbeat(stale, now.Add(-2*heartbeatTimeout)))
+	require.NoError(t, b.heartbeat(alive, now.Add(-heartbeatInterval)))
+
+	// Only the job with a stale heartbeat is requeued
+	require.NoError(t, b.reapStaleJobs(now))
+	vals, err := client.LRange(ctx, "j/reap", 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{redisQueueValue(stale)}, vals)
+
+	require.NoError(t, b.clearHeartbeat(alive))
+	require.NoError(t, b.reapStaleJobs(now.Add(heartbeatTimeout)))
+	vals, err = client.LRange(ctx, "j/reap", 0, -1).Result()
+	require.NoError(t, err)
+	assert.Len(t, vals, 1)
+}
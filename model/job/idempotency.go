@@ -0,0 +1,111 @@
+package job
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+const (
+	// defaultIdempotencyWindow is how long an idempotency key is kept after
+	// the end of its job, when the worker has no IdempotencyWindow.
+	defaultIdempotencyWindow = 10 * time.Minute
+
+	// idempotencyMaxTTL is the expiration of an idempotency key for a job that
+	// has not ended, to not keep it forever if the stack has crashed.
+	idempotencyMaxTTL = 24 * time.Hour
+)
+
+// idempotencyStore keeps the ID of the job pushed for an idempotency key.
+type idempotencyStore interface {
+	// claimIdempotencyKey associates the key to the job ID for the given
+	// duration if the key is free. Else, it returns the ID of the job
+	// associated to the key.
+	claimIdempotencyKey(key, jobID string, ttl time.Duration) (string, error)
+	// expireIdempotencyKey frees the key after the given duration.
+	expireIdempotencyKey(key string, after time.Duration) error
+}
+
+// idempotencyKey returns the key used in the store for the idempotency key of
+// the job: the keys are scoped by instance and worker type.
+func idempotencyKey(job *Job) string {
+	return job.DBPrefix() + "/" + job.WorkerType + "/" + job.IdempotencyKey
+}
+
+// idempotencyTTL returns how long the idempotency key of a job is kept if the
+// job doesn't end: a delayed job keeps it until it can run.
+func idempotencyTTL(job *Job) time.Duration {
+	if job.delayed() {
+		return idempotencyMaxTTL + time.Until(job.RunAt)
+	}
+	return idempotencyMaxTTL
+}
+
+// deduplicateJob claims the idempotency key for a job that has just been
+// created. If the key has already been claimed by another job, the new job is
+// deleted, and the other job is returned. Else, nil is returned.
+func deduplicateJob(store idempotencyStore, job *Job) (*Job, error) {
+	key := idempotencyKey(job)
+	existingID, err := store.claimIdempotencyKey(key, job.ID(), idempotencyTTL(job))
+	if err != nil || existingID == "" {
+		return nil, err
+	}
+	existing, err := Get(job, existingID)
+	if errors.Is(err, ErrNotFoundJob) {
+		// The other job has been deleted, but not its key
+		if err = store.expireIdempotencyKey(key, 0); err != nil {
+			return nil, err
+		}
+		return deduplicateJob(store, job)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := couchdb.DeleteDoc(job, job); err != nil {
+		job.Logger().Warnf("cannot delete the duplicated job %s: %s", job.ID(), err)
+	}
+	return existing, nil
+}
+
+// memIdempotencyStore is the in-memory implementation of idempotencyStore.
+type memIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]memIdempotencyEntry
+}
+
+type memIdempotencyEntry struct {
+	jobID     string
+	expiresAt time.Time
+}
+
+func (s *memIdempotencyStore) claimIdempotencyKey(key, jobID string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.keys == nil {
+		s.keys = make(map[string]memIdempotencyEntry)
+	}
+	if entry, ok := s.keys[key]; ok && entry.expiresAt.After(now) {
+		return entry.jobID, nil
+	}
+	s.keys[key] = memIdempotencyEntry{jobID: jobID, expiresAt: now.Add(ttl)}
+	// Clean the expired keys
+	for k, entry := range s.keys {
+		if !entry.expiresAt.After(now) {
+			delete(s.keys, k)
+		}
+	}
+	return "", nil
+}
+
+func (s *memIdempotencyStore) expireIdempotencyKey(key string, after time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.keys[key]; ok {
+		entry.expiresAt = time.Now().Add(after)
+		s.keys[key] = entry
+	}
+	return nil
+}
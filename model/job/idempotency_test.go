@@ -0,0 +1,51 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemIdempotencyStore(t *testing.T) {
+	var store memIdempotencyStore
+
+	existing, err := store.claimIdempotencyKey("foo", "job-1", time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, existing)
+
+	// The key is used until the job ends
+	existing, err = store.claimIdempotencyKey("foo", "job-2", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "job-1", existing)
+
+	// Another key is free
+	existing, err = store.claimIdempotencyKey("bar", "job-3", time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, existing)
+
+	// The key is kept for the window after the end of the job
+	require.NoError(t, store.expireIdempotencyKey("foo", 20*time.Millisecond))
+	existing, err = store.claimIdempotencyKey("foo", "job-4", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "job-1", existing)
+	time.Sleep(30 * time.Millisecond)
+	existing, err = store.claimIdempotencyKey("foo", "job-4", time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, existing)
+}
+
+func TestIdempotencyTTL(t *testing.T) {
+	j := &Job{WorkerType: "sendmail", IdempotencyKey: "foo"}
+	assert.Equal(t, idempotencyMaxTTL, idempotencyTTL(j))
+	j.RunAt = time.Now().Add(48 * time.Hour)
+	assert.Greater(t, idempotencyTTL(j), idempotencyMaxTTL+47*time.Hour)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	j := &Job{Domain: "alice.cozy.localhost", WorkerType: "sendmail", IdempotencyKey: "foo"}
+	assert.Equal(t, "alice.cozy.localhost/sendmail/foo", idempotencyKey(j))
+	j.Prefix = "cozyabcdef"
+	assert.Equal(t, "cozyabcdef/sendmail/foo", idempotencyKey(j))
+}
@@ -0,0 +1,70 @@
+package job
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxJobLogs is the maximal number of lines of logs kept in a job.
+	maxJobLogs = 200
+	// maxJobLogsSize is the maximal size of the messages of the logs kept in
+	// a job.
+	maxJobLogsSize = 64 * 1024
+	// truncatedJobLogs is the message of the last line of logs, when some logs
+	// have been dropped.
+	truncatedJobLogs = "[TRUNCATED]"
+)
+
+// JobLog is a line of log emitted during the execution of a job.
+type JobLog struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// jobLogsHook is a logrus hook that captures the logs of a job in its
+// document. They are persisted with the next write of the job, and at the
+// latest when the job ends.
+type jobLogsHook struct {
+	job       *Job
+	progress  *progressState
+	size      int
+	truncated bool
+}
+
+func newJobLogsHook(job *Job, progress *progressState) *jobLogsHook {
+	h := &jobLogsHook{job: job, progress: progress}
+	for _, l := range job.Logs {
+		h.size += len(l.Message)
+	}
+	if n := len(job.Logs); n > 0 && job.Logs[n-1].Message == truncatedJobLogs {
+		h.truncated = true
+	}
+	return h
+}
+
+func (h *jobLogsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *jobLogsHook) Fire(entry *logrus.Entry) error {
+	h.progress.mu.Lock()
+	defer h.progress.mu.Unlock()
+	if h.truncated || h.progress.ended {
+		return nil
+	}
+	msg := entry.Message
+	if len(h.job.Logs) >= maxJobLogs-1 || h.size+len(msg) > maxJobLogsSize {
+		msg = truncatedJobLogs
+		h.truncated = true
+	}
+	h.size += len(msg)
+	h.job.Logs = append(h.job.Logs, JobLog{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: msg,
+	})
+	return nil
+}
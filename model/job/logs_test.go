@@ -0,0 +1,65 @@
+package job
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobLogsLimits(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	j := &Job{JobID: "123", Domain: "cozy.localhost"}
+	ctx := NewWorkerContext("test/0", j, nil)
+	for i := 0; i < 2*maxJobLogs; i++ {
+		ctx.Logger().Infof("line %d", i)
+	}
+	require.Len(t, j.Logs, maxJobLogs)
+	assert.Equal(t, "line 0", j.Logs[0].Message)
+	assert.Equal(t, "info", j.Logs[0].Level)
+	assert.Equal(t, truncatedJobLogs, j.Logs[maxJobLogs-1].Message)
+
+	// A new context for the same job, like for a requeued job, doesn't add
+	// lines after the truncation
+	ctx = NewWorkerContext("test/1", j, nil)
+	ctx.Logger().Infof("after restart")
+	assert.Len(t, j.Logs, maxJobLogs)
+
+	j = &Job{JobID: "456", Domain: "cozy.localhost"}
+	ctx = NewWorkerContext("test/0", j, nil)
+	long := strings.Repeat("x", 1900)
+	for i := 0; i < maxJobLogs; i++ {
+		ctx.Logger().Warn(long)
+	}
+	n := len(j.Logs)
+	assert.Less(t, n, maxJobLogs)
+	assert.Equal(t, truncatedJobLogs, j.Logs[n-1].Message)
+	size := 0
+	for _, l := range j.Logs {
+		size += len(l.Message)
+	}
+	assert.LessOrEqual(t, size, maxJobLogsSize+len(truncatedJobLogs))
+}
+
+func TestJobLogsEnded(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	j := &Job{JobID: "123", Domain: "cozy.localhost"}
+	ctx := NewWorkerContext("test/0", j, nil)
+	ctx.Logger().Infof("before the end")
+	ctx.endLogs()
+
+	// A goroutine started by the worker may still log after the end of the job
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx.Logger().Infof("after the end")
+	}()
+	<-done
+	require.Len(t, j.Logs, 1)
+	assert.Equal(t, "before the end", j.Logs[0].Message)
+}
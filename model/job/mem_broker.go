@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -21,10 +23,15 @@ type (
 		MaxCapacity int
 		Jobs        chan *Job
 		closed      chan struct{}
+		pushed      chan struct{}
 
-		list *list.List
-		run  bool
-		jmu  sync.RWMutex
+		list    *list.List
+		delayed map[*time.Timer]*Job
+		run     bool
+		jmu     sync.RWMutex
+
+		// aging is the priority aging of the queued jobs, 0 if disabled
+		aging time.Duration
 	}
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
@@ -33,45 +40,154 @@ type (
 		workers      []*Worker
 		workersTypes []string
 		running      uint32
+		draining     uint32
+
+		deadMu      sync.Mutex
+		deadLetters map[string][]*DeadLetter
+
+		idempotency memIdempotencyStore
 	}
 )
 
 // newMemQueue creates and a new in-memory queue.
 func newMemQueue(workerType string) *memQueue {
 	return &memQueue{
-		list:   list.New(),
-		Jobs:   make(chan *Job),
-		closed: make(chan struct{}),
+		list:    list.New(),
+		delayed: make(map[*time.Timer]*Job),
+		Jobs:    make(chan *Job),
+		closed:  make(chan struct{}),
+		pushed:  make(chan struct{}, 1),
+		aging:   priorityAging(),
 	}
 }
 
-// Enqueue into the queue
+// Enqueue into the queue. The list is kept sorted by priority, and the jobs
+// with the same priority are in FIFO order.
 func (q *memQueue) Enqueue(job *Job) error {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
-	q.list.PushBack(job.Clone())
+	cloned := job.Clone().(*Job)
+	priority := cloned.QueuePriority()
+	e := q.list.Back()
+	for e != nil && e.Value.(*Job).QueuePriority() < priority {
+		e = e.Prev()
+	}
+	if e == nil {
+		q.list.PushFront(cloned)
+	} else {
+		q.list.InsertAfter(cloned, e)
+	}
 	if !q.run {
 		q.run = true
 		go q.send()
+	} else {
+		select {
+		case q.pushed <- struct{}{}:
+		default:
+		}
 	}
 	return nil
 }
 
+// EnqueueAt puts the job in the queue when the given time is reached.
+func (q *memQueue) EnqueueAt(job *Job, runAt time.Time) error {
+	delay := time.Until(runAt)
+	if delay <= 0 {
+		return q.Enqueue(job)
+	}
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.jmu.Lock()
+		_, ok := q.delayed[timer]
+		delete(q.delayed, timer)
+		q.jmu.Unlock()
+		if ok {
+			_ = q.Enqueue(job)
+		}
+	})
+	q.delayed[timer] = job
+	return nil
+}
+
+// remove removes the job from the queue. It returns false if the job was not
+// in the queue.
+func (q *memQueue) remove(job *Job) bool {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		if queued := e.Value.(*Job); sameJob(queued, job) {
+			q.list.Remove(e)
+			// Wake up the sender if it was waiting to send this job
+			select {
+			case q.pushed <- struct{}{}:
+			default:
+			}
+			return true
+		}
+	}
+	for timer, delayed := range q.delayed {
+		if sameJob(delayed, job) {
+			timer.Stop()
+			delete(q.delayed, timer)
+			return true
+		}
+	}
+	return false
+}
+
+func sameJob(a, b *Job) bool {
+	return a.ID() == b.ID() && a.DBPrefix() == b.DBPrefix()
+}
+
+// next returns the element of the next job to dequeue: the job with the
+// highest aged priority, and the oldest one in case of equality.
+func (q *memQueue) next(now time.Time) *list.Element {
+	next := q.list.Front()
+	if next == nil || q.aging <= 0 {
+		return next
+	}
+	nextJob := next.Value.(*Job)
+	nextPriority := nextJob.agedPriority(now, q.aging)
+	for e := next.Next(); e != nil; e = e.Next() {
+		job := e.Value.(*Job)
+		priority := job.agedPriority(now, q.aging)
+		if priority > nextPriority ||
+			(priority == nextPriority && job.QueuedAt.Before(nextJob.QueuedAt)) {
+			next, nextJob, nextPriority = e, job, priority
+		}
+	}
+	return next
+}
+
 func (q *memQueue) send() {
 	for {
 		q.jmu.Lock()
-		e := q.list.Front()
+		e := q.next(time.Now())
 		if e == nil || !q.run {
 			q.run = false
 			q.jmu.Unlock()
 			return
 		}
-		q.list.Remove(e)
+		// With the aging, the priorities change over time, and the next job
+		// must be chosen again regularly.
+		var recheck <-chan time.Time
+		if q.aging > 0 && q.list.Len() > 1 {
+			recheck = time.After(pollInterval)
+		}
 		q.jmu.Unlock()
 		select {
 		case <-q.closed:
 			return
+		case <-q.pushed:
+			// A job has been enqueued and it may have a higher priority than
+			// the job at the front of the queue.
+		case <-recheck:
 		case q.Jobs <- e.Value.(*Job):
+			q.jmu.Lock()
+			q.list.Remove(e)
+			q.jmu.Unlock()
 		}
 	}
 }
@@ -79,6 +195,10 @@ func (q *memQueue) send() {
 func (q *memQueue) close() {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
+	for timer := range q.delayed {
+		timer.Stop()
+		delete(q.delayed, timer)
+	}
 	if !q.run {
 		return
 	}
@@ -86,11 +206,26 @@ func (q *memQueue) close() {
 	go func() { q.closed <- struct{}{} }()
 }
 
-// Len returns the length of the queue
+// Len returns the length of the queue, including the delayed jobs
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
 	defer q.jmu.RUnlock()
-	return q.list.Len()
+	return q.list.Len() + len(q.delayed)
+}
+
+// oldestQueuedAt returns the queued date of the oldest job in the queue,
+// without the delayed jobs, or the zero time if the queue is empty.
+func (q *memQueue) oldestQueuedAt() time.Time {
+	q.jmu.RLock()
+	defer q.jmu.RUnlock()
+	var oldest time.Time
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		queuedAt := e.Value.(*Job).QueuedAt
+		if oldest.IsZero() || queuedAt.Before(oldest) {
+			oldest = queuedAt
+		}
+	}
+	return oldest
 }
 
 // NewMemBroker creates a new in-memory broker system.
@@ -99,7 +234,8 @@ func (q *memQueue) Len() int {
 // workers are actually launched by the broker at its creation.
 func NewMemBroker() Broker {
 	return &memBroker{
-		queues: make(map[string]*memQueue),
+		queues:      make(map[string]*memQueue),
+		deadLetters: make(map[string][]*DeadLetter),
 	}
 }
 
@@ -115,6 +251,9 @@ func (b *memBroker) StartWorkers(ws WorkersList) error {
 		}
 		q := newMemQueue(conf.WorkerType)
 		w := NewWorker(conf)
+		w.deadLetters = b
+		w.idempotency = &b.idempotency
+		w.broker = b
 		b.queues[conf.WorkerType] = q
 		b.workers = append(b.workers, w)
 		if err := w.Start(q.Jobs); err != nil {
@@ -137,6 +276,8 @@ func (b *memBroker) StartWorkers(ws WorkersList) error {
 }
 
 func (b *memBroker) ShutdownWorkers(ctx context.Context) error {
+	atomic.StoreUint32(&b.draining, 1)
+	defer atomic.StoreUint32(&b.draining, 0)
 	if !atomic.CompareAndSwapUint32(&b.running, 1, 0) {
 		return ErrClosed
 	}
@@ -161,6 +302,16 @@ func (b *memBroker) ShutdownWorkers(ctx context.Context) error {
 		}
 	}
 
+	// The in-memory queues don't survive the stack, so the jobs that have not
+	// finished in time can only be put back in the queued state.
+	for _, w := range b.workers {
+		for _, job := range w.abandonInFlight() {
+			if err := requeueAbandonedJob(job); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+
 	if errm != nil {
 		fmt.Println("failed:", errm)
 	} else {
@@ -172,6 +323,9 @@ func (b *memBroker) ShutdownWorkers(ctx context.Context) error {
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error) {
+	if atomic.LoadUint32(&b.draining) == 1 {
+		return nil, ErrDraining
+	}
 	if atomic.LoadUint32(&b.running) == 0 {
 		return nil, ErrClosed
 	}
@@ -187,6 +341,9 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 	if worker == nil && workerType != "client" {
 		return nil, ErrUnknownWorker
 	}
+	if err := worker.validateMessage(req.Message); err != nil {
+		return nil, err
+	}
 
 	// Check for limits
 	ct, err := GetCounterTypeFromWorkerType(req.WorkerType)
@@ -204,6 +361,10 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 		}
 	}
 
+	if err := checkTriggerRateLimit(config.GetRateLimiter(), req); err != nil {
+		return nil, err
+	}
+
 	job := NewJob(db, req)
 	if worker != nil && worker.Conf.BeforeHook != nil {
 		ok, err := worker.Conf.BeforeHook(job)
@@ -218,6 +379,12 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 	if err := job.Create(); err != nil {
 		return nil, err
 	}
+	if job.IdempotencyKey != "" {
+		existing, err := deduplicateJob(&b.idempotency, job)
+		if err != nil || existing != nil {
+			return existing, err
+		}
+	}
 
 	// For client jobs, we don't need to enqueue the job.
 	if workerType == "client" {
@@ -225,7 +392,14 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 	}
 
 	q := b.queues[workerType]
-	if err := q.Enqueue(job); err != nil {
+	if job.delayed() {
+		err = q.EnqueueAt(job, job.RunAt)
+	} else {
+		err = q.Enqueue(job)
+	}
+	if err != nil {
+		// The job has not been queued: a retry must not get it back
+		b.releaseIdempotencyKey(job)
 		return nil, err
 	}
 	return job, nil
@@ -254,4 +428,97 @@ func (b *memBroker) WorkersTypes() []string {
 	return b.workersTypes
 }
 
+// releaseIdempotencyKey frees the idempotency key of a job that has been
+// canceled before its execution, or that could not be queued.
+func (b *memBroker) releaseIdempotencyKey(job *Job) {
+	if job.IdempotencyKey != "" {
+		_ = b.idempotency.expireIdempotencyKey(idempotencyKey(job), 0)
+	}
+}
+
+func (b *memBroker) addDeadLetter(dl *DeadLetter) error {
+	b.deadMu.Lock()
+	defer b.deadMu.Unlock()
+	workerType := dl.Job.WorkerType
+	dls := append(b.deadLetters[workerType], dl)
+	if n := len(dls) - maxDeadLetters; n > 0 {
+		dls = append(dls[:0:0], dls[n:]...)
+	}
+	b.deadLetters[workerType] = dls
+	return nil
+}
+
+func (b *memBroker) DeadLetters(workerType string) ([]*DeadLetter, error) {
+	b.deadMu.Lock()
+	defer b.deadMu.Unlock()
+	dls := make([]*DeadLetter, len(b.deadLetters[workerType]))
+	copy(dls, b.deadLetters[workerType])
+	return dls, nil
+}
+
+func (b *memBroker) RequeueDeadLetter(workerType, jobID string) (*Job, error) {
+	b.deadMu.Lock()
+	var found *DeadLetter
+	dls := b.deadLetters[workerType]
+	for i, dl := range dls {
+		if dl.Job.ID() == jobID {
+			found = dl
+			b.deadLetters[workerType] = append(dls[:i:i], dls[i+1:]...)
+			break
+		}
+	}
+	b.deadMu.Unlock()
+	if found == nil {
+		return nil, ErrNotFoundJob
+	}
+	job, err := b.PushJob(found.Job, found.requeueRequest())
+	if err != nil {
+		_ = b.addDeadLetter(found)
+		return nil, err
+	}
+	return job, nil
+}
+
+func (b *memBroker) CancelJob(db prefixer.Prefixer, jobID string) error {
+	job, err := cancelableJob(db, jobID)
+	if err != nil {
+		return err
+	}
+	if q, ok := b.queues[job.WorkerType]; ok && q.remove(job) {
+		err := job.fail(Canceled, ErrCanceled.Error())
+		if !couchdb.IsConflictError(err) {
+			b.releaseIdempotencyKey(job)
+			return err
+		}
+		// The job has been given to a worker in the meantime
+	}
+	if cancelRunning(runningKey(job, job.ID())) {
+		return nil
+	}
+	return ErrJobNotCancelable
+}
+
+// PushChain pushes the first job of a chain.
+func (b *memBroker) PushChain(db prefixer.Prefixer, specs []JobSpec) (string, error) {
+	return pushChain(b, db, specs)
+}
+
+func (b *memBroker) Stats() ([]WorkerStats, error) {
+	now := time.Now()
+	stats := make([]WorkerStats, 0, len(b.workers))
+	for _, w := range b.workers {
+		q := b.queues[w.Type]
+		s := WorkerStats{
+			WorkerType: w.Type,
+			Queued:     q.Len(),
+			Running:    w.InFlight(),
+		}
+		if oldest := q.oldestQueuedAt(); !oldest.IsZero() {
+			s.OldestAge = now.Sub(oldest)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
 var _ Broker = &memBroker{}
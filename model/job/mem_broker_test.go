@@ -1,15 +1,20 @@
 package job_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/tests/testutils"
@@ -246,6 +251,461 @@ func TestMemBroker(t *testing.T) {
 		w.Wait()
 	})
 
+	t.Run("DeadLetters", func(t *testing.T) {
+		var count int32
+		done := make(chan struct{})
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:   "test",
+				Concurrency:  1,
+				MaxExecCount: 2,
+				RetryDelay:   1 * time.Millisecond,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					if atomic.AddInt32(&count, 1) <= 2 {
+						return errors.New("failure")
+					}
+					close(done)
+					return nil
+				},
+			},
+		}))
+
+		j, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType: "test",
+			Message:    nil,
+		})
+		assert.NoError(t, err)
+
+		var dls []*job.DeadLetter
+		assert.Eventually(t, func() bool {
+			dls, err = broker.DeadLetters("test")
+			return err == nil && len(dls) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, j.ID(), dls[0].Job.ID())
+		assert.Equal(t, "failure", dls[0].Error)
+		assert.Equal(t, 2, dls[0].Attempts)
+
+		_, err = broker.RequeueDeadLetter("test", j.ID())
+		assert.NoError(t, err)
+		<-done
+		dls, err = broker.DeadLetters("test")
+		assert.NoError(t, err)
+		assert.Empty(t, dls)
+	})
+
+	t.Run("Result", func(t *testing.T) {
+		done := make(chan struct{})
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					defer close(done)
+					return ctx.SetResult(map[string]interface{}{"imported": 42})
+				},
+			},
+		}))
+
+		j, err := broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+		assert.NoError(t, err)
+		<-done
+
+		assert.Eventually(t, func() bool {
+			j, err = job.Get(testInstance, j.ID())
+			return err == nil && j.State == job.Done
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.JSONEq(t, `{"imported": 42}`, string(j.Result))
+		assert.False(t, j.StartedAt.IsZero())
+		assert.False(t, j.FinishedAt.IsZero())
+		assert.Empty(t, j.Error)
+	})
+
+	t.Run("IdempotencyKey", func(t *testing.T) {
+		var count int32
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					atomic.AddInt32(&count, 1)
+					time.Sleep(50 * time.Millisecond)
+					return nil
+				},
+			},
+		}))
+
+		j1, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType:     "test",
+			IdempotencyKey: "foo",
+		})
+		assert.NoError(t, err)
+		j2, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType:     "test",
+			IdempotencyKey: "foo",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, j1.ID(), j2.ID())
+		j3, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType:     "test",
+			IdempotencyKey: "bar",
+		})
+		assert.NoError(t, err)
+		assert.NotEqual(t, j1.ID(), j3.ID())
+
+		assert.Eventually(t, func() bool {
+			j, err := job.Get(testInstance, j3.ID())
+			return err == nil && j.State == job.Done
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+		// The key is still used during the idempotency window
+		j4, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType:     "test",
+			IdempotencyKey: "foo",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, j1.ID(), j4.ID())
+
+		// The key is released when the job is canceled
+		delayed, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType:     "test",
+			IdempotencyKey: "baz",
+			RunAt:          time.Now().Add(time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, broker.CancelJob(testInstance, delayed.ID()))
+		j5, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType:     "test",
+			IdempotencyKey: "baz",
+		})
+		assert.NoError(t, err)
+		assert.NotEqual(t, delayed.ID(), j5.ID())
+	})
+
+	t.Run("CancelJob", func(t *testing.T) {
+		started := make(chan struct{})
+		done := make(chan error)
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					close(started)
+					<-ctx.Done()
+					done <- ctx.Err()
+					return ctx.Err()
+				},
+			},
+		}))
+
+		running, err := broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+		assert.NoError(t, err)
+		<-started
+		queued, err := broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+		assert.NoError(t, err)
+
+		// Cancel the queued job: it is removed from the queue
+		assert.NoError(t, broker.CancelJob(testInstance, queued.ID()))
+		n, err := broker.WorkerQueueLen("test")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		j, err := job.Get(testInstance, queued.ID())
+		assert.NoError(t, err)
+		assert.Equal(t, job.Canceled, j.State)
+		assert.Equal(t, job.ErrCanceled.Error(), j.Error)
+
+		// Cancel the running job: its context is canceled, and it is not
+		// retried
+		assert.NoError(t, broker.CancelJob(testInstance, running.ID()))
+		assert.ErrorIs(t, <-done, context.Canceled)
+		assert.Eventually(t, func() bool {
+			j, err = job.Get(testInstance, running.ID())
+			return err == nil && j.State == job.Canceled
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, job.ErrCanceled.Error(), j.Error)
+		select {
+		case <-done:
+			t.Fatal("the canceled job has been retried")
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		// A completed job can't be canceled
+		err = broker.CancelJob(testInstance, running.ID())
+		assert.ErrorIs(t, err, job.ErrJobNotCancelable)
+		err = broker.CancelJob(testInstance, "not-a-job")
+		assert.ErrorIs(t, err, job.ErrNotFoundJob)
+	})
+
+	t.Run("Chain", func(t *testing.T) {
+		var notified int32
+		uploaded := make(chan string, 1)
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "snapshot",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					return ctx.SetResult(map[string]string{"snapshot": "s1"})
+				},
+			},
+			{
+				WorkerType:  "upload",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					var msg map[string]string
+					if err := ctx.UnmarshalMessage(&msg); err != nil {
+						return err
+					}
+					uploaded <- msg["snapshot"]
+					return job.Fatal(errors.New("upload failed"))
+				},
+			},
+			{
+				WorkerType:  "notify",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					atomic.AddInt32(&notified, 1)
+					return nil
+				},
+			},
+		}))
+
+		_, err := broker.PushChain(testInstance, []job.JobSpec{
+			{WorkerType: "snapshot"},
+			{WorkerType: "unknown"},
+		})
+		assert.ErrorIs(t, err, job.ErrUnknownWorker)
+
+		chainID, err := broker.PushChain(testInstance, []job.JobSpec{
+			{WorkerType: "snapshot"},
+			{WorkerType: "upload"},
+			{WorkerType: "notify"},
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, chainID)
+
+		// The result of the first job is the message of the second one
+		select {
+		case snapshot := <-uploaded:
+			assert.Equal(t, "s1", snapshot)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the upload job has not been executed")
+		}
+
+		// The failure of the second job aborts the chain
+		var jobs []*job.Job
+		assert.Eventually(t, func() bool {
+			var all []*job.Job
+			if err := couchdb.GetAllDocs(testInstance, consts.Jobs, nil, &all); err != nil {
+				return false
+			}
+			jobs = jobs[:0]
+			for _, j := range all {
+				if j.Chain != nil && j.Chain.ID == chainID {
+					jobs = append(jobs, j)
+				}
+			}
+			return len(jobs) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		states := make(map[string]*job.Job)
+		for _, j := range jobs {
+			states[j.WorkerType] = j
+		}
+		assert.Equal(t, job.Done, states["snapshot"].State)
+		assert.Equal(t, job.Errored, states["upload"].State)
+		assert.Equal(t, "upload failed", states["upload"].Error)
+		assert.Equal(t, job.Errored, states["notify"].State)
+		assert.Equal(t, job.ErrChainAborted.Error(), states["notify"].Error)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&notified))
+	})
+
+	t.Run("ValidateMessage", func(t *testing.T) {
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:      "test",
+				Concurrency:     1,
+				ValidateMessage: job.RequireFields("url"),
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					return nil
+				},
+			},
+		}))
+
+		msg, _ := job.NewMessage(map[string]string{"method": "GET"})
+		_, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType: "test",
+			Message:    msg,
+		})
+		assert.ErrorIs(t, err, job.ErrMessageInvalid)
+		var invalid *job.InvalidMessageError
+		if assert.ErrorAs(t, err, &invalid) {
+			assert.Equal(t, "url", invalid.Field)
+		}
+
+		msg, _ = job.NewMessage(map[string]string{"url": "https://cozy.io/"})
+		j, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType: "test",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, j.ID())
+	})
+
+	t.Run("Logs", func(t *testing.T) {
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					ctx.Logger().Infof("fetching %d bills", 3)
+					ctx.Logger().Warnf("bill %d is missing", 2)
+					ctx.Logger().Errorf("login failed")
+					return errors.New("LOGIN_FAILED")
+				},
+			},
+		}))
+
+		j, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType: "test",
+			Options:    &job.JobOptions{MaxExecCount: 1},
+		})
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			j, err = job.Get(testInstance, j.ID())
+			return err == nil && j.State == job.Errored
+		}, 5*time.Second, 10*time.Millisecond)
+
+		var messages, levels []string
+		for _, l := range j.Logs {
+			messages = append(messages, l.Message)
+			levels = append(levels, l.Level)
+			assert.False(t, l.Time.IsZero())
+		}
+		if !assert.GreaterOrEqual(t, len(messages), 3) {
+			return
+		}
+		assert.Equal(t, []string{"fetching 3 bills", "bill 2 is missing", "login failed"}, messages[:3])
+		assert.Equal(t, []string{"info", "warning", "error"}, levels[:3])
+	})
+
+	t.Run("GracefulShutdown", func(t *testing.T) {
+		started := make(chan struct{})
+		var completed int32
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					close(started)
+					time.Sleep(300 * time.Millisecond)
+					atomic.StoreInt32(&completed, 1)
+					return nil
+				},
+			},
+		}))
+
+		j, err := broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+		assert.NoError(t, err)
+		<-started
+
+		shutdown := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			shutdown <- broker.ShutdownWorkers(ctx)
+		}()
+
+		// No new job is accepted while the broker is draining
+		assert.Eventually(t, func() bool {
+			_, err := broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+			return errors.Is(err, job.ErrDraining)
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, <-shutdown)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&completed))
+		j, err = job.Get(testInstance, j.ID())
+		assert.NoError(t, err)
+		assert.Equal(t, job.Done, j.State)
+
+		_, err = broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+		assert.ErrorIs(t, err, job.ErrClosed)
+	})
+
+	t.Run("ShutdownRequeue", func(t *testing.T) {
+		started := make(chan struct{})
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					close(started)
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			},
+		}))
+
+		j, err := broker.PushJob(testInstance, &job.JobRequest{WorkerType: "test"})
+		assert.NoError(t, err)
+		<-started
+
+		// The job can't finish before the deadline: it is put back in the
+		// queued state
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = broker.ShutdownWorkers(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		j, err = job.Get(testInstance, j.ID())
+		assert.NoError(t, err)
+		assert.Equal(t, job.Queued, j.State)
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		done := make(chan struct{})
+		broker := job.NewMemBroker()
+		assert.NoError(t, broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "test",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					defer close(done)
+					for _, fraction := range []float64{0.25, 0.5, 1} {
+						if err := ctx.SetProgress(fraction, "importing"); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			},
+		}))
+
+		j, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType: "test",
+			Message:    nil,
+		})
+		assert.NoError(t, err)
+		<-done
+
+		var stored *job.Job
+		assert.Eventually(t, func() bool {
+			stored, err = job.Get(testInstance, j.ID())
+			return err == nil && stored.State == job.Done
+		}, 5*time.Second, 10*time.Millisecond)
+		if assert.NotNil(t, stored.Progress) {
+			assert.Equal(t, 1.0, stored.Progress.Fraction)
+			assert.Equal(t, "importing", stored.Progress.Message)
+		}
+	})
+
 	t.Run("PanicRetried", func(t *testing.T) {
 		var w sync.WaitGroup
 
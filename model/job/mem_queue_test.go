@@ -0,0 +1,137 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemQueuePriority(t *testing.T) {
+	q := newMemQueue("test")
+	defer q.close()
+
+	low := &Job{JobID: "low", Priority: PriorityLow}
+	normal := &Job{JobID: "normal"}
+	high := &Job{JobID: "high", Priority: PriorityHigh}
+	manual := &Job{JobID: "manual", Manual: true}
+	require.NoError(t, q.Enqueue(low))
+	require.NoError(t, q.Enqueue(normal))
+	require.NoError(t, q.Enqueue(high))
+	require.NoError(t, q.Enqueue(manual))
+	assert.Equal(t, 4, q.Len())
+
+	for _, expected := range []string{"high", "manual", "normal", "low"} {
+		select {
+		case j := <-q.Jobs:
+			assert.Equal(t, expected, j.ID())
+		case <-time.After(time.Second):
+			t.Fatalf("no job dequeued, expected %s", expected)
+		}
+	}
+}
+
+func TestMemQueueDelayed(t *testing.T) {
+	q := newMemQueue("test")
+	defer q.close()
+
+	delay := 100 * time.Millisecond
+	start := time.Now()
+	require.NoError(t, q.EnqueueAt(&Job{JobID: "delayed"}, start.Add(delay)))
+	require.NoError(t, q.Enqueue(&Job{JobID: "now"}))
+	assert.Equal(t, 2, q.Len())
+
+	select {
+	case j := <-q.Jobs:
+		assert.Equal(t, "now", j.ID())
+	case <-time.After(time.Second):
+		t.Fatal("no job dequeued")
+	}
+
+	select {
+	case j := <-q.Jobs:
+		assert.Equal(t, "delayed", j.ID())
+		assert.GreaterOrEqual(t, time.Since(start), delay)
+	case <-time.After(time.Second):
+		t.Fatal("the delayed job has not been dequeued")
+	}
+}
+
+func TestMemBrokerStats(t *testing.T) {
+	q := newMemQueue("test")
+	defer q.close()
+	w := NewWorker(&WorkerConfig{WorkerType: "test"})
+	b := &memBroker{
+		queues:  map[string]*memQueue{"test": q},
+		workers: []*Worker{w},
+	}
+
+	now := time.Now()
+	require.NoError(t, q.Enqueue(&Job{JobID: "1", QueuedAt: now.Add(-time.Minute)}))
+	require.NoError(t, q.Enqueue(&Job{JobID: "2", QueuedAt: now.Add(-time.Second)}))
+	require.NoError(t, q.Enqueue(&Job{JobID: "3", QueuedAt: now}))
+
+	stats, err := b.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, "test", stats[0].WorkerType)
+	assert.Equal(t, 3, stats[0].Queued)
+	assert.Equal(t, 0, stats[0].Running)
+	assert.GreaterOrEqual(t, stats[0].OldestAge, time.Minute)
+
+	// The stats are updated when a worker takes a job
+	select {
+	case j := <-q.Jobs:
+		assert.Equal(t, "1", j.ID())
+		w.startInFlight(j)
+	case <-time.After(time.Second):
+		t.Fatal("no job dequeued")
+	}
+	assert.Eventually(t, func() bool {
+		stats, err = b.Stats()
+		return err == nil && stats[0].Queued == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, stats[0].Running)
+	assert.Less(t, stats[0].OldestAge, time.Minute)
+}
+
+func TestMemQueuePriorityAging(t *testing.T) {
+	q := newMemQueue("test")
+	defer q.close()
+	q.aging = 10 * time.Minute
+
+	now := time.Now()
+	// A low priority job that has not waited long enough stays behind
+	require.NoError(t, q.Enqueue(&Job{JobID: "recent-low", Priority: PriorityLow, QueuedAt: now.Add(-5 * time.Minute)}))
+	// A low priority job that has waited for 2 aging periods has the same
+	// priority as a fresh high priority job, and it is older
+	require.NoError(t, q.Enqueue(&Job{JobID: "old-low", Priority: PriorityLow, QueuedAt: now.Add(-25 * time.Minute)}))
+	require.NoError(t, q.Enqueue(&Job{JobID: "high", Priority: PriorityHigh, QueuedAt: now}))
+	require.NoError(t, q.Enqueue(&Job{JobID: "normal", QueuedAt: now}))
+
+	for _, expected := range []string{"old-low", "high", "normal", "recent-low"} {
+		select {
+		case j := <-q.Jobs:
+			assert.Equal(t, expected, j.ID())
+		case <-time.After(time.Second):
+			t.Fatalf("no job dequeued, expected %s", expected)
+		}
+	}
+}
+
+func TestAgedPriority(t *testing.T) {
+	now := time.Now()
+	aging := 10 * time.Minute
+	j := &Job{Priority: PriorityLow, QueuedAt: now}
+	assert.Equal(t, PriorityLow, j.agedPriority(now, aging))
+	assert.Equal(t, PriorityLow, j.agedPriority(now.Add(9*time.Minute), aging))
+	assert.Equal(t, PriorityNormal, j.agedPriority(now.Add(10*time.Minute), aging))
+	assert.Equal(t, PriorityHigh, j.agedPriority(now.Add(20*time.Minute), aging))
+	assert.Equal(t, PriorityLow, j.agedPriority(now.Add(time.Hour), 0))
+	assert.Equal(t, PriorityLow, (&Job{Priority: PriorityLow}).agedPriority(now, aging))
+
+	// A job aged in a queue starts again from the priority of this queue
+	assert.Equal(t, PriorityHigh, agePriority(PriorityNormal, now, now.Add(10*time.Minute), aging))
+	assert.Equal(t, PriorityNormal, agePriority(PriorityNormal, time.Time{}, now, aging))
+}
@@ -173,6 +173,71 @@ func (s *memScheduler) UpdateCron(db prefixer.Prefixer, trigger Trigger, argumen
 	return couchdb.UpdateDoc(db, infos)
 }
 
+// PauseTrigger stops the trigger from pushing jobs. It is still scheduled, but
+// its jobs are skipped while it is paused.
+func (s *memScheduler) PauseTrigger(db prefixer.Prefixer, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.ts[db.DBPrefix()+"/"+id]
+	if !ok {
+		return ErrNotFoundTrigger
+	}
+	infos := t.Infos()
+	if infos.Paused() {
+		return nil
+	}
+	now := time.Now()
+	infos.PausedAt = &now
+	return couchdb.UpdateDoc(db, infos)
+}
+
+// ResumeTrigger allows a paused trigger to push jobs again.
+func (s *memScheduler) ResumeTrigger(db prefixer.Prefixer, id string, backfill bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.ts[db.DBPrefix()+"/"+id]
+	if !ok {
+		return ErrNotFoundTrigger
+	}
+	infos := t.Infos()
+	if !infos.Paused() {
+		return nil
+	}
+	pausedAt := *infos.PausedAt
+	infos.PausedAt = nil
+	if err := couchdb.UpdateDoc(db, infos); err != nil {
+		return err
+	}
+	now := time.Now()
+	if backfill && missedRun(t, pausedAt, now) {
+		go s.pushJob(t, infos.JobRequest())
+	}
+	// An @at trigger whose time has come while it was paused is deleted
+	if at, ok := t.(*AtTrigger); ok && at.at.Before(now) {
+		delete(s.ts, db.DBPrefix()+"/"+id)
+		return couchdb.DeleteDoc(db, infos)
+	}
+	return nil
+}
+
+// FireTrigger pushes the job of the trigger now, out of its schedule.
+func (s *memScheduler) FireTrigger(db prefixer.Prefixer, id string, force bool) (*Job, error) {
+	t, err := s.GetTrigger(db, id)
+	if err != nil {
+		return nil, err
+	}
+	return fireTrigger(s.broker, t, force)
+}
+
+// NextRuns returns the next n executions of a periodic trigger.
+func (s *memScheduler) NextRuns(db prefixer.Prefixer, id string, n int) ([]time.Time, error) {
+	t, err := s.GetTrigger(db, id)
+	if err != nil {
+		return nil, err
+	}
+	return nextRuns(t, n)
+}
+
 // DeleteTrigger removes the trigger with the specified ID. The trigger is unscheduled
 // and remove from the storage.
 func (s *memScheduler) DeleteTrigger(db prefixer.Prefixer, id string) error {
@@ -228,6 +293,7 @@ func (s *memScheduler) schedule(t Trigger) {
 	}
 	var debounced <-chan time.Time
 	var combinedReq *JobRequest
+	var count int
 	var d time.Duration
 	infos := t.Infos()
 	if infos.Debounce != "" {
@@ -241,24 +307,51 @@ func (s *memScheduler) schedule(t Trigger) {
 		select {
 		case req, ok := <-ch:
 			if !ok {
+				if at, isAt := t.(*AtTrigger); isAt && at.ended {
+					s.deleteEndedTrigger(at)
+				}
 				return
 			}
 			if d == 0 {
 				s.pushJob(t, req)
-			} else if debounced == nil {
+				continue
+			}
+			count++
+			if debounced == nil {
 				debounced = time.After(d)
 				combinedReq = combineRequests(t, req, nil)
 			} else {
+				if infos.DebounceReset {
+					debounced = time.After(d)
+				}
 				combinedReq = combineRequests(t, combinedReq, req)
 			}
 		case <-debounced:
+			combinedReq.Debounced = true
+			combinedReq.DebouncedCount = count
 			s.pushJob(t, combinedReq)
 			debounced = nil
 			combinedReq = nil
+			count = 0
 		}
 	}
 }
 
+// deleteEndedTrigger deletes an @at trigger after its time, except if it is
+// paused: it is deleted when resumed.
+func (s *memScheduler) deleteEndedTrigger(t *AtTrigger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.Infos().Paused() {
+		return
+	}
+	delete(s.ts, t.DBPrefix()+"/"+t.Infos().TID)
+	if err := couchdb.DeleteDoc(t, t.Infos()); err != nil {
+		s.log.Errorf("trigger %s(%s): Could not delete: %s",
+			t.Type(), t.Infos().TID, err.Error())
+	}
+}
+
 func combineRequests(t Trigger, req1, req2 *JobRequest) *JobRequest {
 	switch t.CombineRequest() {
 	case appendPayload:
@@ -282,6 +375,11 @@ func (s *memScheduler) pushJob(t Trigger, req *JobRequest) {
 	defer s.mu.Unlock()
 
 	log := s.log.WithField("domain", t.DomainName())
+	if t.Infos().Paused() {
+		log.Infof("trigger %s(%s): Skipping job %s as the trigger is paused",
+			t.Type(), t.Infos().TID, req.WorkerType)
+		return
+	}
 	log.Infof("trigger %s(%s): Pushing new job %s",
 		t.Type(), t.Infos().TID, req.WorkerType)
 	if _, err := s.broker.PushJob(t, req); err != nil {
@@ -2,6 +2,8 @@ package job_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -47,6 +49,206 @@ func TestMemScheduler(t *testing.T) {
 		}
 	})
 
+	t.Run("AtTriggerFiresOnce", func(t *testing.T) {
+		var called int32
+		bro := job.NewMemBroker()
+		assert.NoError(t, bro.StartWorkers(job.WorkersList{
+			{
+				WorkerType:   "worker",
+				Concurrency:  1,
+				MaxExecCount: 1,
+				WorkerFunc: func(_ *job.WorkerContext) error {
+					atomic.AddInt32(&called, 1)
+					return nil
+				},
+			},
+		}))
+		sch := job.NewMemScheduler()
+		require.NoError(t, sch.StartScheduler(bro))
+		defer func() { assert.NoError(t, sch.ShutdownScheduler(context.Background())) }()
+
+		msg, _ := job.NewMessage("@at")
+		add := func(at time.Time) job.Trigger {
+			trigger, err := job.NewTrigger(testInstance, job.TriggerInfos{
+				Type:       "@at",
+				Arguments:  at.Format(time.RFC3339),
+				WorkerType: "worker",
+			}, msg)
+			require.NoError(t, err)
+			require.NoError(t, sch.AddTrigger(trigger))
+			return trigger
+		}
+
+		// The trigger fires once at its time, and is then deleted
+		trigger := add(time.Now().Add(time.Second))
+		assert.Eventually(t, func() bool {
+			_, err := sch.GetTrigger(testInstance, trigger.ID())
+			return errors.Is(err, job.ErrNotFoundTrigger)
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(time.Second)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+
+		// A trigger whose time has passed while the stack was down fires
+		// immediately, except if it is older than the grace delay
+		add(time.Now().Add(-time.Hour))
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		old := add(time.Now().Add(-48 * time.Hour))
+		assert.Eventually(t, func() bool {
+			_, err := sch.GetTrigger(testInstance, old.ID())
+			return errors.Is(err, job.ErrNotFoundTrigger)
+		}, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(500 * time.Millisecond)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&called))
+	})
+
+	t.Run("FireTrigger", func(t *testing.T) {
+		var called int32
+		bro := job.NewMemBroker()
+		assert.NoError(t, bro.StartWorkers(job.WorkersList{
+			{
+				WorkerType:   "worker",
+				Concurrency:  1,
+				MaxExecCount: 1,
+				WorkerFunc: func(_ *job.WorkerContext) error {
+					atomic.AddInt32(&called, 1)
+					return nil
+				},
+			},
+		}))
+		sch := job.NewMemScheduler()
+		require.NoError(t, sch.StartScheduler(bro))
+		defer func() { assert.NoError(t, sch.ShutdownScheduler(context.Background())) }()
+
+		msg, _ := job.NewMessage("@cron")
+		trigger, err := job.NewTrigger(testInstance, job.TriggerInfos{
+			Type:       "@cron",
+			Arguments:  "0 0 0 1 1 *",
+			WorkerType: "worker",
+		}, msg)
+		require.NoError(t, err)
+		require.NoError(t, sch.AddTrigger(trigger))
+		defer func() { assert.NoError(t, sch.DeleteTrigger(testInstance, trigger.ID())) }()
+		now := time.Now()
+		next := trigger.(*job.CronTrigger).NextExecution(now)
+
+		_, err = sch.FireTrigger(testInstance, "unknown", false)
+		assert.ErrorIs(t, err, job.ErrNotFoundTrigger)
+
+		// The job is pushed now, and the schedule is unchanged
+		fired, err := sch.FireTrigger(testInstance, trigger.ID(), false)
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		j, err := job.Get(testInstance, fired.ID())
+		require.NoError(t, err)
+		assert.Equal(t, trigger.ID(), j.TriggerID)
+		assert.True(t, j.Manual)
+		after, err := sch.GetTrigger(testInstance, trigger.ID())
+		require.NoError(t, err)
+		assert.Equal(t, next, after.(*job.CronTrigger).NextExecution(now))
+
+		// The next runs are computed without pushing jobs
+		runs, err := sch.NextRuns(testInstance, trigger.ID(), 3)
+		require.NoError(t, err)
+		require.Len(t, runs, 3)
+		assert.Equal(t, next, runs[0])
+		for _, run := range runs {
+			assert.Equal(t, time.January, run.Month())
+			assert.Equal(t, 1, run.Day())
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+		_, err = sch.NextRuns(testInstance, "unknown", 3)
+		assert.ErrorIs(t, err, job.ErrNotFoundTrigger)
+
+		// A paused trigger is fired only when forced
+		require.NoError(t, sch.PauseTrigger(testInstance, trigger.ID()))
+		_, err = sch.FireTrigger(testInstance, trigger.ID(), false)
+		assert.ErrorIs(t, err, job.ErrTriggerPaused)
+		_, err = sch.FireTrigger(testInstance, trigger.ID(), true)
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("PauseAndResume", func(t *testing.T) {
+		var called int32
+		bro := job.NewMemBroker()
+		assert.NoError(t, bro.StartWorkers(job.WorkersList{
+			{
+				WorkerType:   "worker",
+				Concurrency:  1,
+				MaxExecCount: 1,
+				WorkerFunc: func(_ *job.WorkerContext) error {
+					atomic.AddInt32(&called, 1)
+					return nil
+				},
+			},
+		}))
+		sch := job.NewMemScheduler()
+		require.NoError(t, sch.StartScheduler(bro))
+		defer func() { assert.NoError(t, sch.ShutdownScheduler(context.Background())) }()
+
+		msg, _ := job.NewMessage("@event")
+		trigger, err := job.NewTrigger(testInstance, job.TriggerInfos{
+			Type:       "@event",
+			Arguments:  "io.cozy.testpause",
+			WorkerType: "worker",
+		}, msg)
+		require.NoError(t, err)
+		require.NoError(t, sch.AddTrigger(trigger))
+		defer func() { assert.NoError(t, sch.DeleteTrigger(testInstance, trigger.ID())) }()
+
+		doc := &couchdb.JSONDoc{
+			Type: "io.cozy.testpause",
+			M: map[string]interface{}{
+				"_id":  "test-id",
+				"_rev": "1-xxabxx",
+			},
+		}
+
+		// A paused trigger produces no jobs, but it is preserved
+		require.NoError(t, sch.PauseTrigger(testInstance, trigger.ID()))
+		realtime.GetHub().Publish(testInstance, realtime.EventCreate, doc, nil)
+		time.Sleep(500 * time.Millisecond)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&called))
+		paused, err := sch.GetTrigger(testInstance, trigger.ID())
+		require.NoError(t, err)
+		assert.True(t, paused.Infos().Paused())
+
+		// A resumed trigger pushes jobs again
+		require.NoError(t, sch.ResumeTrigger(testInstance, trigger.ID(), false))
+		assert.False(t, paused.Infos().Paused())
+		realtime.GetHub().Publish(testInstance, realtime.EventCreate, doc, nil)
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// A paused @every trigger misses its runs, and can backfill them on
+		// resume with a single job
+		every, err := job.NewTrigger(testInstance, job.TriggerInfos{
+			Type:       "@every",
+			Arguments:  "1s",
+			WorkerType: "worker",
+		}, msg)
+		require.NoError(t, err)
+		require.NoError(t, sch.AddTrigger(every))
+		defer func() { assert.NoError(t, sch.DeleteTrigger(testInstance, every.ID())) }()
+		require.NoError(t, sch.PauseTrigger(testInstance, every.ID()))
+		time.Sleep(2500 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+		require.NoError(t, sch.ResumeTrigger(testInstance, every.ID(), true))
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) >= 2
+		}, 500*time.Millisecond, 10*time.Millisecond)
+	})
+
 	t.Run("MemSchedulerWithDebounce", func(t *testing.T) {
 		var called int32
 		bro := job.NewMemBroker()
@@ -133,4 +335,62 @@ func TestMemScheduler(t *testing.T) {
 		err = sch.ShutdownScheduler(context.Background())
 		assert.NoError(t, err)
 	})
+
+	t.Run("MemSchedulerWithDebounceReset", func(t *testing.T) {
+		var called, count int32
+		bro := job.NewMemBroker()
+		assert.NoError(t, bro.StartWorkers(job.WorkersList{
+			{
+				WorkerType:   "worker",
+				Concurrency:  1,
+				MaxExecCount: 1,
+				Timeout:      1 * time.Second,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					atomic.AddInt32(&called, 1)
+					atomic.StoreInt32(&count, int32(ctx.DebouncedCount()))
+					return nil
+				},
+			},
+		}))
+
+		msg, _ := job.NewMessage("@event")
+		sch := job.NewMemScheduler()
+		if !assert.NoError(t, sch.StartScheduler(bro)) {
+			return
+		}
+		trigger, err := job.NewTrigger(testInstance, job.TriggerInfos{
+			Type:          "@event",
+			Arguments:     "io.cozy.testdebouncereset",
+			Debounce:      "500ms",
+			DebounceReset: true,
+			WorkerType:    "worker",
+			Message:       msg,
+		}, msg)
+		require.NoError(t, err)
+		require.NoError(t, sch.AddTrigger(trigger))
+
+		// A burst of changes longer than the debounce window: as the timer
+		// is reset for each change, a single job is pushed after the burst.
+		for i := 0; i < 500; i++ {
+			if i%50 == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			doc := &couchdb.JSONDoc{
+				Type: "io.cozy.testdebouncereset",
+				M: map[string]interface{}{
+					"_id":  fmt.Sprintf("file-%d", i),
+					"_rev": "1-xxabxx",
+				},
+			}
+			realtime.GetHub().Publish(testInstance, realtime.EventCreate, doc, nil)
+		}
+		assert.Equal(t, int32(0), atomic.LoadInt32(&called))
+
+		time.Sleep(1500 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+		assert.Equal(t, int32(500), atomic.LoadInt32(&count))
+
+		assert.NoError(t, sch.DeleteTrigger(testInstance, trigger.ID()))
+		assert.NoError(t, sch.ShutdownScheduler(context.Background()))
+	})
 }
@@ -3,33 +3,60 @@ package job
 import "github.com/prometheus/client_golang/prometheus"
 
 type workersQueuesCollector struct {
-	prometheus.Desc
+	len       *prometheus.Desc
+	running   *prometheus.Desc
+	oldestAge *prometheus.Desc
 }
 
 func newWorkersQueuesCollector() prometheus.Collector {
-	desc := prometheus.NewDesc(
-		prometheus.BuildFQName("workers", "queues", "len"),
-		`Len of the workers queues by worker type`,
-		[]string{"worker_type"},
-		prometheus.Labels{},
-	)
-	return &workersQueuesCollector{*desc}
+	return &workersQueuesCollector{
+		len: prometheus.NewDesc(
+			prometheus.BuildFQName("workers", "queues", "len"),
+			`Len of the workers queues by worker type`,
+			[]string{"worker_type"},
+			prometheus.Labels{},
+		),
+		running: prometheus.NewDesc(
+			prometheus.BuildFQName("workers", "queues", "running"),
+			`Number of jobs being executed by this stack, by worker type`,
+			[]string{"worker_type"},
+			prometheus.Labels{},
+		),
+		oldestAge: prometheus.NewDesc(
+			prometheus.BuildFQName("workers", "queues", "oldest_age_seconds"),
+			`Age of the oldest job waiting in the workers queues by worker type`,
+			[]string{"worker_type"},
+			prometheus.Labels{},
+		),
+	}
 }
 
 func (i *workersQueuesCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- &i.Desc
+	ch <- i.len
+	ch <- i.running
+	ch <- i.oldestAge
 }
 
 func (i *workersQueuesCollector) Collect(ch chan<- prometheus.Metric) {
-	broker := globalJobSystem
-	for _, workerType := range broker.WorkersTypes() {
-		count, err := broker.WorkerQueueLen(workerType)
-		if err != nil {
-			continue
-		}
+	if globalJobSystem == nil {
+		return
+	}
+	stats, err := globalJobSystem.Stats()
+	if err != nil {
+		return
+	}
+	for _, s := range stats {
+		ch <- prometheus.MustNewConstMetric(
+			i.len, prometheus.GaugeValue, float64(s.Queued),
+			s.WorkerType,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			i.running, prometheus.GaugeValue, float64(s.Running),
+			s.WorkerType,
+		)
 		ch <- prometheus.MustNewConstMetric(
-			&i.Desc, prometheus.GaugeValue, float64(count),
-			workerType,
+			i.oldestAge, prometheus.GaugeValue, s.OldestAge.Seconds(),
+			s.WorkerType,
 		)
 	}
 }
@@ -0,0 +1,29 @@
+package job
+
+// WorkerMiddleware wraps the execution of the workers, for the cross-cutting
+// concerns like logging, metrics or the recovery of panics.
+type WorkerMiddleware func(next WorkerFunc) WorkerFunc
+
+// workerMiddlewares is the list of the registered middlewares, the first one
+// being the outermost.
+var workerMiddlewares []WorkerMiddleware
+
+// RegisterWorkerMiddleware adds a middleware that will be applied around each
+// execution of the workers. The middlewares are applied in the order of their
+// registration: the first registered is the first called. It should be called
+// before starting the workers, typically in an init function.
+func RegisterWorkerMiddleware(mw WorkerMiddleware) {
+	if mw == nil {
+		panic("Missing worker middleware")
+	}
+	workerMiddlewares = append(workerMiddlewares, mw)
+}
+
+// withMiddlewares returns the worker function wrapped in the registered
+// middlewares.
+func withMiddlewares(fn WorkerFunc) WorkerFunc {
+	for i := len(workerMiddlewares) - 1; i >= 0; i-- {
+		fn = workerMiddlewares[i](fn)
+	}
+	return fn
+}
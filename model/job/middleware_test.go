@@ -0,0 +1,78 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runWithMiddlewares(t *testing.T, fn WorkerFunc, mws ...WorkerMiddleware) error {
+	saved := workerMiddlewares
+	workerMiddlewares = nil
+	defer func() { workerMiddlewares = saved }()
+	for _, mw := range mws {
+		RegisterWorkerMiddleware(mw)
+	}
+
+	w := NewWorker(&WorkerConfig{
+		WorkerType:   "test",
+		MaxExecCount: 1,
+		WorkerFunc:   fn,
+	})
+	j := &Job{JobID: "job-1", Domain: "cozy.localhost"}
+	return newTestTask(w, j).run()
+}
+
+func TestWorkerMiddlewares(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	var calls []string
+	recorder := func(name string) WorkerMiddleware {
+		return func(next WorkerFunc) WorkerFunc {
+			return func(ctx *WorkerContext) error {
+				calls = append(calls, "start "+name)
+				err := next(ctx)
+				calls = append(calls, "end "+name)
+				return err
+			}
+		}
+	}
+	err := runWithMiddlewares(t, func(ctx *WorkerContext) error {
+		calls = append(calls, "worker")
+		return nil
+	}, recorder("first"), recorder("second"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"start first",
+		"start second",
+		"worker",
+		"end second",
+		"end first",
+	}, calls)
+}
+
+func TestWorkerMiddlewareRecover(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	errPanic := errors.New("worker panicked")
+	recoverer := func(next WorkerFunc) WorkerFunc {
+		return func(ctx *WorkerContext) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%w: %v", errPanic, r)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+	err := runWithMiddlewares(t, func(ctx *WorkerContext) error {
+		panic("boom")
+	}, recoverer)
+	assert.ErrorIs(t, err, errPanic)
+	assert.Contains(t, err.Error(), "boom")
+}
@@ -2,6 +2,9 @@ package job
 
 import (
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/limits"
 )
@@ -35,3 +38,50 @@ func GetCounterTypeFromWorkerType(workerType string) (limits.CounterType, error)
 		return -1, errors.New("CounterType was not found")
 	}
 }
+
+// ParseRateLimit parses the rate-limit of a trigger, like "10/1h" for at most
+// 10 jobs per hour.
+func ParseRateLimit(rateLimit string) (int64, time.Duration, error) {
+	parts := strings.SplitN(rateLimit, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid rate-limit (10/1h expected)")
+	}
+	limit, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, 0, errors.New("Invalid number of jobs for the rate-limit")
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return 0, 0, errors.New("Invalid period for the rate-limit")
+	}
+	return limit, period, nil
+}
+
+// checkTriggerRateLimit returns ErrRateLimited if the job request comes from
+// a trigger that has already pushed too many jobs in its rate-limit period.
+// The excess jobs are dropped, not delayed.
+func checkTriggerRateLimit(limiter *limits.RateLimiter, req *JobRequest) error {
+	if req.Trigger == nil || limiter == nil {
+		return nil
+	}
+	infos := req.Trigger.Infos()
+	if infos.RateLimit == "" {
+		return nil
+	}
+	limit, period, err := ParseRateLimit(infos.RateLimit)
+	if err != nil {
+		joblog.Warnf("Trigger %s %s has an invalid rate-limit: %s",
+			infos.Domain, infos.TID, infos.RateLimit)
+		return nil
+	}
+	key := "trigger:" + infos.DBPrefix() + "/" + infos.TID
+	err = limiter.CheckCustomRateLimit(key, limit, period)
+	if limits.IsLimitReachedOrExceeded(err) {
+		if errors.Is(err, limits.ErrRateLimitReached) {
+			joblog.Infof("Trigger %s %s has reached its rate-limit",
+				infos.Domain, infos.TID)
+		}
+		return ErrRateLimited
+	}
+	return err
+}
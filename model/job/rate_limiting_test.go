@@ -0,0 +1,51 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, period, err := ParseRateLimit("10/1h")
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, limit)
+	assert.Equal(t, time.Hour, period)
+
+	for _, invalid := range []string{"", "10", "0/1h", "-1/1h", "ten/1h", "10/forever", "10/-1s"} {
+		_, _, err := ParseRateLimit(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTriggerRateLimit(t *testing.T) {
+	limiter := limits.NewRateLimiter(nil)
+	n := 3
+	trigger, err := NewEventTrigger(&TriggerInfos{
+		TID:        "rate-limited",
+		Domain:     "cozy.localhost",
+		Type:       "@event",
+		WorkerType: "test",
+		Arguments:  "io.cozy.files",
+		RateLimit:  "3/1m",
+	})
+	require.NoError(t, err)
+
+	pushed := 0
+	for i := 0; i < 10*n; i++ {
+		err := checkTriggerRateLimit(limiter, trigger.Infos().JobRequest())
+		if err == nil {
+			pushed++
+		} else {
+			assert.Equal(t, ErrRateLimited, err)
+		}
+	}
+	assert.Equal(t, n, pushed)
+
+	// A trigger without a rate-limit is not limited
+	trigger.Infos().RateLimit = ""
+	assert.NoError(t, checkTriggerRateLimit(limiter, trigger.Infos().JobRequest()))
+}
@@ -2,15 +2,18 @@ package job
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -23,8 +26,86 @@ const (
 	redisPrefix = "j/"
 	// redisHighPrioritySuffix suffix is the suffix used for prioritized queue.
 	redisHighPrioritySuffix = "/p0"
+	// redisLowPrioritySuffix suffix is the suffix used for the queue of the
+	// jobs with a low priority.
+	redisLowPrioritySuffix = "/p2"
+	// redisDeadLettersSuffix is the suffix of the hash where the dead letters
+	// of a worker type are kept, by job ID.
+	redisDeadLettersSuffix = "/dead"
+	// redisDeadLettersIndexSuffix is the suffix of the sorted set of the IDs
+	// of the dead letters of a worker type, with the time in milliseconds of
+	// their failure as score. It is used to remove the oldest dead letters.
+	redisDeadLettersIndexSuffix = "/index"
+	// redisDelayedSuffix is the suffix of the sorted set where the delayed
+	// jobs of a queue wait, with the time in milliseconds when they can be
+	// executed as score.
+	redisDelayedSuffix = "/delayed"
+	// redisEnqueuedSuffix is the suffix of the sorted set of the jobs waiting
+	// in a queue, with the time in milliseconds when they were put in this
+	// queue as score. It allows to know how long they have waited without
+	// loading them from CouchDB.
+	redisEnqueuedSuffix = "/enqueued"
+	// redisCancelChannel is the pub/sub channel used to ask the stacks to
+	// cancel a running job.
+	redisCancelChannel = "j-cancel"
+	// redisHeartbeatsSuffix is the suffix of the sorted set where the
+	// running jobs of a queue are kept, with the time in milliseconds of
+	// their last heartbeat as score.
+	redisHeartbeatsSuffix = "/heartbeats"
+	// redisIdempotencyPrefix is the prefix of the keys where the job IDs are
+	// kept by idempotency key.
+	redisIdempotencyPrefix = "j-idempotency:"
 )
 
+// luaPollDelayed returns the lua script used for moving the delayed jobs that
+// are ready from the sorted set KEYS[1] to their queue KEYS[2]. The members of
+// the sorted set are the values to push in the queue, and they are added to
+// the enqueued set KEYS[3] with the time ARGV[2].
+const luaPollDelayed = `
+local jobs = redis.call("ZRANGEBYSCORE", KEYS[1], 0, ARGV[1], "LIMIT", 0, 100)
+for _, val in ipairs(jobs) do
+  redis.call("ZADD", KEYS[3], ARGV[2], val)
+  redis.call("LPUSH", KEYS[2], val)
+  redis.call("ZREM", KEYS[1], val)
+end
+return #jobs`
+
+// redisQueueSetKey returns the key of a sorted set for the jobs of a queue,
+// like the delayed jobs. The key of the queue is used as a hash tag, so that
+// the sorted set and the queue are in the same slot on a redis cluster, and
+// can be used by the same lua script.
+func redisQueueSetKey(queue, suffix string) string {
+	return "{" + queue + "}" + suffix
+}
+
+// luaAddDeadLetter adds a dead letter in the hash KEYS[1], and its ID in the
+// index KEYS[2]. The oldest dead letters are removed when there are more than
+// ARGV[4].
+const luaAddDeadLetter = `
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+local n = redis.call("ZCARD", KEYS[2]) - tonumber(ARGV[4])
+if n > 0 then
+  local ids = redis.call("ZRANGE", KEYS[2], 0, n - 1)
+  redis.call("ZREMRANGEBYRANK", KEYS[2], 0, n - 1)
+  redis.call("HDEL", KEYS[1], unpack(ids))
+end
+return 0`
+
+// luaAgeJob moves the last value of a queue (the next one to be dequeued) to
+// the end of another queue, if it is still the given value. It is also moved
+// from the enqueued set KEYS[3] of the first queue to the enqueued set KEYS[4]
+// of the other queue, with the time ARGV[2].
+const luaAgeJob = `
+if redis.call("LINDEX", KEYS[1], -1) == ARGV[1] then
+  redis.call("RPOP", KEYS[1])
+  redis.call("ZREM", KEYS[3], ARGV[1])
+  redis.call("ZADD", KEYS[4], ARGV[2], ARGV[1])
+  redis.call("RPUSH", KEYS[2], ARGV[1])
+  return 1
+end
+return 0`
+
 type redisBroker struct {
 	client         redis.UniversalClient
 	ctx            context.Context
@@ -32,7 +113,9 @@ type redisBroker struct {
 	workersRunning []*Worker
 	workersTypes   []string
 	running        uint32
+	draining       uint32
 	closed         chan struct{}
+	cancels        *redis.PubSub
 }
 
 // NewRedisBroker creates a new broker that will use redis to distribute
@@ -54,6 +137,10 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 	for _, conf := range ws {
 		b.workersTypes = append(b.workersTypes, conf.WorkerType)
 		w := NewWorker(conf)
+		w.deadLetters = b
+		w.idempotency = b
+		w.heartbeats = b
+		w.broker = b
 		b.workers = append(b.workers, w)
 		if conf.Concurrency <= 0 {
 			continue
@@ -68,6 +155,9 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 
 	if len(b.workersRunning) > 0 {
 		joblog.Infof("Started redis broker for %d workers type", len(b.workersRunning))
+		go b.pollDelayedLoop()
+		b.cancels = b.client.Subscribe(b.ctx, redisCancelChannel)
+		go b.cancelLoop(b.cancels.Channel())
 	}
 
 	// XXX for retro-compat
@@ -85,6 +175,8 @@ func (b *redisBroker) WorkersTypes() []string {
 }
 
 func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
+	atomic.StoreUint32(&b.draining, 1)
+	defer atomic.StoreUint32(&b.draining, 0)
 	if !atomic.CompareAndSwapUint32(&b.running, 1, 0) {
 		return ErrClosed
 	}
@@ -94,12 +186,19 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 	fmt.Print("  shutting down redis broker...")
 	defer b.client.Close()
+	if b.cancels != nil {
+		_ = b.cancels.Close()
+	}
 
 	for i := 0; i < len(b.workersRunning); i++ {
 		select {
 		case <-ctx.Done():
-			fmt.Println("failed:", ctx.Err())
-			return ctx.Err()
+			err := ctx.Err()
+			if errq := b.requeueInFlight(); errq != nil {
+				err = multierror.Append(err, errq)
+			}
+			fmt.Println("failed:", err)
+			return err
 		case <-b.closed:
 		}
 	}
@@ -116,6 +215,10 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 		}
 	}
 
+	if err := b.requeueInFlight(); err != nil {
+		errm = multierror.Append(errm, err)
+	}
+
 	if errm != nil {
 		fmt.Println("failed: ", errm)
 	} else {
@@ -148,13 +251,14 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 		// manual queue, this would cause a starvation for our main queue if too
 		// many "manual" jobs are pushed. By randomizing the order we make sure we
 		// avoid such starvation. For one in three call, the main queue is
-		// selected.
+		// selected. The low priority queue is always the last one.
 		keyP0 := key + redisHighPrioritySuffix
 		keyP1 := key
+		keyP2 := key + redisLowPrioritySuffix
 		if rng.Intn(3) == 0 {
 			keyP1, keyP0 = keyP0, keyP1
 		}
-		results, err := b.client.BRPop(b.ctx, redisBRPopTimeout, keyP0, keyP1).Result()
+		results, err := b.client.BRPop(b.ctx, redisBRPopTimeout, keyP0, keyP1, keyP2).Result()
 		if err != nil || len(results) < 2 {
 			time.Sleep(100 * time.Millisecond)
 			continue
@@ -165,24 +269,13 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 			joblog.Warnf("Invalid key %s", key)
 			continue
 		}
-
-		parts := strings.SplitN(val, "/", 2)
-		if len(parts) != 2 {
-			joblog.Warnf("Invalid val %s", val)
-			continue
+		if err := b.client.ZRem(b.ctx, redisQueueSetKey(key, redisEnqueuedSuffix), val).Err(); err != nil {
+			joblog.Warnf("Cannot remove %s from the enqueued jobs: %s", val, err)
 		}
 
-		jobID := parts[1]
-		parts = strings.SplitN(parts[0], "%", 2)
-		prefix := parts[0]
-		var cluster int
-		if len(parts) > 1 {
-			cluster, _ = strconv.Atoi(parts[1])
-		}
-		job, err := Get(prefixer.NewPrefixer(cluster, "", prefix), jobID)
+		job, err := redisQueuedJob(val)
 		if err != nil {
-			joblog.Warnf("Cannot find job %s on domain %s (%d): %s",
-				jobID, prefix, cluster, err)
+			joblog.Warnf("Cannot find job %s: %s", val, err)
 			continue
 		}
 
@@ -190,9 +283,133 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 	}
 }
 
+// pollDelayedLoop regularly moves the delayed jobs that are ready to their
+// queues.
+func (b *redisBroker) pollDelayedLoop() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadUint32(&b.running) == 0 {
+			return
+		}
+		now := time.Now()
+		if err := b.pollDelayed(now); err != nil {
+			joblog.Warnf("Failed to poll the delayed jobs: %s", err)
+		}
+		if err := b.reapStaleJobs(now); err != nil {
+			joblog.Warnf("Failed to reap the stale jobs: %s", err)
+		}
+		if err := b.ageQueues(now); err != nil {
+			joblog.Warnf("Failed to age the queued jobs: %s", err)
+		}
+	}
+}
+
+// cancelLoop cancels the jobs running on this stack when a stack asks for it.
+func (b *redisBroker) cancelLoop(ch <-chan *redis.Message) {
+	for msg := range ch {
+		cancelRunning(msg.Payload)
+	}
+}
+
+func (b *redisBroker) pollDelayed(now time.Time) error {
+	return b.pollQueueSets(redisDelayedSuffix, now, now.UnixMilli())
+}
+
+// reapStaleJobs puts back in their queue the running jobs whose heartbeat is
+// older than heartbeatTimeout: the stack that was running them has probably
+// crashed. It uses the same script as for the delayed jobs.
+func (b *redisBroker) reapStaleJobs(now time.Time) error {
+	return b.pollQueueSets(redisHeartbeatsSuffix, now, now.Add(-heartbeatTimeout).UnixMilli())
+}
+
+// pollQueueSets moves the jobs with a score lower than max from the sorted
+// sets with the given suffix to their queues, where they are enqueued at now.
+// The scripts for all the queues are sent in a single pipeline, and at most
+// 100 jobs are moved for a queue on each call.
+func (b *redisBroker) pollQueueSets(suffix string, now time.Time, max int64) error {
+	_, err := b.client.Pipelined(b.ctx, func(pipe redis.Pipeliner) error {
+		for _, workerType := range b.workersTypes {
+			key := redisPrefix + workerType
+			for _, queue := range []string{key + redisHighPrioritySuffix, key, key + redisLowPrioritySuffix} {
+				keys := []string{
+					redisQueueSetKey(queue, suffix),
+					queue,
+					redisQueueSetKey(queue, redisEnqueuedSuffix),
+				}
+				pipe.Eval(b.ctx, luaPollDelayed, keys, max, now.UnixMilli())
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// ageQueues moves the jobs that have waited long enough in their queue to the
+// queue with the higher priority. The oldest job of a queue is at its end, and
+// it is moved at the end of the other queue to be the next one dequeued. The
+// time it has waited is taken from the enqueued set, and it starts again from
+// zero in the other queue.
+func (b *redisBroker) ageQueues(now time.Time) error {
+	aging := priorityAging()
+	if aging <= 0 {
+		return nil
+	}
+	for _, workerType := range b.workersTypes {
+		for _, level := range []Priority{PriorityLow, PriorityNormal} {
+			key := redisPrefix + workerType + redisPrioritySuffix(level)
+			for i := 0; i < 100; i++ {
+				val, queuedAt, err := b.oldestQueued(key)
+				if errors.Is(err, redis.Nil) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				priority := agePriority(level, queuedAt, now, aging)
+				if priority <= level {
+					break
+				}
+				dest := redisPrefix + workerType + redisPrioritySuffix(priority)
+				keys := []string{
+					key,
+					dest,
+					redisQueueSetKey(key, redisEnqueuedSuffix),
+					redisQueueSetKey(dest, redisEnqueuedSuffix),
+				}
+				if err := b.client.Eval(b.ctx, luaAgeJob, keys, val, now.UnixMilli()).Err(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// redisHeartbeatsKey returns the key of the heartbeats sorted set for the
+// job.
+func redisHeartbeatsKey(job *Job) string {
+	queue := redisPrefix + job.WorkerType + redisPrioritySuffix(job.QueuePriority())
+	return redisQueueSetKey(queue, redisHeartbeatsSuffix)
+}
+
+func (b *redisBroker) heartbeat(job *Job, at time.Time) error {
+	return b.client.ZAdd(b.ctx, redisHeartbeatsKey(job), redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: redisQueueValue(job),
+	}).Err()
+}
+
+func (b *redisBroker) clearHeartbeat(job *Job) error {
+	return b.client.ZRem(b.ctx, redisHeartbeatsKey(job), redisQueueValue(job)).Err()
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error) {
+	if atomic.LoadUint32(&b.draining) == 1 {
+		return nil, ErrDraining
+	}
 	if atomic.LoadUint32(&b.running) == 0 {
 		return nil, ErrClosed
 	}
@@ -207,6 +424,9 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 	if worker == nil && req.WorkerType != "client" {
 		return nil, ErrUnknownWorker
 	}
+	if err := worker.validateMessage(req.Message); err != nil {
+		return nil, err
+	}
 
 	// Check for limits
 	ct, err := GetCounterTypeFromWorkerType(req.WorkerType)
@@ -224,6 +444,10 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 		}
 	}
 
+	if err := checkTriggerRateLimit(config.GetRateLimiter(), req); err != nil {
+		return nil, err
+	}
+
 	job := NewJob(db, req)
 	if worker != nil && worker.Conf.BeforeHook != nil {
 		ok, err := worker.Conf.BeforeHook(job)
@@ -238,32 +462,159 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 	if err := job.Create(); err != nil {
 		return nil, err
 	}
+	if job.IdempotencyKey != "" {
+		existing, err := deduplicateJob(b, job)
+		if err != nil || existing != nil {
+			return existing, err
+		}
+	}
 
 	// For client jobs, we don't need to enqueue the job in redis.
 	if worker == nil {
 		return job, nil
 	}
 
-	key := redisPrefix + job.WorkerType
-	prefix := job.DBPrefix()
-	if cluster := job.DBCluster(); cluster > 0 {
-		prefix = fmt.Sprintf("%s%%%d", prefix, cluster)
-	}
-	val := prefix + "/" + job.JobID
+	key := redisPrefix + job.WorkerType + redisPrioritySuffix(job.QueuePriority())
+	val := redisQueueValue(job)
 
-	// When the job is manual, it is being pushed in a specific prioritized
-	// queue.
-	if job.Manual {
-		key += redisHighPrioritySuffix
+	if job.delayed() {
+		err := b.client.ZAdd(b.ctx, redisQueueSetKey(key, redisDelayedSuffix), redis.Z{
+			Score:  float64(job.RunAt.UnixMilli()),
+			Member: val,
+		}).Err()
+		if err != nil {
+			// The job has not been queued: a retry must not get it back
+			b.releaseIdempotencyKey(job)
+			return nil, err
+		}
+		return job, nil
 	}
 
-	if err := b.client.LPush(b.ctx, key, val).Err(); err != nil {
+	if err := b.enqueue(key, val, false); err != nil {
+		b.releaseIdempotencyKey(job)
 		return nil, err
 	}
 
 	return job, nil
 }
 
+// enqueue puts the value in the queue, and the time of now in its enqueued
+// set. With next, the value is put on the side where the jobs are consumed.
+func (b *redisBroker) enqueue(queue, val string, next bool) error {
+	_, err := b.client.TxPipelined(b.ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(b.ctx, redisQueueSetKey(queue, redisEnqueuedSuffix), redis.Z{
+			Score:  float64(time.Now().UnixMilli()),
+			Member: val,
+		})
+		if next {
+			pipe.RPush(b.ctx, queue, val)
+		} else {
+			pipe.LPush(b.ctx, queue, val)
+		}
+		return nil
+	})
+	return err
+}
+
+// oldestQueued returns the next value to be dequeued from the queue, and the
+// time when it was put in this queue. The time is zero for the jobs enqueued
+// by an older version of the stack. redis.Nil is returned for an empty queue.
+func (b *redisBroker) oldestQueued(queue string) (string, time.Time, error) {
+	val, err := b.client.LIndex(b.ctx, queue, -1).Result()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	score, err := b.client.ZScore(b.ctx, redisQueueSetKey(queue, redisEnqueuedSuffix), val).Result()
+	if errors.Is(err, redis.Nil) {
+		return val, time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return val, time.UnixMilli(int64(score)), nil
+}
+
+func (b *redisBroker) claimIdempotencyKey(key, jobID string, ttl time.Duration) (string, error) {
+	key = redisIdempotencyPrefix + key
+	for {
+		ok, err := b.client.SetNX(b.ctx, key, jobID, ttl).Result()
+		if err != nil || ok {
+			return "", err
+		}
+		existing, err := b.client.Get(b.ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue // the key has expired in the meantime
+		}
+		return existing, err
+	}
+}
+
+func (b *redisBroker) expireIdempotencyKey(key string, after time.Duration) error {
+	key = redisIdempotencyPrefix + key
+	if after <= 0 {
+		return b.client.Del(b.ctx, key).Err()
+	}
+	return b.client.Expire(b.ctx, key, after).Err()
+}
+
+// releaseIdempotencyKey frees the idempotency key of a job that has been
+// canceled before its execution, or that could not be queued.
+func (b *redisBroker) releaseIdempotencyKey(job *Job) {
+	if job.IdempotencyKey != "" {
+		_ = b.expireIdempotencyKey(idempotencyKey(job), 0)
+	}
+}
+
+// requeueInFlight puts the jobs that have not finished in time back in their
+// queue, to be executed by another stack (or by this one after a restart).
+func (b *redisBroker) requeueInFlight() error {
+	var errm error
+	for _, w := range b.workersRunning {
+		for _, job := range w.abandonInFlight() {
+			if err := b.requeueJob(job); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+	return errm
+}
+
+// requeueJob puts a job abandoned on shutdown back in its queue. It is pushed
+// on the side where the jobs are consumed, as it was already dequeued once.
+func (b *redisBroker) requeueJob(job *Job) error {
+	if err := requeueAbandonedJob(job); err != nil {
+		return err
+	}
+	key := redisPrefix + job.WorkerType + redisPrioritySuffix(job.QueuePriority())
+	return b.enqueue(key, redisQueueValue(job), true)
+}
+
+// redisQueuedJob loads the job from the value that was in a redis queue.
+func redisQueuedJob(val string) (*Job, error) {
+	parts := strings.SplitN(val, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid value %q", val)
+	}
+
+	jobID := parts[1]
+	parts = strings.SplitN(parts[0], "%", 2)
+	prefix := parts[0]
+	var cluster int
+	if len(parts) > 1 {
+		cluster, _ = strconv.Atoi(parts[1])
+	}
+	return Get(prefixer.NewPrefixer(cluster, "", prefix), jobID)
+}
+
+// redisQueueValue returns the value put in the redis queue for the job.
+func redisQueueValue(job *Job) string {
+	prefix := job.DBPrefix()
+	if cluster := job.DBCluster(); cluster > 0 {
+		prefix = fmt.Sprintf("%s%%%d", prefix, cluster)
+	}
+	return prefix + "/" + job.JobID
+}
+
 // QueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
@@ -276,7 +627,23 @@ func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return int(l1 + l2), nil
+	l3, err := b.client.LLen(b.ctx, key+redisLowPrioritySuffix).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(l1 + l2 + l3), nil
+}
+
+// redisPrioritySuffix returns the suffix of the queue for the jobs with the
+// given priority.
+func redisPrioritySuffix(priority Priority) string {
+	switch {
+	case priority > PriorityNormal:
+		return redisHighPrioritySuffix
+	case priority < PriorityNormal:
+		return redisLowPrioritySuffix
+	}
+	return ""
 }
 
 func (b *redisBroker) WorkerIsReserved(workerType string) (bool, error) {
@@ -287,3 +654,153 @@ func (b *redisBroker) WorkerIsReserved(workerType string) (bool, error) {
 	}
 	return false, ErrUnknownWorker
 }
+
+func (b *redisBroker) addDeadLetter(dl *DeadLetter) error {
+	val, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	key := redisPrefix + dl.Job.WorkerType + redisDeadLettersSuffix
+	index := redisQueueSetKey(key, redisDeadLettersIndexSuffix)
+	return b.client.Eval(b.ctx, luaAddDeadLetter, []string{key, index},
+		dl.Job.ID(), packRedisValue(val), dl.FailedAt.UnixMilli(), maxDeadLetters).Err()
+}
+
+func (b *redisBroker) DeadLetters(workerType string) ([]*DeadLetter, error) {
+	key := redisPrefix + workerType + redisDeadLettersSuffix
+	vals, err := b.client.HGetAll(b.ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	dls := make([]*DeadLetter, 0, len(vals))
+	for _, val := range vals {
+		raw, err := unpackRedisValue([]byte(val))
+		if err != nil {
+			return nil, err
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(raw, &dl); err != nil {
+			return nil, err
+		}
+		dls = append(dls, &dl)
+	}
+	sort.Slice(dls, func(i, j int) bool { return dls[i].FailedAt.Before(dls[j].FailedAt) })
+	return dls, nil
+}
+
+func (b *redisBroker) RequeueDeadLetter(workerType, jobID string) (*Job, error) {
+	key := redisPrefix + workerType + redisDeadLettersSuffix
+	val, err := b.client.HGet(b.ctx, key, jobID).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFoundJob
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := unpackRedisValue([]byte(val))
+	if err != nil {
+		return nil, err
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(raw, &dl); err != nil {
+		return nil, err
+	}
+	// Another stack may have requeued the job in the meantime
+	if n, err := b.client.HDel(b.ctx, key, jobID).Result(); err != nil || n == 0 {
+		return nil, ErrNotFoundJob
+	}
+	_ = b.client.ZRem(b.ctx, redisQueueSetKey(key, redisDeadLettersIndexSuffix), jobID).Err()
+	job, err := b.PushJob(dl.Job, dl.requeueRequest())
+	if err != nil {
+		_ = b.addDeadLetter(&dl)
+		return nil, err
+	}
+	return job, nil
+}
+
+// CancelJob removes the job from the redis queues if it is still there.
+// Else, the job may be running on any stack, and a message is published to
+// ask the stacks to cancel it.
+func (b *redisBroker) CancelJob(db prefixer.Prefixer, jobID string) error {
+	job, err := cancelableJob(db, jobID)
+	if err != nil {
+		return err
+	}
+	if job.WorkerType == "client" {
+		return ErrJobNotCancelable
+	}
+
+	if job.State == Queued {
+		key := redisPrefix + job.WorkerType
+		val := redisQueueValue(job)
+		removed := int64(0)
+		for _, suffix := range []string{redisHighPrioritySuffix, "", redisLowPrioritySuffix} {
+			n, err := b.client.LRem(b.ctx, key+suffix, 0, val).Result()
+			if err != nil {
+				return err
+			}
+			removed += n
+			if n > 0 {
+				b.client.ZRem(b.ctx, redisQueueSetKey(key+suffix, redisEnqueuedSuffix), val)
+			}
+		}
+		delayed := redisQueueSetKey(key+redisPrioritySuffix(job.QueuePriority()), redisDelayedSuffix)
+		n, err := b.client.ZRem(b.ctx, delayed, val).Result()
+		if err != nil {
+			return err
+		}
+		if removed+n > 0 {
+			err := job.fail(Canceled, ErrCanceled.Error())
+			if !couchdb.IsConflictError(err) {
+				b.releaseIdempotencyKey(job)
+				return err
+			}
+			// The job has been given to a worker in the meantime
+		}
+	}
+
+	key := runningKey(job, job.ID())
+	if cancelRunning(key) {
+		return nil
+	}
+	return b.client.Publish(b.ctx, redisCancelChannel, key).Err()
+}
+
+// PushChain pushes the first job of a chain.
+func (b *redisBroker) PushChain(db prefixer.Prefixer, specs []JobSpec) (string, error) {
+	return pushChain(b, db, specs)
+}
+
+// Stats returns the statistics of the queues in redis. The oldest job of a
+// queue is the last element of the list, as the jobs are pushed on the left.
+func (b *redisBroker) Stats() ([]WorkerStats, error) {
+	now := time.Now()
+	stats := make([]WorkerStats, 0, len(b.workers))
+	for _, w := range b.workers {
+		queued, err := b.WorkerQueueLen(w.Type)
+		if err != nil {
+			return nil, err
+		}
+		s := WorkerStats{
+			WorkerType: w.Type,
+			Queued:     queued,
+			Running:    w.InFlight(),
+		}
+		key := redisPrefix + w.Type
+		for _, suffix := range []string{redisHighPrioritySuffix, "", redisLowPrioritySuffix} {
+			_, queuedAt, err := b.oldestQueued(key + suffix)
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				joblog.Warnf("Cannot get the oldest job of %s: %s", key+suffix, err)
+				continue
+			}
+			if age := now.Sub(queuedAt); !queuedAt.IsZero() && age > s.OldestAge {
+				s.OldestAge = age
+			}
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
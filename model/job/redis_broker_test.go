@@ -2,10 +2,12 @@ package job_test
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -176,6 +178,107 @@ func TestRedisBroker(t *testing.T) {
 		assert.Error(t, err)
 		assert.Nil(t, j)
 	})
+
+	t.Run("RedisStats", func(t *testing.T) {
+		opts1, _ := redis.ParseURL(redisURL1)
+		client1 := redis.NewClient(opts1)
+		ctx := context.Background()
+		_ = client1.Del(ctx, "j/stats", "{j/stats}/enqueued")
+
+		started := make(chan struct{}, 3)
+		unblock := make(chan struct{})
+		broker := job.NewRedisBroker(client1)
+		err := broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:  "stats",
+				Concurrency: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					started <- struct{}{}
+					<-unblock
+					return nil
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			_, err = broker.PushJob(testInstance, &job.JobRequest{WorkerType: "stats"})
+			assert.NoError(t, err)
+		}
+		<-started
+		time.Sleep(100 * time.Millisecond)
+
+		stats, err := broker.Stats()
+		assert.NoError(t, err)
+		for _, s := range stats {
+			if s.WorkerType == "stats" {
+				assert.Equal(t, 2, s.Queued)
+				assert.Greater(t, s.OldestAge, time.Duration(0))
+				assert.Less(t, s.OldestAge, 5*time.Second)
+			}
+		}
+		// The enqueued set has only the jobs still in the queue
+		n, err := client1.ZCard(ctx, "{j/stats}/enqueued").Result()
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, n)
+
+		close(unblock)
+		err = broker.ShutdownWorkers(context.Background())
+		assert.NoError(t, err)
+	})
+
+	t.Run("RedisDeadLettersCompressed", func(t *testing.T) {
+		opts1, _ := redis.ParseURL(redisURL1)
+		client1 := redis.NewClient(opts1)
+		large := strings.Repeat("io.cozy.files/0123456789abcdef ", 1000)
+
+		var count int32
+		received := make(chan string, 1)
+		broker := job.NewRedisBroker(client1)
+		err := broker.StartWorkers(job.WorkersList{
+			{
+				WorkerType:   "compressed",
+				Concurrency:  1,
+				MaxExecCount: 1,
+				WorkerFunc: func(ctx *job.WorkerContext) error {
+					if atomic.AddInt32(&count, 1) == 1 {
+						return errors.New("failure")
+					}
+					var msg string
+					err := ctx.UnmarshalMessage(&msg)
+					received <- msg
+					return err
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		msg, _ := job.NewMessage(large)
+		j, err := broker.PushJob(testInstance, &job.JobRequest{
+			WorkerType: "compressed",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+
+		var dls []*job.DeadLetter
+		assert.Eventually(t, func() bool {
+			dls, err = broker.DeadLetters("compressed")
+			return err == nil && len(dls) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// The value stored in redis is compressed
+		raw, err := client1.HGet(context.Background(), "j/compressed/dead", j.ID()).Bytes()
+		assert.NoError(t, err)
+		assert.Less(t, len(raw), len(large))
+		assert.Equal(t, byte(0x01), raw[0])
+
+		_, err = broker.RequeueDeadLetter("compressed", j.ID())
+		assert.NoError(t, err)
+		assert.Equal(t, large, <-received)
+
+		err = broker.ShutdownWorkers(context.Background())
+		assert.NoError(t, err)
+	})
 }
 
 func randomMicro(min, max int) time.Duration {
@@ -0,0 +1,69 @@
+package job
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+const (
+	// redisCompressThreshold is the size above which the values with the
+	// data of a job are compressed before being stored in redis.
+	redisCompressThreshold = 4 * 1024
+	// redisGzipFlag is the first byte of a compressed value. The values that
+	// are not compressed are stored unchanged, except if they start with this
+	// byte, like a raw payload of a webhook can: they are escaped with this
+	// byte followed by redisRawFlag.
+	redisGzipFlag byte = 0x01
+	// redisRawFlag is the second byte of an escaped value. A gzip stream
+	// always starts with 0x1f, so it can't be confused with a compressed
+	// value.
+	redisRawFlag byte = 0x00
+)
+
+// packRedisValue compresses a value that carries the data of a job (message,
+// payload, etc.) before it is stored in redis. Small values are returned
+// unchanged, or escaped if they start with redisGzipFlag.
+func packRedisValue(val []byte) []byte {
+	if len(val) < redisCompressThreshold {
+		return escapeRedisValue(val)
+	}
+	buf := bytes.NewBuffer([]byte{redisGzipFlag})
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(val); err != nil {
+		return escapeRedisValue(val)
+	}
+	if err := gw.Close(); err != nil {
+		return escapeRedisValue(val)
+	}
+	if buf.Len() >= len(val) {
+		return escapeRedisValue(val)
+	}
+	return buf.Bytes()
+}
+
+// escapeRedisValue returns the value unchanged, or prefixed by redisGzipFlag
+// and redisRawFlag if it starts with redisGzipFlag.
+func escapeRedisValue(val []byte) []byte {
+	if len(val) == 0 || val[0] != redisGzipFlag {
+		return val
+	}
+	return append([]byte{redisGzipFlag, redisRawFlag}, val...)
+}
+
+// unpackRedisValue returns the original value for a value packed with
+// packRedisValue.
+func unpackRedisValue(val []byte) ([]byte, error) {
+	if len(val) == 0 || val[0] != redisGzipFlag {
+		return val, nil
+	}
+	if len(val) > 1 && val[1] == redisRawFlag {
+		return val[2:], nil
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(val[1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
@@ -0,0 +1,40 @@
+package job
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackRedisValue(t *testing.T) {
+	small := []byte(`{"message":"small"}`)
+	assert.Equal(t, small, packRedisValue(small))
+	unpacked, err := unpackRedisValue(small)
+	require.NoError(t, err)
+	assert.Equal(t, small, unpacked)
+
+	large := []byte(`{"ids":"` + strings.Repeat("0123456789abcdef", 1000) + `"}`)
+	packed := packRedisValue(large)
+	assert.Equal(t, redisGzipFlag, packed[0])
+	assert.Less(t, len(packed), len(large))
+	unpacked, err = unpackRedisValue(packed)
+	require.NoError(t, err)
+	assert.Equal(t, large, unpacked)
+
+	_, err = unpackRedisValue([]byte{redisGzipFlag, 'x'})
+	assert.Error(t, err)
+
+	// A raw value that starts with the flag is escaped, not decompressed
+	for _, raw := range [][]byte{
+		{redisGzipFlag},
+		{redisGzipFlag, 'x', 'y'},
+		append([]byte{redisGzipFlag, redisRawFlag}, large...),
+	} {
+		packed = packRedisValue(raw)
+		unpacked, err = unpackRedisValue(packed)
+		require.NoError(t, err)
+		assert.Equal(t, raw, unpacked)
+	}
+}
@@ -87,6 +87,10 @@ func payloadKey(t Trigger) string {
 	return "payload-" + t.DBPrefix() + "/" + t.Infos().TID
 }
 
+func countKey(t Trigger) string {
+	return "count-" + t.DBPrefix() + "/" + t.Infos().TID
+}
+
 func eventsKey(db prefixer.Prefixer) string {
 	return "events-" + db.DBPrefix()
 }
@@ -180,14 +184,17 @@ func (s *redisScheduler) eventLoop(eventsCh <-chan *realtime.Event) {
 				continue
 			}
 			et := t.(*EventTrigger)
+			if et.Infos().Paused() || !et.match(event) {
+				continue
+			}
 			if et.Infos().Debounce != "" {
 				var d time.Duration
 				if d, err = time.ParseDuration(et.Infos().Debounce); err == nil {
-					timestamp := time.Now().Add(d)
-					s.client.ZAddNX(s.ctx, TriggersKey, redis.Z{
-						Score:  float64(timestamp.UTC().Unix()),
-						Member: redisKey(t),
-					})
+					pipe := s.client.Pipeline()
+					s.debounce(pipe, t, d)
+					if _, err := pipe.Exec(s.ctx); err != nil {
+						s.log.Warnf("Cannot debounce trigger because of redis error: %s", err)
+					}
 					continue
 				} else {
 					s.log.Warnf("Trigger %s %s has an invalid debounce: %s",
@@ -214,6 +221,9 @@ func (s *redisScheduler) eventLoop(eventsCh <-chan *realtime.Event) {
 // fire is called when a webhook is fired.
 func (s *redisScheduler) fire(trigger Trigger, request *JobRequest) {
 	infos := trigger.Infos()
+	if infos.Paused() {
+		return
+	}
 	if infos.Debounce == "" {
 		if _, err := s.broker.PushJob(trigger, request); err != nil {
 			s.log.Warnf("Could not push job trigger by webhook %s %s: %s",
@@ -227,23 +237,37 @@ func (s *redisScheduler) fire(trigger Trigger, request *JobRequest) {
 		s.log.Warnf("Trigger %s %s has an invalid debounce: %s",
 			infos.Domain, infos.TID, infos.Debounce)
 	}
-	timestamp := time.Now().Add(d)
 	pipe := s.client.Pipeline()
 	switch trigger.CombineRequest() {
 	case appendPayload:
-		pipe.RPush(s.ctx, payloadKey(trigger), string(request.Payload))
+		pipe.RPush(s.ctx, payloadKey(trigger), packRedisValue(request.Payload))
 	case keepOriginalRequest:
-		pipe.SetNX(s.ctx, payloadKey(trigger), string(request.Payload), 30*24*time.Hour)
+		pipe.SetNX(s.ctx, payloadKey(trigger), packRedisValue(request.Payload), 30*24*time.Hour)
 	}
-	pipe.ZAddNX(s.ctx, TriggersKey, redis.Z{
-		Score:  float64(timestamp.UTC().Unix()),
-		Member: redisKey(trigger),
-	})
+	s.debounce(pipe, trigger, d)
 	if _, err := pipe.Exec(s.ctx); err != nil {
 		s.log.Warnf("Cannot fire trigger because of redis error: %s", err)
 	}
 }
 
+// debounce adds to the pipeline the commands to schedule the debounced
+// trigger after the delay d, and to count the events for the job. When the
+// trigger has the debounce_reset option, the delay is restarted for each
+// event, else it is counted from the first event.
+func (s *redisScheduler) debounce(pipe redis.Pipeliner, t Trigger, d time.Duration) {
+	z := redis.Z{
+		Score:  float64(time.Now().Add(d).UTC().Unix()),
+		Member: redisKey(t),
+	}
+	if t.Infos().DebounceReset {
+		pipe.ZAdd(s.ctx, TriggersKey, z)
+	} else {
+		pipe.ZAddNX(s.ctx, TriggersKey, z)
+	}
+	pipe.Incr(s.ctx, countKey(t))
+	pipe.Expire(s.ctx, countKey(t), 30*24*time.Hour)
+}
+
 // ShutdownScheduler shuts down the the scheduling of triggers
 func (s *redisScheduler) ShutdownScheduler(ctx context.Context) error {
 	if s.closed == nil {
@@ -297,6 +321,12 @@ func (s *redisScheduler) PollScheduler(now int64) error {
 			}
 			return err
 		}
+		if t.Infos().Paused() {
+			if err := s.skipPaused(t, results); err != nil {
+				return err
+			}
+			continue
+		}
 		switch t := t.(type) {
 		case *EventTrigger, *WebhookTrigger: // Debounced
 			job := t.Infos().JobRequest()
@@ -304,27 +334,53 @@ func (s *redisScheduler) PollScheduler(now int64) error {
 			if err = s.client.ZRem(s.ctx, SchedKey, results[0]).Err(); err != nil {
 				return err
 			}
+			// The count is read and deleted in a transaction, to not lose
+			// the events counted in the meantime
+			tx := s.client.TxPipeline()
+			count := tx.Get(s.ctx, countKey(t))
+			tx.Del(s.ctx, countKey(t))
+			if _, err := tx.Exec(s.ctx); err == nil {
+				job.DebouncedCount, _ = count.Int()
+			}
 			switch t.CombineRequest() {
 			case appendPayload:
 				pipe := s.client.Pipeline()
 				lrange := pipe.LRange(s.ctx, payloadKey(t), 0, -1)
 				pipe.Del(s.ctx, payloadKey(t))
 				if _, err := pipe.Exec(s.ctx); err == nil {
-					payloads := strings.Join(lrange.Val(), ",")
-					job.Payload = Payload(`{"payloads":[` + payloads + "]}")
+					payloads := make([]string, 0, len(lrange.Val()))
+					for _, val := range lrange.Val() {
+						payload, err := unpackRedisValue([]byte(val))
+						if err != nil {
+							s.log.Warnf("Cannot read the payload for trigger %s: %s", t.ID(), err)
+							continue
+						}
+						payloads = append(payloads, string(payload))
+					}
+					job.Payload = Payload(`{"payloads":[` + strings.Join(payloads, ",") + "]}")
 				}
 			case keepOriginalRequest:
 				pipe := s.client.Pipeline()
 				get := pipe.Get(s.ctx, payloadKey(t))
 				pipe.Del(s.ctx, payloadKey(t))
 				if _, err := pipe.Exec(s.ctx); err == nil {
-					job.Payload = Payload(get.Val())
+					if payload, err := unpackRedisValue([]byte(get.Val())); err == nil {
+						job.Payload = Payload(payload)
+					}
 				}
 			}
 			if _, err = s.broker.PushJob(t, job); err != nil {
 				return err
 			}
 		case *AtTrigger:
+			// The stack may have been down at the time of the trigger
+			if t.tooLate(time.Now()) {
+				s.log.Infof("trigger %s: discarded as its time is too old", t.ID())
+				if err = s.deleteTrigger(t); err != nil {
+					return err
+				}
+				continue
+			}
 			job := t.Infos().JobRequest()
 			if _, err = s.broker.PushJob(t, job); err != nil {
 				if limits.IsLimitReachedOrExceeded(err) {
@@ -362,6 +418,92 @@ func (s *redisScheduler) PollScheduler(now int64) error {
 	}
 }
 
+// skipPaused is called by PollScheduler when a paused trigger is ready: no job
+// is pushed, but a @cron trigger is scheduled for its next execution, and the
+// combined payloads of a debounced trigger are discarded. An @at trigger is
+// removed from redis and added again when it is resumed.
+func (s *redisScheduler) skipPaused(t Trigger, results []interface{}) error {
+	switch t := t.(type) {
+	case *CronTrigger:
+		score, err := strconv.ParseInt(results[1].(string), 10, 64)
+		prev := time.Now()
+		if err == nil {
+			prev = time.Unix(score, 0)
+		}
+		return s.addToRedis(t, prev)
+	case *EventTrigger, *WebhookTrigger:
+		s.client.Del(s.ctx, payloadKey(t), countKey(t))
+	}
+	return s.client.ZRem(s.ctx, SchedKey, results[0]).Err()
+}
+
+// PauseTrigger stops the trigger from pushing jobs. It stays in redis, but
+// its jobs are skipped while it is paused.
+func (s *redisScheduler) PauseTrigger(db prefixer.Prefixer, id string) error {
+	t, err := s.GetTrigger(db, id)
+	if err != nil {
+		return err
+	}
+	infos := t.Infos()
+	if infos.Paused() {
+		return nil
+	}
+	now := time.Now()
+	infos.PausedAt = &now
+	return couchdb.UpdateDoc(db, infos)
+}
+
+// ResumeTrigger allows a paused trigger to push jobs again.
+func (s *redisScheduler) ResumeTrigger(db prefixer.Prefixer, id string, backfill bool) error {
+	t, err := s.GetTrigger(db, id)
+	if err != nil {
+		return err
+	}
+	infos := t.Infos()
+	if !infos.Paused() {
+		return nil
+	}
+	pausedAt := *infos.PausedAt
+	infos.PausedAt = nil
+	if err := couchdb.UpdateDoc(db, infos); err != nil {
+		return err
+	}
+	now := time.Now()
+	switch t := t.(type) {
+	case *AtTrigger:
+		// The @at trigger was removed from redis if its time has come while
+		// it was paused.
+		if t.at.After(now) || backfill {
+			return s.addToRedis(t, now)
+		}
+		return s.deleteTrigger(t)
+	case *CronTrigger:
+		if backfill && missedRun(t, pausedAt, now) {
+			_, err := s.broker.PushJob(t, infos.JobRequest())
+			return err
+		}
+	}
+	return nil
+}
+
+// FireTrigger pushes the job of the trigger now, out of its schedule.
+func (s *redisScheduler) FireTrigger(db prefixer.Prefixer, id string, force bool) (*Job, error) {
+	t, err := s.GetTrigger(db, id)
+	if err != nil {
+		return nil, err
+	}
+	return fireTrigger(s.broker, t, force)
+}
+
+// NextRuns returns the next n executions of a periodic trigger.
+func (s *redisScheduler) NextRuns(db prefixer.Prefixer, id string, n int) ([]time.Time, error) {
+	t, err := s.GetTrigger(db, id)
+	if err != nil {
+		return nil, err
+	}
+	return nextRuns(t, n)
+}
+
 // AddTrigger a trigger to the system, by persisting it and using redis for
 // scheduling its jobs
 func (s *redisScheduler) AddTrigger(t Trigger) error {
@@ -312,6 +312,43 @@ func TestRedisScheduler(t *testing.T) {
 		assert.Equal(t, 1, count)
 	})
 
+	t.Run("RedisTriggerEventWithSelector", func(t *testing.T) {
+		err := client.Del(context.Background(), job.TriggersKey, job.SchedKey).Err()
+		assert.NoError(t, err)
+
+		bro := newMockBroker()
+		sch := job.NewRedisScheduler(client)
+		defer func() {
+			assert.NoError(t, sch.ShutdownScheduler(context.Background()))
+		}()
+		assert.NoError(t, sch.StartScheduler(bro))
+
+		evTrigger := job.TriggerInfos{
+			Type:       "@event",
+			Arguments:  "io.cozy.event.test:CREATED",
+			WorkerType: "incr",
+			Selector:   map[string]interface{}{"kind": "good"},
+		}
+
+		tri, err := job.NewTrigger(testInstance, evTrigger, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, sch.AddTrigger(tri))
+
+		realtime.GetHub().Publish(testInstance, realtime.EventCreate, &couchdb.JSONDoc{
+			Type: "io.cozy.event.test",
+			M:    map[string]interface{}{"_id": "bad", "kind": "bad"},
+		}, nil)
+		realtime.GetHub().Publish(testInstance, realtime.EventCreate, &couchdb.JSONDoc{
+			Type: "io.cozy.event.test",
+			M:    map[string]interface{}{"_id": "good", "kind": "good"},
+		}, nil)
+
+		time.Sleep(1 * time.Second)
+
+		count, _ := bro.WorkerQueueLen("incr")
+		assert.Equal(t, 1, count)
+	})
+
 	t.Run("RedisTriggerEventForDirectories", func(t *testing.T) {
 		err := client.Del(context.Background(), job.TriggersKey, job.SchedKey).Err()
 		assert.NoError(t, err)
@@ -519,6 +556,26 @@ func (b *mockBroker) WorkersTypes() []string {
 	return []string{}
 }
 
+func (b *mockBroker) DeadLetters(workerType string) ([]*job.DeadLetter, error) {
+	return nil, nil
+}
+
+func (b *mockBroker) RequeueDeadLetter(workerType, jobID string) (*job.Job, error) {
+	return nil, job.ErrNotFoundJob
+}
+
+func (b *mockBroker) CancelJob(db prefixer.Prefixer, jobID string) error {
+	return job.ErrNotFoundJob
+}
+
+func (b *mockBroker) Stats() ([]job.WorkerStats, error) {
+	return nil, nil
+}
+
+func (b *mockBroker) PushChain(db prefixer.Prefixer, specs []job.JobSpec) (string, error) {
+	return "", nil
+}
+
 func (d fakeFilePather) FilePath(doc *vfs.FileDoc) (string, error) {
 	return d.Fullpath, nil
 }
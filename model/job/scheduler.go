@@ -51,6 +51,20 @@ type (
 		GetTrigger(db prefixer.Prefixer, id string) (Trigger, error)
 		UpdateMessage(db prefixer.Prefixer, trigger Trigger, message json.RawMessage) error
 		UpdateCron(db prefixer.Prefixer, trigger Trigger, arguments string) error
+		// PauseTrigger stops the trigger from pushing jobs, but keeps it.
+		PauseTrigger(db prefixer.Prefixer, id string) error
+		// ResumeTrigger allows a paused trigger to push jobs again. When
+		// backfill is true, a time-based trigger that has missed runs while
+		// paused pushes a job immediately (only one, whatever the number of
+		// missed runs).
+		ResumeTrigger(db prefixer.Prefixer, id string, backfill bool) error
+		// FireTrigger pushes the job of the trigger now, without changing its
+		// schedule, and returns the job. A paused trigger is not fired, unless
+		// force is true.
+		FireTrigger(db prefixer.Prefixer, id string, force bool) (*Job, error)
+		// NextRuns returns the next n executions of a periodic trigger,
+		// without pushing any job.
+		NextRuns(db prefixer.Prefixer, id string, n int) ([]time.Time, error)
 		DeleteTrigger(db prefixer.Prefixer, id string) error
 		GetAllTriggers(db prefixer.Prefixer) ([]Trigger, error)
 		HasTrigger(db prefixer.Prefixer, infos TriggerInfos) bool
@@ -69,10 +83,19 @@ type (
 		WorkerType   string                 `json:"worker"`
 		Arguments    string                 `json:"arguments"`
 		Debounce     string                 `json:"debounce"`
+		RateLimit    string                 `json:"rate_limit,omitempty"`
+		Jitter       float64                `json:"jitter,omitempty"`
+		Secret       string                 `json:"secret,omitempty"`
+		Selector     map[string]interface{} `json:"selector,omitempty"`
+		PausedAt     *time.Time             `json:"paused_at,omitempty"`
 		Options      *JobOptions            `json:"options"`
 		Message      Message                `json:"message"`
 		CurrentState *TriggerState          `json:"current_state,omitempty"`
 		Metadata     *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
+		// DebounceReset is used with Debounce to restart the debounce timer
+		// each time a new event comes, instead of waiting a fixed delay after
+		// the first event.
+		DebounceReset bool `json:"debounce_reset,omitempty"`
 	}
 
 	// TriggerState represent the current state of the trigger
@@ -109,6 +132,23 @@ func (t *TriggerInfos) DomainName() string {
 	return t.Domain
 }
 
+// Paused returns true if the trigger has been paused.
+func (t *TriggerInfos) Paused() bool {
+	return t.PausedAt != nil
+}
+
+// missedRun returns true if the trigger should have pushed a job between the
+// two given times. Only the time-based triggers can miss runs.
+func missedRun(t Trigger, since, now time.Time) bool {
+	switch t := t.(type) {
+	case *CronTrigger:
+		return t.NextExecution(since).Before(now)
+	case *AtTrigger:
+		return !t.at.Before(since) && t.at.Before(now)
+	}
+	return false
+}
+
 func (t *TriggerInfos) IsKonnectorTrigger() bool {
 	return t.WorkerType == "konnector" || t.WorkerType == "client"
 }
@@ -141,6 +181,41 @@ func NewTrigger(db prefixer.Prefixer, infos TriggerInfos, data interface{}) (Tri
 	return fromTriggerInfos(&infos)
 }
 
+// fireTrigger pushes a job for the trigger, as a manual execution.
+func fireTrigger(b Broker, t Trigger, force bool) (*Job, error) {
+	infos := t.Infos()
+	if infos.Paused() && !force {
+		return nil, ErrTriggerPaused
+	}
+	req := infos.JobRequest()
+	req.Manual = true
+	j, err := b.PushJob(t, req)
+	if err != nil {
+		return nil, err
+	}
+	if j.WorkerType == "client" {
+		if err := j.AckConsumed(); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// maxNextRuns is the maximal number of executions returned by NextRuns.
+const maxNextRuns = 100
+
+// nextRuns returns the next n executions of a periodic trigger.
+func nextRuns(t Trigger, n int) ([]time.Time, error) {
+	c, ok := t.(*CronTrigger)
+	if !ok {
+		return nil, ErrNotCronTrigger
+	}
+	if n > maxNextRuns {
+		n = maxNextRuns
+	}
+	return c.NextRuns(time.Now(), n), nil
+}
+
 func fromTriggerInfos(infos *TriggerInfos) (Trigger, error) {
 	switch infos.Type {
 	case "@at":
@@ -197,6 +272,11 @@ func (t *TriggerInfos) Clone() couchdb.Doc {
 		cloned.CurrentState = &tmp
 	}
 
+	if t.PausedAt != nil {
+		tmp := *t.PausedAt
+		cloned.PausedAt = &tmp
+	}
+
 	if t.Metadata != nil {
 		cloned.Metadata = t.Metadata.Clone()
 	}
@@ -301,12 +381,12 @@ func GetTriggerState(db prefixer.Prefixer, triggerID string) (*TriggerState, err
 			state.LastManualJobID = j.ID()
 		}
 
-		switch j.State {
-		case Errored:
+		switch {
+		case j.State.Failed():
 			state.LastFailure = startedAt
 			state.LastFailedJobID = j.ID()
 			state.LastError = j.Error
-		case Done:
+		case j.State == Done:
 			state.LastSuccess = startedAt
 			state.LastSuccessfulJobID = j.ID()
 		default:
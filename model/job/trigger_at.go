@@ -2,18 +2,31 @@ package job
 
 import (
 	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
 )
 
 // maxPastTriggerTime is the maximum duration in the past for which the at
-// triggers are executed immediately instead of discarded.
+// triggers are executed immediately instead of discarded, when it is not
+// configured.
 var maxPastTriggerTime = 24 * time.Hour
 
+// atTriggerGrace returns the maximum duration in the past for which the at
+// triggers are executed immediately instead of discarded.
+func atTriggerGrace() time.Duration {
+	if cfg := config.GetConfig(); cfg != nil && cfg.Jobs.AtGrace > 0 {
+		return cfg.Jobs.AtGrace
+	}
+	return maxPastTriggerTime
+}
+
 // AtTrigger implements the @at trigger type. It schedules a job at a specified
-// time in the future.
+// time in the future. The trigger is deleted after its time.
 type AtTrigger struct {
 	*TriggerInfos
-	at   time.Time
-	done chan struct{}
+	at    time.Time
+	done  chan struct{}
+	ended bool // true when the time has come, false if unscheduled
 }
 
 // NewAtTrigger returns a new instance of AtTrigger given the specified
@@ -54,24 +67,31 @@ func (a *AtTrigger) Type() string {
 func (a *AtTrigger) Schedule() <-chan *JobRequest {
 	ch := make(chan *JobRequest)
 	go func() {
+		defer close(ch)
 		duration := -time.Since(a.at)
 		if duration < 0 {
-			if duration > -maxPastTriggerTime {
+			a.ended = true
+			if !a.tooLate(time.Now()) {
 				ch <- a.TriggerInfos.JobRequest()
 			}
-			close(ch)
 			return
 		}
 		select {
 		case <-time.After(duration):
+			a.ended = true
 			ch <- a.TriggerInfos.JobRequest()
 		case <-a.done:
 		}
-		close(ch)
 	}()
 	return ch
 }
 
+// tooLate returns true if the time of the trigger is too far in the past for
+// its job to be pushed: the stack was probably down at that time.
+func (a *AtTrigger) tooLate(now time.Time) bool {
+	return now.Sub(a.at) > atTriggerGrace()
+}
+
 // Unschedule implements the Unschedule method of the Trigger interface.
 func (a *AtTrigger) Unschedule() {
 	close(a.done)
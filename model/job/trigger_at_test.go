@@ -0,0 +1,49 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAtTriggerMissedWhileDown(t *testing.T) {
+	newAt := func(at time.Time) *AtTrigger {
+		trigger, err := NewAtTrigger(&TriggerInfos{
+			Type:       "@at",
+			WorkerType: "test",
+			Arguments:  at.Format(time.RFC3339),
+		})
+		require.NoError(t, err)
+		return trigger
+	}
+
+	// A trigger in the past, but in the grace delay, fires immediately
+	trigger := newAt(time.Now().Add(-time.Hour))
+	ch := trigger.Schedule()
+	select {
+	case req, ok := <-ch:
+		require.True(t, ok)
+		assert.Equal(t, "test", req.WorkerType)
+	case <-time.After(time.Second):
+		t.Fatal("the trigger has not fired")
+	}
+	_, ok := <-ch
+	assert.False(t, ok)
+	assert.True(t, trigger.ended)
+
+	// A trigger too far in the past is discarded
+	trigger = newAt(time.Now().Add(-2 * maxPastTriggerTime))
+	_, ok = <-trigger.Schedule()
+	assert.False(t, ok)
+	assert.True(t, trigger.ended)
+
+	// An unscheduled trigger has not ended
+	trigger = newAt(time.Now().Add(time.Hour))
+	ch = trigger.Schedule()
+	trigger.Unschedule()
+	_, ok = <-ch
+	assert.False(t, ok)
+	assert.False(t, trigger.ended)
+}
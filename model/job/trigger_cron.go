@@ -2,6 +2,7 @@ package job
 
 import (
 	"fmt"
+	"hash/fnv"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -26,6 +27,11 @@ func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
+	// The crontab can be prefixed by TZ=<location> or CRON_TZ=<location>, and
+	// the parser puts this location in the schedule.
+	if spec, ok := schedule.(*cron.SpecSchedule); ok && spec.Location != time.Local {
+		schedule = newTZSchedule(spec)
+	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
@@ -34,12 +40,20 @@ func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 }
 
 // NewEveryTrigger returns a new instance of CronTrigger given the specified
-// options as @every.
+// options as @every. With a jitter, the executions are spread inside the
+// interval, at an offset that depends on the instance.
 func NewEveryTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 	schedule, err := cronParser.Parse("@every " + infos.Arguments)
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
+	if infos.Jitter < 0 || infos.Jitter > 1 {
+		return nil, ErrMalformedTrigger
+	}
+	if every, ok := schedule.(cron.ConstantDelaySchedule); ok && infos.Jitter > 0 {
+		seed := fmt.Sprintf("%s/%s/%v", infos.Domain, infos.WorkerType, infos.Message)
+		schedule = newJitterSchedule(every.Delay, infos.Jitter, seed)
+	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
@@ -93,6 +107,66 @@ func newPeriodicTrigger(infos *TriggerInfos, frequency FrequencyKind) (*CronTrig
 	}, nil
 }
 
+// tzSchedule computes the next executions of a schedule on the wall clock of a
+// timezone. On the daylight saving time transitions, a time that happens
+// twice (fall back) fires only once, and a time that doesn't exist (spring
+// forward) is shifted by the length of the gap (02:30 fires at 03:30).
+type tzSchedule struct {
+	sched cron.Schedule
+	loc   *time.Location
+}
+
+func newTZSchedule(spec *cron.SpecSchedule) *tzSchedule {
+	wall := *spec
+	wall.Location = time.UTC
+	return &tzSchedule{sched: &wall, loc: spec.Location}
+}
+
+// Next implements the cron.Schedule interface.
+func (s *tzSchedule) Next(t time.Time) time.Time {
+	// The wall clock is represented as a time in UTC, as there are no
+	// transitions in UTC.
+	local := t.In(s.loc)
+	wall := time.Date(local.Year(), local.Month(), local.Day(),
+		local.Hour(), local.Minute(), local.Second(), 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		wall = s.sched.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		next := time.Date(wall.Year(), wall.Month(), wall.Day(),
+			wall.Hour(), wall.Minute(), wall.Second(), 0, s.loc)
+		// The wall clock time may be in a gap and be moved before t
+		if next.After(t) {
+			return next.In(t.Location())
+		}
+	}
+	return time.Time{}
+}
+
+// jitterSchedule is the schedule of an @every trigger with a jitter. The
+// executions are aligned on the multiples of the interval, and shifted by an
+// offset computed from a seed: it is stable across restarts, but the triggers
+// of many instances don't fire at the same time.
+type jitterSchedule struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+func newJitterSchedule(interval time.Duration, jitter float64, seed string) *jitterSchedule {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(seed))
+	ratio := float64(h.Sum64()%1000000) / 1000000
+	offset := time.Duration(ratio * jitter * float64(interval)).Truncate(time.Second)
+	return &jitterSchedule{interval: interval, offset: offset}
+}
+
+// Next implements the cron.Schedule interface.
+func (s *jitterSchedule) Next(t time.Time) time.Time {
+	start := t.Add(-s.offset).Truncate(s.interval)
+	return start.Add(s.interval + s.offset)
+}
+
 // Type implements the Type method of the Trigger interface.
 func (c *CronTrigger) Type() string {
 	return c.TriggerInfos.Type
@@ -103,6 +177,19 @@ func (c *CronTrigger) NextExecution(last time.Time) time.Time {
 	return c.sched.Next(last)
 }
 
+// NextRuns returns the next n executions of the trigger after the given time.
+func (c *CronTrigger) NextRuns(from time.Time, n int) []time.Time {
+	runs := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		from = c.NextExecution(from)
+		if from.IsZero() {
+			break
+		}
+		runs = append(runs, from)
+	}
+	return runs
+}
+
 // Schedule implements the Schedule method of the Trigger interface.
 func (c *CronTrigger) Schedule() <-chan *JobRequest {
 	ch := make(chan *JobRequest)
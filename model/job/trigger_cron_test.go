@@ -0,0 +1,143 @@
+package job_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronTriggerTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	nextRuns := func(spec string, from time.Time, n int) []time.Time {
+		trigger, err := job.NewCronTrigger(&job.TriggerInfos{
+			Type:      "@cron",
+			Arguments: spec,
+		})
+		require.NoError(t, err)
+		var runs []time.Time
+		for i := 0; i < n; i++ {
+			from = trigger.NextExecution(from)
+			runs = append(runs, from.In(paris))
+		}
+		return runs
+	}
+	local := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2023, month, day, hour, min, 0, 0, paris)
+	}
+
+	t.Run("EveryDayAt8", func(t *testing.T) {
+		from := time.Date(2023, time.March, 25, 12, 0, 0, 0, time.UTC)
+		runs := nextRuns("TZ=Europe/Paris 0 0 8 * * *", from, 2)
+		assert.Equal(t, []time.Time{local(time.March, 26, 8, 0), local(time.March, 27, 8, 0)}, runs)
+		for _, run := range runs {
+			assert.Equal(t, 6, run.UTC().Hour())
+		}
+
+		from = time.Date(2023, time.October, 28, 12, 0, 0, 0, time.UTC)
+		runs = nextRuns("CRON_TZ=Europe/Paris 0 0 8 * * *", from, 2)
+		assert.Equal(t, []time.Time{local(time.October, 29, 8, 0), local(time.October, 30, 8, 0)}, runs)
+		for _, run := range runs {
+			assert.Equal(t, 7, run.UTC().Hour())
+		}
+	})
+
+	t.Run("SpringForward", func(t *testing.T) {
+		// 02:30 doesn't exist on 2023-03-26 in Paris: the trigger fires once,
+		// at 03:30.
+		from := time.Date(2023, time.March, 25, 12, 0, 0, 0, time.UTC)
+		runs := nextRuns("TZ=Europe/Paris 0 30 2 * * *", from, 3)
+		assert.Equal(t, local(time.March, 26, 3, 30), runs[0])
+		assert.Equal(t, local(time.March, 27, 2, 30), runs[1])
+		assert.Equal(t, local(time.March, 28, 2, 30), runs[2])
+	})
+
+	t.Run("FallBack", func(t *testing.T) {
+		// 02:30 happens twice on 2023-10-29 in Paris: the trigger fires once.
+		from := time.Date(2023, time.October, 28, 12, 0, 0, 0, time.UTC)
+		runs := nextRuns("TZ=Europe/Paris 0 30 2 * * *", from, 3)
+		assert.Equal(t, 29, runs[0].Day())
+		assert.Equal(t, 2, runs[0].Hour())
+		assert.Equal(t, 30, runs[0].Minute())
+		assert.Equal(t, local(time.October, 30, 2, 30), runs[1])
+		assert.Equal(t, local(time.October, 31, 2, 30), runs[2])
+	})
+
+	t.Run("WeekdayMornings", func(t *testing.T) {
+		trigger, err := job.NewCronTrigger(&job.TriggerInfos{
+			Type:      "@cron",
+			Arguments: "TZ=Europe/Paris 0 0 8 * * 1-5",
+		})
+		require.NoError(t, err)
+		// Friday, after 8am in Paris
+		from := time.Date(2023, time.June, 9, 12, 0, 0, 0, time.UTC)
+		runs := trigger.NextRuns(from, 6)
+		for i := range runs {
+			runs[i] = runs[i].In(paris)
+		}
+		assert.Equal(t, []time.Time{
+			local(time.June, 12, 8, 0),
+			local(time.June, 13, 8, 0),
+			local(time.June, 14, 8, 0),
+			local(time.June, 15, 8, 0),
+			local(time.June, 16, 8, 0),
+			local(time.June, 19, 8, 0),
+		}, runs)
+	})
+
+	t.Run("InvalidTimezone", func(t *testing.T) {
+		_, err := job.NewCronTrigger(&job.TriggerInfos{
+			Type:      "@cron",
+			Arguments: "TZ=Mars/Olympus 0 0 8 * * *",
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestEveryTriggerJitter(t *testing.T) {
+	now := time.Date(2023, time.June, 12, 10, 17, 42, 0, time.UTC)
+	window := 30 * time.Minute
+
+	nextRun := func(domain string) time.Time {
+		trigger, err := job.NewEveryTrigger(&job.TriggerInfos{
+			Type:       "@every",
+			Domain:     domain,
+			WorkerType: "sync",
+			Arguments:  "1h",
+			Jitter:     0.5,
+		})
+		require.NoError(t, err)
+		return trigger.NextExecution(now)
+	}
+
+	const instances = 1000
+	const buckets = 10
+	counts := make([]int, buckets)
+	for i := 0; i < instances; i++ {
+		domain := fmt.Sprintf("alice%d.cozy.example", i)
+		next := nextRun(domain)
+		assert.True(t, next.After(now))
+		assert.False(t, next.After(now.Add(time.Hour)))
+		assert.Equal(t, next, nextRun(domain), "stable for an instance")
+
+		offset := next.Sub(next.Truncate(time.Hour))
+		require.Less(t, offset, window)
+		counts[int(offset*buckets/window)]++
+	}
+	for i, count := range counts {
+		assert.Greater(t, count, instances/buckets/2, "bucket %d", i)
+		assert.Less(t, count, instances/buckets*2, "bucket %d", i)
+	}
+
+	_, err := job.NewEveryTrigger(&job.TriggerInfos{
+		Type:      "@every",
+		Arguments: "1h",
+		Jitter:    1.5,
+	})
+	assert.ErrorIs(t, err, job.ErrMalformedTrigger)
+}
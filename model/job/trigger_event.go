@@ -17,6 +17,7 @@ type EventTrigger struct {
 	*TriggerInfos
 	unscheduled chan struct{}
 	mask        []permission.Rule
+	selector    docMatcher
 }
 
 // NewEventTrigger returns a new instance of EventTrigger given the specified
@@ -31,10 +32,18 @@ func NewEventTrigger(infos *TriggerInfos) (*EventTrigger, error) {
 		}
 		rules[i] = rule
 	}
+	var selector docMatcher
+	if len(infos.Selector) > 0 {
+		var err error
+		if selector, err = compileSelector(infos.Selector); err != nil {
+			return nil, ErrMalformedTrigger
+		}
+	}
 	return &EventTrigger{
 		TriggerInfos: infos,
 		unscheduled:  make(chan struct{}),
 		mask:         rules,
+		selector:     selector,
 	}, nil
 }
 
@@ -58,14 +67,7 @@ func (t *EventTrigger) Schedule() <-chan *JobRequest {
 		for {
 			select {
 			case e := <-sub.Channel:
-				found := false
-				for _, m := range t.mask {
-					if eventMatchRule(e, &m) {
-						found = true
-						break
-					}
-				}
-				if found {
+				if t.match(e) {
 					if evt, err := t.Infos().JobRequestWithEvent(e); err == nil {
 						ch <- evt
 					}
@@ -93,6 +95,30 @@ func (t *EventTrigger) CombineRequest() string {
 	return suppressPayload
 }
 
+// match returns true if the event matches one of the rules of the mask, and
+// the selector of the trigger if it has one. The selector is evaluated last,
+// as it is the most expensive check.
+func (t *EventTrigger) match(e *realtime.Event) bool {
+	found := false
+	for _, m := range t.mask {
+		if eventMatchRule(e, &m) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if t.selector == nil {
+		return true
+	}
+	doc, err := docToMap(e.Doc)
+	if err != nil {
+		return false
+	}
+	return t.selector(doc)
+}
+
 func eventMatchRule(e *realtime.Event, rule *permission.Rule) bool {
 	if e.Doc.DocType() != rule.Type {
 		return false
@@ -0,0 +1,296 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// docMatcher tells if a document, as a JSON map, matches a selector.
+type docMatcher func(doc map[string]interface{}) bool
+
+// valueMatcher tells if the value of a field matches a condition. The found
+// parameter is false when the field is missing in the document.
+type valueMatcher func(value interface{}, found bool) bool
+
+// compileSelector transforms a Mango selector, like the ones used for
+// couchdb.FindRequest, into a function that can be evaluated against the
+// documents in memory. It supports the implicit equality, the nested fields
+// (with a dot in the name or with a sub-selector), and the $eq, $ne, $gt,
+// $gte, $lt, $lte, $exists, $in, $nin, $and, $or, $nor, and $not operators.
+//
+// As with CouchDB, a missing field only matches the {"$exists": false}
+// condition, or a $not of another condition.
+func compileSelector(selector map[string]interface{}) (docMatcher, error) {
+	// The selector is normalized by a JSON round-trip to work on the same
+	// types for the numbers as the documents
+	buf, err := json.Marshal(selector)
+	if err != nil {
+		return nil, err
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(buf, &normalized); err != nil {
+		return nil, err
+	}
+	return compileMap(normalized)
+}
+
+func compileMap(selector map[string]interface{}) (docMatcher, error) {
+	matchers := make([]docMatcher, 0, len(selector))
+	for key, cond := range selector {
+		var m docMatcher
+		var err error
+		if strings.HasPrefix(key, "$") {
+			m, err = compileLogic(key, cond)
+		} else {
+			m, err = compileField(strings.Split(key, "."), cond)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogic(op string, cond interface{}) (docMatcher, error) {
+	if op == "$not" {
+		sub, ok := cond.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects a selector", op)
+		}
+		m, err := compileMap(sub)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc map[string]interface{}) bool { return !m(doc) }, nil
+	}
+
+	list, ok := cond.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s expects an array of selectors", op)
+	}
+	matchers := make([]docMatcher, len(list))
+	for i, item := range list {
+		sub, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects an array of selectors", op)
+		}
+		m, err := compileMap(sub)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	anyMatch := func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if m(doc) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch op {
+	case "$and":
+		return func(doc map[string]interface{}) bool {
+			for _, m := range matchers {
+				if !m(doc) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case "$or":
+		return anyMatch, nil
+	case "$nor":
+		return func(doc map[string]interface{}) bool { return !anyMatch(doc) }, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func compileField(path []string, cond interface{}) (docMatcher, error) {
+	m, err := compileCondition(cond)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc map[string]interface{}) bool {
+		value, found := lookupField(doc, path)
+		return m(value, found)
+	}, nil
+}
+
+func lookupField(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, part := range path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func compileCondition(cond interface{}) (valueMatcher, error) {
+	obj, ok := cond.(map[string]interface{})
+	if !ok {
+		return equalTo(cond), nil
+	}
+
+	hasOperator := false
+	for key := range obj {
+		if strings.HasPrefix(key, "$") {
+			hasOperator = true
+			break
+		}
+	}
+	if !hasOperator {
+		// A sub-selector for a nested object
+		sub, err := compileMap(obj)
+		if err != nil {
+			return nil, err
+		}
+		return func(value interface{}, found bool) bool {
+			nested, ok := value.(map[string]interface{})
+			return found && ok && sub(nested)
+		}, nil
+	}
+
+	matchers := make([]valueMatcher, 0, len(obj))
+	for op, arg := range obj {
+		m, err := compileOperator(op, arg)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(value interface{}, found bool) bool {
+		for _, m := range matchers {
+			if !m(value, found) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileOperator(op string, arg interface{}) (valueMatcher, error) {
+	switch op {
+	case "$eq":
+		return equalTo(arg), nil
+	case "$ne":
+		return func(value interface{}, found bool) bool {
+			return found && !reflect.DeepEqual(value, arg)
+		}, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return func(value interface{}, found bool) bool {
+			if !found {
+				return false
+			}
+			cmp, ok := compareValues(value, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return cmp > 0
+			case "$gte":
+				return cmp >= 0
+			case "$lt":
+				return cmp < 0
+			default:
+				return cmp <= 0
+			}
+		}, nil
+	case "$exists":
+		expected, ok := arg.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a boolean", op)
+		}
+		return func(_ interface{}, found bool) bool { return found == expected }, nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects an array", op)
+		}
+		return func(value interface{}, found bool) bool {
+			if !found {
+				return false
+			}
+			for _, item := range list {
+				if reflect.DeepEqual(value, item) {
+					return op == "$in"
+				}
+			}
+			return op == "$nin"
+		}, nil
+	case "$not":
+		m, err := compileCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(value interface{}, found bool) bool {
+			return !m(value, found)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func equalTo(expected interface{}) valueMatcher {
+	return func(value interface{}, found bool) bool {
+		return found && reflect.DeepEqual(value, expected)
+	}
+}
+
+// compareValues compares two numbers or two strings. The boolean is false if
+// the values can't be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// docToMap returns the document of a realtime event as a JSON map, to be
+// evaluated by a selector.
+func docToMap(doc realtime.Doc) (map[string]interface{}, error) {
+	if d, ok := doc.(*couchdb.JSONDoc); ok {
+		return d.M, nil
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,125 @@
+package job
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventTriggerSelector(t *testing.T) {
+	trigger, err := NewEventTrigger(&TriggerInfos{
+		Type:       "@event",
+		Arguments:  "io.cozy.files:CREATED,UPDATED",
+		WorkerType: "print",
+		Selector: map[string]interface{}{
+			"type":         "directory",
+			"metadata.tag": map[string]interface{}{"$in": []string{"a", "b"}},
+			"size":         map[string]interface{}{"$not": map[string]interface{}{"$gt": 10}},
+		},
+	})
+	require.NoError(t, err)
+
+	event := func(verb string, doc map[string]interface{}) *realtime.Event {
+		doc["_id"] = "id"
+		return &realtime.Event{
+			Verb: verb,
+			Doc:  &couchdb.JSONDoc{Type: "io.cozy.files", M: doc},
+		}
+	}
+
+	assert.True(t, trigger.match(event(realtime.EventCreate, map[string]interface{}{
+		"type":     "directory",
+		"metadata": map[string]interface{}{"tag": "a"},
+	})))
+	assert.True(t, trigger.match(event(realtime.EventUpdate, map[string]interface{}{
+		"type":     "directory",
+		"metadata": map[string]interface{}{"tag": "b"},
+		"size":     float64(3),
+	})))
+	// The verb is not in the mask
+	assert.False(t, trigger.match(event(realtime.EventDelete, map[string]interface{}{
+		"type":     "directory",
+		"metadata": map[string]interface{}{"tag": "a"},
+	})))
+	assert.False(t, trigger.match(event(realtime.EventCreate, map[string]interface{}{
+		"type":     "file",
+		"metadata": map[string]interface{}{"tag": "a"},
+	})))
+	assert.False(t, trigger.match(event(realtime.EventCreate, map[string]interface{}{
+		"type":     "directory",
+		"metadata": map[string]interface{}{"tag": "c"},
+	})))
+	assert.False(t, trigger.match(event(realtime.EventCreate, map[string]interface{}{
+		"type":     "directory",
+		"metadata": map[string]interface{}{"tag": "a"},
+		"size":     float64(42),
+	})))
+	// A document missing the selected field
+	assert.False(t, trigger.match(event(realtime.EventCreate, map[string]interface{}{
+		"type": "directory",
+	})))
+
+	// Without a selector, all the changes matching the mask are accepted
+	trigger, err = NewEventTrigger(&TriggerInfos{
+		Type:       "@event",
+		Arguments:  "io.cozy.files:CREATED",
+		WorkerType: "print",
+	})
+	require.NoError(t, err)
+	assert.True(t, trigger.match(event(realtime.EventCreate, map[string]interface{}{})))
+
+	_, err = NewEventTrigger(&TriggerInfos{
+		Type:       "@event",
+		Arguments:  "io.cozy.files",
+		WorkerType: "print",
+		Selector:   map[string]interface{}{"size": map[string]interface{}{"$foo": 1}},
+	})
+	assert.Equal(t, ErrMalformedTrigger, err)
+}
+
+func TestCompileSelector(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "foo",
+		"size": float64(12),
+		"tags": []interface{}{"x", "y"},
+	}
+	tests := []struct {
+		selector map[string]interface{}
+		expected bool
+	}{
+		{map[string]interface{}{"name": "foo"}, true},
+		{map[string]interface{}{"name": map[string]interface{}{"$ne": "foo"}}, false},
+		{map[string]interface{}{"size": map[string]interface{}{"$gte": 12, "$lt": 20}}, true},
+		{map[string]interface{}{"name": map[string]interface{}{"$gt": 1}}, false},
+		{map[string]interface{}{"tags": []interface{}{"x", "y"}}, true},
+		{map[string]interface{}{"missing": map[string]interface{}{"$exists": false}}, true},
+		{map[string]interface{}{"missing": map[string]interface{}{"$ne": "foo"}}, false},
+		{map[string]interface{}{"missing": map[string]interface{}{"$nin": []string{"foo"}}}, false},
+		{map[string]interface{}{"name": map[string]interface{}{"$nin": []string{"bar"}}}, true},
+		{map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"name": "bar"},
+			map[string]interface{}{"size": 12},
+		}}, true},
+		{map[string]interface{}{"$nor": []interface{}{
+			map[string]interface{}{"name": "bar"},
+			map[string]interface{}{"size": 12},
+		}}, false},
+		{map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"name": "foo"},
+			map[string]interface{}{"$not": map[string]interface{}{"size": 12}},
+		}}, false},
+	}
+	for _, test := range tests {
+		m, err := compileSelector(test.selector)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, m(doc), "selector: %v", test.selector)
+	}
+
+	_, err := compileSelector(map[string]interface{}{"$or": "foo"})
+	assert.Error(t, err)
+	_, err = compileSelector(map[string]interface{}{"name": map[string]interface{}{"$exists": "yes"}})
+	assert.Error(t, err)
+}
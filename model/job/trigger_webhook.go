@@ -1,6 +1,20 @@
 package job
 
-import "sync"
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// WebhookSignatureHeader is the HTTP header with the signature of the body of
+// a request made on a webhook that has a secret.
+const WebhookSignatureHeader = "X-Cozy-Signature"
+
+// webhookSignaturePrefix is the prefix of the signature, with the algorithm
+// used for the HMAC.
+const webhookSignaturePrefix = "sha256="
 
 type firer interface {
 	fire(trigger Trigger, request *JobRequest)
@@ -52,6 +66,30 @@ func (w *WebhookTrigger) CombineRequest() string {
 	return appendPayload
 }
 
+// CheckSignature returns true if the signature is the HMAC-SHA256 of the body,
+// with the secret of the trigger as key. The webhooks without a secret accept
+// all the requests.
+func (w *WebhookTrigger) CheckSignature(body []byte, signature string) bool {
+	if w.Secret == "" {
+		return true
+	}
+	if !strings.HasPrefix(signature, webhookSignaturePrefix) {
+		return false
+	}
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, webhookSignaturePrefix))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(received, SignWebhookBody(w.Secret, body))
+}
+
+// SignWebhookBody returns the HMAC-SHA256 of the body, with the given secret.
+func SignWebhookBody(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
 // SetCallback registers a struct to be called when the webhook is fired.
 func (w *WebhookTrigger) SetCallback(cb firer) {
 	w.mu.Lock()
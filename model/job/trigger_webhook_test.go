@@ -0,0 +1,26 @@
+package job
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookCheckSignature(t *testing.T) {
+	body := []byte(`{"foo":"bar"}`)
+	w := &WebhookTrigger{TriggerInfos: &TriggerInfos{Secret: "secret"}}
+
+	valid := "sha256=" + hex.EncodeToString(SignWebhookBody("secret", body))
+	assert.True(t, w.CheckSignature(body, valid))
+	assert.False(t, w.CheckSignature([]byte(`{"foo":"baz"}`), valid))
+	assert.False(t, w.CheckSignature(body, ""))
+	assert.False(t, w.CheckSignature(body, "sha256=not-hex"))
+	assert.False(t, w.CheckSignature(body, hex.EncodeToString(SignWebhookBody("secret", body))))
+	other := "sha256=" + hex.EncodeToString(SignWebhookBody("other", body))
+	assert.False(t, w.CheckSignature(body, other))
+
+	// Without a secret, the webhook accepts all the requests
+	w = &WebhookTrigger{TriggerInfos: &TriggerInfos{}}
+	assert.True(t, w.CheckSignature(body, ""))
+}
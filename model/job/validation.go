@@ -0,0 +1,56 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// InvalidMessageError is the error returned when a message is rejected by the
+// validation of its worker, with the field that is not valid.
+type InvalidMessageError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidMessageError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", ErrMessageInvalid, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s %s", ErrMessageInvalid, e.Field, e.Reason)
+}
+
+// Is returns true for ErrMessageInvalid.
+func (e *InvalidMessageError) Is(target error) bool {
+	return target == ErrMessageInvalid
+}
+
+// RequireFields returns a function for WorkerConfig.ValidateMessage that
+// checks that the message is a JSON object with the given fields.
+func RequireFields(fields ...string) func(msg Message) error {
+	return func(msg Message) error {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(msg, &obj); err != nil || obj == nil {
+			return &InvalidMessageError{Reason: "must be a JSON object"}
+		}
+		for _, field := range fields {
+			if val, ok := obj[field]; !ok || string(val) == "null" {
+				return &InvalidMessageError{Field: field, Reason: "is required"}
+			}
+		}
+		return nil
+	}
+}
+
+// validateMessage checks the message of a job pushed for this worker. The
+// errors of the validation function are wrapped with ErrMessageInvalid.
+func (w *Worker) validateMessage(msg Message) error {
+	if w == nil || w.Conf == nil || w.Conf.ValidateMessage == nil {
+		return nil
+	}
+	err := w.Conf.ValidateMessage(msg)
+	if err == nil || errors.Is(err, ErrMessageInvalid) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrMessageInvalid, err)
+}
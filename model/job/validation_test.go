@@ -0,0 +1,46 @@
+package job
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMessage(t *testing.T) {
+	w := NewWorker(&WorkerConfig{
+		WorkerType:      "sendmail",
+		ValidateMessage: RequireFields("mode", "template_name"),
+	})
+
+	err := w.validateMessage(Message(`{"mode":"noreply"}`))
+	assert.ErrorIs(t, err, ErrMessageInvalid)
+	var invalid *InvalidMessageError
+	if assert.True(t, errors.As(err, &invalid)) {
+		assert.Equal(t, "template_name", invalid.Field)
+	}
+	assert.EqualError(t, err, "jobs: message is invalid: template_name is required")
+
+	err = w.validateMessage(Message(`{"mode":"noreply","template_name":null}`))
+	assert.ErrorIs(t, err, ErrMessageInvalid)
+	err = w.validateMessage(Message(`"noreply"`))
+	assert.EqualError(t, err, "jobs: message is invalid: must be a JSON object")
+
+	assert.NoError(t, w.validateMessage(Message(`{"mode":"noreply","template_name":"foo"}`)))
+
+	// The errors of a custom validation are wrapped
+	w = NewWorker(&WorkerConfig{
+		WorkerType: "test",
+		ValidateMessage: func(msg Message) error {
+			return errors.New("bad message")
+		},
+	})
+	err = w.validateMessage(Message(`{}`))
+	assert.ErrorIs(t, err, ErrMessageInvalid)
+	assert.EqualError(t, err, "jobs: message is invalid: bad message")
+
+	// Without validation, all the messages are accepted
+	assert.NoError(t, NewWorker(&WorkerConfig{WorkerType: "test"}).validateMessage(nil))
+	var none *Worker
+	assert.NoError(t, none.validateMessage(nil))
+}
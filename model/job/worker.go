@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"runtime"
 	"runtime/debug"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/metrics"
@@ -25,6 +28,13 @@ var (
 	defaultMaxExecCount = 1
 	defaultRetryDelay   = 60 * time.Millisecond
 	defaultTimeout      = 10 * time.Second
+
+	// progressThrottle is the minimal interval between two writes of the
+	// progress of a job in CouchDB.
+	progressThrottle = 1 * time.Second
+
+	// maxResultSize is the maximal size of the JSON-encoded result of a job.
+	maxResultSize = 64 * 1024
 )
 
 type (
@@ -70,16 +80,51 @@ type (
 		Reserved     bool // true when the clients must not push jobs for this worker
 		Timeout      time.Duration
 		RetryDelay   time.Duration
+		// RetryPolicy is optional, and when it is nil, the retries are
+		// made with a delay doubled on each attempt, starting from
+		// RetryDelay.
+		RetryPolicy *RetryPolicy
+		// MaxRetries is the number of retries after the first execution of a
+		// job, after which the job is dead-lettered with its last error. When
+		// it is set, it takes precedence over MaxExecCount, and 0 means that
+		// the job is never retried. When it is nil, MaxExecCount is used.
+		MaxRetries *int
+		// IdempotencyWindow is how long the idempotency key of a job is kept
+		// after the end of the job (10 minutes by default).
+		IdempotencyWindow time.Duration
+		// ValidateMessage is optional. It is called when a job is pushed, to
+		// reject it early if its message is invalid.
+		ValidateMessage func(msg Message) error
+	}
+
+	// RetryPolicy defines how the failed executions of a job are retried: the
+	// attempt N (starting from 0 for the first retry) waits
+	// BaseDelay*Multiplier^N, capped to MaxDelay, with a random jitter.
+	RetryPolicy struct {
+		MaxAttempts int           // the maximal number of executions
+		BaseDelay   time.Duration // the delay before the first retry
+		Multiplier  float64       // 1 means a constant delay
+		MaxDelay    time.Duration // 0 means no limit
+		Jitter      float64       // 0.1 means +/- 10% of the delay
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
 	// method for each jobs it pulls.
 	Worker struct {
-		Type    string
-		Conf    *WorkerConfig
-		jobs    chan *Job
-		running uint32
-		closed  chan struct{}
+		Type        string
+		Conf        *WorkerConfig
+		jobs        chan *Job
+		running     uint32
+		closed      chan struct{}
+		deadLetters deadLetterStore
+		idempotency idempotencyStore
+		heartbeats  heartbeatStore
+		broker      Broker
+
+		// inFlight are the jobs being executed, with true for the jobs that
+		// have been abandoned on shutdown.
+		inFlightMu sync.Mutex
+		inFlight   map[*Job]bool
 	}
 
 	// WorkerContext is a context.Context passed to the worker for each job
@@ -92,6 +137,17 @@ type (
 		id       string
 		cookie   interface{}
 		noRetry  bool
+		progress *progressState
+	}
+
+	// progressState is shared by the clones of a worker context to throttle
+	// the writes of the progress. ended is set when the job is acked: the
+	// logs are no longer captured, even if a goroutine started by the worker
+	// is still running.
+	progressState struct {
+		mu        sync.Mutex
+		lastWrite time.Time
+		ended     bool
 	}
 )
 
@@ -115,6 +171,8 @@ func NewWorkerContext(workerID string, job *Job, inst *instance.Instance) *Worke
 	ctx := context.Background()
 	id := fmt.Sprintf("%s/%s", workerID, job.ID())
 	entry := logger.WithDomain(job.Domain).WithNamespace("jobs")
+	progress := &progressState{}
+	entry.AddHook(newJobLogsHook(job, progress))
 
 	if job.ForwardLogs {
 		hook := realtime.LogHook(job, realtime.GetHub(), consts.Jobs, job.ID())
@@ -131,6 +189,7 @@ func NewWorkerContext(workerID string, job *Job, inst *instance.Instance) *Worke
 		job:      job,
 		log:      log,
 		id:       id,
+		progress: progress,
 	}
 }
 
@@ -167,7 +226,58 @@ func (c *WorkerContext) clone() *WorkerContext {
 		log:      c.log,
 		id:       c.id,
 		cookie:   c.cookie,
+		progress: c.progress,
+	}
+}
+
+// SetProgress reports the progress of the job, as a fraction between 0 and 1,
+// with an optional message. The progress is persisted in the job document, so
+// that a client can follow it, but the writes are throttled: the last progress
+// is always written when the job ends.
+func (c *WorkerContext) SetProgress(fraction float64, message string) error {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	now := time.Now()
+	c.progress.mu.Lock()
+	defer c.progress.mu.Unlock()
+	c.job.Progress = &Progress{
+		Fraction:  fraction,
+		Message:   message,
+		UpdatedAt: now,
+	}
+	if fraction < 1 && now.Sub(c.progress.lastWrite) < progressThrottle {
+		return nil
 	}
+	c.progress.lastWrite = now
+	return c.job.Update()
+}
+
+// SetResult keeps the given value, serialized in JSON, as the result of the
+// job. It is persisted in the job document when the job ends, and the size of
+// the result is limited to maxResultSize bytes.
+func (c *WorkerContext) SetResult(v interface{}) error {
+	result, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(result) > maxResultSize {
+		return ErrResultTooLarge
+	}
+	c.progress.mu.Lock()
+	defer c.progress.mu.Unlock()
+	c.job.Result = result
+	return nil
+}
+
+// endLogs stops capturing the logs in the job document, before it is written
+// for the last time.
+func (c *WorkerContext) endLogs() {
+	c.progress.mu.Lock()
+	defer c.progress.mu.Unlock()
+	c.progress.ended = true
 }
 
 // ID returns a unique identifier for the worker context.
@@ -219,11 +329,18 @@ func (c *WorkerContext) Manual() bool {
 	return c.job.Manual
 }
 
+// DebouncedCount returns the number of events combined in the job when it
+// has been pushed by a debounced trigger.
+func (c *WorkerContext) DebouncedCount() int {
+	return c.job.DebouncedCount
+}
+
 // NewWorker creates a new instance of Worker with the given configuration.
 func NewWorker(conf *WorkerConfig) *Worker {
 	return &Worker{
-		Type: conf.WorkerType,
-		Conf: conf,
+		Type:     conf.WorkerType,
+		Conf:     conf,
+		inFlight: make(map[*Job]bool),
 	}
 }
 
@@ -247,7 +364,51 @@ func (w *Worker) Start(jobs chan *Job) error {
 	return nil
 }
 
-// Shutdown is used to close the worker, waiting for all tasks to end
+// InFlight returns the number of jobs being executed by this worker.
+func (w *Worker) InFlight() int {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+	return len(w.inFlight)
+}
+
+func (w *Worker) startInFlight(job *Job) {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+	w.inFlight[job] = false
+}
+
+// endInFlight removes the job from the jobs being executed, and returns true
+// if it has been abandoned.
+func (w *Worker) endInFlight(job *Job) bool {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+	abandoned := w.inFlight[job]
+	delete(w.inFlight, job)
+	return abandoned
+}
+
+// abandonInFlight cancels the jobs that are still being executed, and returns
+// them. The worker won't ack them, as they are expected to be requeued by the
+// broker.
+func (w *Worker) abandonInFlight() []*Job {
+	w.inFlightMu.Lock()
+	defer w.inFlightMu.Unlock()
+	var jobs []*Job
+	for job, abandoned := range w.inFlight {
+		if abandoned {
+			continue
+		}
+		w.inFlight[job] = true
+		cancelRunning(runningKey(job, job.ID()))
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Shutdown is used to close the worker, waiting for all tasks to end. If the
+// context expires before, the jobs still in progress are canceled and
+// ctx.Err() is returned: it is up to the broker to requeue them, with
+// abandonInFlight.
 func (w *Worker) Shutdown(ctx context.Context) error {
 	if !atomic.CompareAndSwapUint32(&w.running, 1, 0) {
 		return ErrClosed
@@ -292,9 +453,14 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 			}
 		}
 		parentCtx := NewWorkerContext(workerID, job, inst)
+		ctx, cancel := context.WithCancel(parentCtx.Context)
+		parentCtx.Context = ctx
+		registerRunning(job, cancel)
 		if err := job.AckConsumed(); err != nil {
 			parentCtx.Logger().Errorf("error acking consume job: %s",
 				err.Error())
+			unregisterRunning(job)
+			cancel()
 			continue
 		}
 		t := &task{
@@ -305,18 +471,40 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 		}
 		var runResultLabel string
 		var errAck error
+		w.startInFlight(job)
+		stopHeartbeat := w.startHeartbeat(parentCtx)
 		errRun := t.run()
+		stopHeartbeat()
+		abandoned := w.endInFlight(job)
+		unregisterRunning(job)
+		cancel()
+		if abandoned {
+			parentCtx.Logger().Infof("job abandoned on shutdown")
+			continue
+		}
 		if errRun == ErrAbort {
 			errRun = nil
 		}
 		if errRun != nil {
 			parentCtx.Logger().Errorf("error while performing job: %s",
 				errRun.Error())
+			parentCtx.endLogs()
 			runResultLabel = metrics.WorkerExecResultErrored
-			errAck = job.Nack(errRun.Error())
+			errAck = job.fail(failedState(errRun), errRun.Error())
+			if job.Chain != nil {
+				abortChain(job, job.Chain.ID, job.Chain.Next)
+			}
+			if dl, ok := newDeadLetter(job, errRun); ok && w.deadLetters != nil {
+				if err := w.deadLetters.addDeadLetter(dl); err != nil {
+					parentCtx.Logger().Errorf("error while adding the job to the dead letters: %s",
+						err.Error())
+				}
+			}
 		} else {
+			parentCtx.endLogs()
 			runResultLabel = metrics.WorkerExecResultSuccess
 			errAck = job.Ack()
+			w.continueChain(job)
 		}
 
 		// Distinguish classic job execution and konnector/account deletion
@@ -339,6 +527,21 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 				errAck.Error())
 		}
 
+		if job.IdempotencyKey != "" && w.idempotency != nil {
+			window := w.Conf.IdempotencyWindow
+			if window == 0 {
+				window = defaultIdempotencyWindow
+			}
+			// A canceled job can be pushed again
+			if errors.Is(errRun, ErrCanceled) {
+				window = 0
+			}
+			if err := w.idempotency.expireIdempotencyKey(idempotencyKey(job), window); err != nil {
+				parentCtx.Logger().Errorf("error while expiring the idempotency key: %s",
+					err.Error())
+			}
+		}
+
 		// Delete the trigger associated with the job (if any) when we receive a
 		// ErrBadTrigger.
 		if job.TriggerID != "" && globalJobSystem != nil {
@@ -363,7 +566,23 @@ func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 		c.RetryDelay = defaultRetryDelay
 	}
 	if c.Timeout == 0 {
-		c.Timeout = defaultTimeout
+		if conf := config.GetConfig(); conf != nil && conf.Jobs.Timeout > 0 {
+			c.Timeout = conf.Jobs.Timeout
+		} else {
+			c.Timeout = defaultTimeout
+		}
+	}
+	if c.RetryPolicy == nil {
+		c.RetryPolicy = &RetryPolicy{
+			BaseDelay:  c.RetryDelay,
+			Multiplier: 2,
+			Jitter:     0.1,
+		}
+	} else if c.RetryPolicy.MaxAttempts > 0 {
+		c.MaxExecCount = c.RetryPolicy.MaxAttempts
+	}
+	if c.MaxRetries != nil && *c.MaxRetries >= 0 {
+		c.MaxExecCount = *c.MaxRetries + 1
 	}
 	if opts == nil {
 		return c
@@ -424,7 +643,14 @@ func (t *task) run() (err error) {
 		}
 
 		if delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-t.ctx.Done():
+			}
+		}
+		if errors.Is(t.ctx.Err(), context.Canceled) {
+			err = ErrCanceled
+			break
 		}
 
 		t.ctx.Logger().Debugf("Executing job (%d) (timeout set to %s)",
@@ -448,6 +674,14 @@ func (t *task) run() (err error) {
 		timer.ObserveDuration()
 		t.endTime = time.Now()
 
+		// The job has been canceled, and it must not be retried
+		if errors.Is(t.ctx.Err(), context.Canceled) {
+			cancel()
+			t.execCount++
+			err = ErrCanceled
+			break
+		}
+
 		// Incrementing timeouts counter
 		if t.job.Message != nil {
 			var slug string
@@ -468,7 +702,7 @@ func (t *task) run() (err error) {
 				// Forcing the timeout counter to 0 if it has not been initialized
 				metrics.WorkerExecTimeoutsCounter.WithLabelValues(t.w.Type, slug)
 
-				if errors.Is(err, context.DeadlineExceeded) { // This is a timeout
+				if errors.Is(err, ErrTimeout) {
 					metrics.WorkerExecTimeoutsCounter.WithLabelValues(t.w.Type, slug).Inc()
 				}
 			}
@@ -485,42 +719,77 @@ func (t *task) run() (err error) {
 		}
 	}
 
+	// The jobs that have failed on their last attempt are kept in the dead
+	// letters, but not the jobs that can't be recovered from
+	if err != nil && !unrecoverable(err) {
+		err = &deadLetteredError{err: err, attempts: t.execCount}
+	}
+
 	metrics.WorkerExecRetries.WithLabelValues(t.w.Type).Observe(float64(t.execCount))
 	return
 }
 
+// exec executes the worker function. It returns ErrTimeout when the context
+// has expired, even if the worker function has ignored it. In this case, exec
+// returns and the slot is freed at the deadline, without waiting for the end
+// of the worker function.
 func (t *task) exec(ctx *WorkerContext) (err error) {
 	var slot struct{}
 	if slots != nil {
 		slot = <-slots
+		defer func() { slots <- slot }()
 	}
-	defer func() {
-		if slots != nil {
-			slots <- slot
-		}
-		if r := recover(); r != nil {
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("%v", r)
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				var ok bool
+				err, ok = r.(error)
+				if !ok {
+					err = fmt.Errorf("%v", r)
+				}
+				ctx.Logger().Errorf("[panic] %s: %s", r, debug.Stack())
 			}
-			ctx.Logger().Errorf("[panic] %s: %s", r, debug.Stack())
-		}
+			done <- err
+		}()
+		err = withMiddlewares(t.conf.WorkerFunc)(ctx)
 	}()
-	return t.conf.WorkerFunc(ctx)
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// A canceled job is still waited, only the deadline frees the slot
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = <-done
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = ErrTimeout
+	}
+	return err
+}
+
+// unrecoverable returns true for the kinds of errors for which we do not have
+// a retry since these error cannot be recovered from.
+func unrecoverable(err error) bool {
+	if _, ok := err.(BadTriggerError); ok {
+		return true
+	}
+	if errors.Is(err, ErrFatal) {
+		return true
+	}
+	switch err {
+	case ErrAbort, ErrMessageUnmarshal, ErrMessageNil, ErrCanceled:
+		return true
+	}
+	return false
 }
 
 func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
-	// for certain kinds of errors, we do not have a retry since these error
-	// cannot be recovered from
-	{
-		if _, ok := prevError.(BadTriggerError); ok {
-			return false, 0, 0
-		}
-		switch prevError {
-		case ErrAbort, ErrMessageUnmarshal, ErrMessageNil:
-			return false, 0, 0
-		}
+	if unrecoverable(prevError) {
+		return false, 0, 0
 	}
 
 	c := t.conf
@@ -534,16 +803,29 @@ func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 	timeout := c.Timeout
 
 	var nextDelay time.Duration
-	if t.execCount == 0 {
+	if t.execCount > 0 {
 		// on first execution, execute immediately
-		nextDelay = 0
-	} else {
-		nextDelay = c.RetryDelay << uint(t.execCount-1)
-
-		// fuzzDelay number between delay * (1 +/- 0.1)
-		fuzzDelay := int(0.1 * float64(nextDelay))
-		nextDelay += time.Duration((rand.Intn(2*fuzzDelay) - fuzzDelay))
+		nextDelay = c.RetryPolicy.Delay(t.execCount - 1)
 	}
 
 	return true, nextDelay, timeout
 }
+
+// Delay returns the delay to wait before the given retry attempt (0 for the
+// first retry).
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.BaseDelay) * math.Pow(multiplier, float64(attempt))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	// fuzzDelay number between delay * (1 +/- jitter)
+	if fuzzDelay := int64(p.Jitter * delay); fuzzDelay > 0 {
+		delay += float64(rand.Int63n(2*fuzzDelay) - fuzzDelay)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,348 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTask returns a task to execute the job j with the worker w, without
+// broker.
+func newTestTask(w *Worker, j *Job) *task {
+	return &task{
+		w:    w,
+		ctx:  NewWorkerContext("test/0", j, nil),
+		job:  j,
+		conf: w.defaultedConf(nil),
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{
+		BaseDelay:  100 * time.Millisecond,
+		Multiplier: 3,
+		MaxDelay:   time.Second,
+	}
+	assert.Equal(t, 100*time.Millisecond, p.Delay(0))
+	assert.Equal(t, 300*time.Millisecond, p.Delay(1))
+	assert.Equal(t, 900*time.Millisecond, p.Delay(2))
+	assert.Equal(t, time.Second, p.Delay(3))
+
+	p.Jitter = 0.1
+	for i := 0; i < 10; i++ {
+		d := p.Delay(0)
+		assert.GreaterOrEqual(t, d, 90*time.Millisecond)
+		assert.LessOrEqual(t, d, 110*time.Millisecond)
+	}
+}
+
+func TestTaskRetries(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	var calls []time.Time
+	conf := &WorkerConfig{
+		WorkerType: "test",
+		WorkerFunc: func(ctx *WorkerContext) error {
+			calls = append(calls, time.Now())
+			return errors.New("failure")
+		},
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 4,
+			BaseDelay:   10 * time.Millisecond,
+			Multiplier:  2,
+		},
+	}
+	w := NewWorker(conf)
+	j := &Job{JobID: "retried", Domain: "cozy.localhost"}
+	task := newTestTask(w, j)
+	err := task.run()
+	assert.EqualError(t, err, "failure")
+	assert.ErrorIs(t, err, ErrDeadLettered)
+	require.Len(t, calls, 4)
+	for i := 1; i < len(calls); i++ {
+		expected := conf.RetryPolicy.Delay(i - 1)
+		assert.GreaterOrEqual(t, calls[i].Sub(calls[i-1]), expected)
+	}
+
+	// ErrAbort stops the retries
+	calls = nil
+	conf.WorkerFunc = func(ctx *WorkerContext) error {
+		calls = append(calls, time.Now())
+		return ErrAbort
+	}
+	task.conf = w.defaultedConf(nil)
+	assert.Equal(t, ErrAbort, task.run())
+	assert.Len(t, calls, 1)
+}
+
+func TestDeadLetters(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	failure := errors.New("failure")
+	conf := &WorkerConfig{
+		WorkerType:   "test",
+		WorkerFunc:   func(ctx *WorkerContext) error { return failure },
+		MaxExecCount: 3,
+		RetryDelay:   time.Millisecond,
+	}
+	w := NewWorker(conf)
+	j := &Job{JobID: "dead", Domain: "cozy.localhost", WorkerType: "test"}
+	task := newTestTask(w, j)
+	dl, ok := newDeadLetter(j, task.run())
+	require.True(t, ok)
+	assert.Equal(t, j, dl.Job)
+	assert.Equal(t, "failure", dl.Error)
+	assert.Equal(t, 3, dl.Attempts)
+
+	b := NewMemBroker().(*memBroker)
+	require.NoError(t, b.addDeadLetter(dl))
+	dls, err := b.DeadLetters("test")
+	require.NoError(t, err)
+	assert.Equal(t, []*DeadLetter{dl}, dls)
+	_, err = b.RequeueDeadLetter("test", "unknown")
+	assert.Equal(t, ErrNotFoundJob, err)
+
+	// The jobs with a single execution are also dead-lettered
+	task.conf = w.defaultedConf(&JobOptions{MaxExecCount: 1})
+	dl, ok = newDeadLetter(j, task.run())
+	require.True(t, ok)
+	assert.Equal(t, 1, dl.Attempts)
+
+	// But not the jobs that can't be recovered from
+	conf.WorkerFunc = func(ctx *WorkerContext) error { return Fatal(failure) }
+	task.conf = w.defaultedConf(nil)
+	_, ok = newDeadLetter(j, task.run())
+	assert.False(t, ok)
+
+	// The oldest dead letters are removed when there are too many of them
+	defer func(max int) { maxDeadLetters = max }(maxDeadLetters)
+	maxDeadLetters = 2
+	for i := 0; i < 3; i++ {
+		job := &Job{JobID: fmt.Sprintf("dead-%d", i), WorkerType: "test"}
+		require.NoError(t, b.addDeadLetter(&DeadLetter{Job: job, Error: "failure"}))
+	}
+	dls, err = b.DeadLetters("test")
+	require.NoError(t, err)
+	require.Len(t, dls, 2)
+	assert.Equal(t, "dead-1", dls[0].Job.ID())
+	assert.Equal(t, "dead-2", dls[1].Job.ID())
+}
+
+func TestMaxRetries(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	var calls int
+	two := 2
+	conf := &WorkerConfig{
+		WorkerType: "test",
+		WorkerFunc: func(ctx *WorkerContext) error {
+			calls++
+			return fmt.Errorf("failure %d", calls)
+		},
+		MaxExecCount: 5,
+		MaxRetries:   &two,
+		RetryDelay:   time.Millisecond,
+	}
+	w := NewWorker(conf)
+	j := &Job{JobID: "retries", Domain: "cozy.localhost", WorkerType: "test"}
+	task := newTestTask(w, j)
+	dl, ok := newDeadLetter(j, task.run())
+	assert.Equal(t, 3, calls)
+	require.True(t, ok)
+	assert.Equal(t, "failure 3", dl.Error)
+	assert.Equal(t, 3, dl.Attempts)
+
+	// MaxRetries=0 means no retries, even with a MaxExecCount
+	calls = 0
+	zero := 0
+	conf.MaxRetries = &zero
+	task.conf = w.defaultedConf(nil)
+	dl, ok = newDeadLetter(j, task.run())
+	assert.Equal(t, 1, calls)
+	require.True(t, ok)
+	assert.Equal(t, "failure 1", dl.Error)
+
+	// Without MaxRetries, MaxExecCount is used
+	calls = 0
+	conf.MaxRetries = nil
+	conf.MaxExecCount = 0
+	task.conf = w.defaultedConf(nil)
+	assert.EqualError(t, task.run(), "failure 1")
+	assert.Equal(t, 1, calls)
+}
+
+func TestSetResult(t *testing.T) {
+	j := &Job{JobID: "result", Domain: "cozy.localhost"}
+	ctx := NewWorkerContext("test/0", j, nil)
+	require.NoError(t, ctx.SetResult(map[string]interface{}{"imported": 42}))
+	assert.JSONEq(t, `{"imported": 42}`, string(j.Result))
+
+	// The result is also kept by the clones of the context
+	cloned, cancel := ctx.WithTimeout(time.Second)
+	defer cancel()
+	require.NoError(t, cloned.SetResult("done"))
+	assert.Equal(t, `"done"`, string(j.Result))
+
+	large := strings.Repeat("x", maxResultSize)
+	assert.Equal(t, ErrResultTooLarge, ctx.SetResult(large))
+	assert.Equal(t, `"done"`, string(j.Result))
+}
+
+func TestConcurrency(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	var running, maxRunning, executed int32
+	conf := &WorkerConfig{
+		WorkerType:  "test",
+		Concurrency: 2,
+		WorkerFunc: func(ctx *WorkerContext) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&executed, 1)
+			return nil
+		},
+	}
+	w := NewWorker(conf)
+
+	// The jobs are dispatched to Concurrency goroutines, like in Start
+	jobs := make(chan *Job, 5)
+	for i := 0; i < 5; i++ {
+		jobs <- &Job{JobID: fmt.Sprintf("job-%d", i), Domain: "cozy.localhost"}
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				assert.NoError(t, newTestTask(w, j).run())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&executed))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestTaskTimeout(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	setNbSlots(1)
+	defer func() { slots = nil }()
+
+	var calls int32
+	ctxErr := make(chan error, 2)
+	conf := &WorkerConfig{
+		WorkerType:   "test",
+		MaxExecCount: 2,
+		RetryDelay:   time.Millisecond,
+		Timeout:      50 * time.Millisecond,
+		WorkerFunc: func(ctx *WorkerContext) error {
+			atomic.AddInt32(&calls, 1)
+			// The worker doesn't watch its context, and returns no error
+			time.Sleep(200 * time.Millisecond)
+			ctxErr <- ctx.Err()
+			return nil
+		},
+	}
+	w := NewWorker(conf)
+	j := &Job{JobID: "job-1", Domain: "cozy.localhost"}
+
+	start := time.Now()
+	err := newTestTask(w, j).run()
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// The slot has been freed at the deadline of each execution, without
+	// waiting for the end of the worker function
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+	assert.Len(t, slots, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// The context of the worker has been canceled
+	assert.ErrorIs(t, <-ctxErr, context.DeadlineExceeded)
+	assert.ErrorIs(t, <-ctxErr, context.DeadlineExceeded)
+}
+
+func TestAbandonInFlight(t *testing.T) {
+	w := NewWorker(&WorkerConfig{WorkerType: "test"})
+	j1 := &Job{JobID: "job-1", Domain: "cozy.localhost"}
+	j2 := &Job{JobID: "job-2", Domain: "cozy.localhost"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerRunning(j1, cancel)
+	w.startInFlight(j1)
+	w.startInFlight(j2)
+	assert.False(t, w.endInFlight(j2))
+	assert.Equal(t, 1, w.InFlight())
+
+	// The job still in progress is canceled and returned to be requeued
+	jobs := w.abandonInFlight()
+	assert.Equal(t, []*Job{j1}, jobs)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.Empty(t, w.abandonInFlight())
+	assert.True(t, w.endInFlight(j1))
+	assert.Equal(t, 0, w.InFlight())
+}
+
+func TestRetryableAndFatalErrors(t *testing.T) {
+	require.NoError(t, logger.Init(logger.Options{Output: io.Discard}))
+
+	failure := errors.New("failure")
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+		calls    int
+	}{
+		{"Retryable", Retryable(failure), failure, 3},
+		{"Fatal", Fatal(failure), failure, 1},
+		{"Bare", failure, failure, 3},
+		{"Abort", ErrAbort, ErrAbort, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			conf := &WorkerConfig{
+				WorkerType:   "test",
+				MaxExecCount: 3,
+				RetryDelay:   time.Millisecond,
+				WorkerFunc: func(ctx *WorkerContext) error {
+					calls++
+					return test.err
+				},
+			}
+			w := NewWorker(conf)
+			j := &Job{JobID: "marked", Domain: "cozy.localhost"}
+			task := newTestTask(w, j)
+			err := task.run()
+			assert.ErrorIs(t, err, test.expected)
+			assert.Equal(t, test.expected.Error(), err.Error())
+			assert.Equal(t, test.calls, calls)
+		})
+	}
+
+	assert.ErrorIs(t, Retryable(failure), ErrRetryable)
+	assert.NotErrorIs(t, Retryable(failure), ErrFatal)
+	assert.ErrorIs(t, Fatal(failure), ErrFatal)
+	assert.NotErrorIs(t, Fatal(failure), ErrRetryable)
+	assert.NoError(t, Fatal(nil))
+	assert.NoError(t, Retryable(nil))
+}
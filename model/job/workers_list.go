@@ -78,6 +78,10 @@ func applyWorkerConfig(w *WorkerConfig, c config.Worker) *WorkerConfig {
 	if c.MaxExecCount != nil {
 		w.MaxExecCount = *c.MaxExecCount
 	}
+	if c.MaxRetries != nil {
+		maxRetries := *c.MaxRetries
+		w.MaxRetries = &maxRetries
+	}
 	if c.Timeout != nil {
 		w.Timeout = *c.Timeout
 	}
@@ -0,0 +1,81 @@
+package custom
+
+import (
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// An Emoji struct represents an emoji written with its shortcode, like
+// :smile:.
+type Emoji struct {
+	ast.BaseInline
+	Shortcode string
+	Value     string
+}
+
+// Dump implements Node.Dump.
+func (n *Emoji) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Shortcode": n.Shortcode}, nil)
+}
+
+// KindEmoji is a NodeKind of the Emoji node.
+var KindEmoji = ast.NewNodeKind("Emoji")
+
+// Kind implements Node.Kind.
+func (n *Emoji) Kind() ast.NodeKind {
+	return KindEmoji
+}
+
+// NewEmoji returns a new Emoji node.
+func NewEmoji(shortcode, value string) *Emoji {
+	return &Emoji{
+		BaseInline: ast.BaseInline{},
+		Shortcode:  shortcode,
+		Value:      value,
+	}
+}
+
+type emojiParser struct {
+	emojis map[string]string
+}
+
+// NewEmojiParser returns a new InlineParser that can parse the shortcodes of
+// the emojis, like :smile:. The emojis map is the table from the shortcodes
+// (without the colons) to the emojis. The panel types, like :info:, are never
+// parsed as emojis.
+func NewEmojiParser(emojis map[string]string) parser.InlineParser {
+	return &emojiParser{emojis: emojis}
+}
+
+func (s *emojiParser) Trigger() []byte {
+	return []byte{':'}
+}
+
+func (s *emojiParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	for pos := 1; pos < len(line) && pos < 50; pos++ {
+		c := line[pos]
+		if c == ':' {
+			shortcode := string(line[1:pos])
+			value, ok := s.emojis[shortcode]
+			if !ok || isKnownPanelType(shortcode) {
+				return nil
+			}
+			block.Advance(pos + 1)
+			return NewEmoji(shortcode, value)
+		}
+		if !isShortcodeChar(c) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *emojiParser) CloseBlock(parent ast.Node, pc parser.Context) {
+	// nothing to do
+}
+
+func isShortcodeChar(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '_' || c == '+' || c == '-'
+}
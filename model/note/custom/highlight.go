@@ -0,0 +1,78 @@
+package custom
+
+import (
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// A Highlight struct represents a highlighted text, like ==foo==. It is not
+// in the CommonMark spec, but it is a common extension of markdown.
+type Highlight struct {
+	ast.BaseInline
+}
+
+// Dump implements Node.Dump.
+func (n *Highlight) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// KindHighlight is a NodeKind of the Highlight node.
+var KindHighlight = ast.NewNodeKind("Highlight")
+
+// Kind implements Node.Kind.
+func (n *Highlight) Kind() ast.NodeKind {
+	return KindHighlight
+}
+
+// NewHighlight returns a new Highlight node.
+func NewHighlight() *Highlight {
+	return &Highlight{}
+}
+
+type highlightDelimiterProcessor struct{}
+
+func (p *highlightDelimiterProcessor) IsDelimiter(b byte) bool {
+	return b == '='
+}
+
+func (p *highlightDelimiterProcessor) CanOpenCloser(opener, closer *parser.Delimiter) bool {
+	return opener.Char == closer.Char
+}
+
+func (p *highlightDelimiterProcessor) OnMatch(consumes int) ast.Node {
+	return NewHighlight()
+}
+
+var defaultHighlightDelimiterProcessor = &highlightDelimiterProcessor{}
+
+type highlightParser struct{}
+
+var defaultHighlightParser = &highlightParser{}
+
+// NewHighlightParser returns a new InlineParser that can parse highlighted
+// texts, like ==foo==.
+func NewHighlightParser() parser.InlineParser {
+	return defaultHighlightParser
+}
+
+func (s *highlightParser) Trigger() []byte {
+	return []byte{'='}
+}
+
+func (s *highlightParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	before := block.PrecendingCharacter()
+	line, segment := block.PeekLine()
+	node := parser.ScanDelimiter(line, before, 2, defaultHighlightDelimiterProcessor)
+	if node == nil {
+		return nil
+	}
+	node.Segment = segment.WithStop(segment.Start + node.OriginalLength)
+	block.Advance(node.OriginalLength)
+	pc.PushDelimiter(node)
+	return node
+}
+
+func (s *highlightParser) CloseBlock(parent ast.Node, pc parser.Context) {
+	// nothing to do
+}
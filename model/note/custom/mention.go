@@ -0,0 +1,95 @@
+package custom
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// A Mention struct represents a mention of someone, like @alice.
+type Mention struct {
+	ast.BaseInline
+	Handle string
+}
+
+// Dump implements Node.Dump.
+func (n *Mention) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Handle": n.Handle}, nil)
+}
+
+// KindMention is a NodeKind of the Mention node.
+var KindMention = ast.NewNodeKind("Mention")
+
+// Kind implements Node.Kind.
+func (n *Mention) Kind() ast.NodeKind {
+	return KindMention
+}
+
+// NewMention returns a new Mention node.
+func NewMention(handle string) *Mention {
+	return &Mention{
+		BaseInline: ast.BaseInline{},
+		Handle:     handle,
+	}
+}
+
+type mentionParser struct{}
+
+var defaultMentionParser = &mentionParser{}
+
+// NewMentionParser returns a new InlineParser that can parse mentions, like
+// @alice. The @ in the middle of a word, like in an email address, is not a
+// mention.
+func NewMentionParser() parser.InlineParser {
+	return defaultMentionParser
+}
+
+func (s *mentionParser) Trigger() []byte {
+	return []byte{'@'}
+}
+
+func (s *mentionParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	length := MentionLength(block.PrecendingCharacter(), line)
+	if length == 0 {
+		return nil
+	}
+	block.Advance(length)
+	return NewMention(string(line[1:length]))
+}
+
+func (s *mentionParser) CloseBlock(parent ast.Node, pc parser.Context) {
+	// nothing to do
+}
+
+// MentionLength returns the length of the mention at the start of line, with
+// the @, or 0 if line doesn't start with a mention. before is the character
+// just before the line.
+func MentionLength(before rune, line []byte) int {
+	if len(line) == 0 || line[0] != '@' || isHandleChar(before) {
+		return 0
+	}
+	end := 1
+	for end < len(line) {
+		c, size := utf8.DecodeRune(line[end:])
+		if !isHandleChar(c) {
+			break
+		}
+		end += size
+	}
+	// A dot or a dash at the end is the punctuation of the sentence
+	for end > 1 && (line[end-1] == '.' || line[end-1] == '-') {
+		end--
+	}
+	if end == 1 {
+		return 0
+	}
+	return end
+}
+
+func isHandleChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '-' || c == '.'
+}
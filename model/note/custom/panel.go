@@ -7,6 +7,12 @@ import (
 	"github.com/yuin/goldmark/util"
 )
 
+// PanelTypes is the list of the known types for the panels.
+var PanelTypes = []string{"info", "note", "success", "warning", "error"}
+
+// DefaultPanelType is the type used for a panel with an unknown type.
+const DefaultPanelType = "info"
+
 // A Panel struct represents a panel in atlaskit.
 type Panel struct {
 	ast.BaseBlock
@@ -62,20 +68,42 @@ func (b *panelParser) Open(parent ast.Node, reader text.Reader, pc parser.Contex
 		if line[pos] == ':' {
 			panelType := string(line[start:pos])
 			pos++
-			if pos >= len(line) || line[pos] != ' ' {
+			if pos >= len(line) || line[pos] != ' ' || !isPanelMarker(panelType) {
 				break
 			}
-			switch panelType {
-			case "info", "note", "success", "warning", "error":
-				reader.Advance(pos)
-				return NewPanel(panelType), parser.HasChildren
+			if !isKnownPanelType(panelType) {
+				panelType = DefaultPanelType
 			}
-			break
+			reader.Advance(pos)
+			return NewPanel(panelType), parser.HasChildren
 		}
 	}
 	return nil, parser.NoChildren
 }
 
+// isPanelMarker returns true if the type between the colons can be used for
+// a panel: it must be a lowercase word.
+func isPanelMarker(panelType string) bool {
+	if panelType == "" {
+		return false
+	}
+	for _, c := range panelType {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func isKnownPanelType(panelType string) bool {
+	for _, typ := range PanelTypes {
+		if typ == panelType {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *panelParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
 	line, segment := reader.PeekLine()
 	if util.IsBlank(line) {
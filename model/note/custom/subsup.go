@@ -0,0 +1,121 @@
+package custom
+
+import (
+	"github.com/yuin/goldmark/ast"
+	extensionast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// A SubSup struct represents a text in subscript, like H~2~O, or in
+// superscript, like x^2^. It is the syntax of pandoc.
+type SubSup struct {
+	ast.BaseInline
+	// Position is "sub" or "sup"
+	Position string
+}
+
+// Dump implements Node.Dump.
+func (n *SubSup) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Position": n.Position}, nil)
+}
+
+// KindSubSup is a NodeKind of the SubSup node.
+var KindSubSup = ast.NewNodeKind("SubSup")
+
+// Kind implements Node.Kind.
+func (n *SubSup) Kind() ast.NodeKind {
+	return KindSubSup
+}
+
+// NewSubSup returns a new SubSup node.
+func NewSubSup(position string) *SubSup {
+	return &SubSup{
+		BaseInline: ast.BaseInline{},
+		Position:   position,
+	}
+}
+
+// tildeDelimiterProcessor is used for the subscripts with a single tilde, and
+// for the strikethroughs with two tildes, like the emphasis and the strong
+// emphasis with the stars.
+type tildeDelimiterProcessor struct{}
+
+func (p *tildeDelimiterProcessor) IsDelimiter(b byte) bool {
+	return b == '~'
+}
+
+func (p *tildeDelimiterProcessor) CanOpenCloser(opener, closer *parser.Delimiter) bool {
+	return opener.Char == closer.Char
+}
+
+func (p *tildeDelimiterProcessor) OnMatch(consumes int) ast.Node {
+	if consumes == 2 {
+		return extensionast.NewStrikethrough()
+	}
+	return NewSubSup("sub")
+}
+
+type caretDelimiterProcessor struct{}
+
+func (p *caretDelimiterProcessor) IsDelimiter(b byte) bool {
+	return b == '^'
+}
+
+func (p *caretDelimiterProcessor) CanOpenCloser(opener, closer *parser.Delimiter) bool {
+	return opener.Char == closer.Char
+}
+
+func (p *caretDelimiterProcessor) OnMatch(consumes int) ast.Node {
+	return NewSubSup("sup")
+}
+
+type subSupParser struct {
+	trigger   byte
+	processor parser.DelimiterProcessor
+}
+
+var defaultSubscriptParser = &subSupParser{
+	trigger:   '~',
+	processor: &tildeDelimiterProcessor{},
+}
+
+var defaultSuperscriptParser = &subSupParser{
+	trigger:   '^',
+	processor: &caretDelimiterProcessor{},
+}
+
+// NewSubscriptParser returns a new InlineParser that can parse subscripts,
+// like H~2~O, and strikethroughs, like ~~foo~~. It replaces the
+// strikethrough parser of the goldmark extensions, as they use the same
+// delimiter.
+func NewSubscriptParser() parser.InlineParser {
+	return defaultSubscriptParser
+}
+
+// NewSuperscriptParser returns a new InlineParser that can parse
+// superscripts, like x^2^.
+func NewSuperscriptParser() parser.InlineParser {
+	return defaultSuperscriptParser
+}
+
+func (s *subSupParser) Trigger() []byte {
+	return []byte{s.trigger}
+}
+
+func (s *subSupParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	before := block.PrecendingCharacter()
+	line, segment := block.PeekLine()
+	node := parser.ScanDelimiter(line, before, 1, s.processor)
+	if node == nil {
+		return nil
+	}
+	node.Segment = segment.WithStop(segment.Start + node.OriginalLength)
+	block.Advance(node.OriginalLength)
+	pc.PushDelimiter(node)
+	return node
+}
+
+func (s *subSupParser) CloseBlock(parent ast.Node, pc parser.Context) {
+	// nothing to do
+}
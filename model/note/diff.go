@@ -0,0 +1,133 @@
+package note
+
+import "github.com/cozy/prosemirror-go/model"
+
+// ChangeKind is the kind of change for a block between two versions of a
+// note.
+type ChangeKind string
+
+const (
+	// BlockAdded is used for a block that is only in the new version.
+	BlockAdded ChangeKind = "added"
+	// BlockRemoved is used for a block that is only in the old version.
+	BlockRemoved ChangeKind = "removed"
+	// BlockModified is used for a block that has been edited: the old and new
+	// versions have the same type, but a different content or attributes.
+	BlockModified ChangeKind = "modified"
+)
+
+// Change is a change for a top-level block (paragraph, heading, list, etc.)
+// between two versions of a note.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	// OldIndex is the position of the block in the old version, or -1 for an
+	// added block.
+	OldIndex int `json:"old_index"`
+	// NewIndex is the position of the block in the new version, or -1 for a
+	// removed block.
+	NewIndex int         `json:"new_index"`
+	Old      *model.Node `json:"old,omitempty"`
+	New      *model.Node `json:"new,omitempty"`
+}
+
+// Diff returns the changes between two versions of the document of a note, in
+// the order of the document. The blocks are compared with a longest common
+// subsequence, so the unchanged blocks are never reported, even if they have
+// moved because of the blocks added or removed before them.
+func Diff(oldNode, newNode *model.Node) []Change {
+	olds := oldNode.Content.Content
+	news := newNode.Content.Content
+	lcs := lcsTable(olds, news)
+
+	var changes []Change
+	var removed, added []int
+	flush := func() {
+		changes = append(changes, pairChanges(olds, news, removed, added)...)
+		removed, added = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(olds) || j < len(news) {
+		switch {
+		case i < len(olds) && j < len(news) && sameNode(olds[i], news[j]):
+			flush()
+			i++
+			j++
+		case j == len(news) || (i < len(olds) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, i)
+			i++
+		default:
+			added = append(added, j)
+			j++
+		}
+	}
+	flush()
+	return changes
+}
+
+// lcsTable returns a table where lcs[i][j] is the length of the longest common
+// subsequence of olds[i:] and news[j:].
+func lcsTable(olds, news []*model.Node) [][]int {
+	lcs := make([][]int, len(olds)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(news)+1)
+	}
+	for i := len(olds) - 1; i >= 0; i-- {
+		for j := len(news) - 1; j >= 0; j-- {
+			if sameNode(olds[i], news[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs
+}
+
+// pairChanges returns the changes for the blocks removed and added between
+// two unchanged blocks. A removed block and an added block at the same rank
+// are reported as a modification if they have the same type.
+func pairChanges(olds, news []*model.Node, removed, added []int) []Change {
+	var changes []Change
+	for k := 0; k < len(removed) || k < len(added); k++ {
+		switch {
+		case k < len(removed) && k < len(added):
+			o, n := removed[k], added[k]
+			if olds[o].Type == news[n].Type {
+				changes = append(changes, Change{Kind: BlockModified, OldIndex: o, NewIndex: n, Old: olds[o], New: news[n]})
+			} else {
+				changes = append(changes,
+					Change{Kind: BlockRemoved, OldIndex: o, NewIndex: -1, Old: olds[o]},
+					Change{Kind: BlockAdded, OldIndex: -1, NewIndex: n, New: news[n]})
+			}
+		case k < len(removed):
+			o := removed[k]
+			changes = append(changes, Change{Kind: BlockRemoved, OldIndex: o, NewIndex: -1, Old: olds[o]})
+		default:
+			n := added[k]
+			changes = append(changes, Change{Kind: BlockAdded, OldIndex: -1, NewIndex: n, New: news[n]})
+		}
+	}
+	return changes
+}
+
+// sameNode returns true if the two nodes have the same markup and content.
+// Node.Eq is not enough, as it doesn't compare the text of the text nodes.
+func sameNode(a, b *model.Node) bool {
+	if !a.SameMarkup(b) {
+		return false
+	}
+	if a.IsText() || b.IsText() {
+		return a.IsText() && b.IsText() && *a.Text == *b.Text
+	}
+	if a.ChildCount() != b.ChildCount() {
+		return false
+	}
+	for i, child := range a.Content.Content {
+		if !sameNode(child, b.Content.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package note
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/note/custom"
+	"github.com/cozy/prosemirror-go/markdown"
+	"github.com/cozy/prosemirror-go/model"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/util"
+)
+
+// DefaultEmojis is a table of the shortcodes for the most common emojis. The
+// panel types, like info, are not used as shortcodes.
+var DefaultEmojis = map[string]string{
+	"smile":            "😄",
+	"grinning":         "😀",
+	"laughing":         "😆",
+	"joy":              "😂",
+	"wink":             "😉",
+	"thinking":         "🤔",
+	"sob":              "😭",
+	"heart":            "❤️",
+	"thumbsup":         "👍",
+	"thumbsdown":       "👎",
+	"ok_hand":          "👌",
+	"clap":             "👏",
+	"pray":             "🙏",
+	"eyes":             "👀",
+	"tada":             "🎉",
+	"sparkles":         "✨",
+	"rocket":           "🚀",
+	"fire":             "🔥",
+	"star":             "⭐",
+	"bulb":             "💡",
+	"memo":             "📝",
+	"calendar":         "📅",
+	"bug":              "🐛",
+	"white_check_mark": "✅",
+	"x":                "❌",
+	"question":         "❓",
+}
+
+// withEmojis returns the option for the markdown parser to convert the
+// shortcodes to emojis.
+func withEmojis(emojis map[string]string) parser.Option {
+	return parser.WithInlineParsers(
+		util.Prioritized(custom.NewEmojiParser(emojis), 800),
+	)
+}
+
+// emojiShortcodes returns the serializer overrides to write the emojis with
+// their shortcodes, like :smile:, for the markdown editors that don't support
+// the emojis. When several shortcodes are used for the same emoji, the first
+// in alphabetical order is used.
+func emojiShortcodes(emojis map[string]string) *SerializerOverrides {
+	shortcodes := make(map[string]string, len(emojis))
+	for shortcode, emoji := range emojis {
+		if other, ok := shortcodes[emoji]; !ok || shortcode < other {
+			shortcodes[emoji] = shortcode
+		}
+	}
+	// The longest emojis first, for the sequences of several code points
+	values := make([]string, 0, len(shortcodes))
+	for emoji := range shortcodes {
+		values = append(values, emoji)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	pairs := make([]string, 0, 2*len(values))
+	for _, emoji := range values {
+		pairs = append(pairs, emoji, ":"+shortcodes[emoji]+":")
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	return &SerializerOverrides{
+		Nodes: map[string]markdown.NodeSerializerFunc{
+			"text": func(state *markdown.SerializerState, node, parent *model.Node, index int) {
+				txt := *node.Text
+				// An emoji at the start of a block is kept, as its shortcode
+				// would be read as the marker of a panel
+				prefix := ""
+				if index == 0 && len(node.Marks) == 0 {
+					for _, emoji := range values {
+						if strings.HasPrefix(txt, emoji+" ") {
+							prefix, txt = emoji, txt[len(emoji):]
+							break
+						}
+					}
+				}
+				serializeText(state, node.WithText(prefix+replacer.Replace(txt)), parent, index)
+			},
+		},
+	}
+}
@@ -20,4 +20,10 @@ var (
 	ErrTooOld = errors.New("The revision is too old")
 	// ErrMissingSessionID is used when a telepointer has no identifier.
 	ErrMissingSessionID = errors.New("The session id is missing")
+	// ErrCannotMerge is used when two versions of a note can't be merged
+	// into a valid document.
+	ErrCannotMerge = errors.New("Cannot merge the versions of the note")
+	// ErrNoteTooLarge is used when a note is larger than the limits of the
+	// configuration.
+	ErrNoteTooLarge = errors.New("The note is too large")
 )
@@ -0,0 +1,69 @@
+package note
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontmatterDelimiter is the line before and after the YAML frontmatter of a
+// markdown.
+const frontmatterDelimiter = "---"
+
+// splitFrontmatter returns the metadata from the YAML frontmatter at the
+// start of a markdown, and the markdown without this frontmatter. If there is
+// no frontmatter, the metadata is nil and the markdown is unchanged. A block
+// that is not a YAML mapping, like a title between two horizontal rules, is
+// not a frontmatter.
+func splitFrontmatter(buf []byte) (map[string]interface{}, []byte) {
+	rest, ok := cutLine(buf, frontmatterDelimiter)
+	if !ok {
+		return nil, buf
+	}
+	for pos := 0; pos < len(rest); {
+		line := rest[pos:]
+		if idx := bytes.IndexByte(line, '\n'); idx >= 0 {
+			line = line[:idx+1]
+		}
+		if body, ok := cutLine(line, frontmatterDelimiter); ok && len(body) == 0 {
+			var metadata map[string]interface{}
+			if err := yaml.Unmarshal(rest[:pos], &metadata); err != nil || len(metadata) == 0 {
+				return nil, buf
+			}
+			return metadata, bytes.TrimLeft(rest[pos+len(line):], "\r\n")
+		}
+		pos += len(line)
+	}
+	return nil, buf
+}
+
+// cutLine returns the content after the first line if this line is exactly
+// the given text.
+func cutLine(buf []byte, line string) ([]byte, bool) {
+	if !bytes.HasPrefix(buf, []byte(line)) {
+		return nil, false
+	}
+	rest := buf[len(line):]
+	switch {
+	case len(rest) == 0:
+		return rest, true
+	case rest[0] == '\n':
+		return rest[1:], true
+	case bytes.HasPrefix(rest, []byte("\r\n")):
+		return rest[2:], true
+	}
+	return nil, false
+}
+
+// writeFrontmatter returns the YAML frontmatter for the metadata, followed by
+// the markdown. Without metadata, the markdown is returned unchanged.
+func writeFrontmatter(metadata map[string]interface{}, md string) (string, error) {
+	if len(metadata) == 0 {
+		return md, nil
+	}
+	out, err := yaml.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	return frontmatterDelimiter + "\n" + string(out) + frontmatterDelimiter + "\n\n" + md, nil
+}
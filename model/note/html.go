@@ -0,0 +1,673 @@
+package note
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/prosemirror-go/model"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// SerializeToHTML returns the HTML for a document of a note, to render it
+// where prosemirror is not available. The text and the attributes are escaped,
+// and the links are kept only for the safe schemes.
+func SerializeToHTML(node *model.Node, schema *model.Schema) (string, error) {
+	var buf strings.Builder
+	s := &htmlSerializer{buf: &buf, schema: schema}
+	if err := s.renderContent(node); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type htmlSerializer struct {
+	buf     *strings.Builder
+	schema  *model.Schema
+	anchors anchorSlugger
+}
+
+var htmlColorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{3,8}$`)
+
+func (s *htmlSerializer) renderContent(parent *model.Node) error {
+	for _, child := range parent.Content.Content {
+		if err := s.render(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrap renders the content of the node inside the given tag. The attributes
+// must already be escaped.
+func (s *htmlSerializer) wrap(node *model.Node, tag, attrs string) error {
+	s.buf.WriteString("<" + tag + attrs + ">")
+	if err := s.renderContent(node); err != nil {
+		return err
+	}
+	s.buf.WriteString("</" + tag + ">")
+	return nil
+}
+
+func (s *htmlSerializer) render(node *model.Node) error {
+	if node.Type.Schema != s.schema {
+		return ErrInvalidSchema
+	}
+
+	switch node.Type.Name {
+	case "text":
+		s.renderText(node)
+		return nil
+	case "paragraph":
+		var attrs string
+		for _, mark := range node.Marks {
+			if mark.Type.Name == "alignment" {
+				switch mark.Attrs["align"] {
+				case "center":
+					attrs = ` class="center"`
+				case "end":
+					attrs = ` class="right"`
+				}
+			}
+		}
+		return s.wrap(node, "p", attrs)
+	case "heading":
+		level := intAttr(node.Attrs, "level", 1)
+		if level < 1 || level > 6 {
+			level = 1
+		}
+		id := s.anchors.anchor(node.TextContent())
+		return s.wrap(node, fmt.Sprintf("h%d", level), ` id="`+html.EscapeString(id)+`"`)
+	case "bulletList":
+		return s.wrap(node, "ul", "")
+	case "orderedList":
+		return s.wrap(node, "ol", "")
+	case "listItem":
+		return s.wrap(node, "li", "")
+	case "taskList":
+		return s.wrap(node, "ul", ` class="task-list"`)
+	case "taskItem":
+		checked := ""
+		if node.Attrs["state"] == "DONE" {
+			checked = " checked"
+		}
+		s.buf.WriteString(`<li class="task-item"><input type="checkbox" disabled` + checked + "> ")
+		if err := s.renderContent(node); err != nil {
+			return err
+		}
+		s.buf.WriteString("</li>")
+		return nil
+	case "decisionList":
+		return s.wrap(node, "ul", ` class="decision-list"`)
+	case "decisionItem":
+		return s.wrap(node, "li", ` class="decision-item"`)
+	case "blockquote":
+		return s.wrap(node, "blockquote", "")
+	case "rule":
+		s.buf.WriteString("<hr>")
+		return nil
+	case "hardBreak":
+		s.buf.WriteString("<br>")
+		return nil
+	case "codeBlock":
+		var attrs string
+		if lang, ok := node.Attrs["language"].(string); ok && lang != "" {
+			attrs = ` class="language-` + html.EscapeString(lang) + `"`
+		}
+		s.buf.WriteString("<pre><code" + attrs + ">")
+		s.buf.WriteString(html.EscapeString(node.TextContent()))
+		s.buf.WriteString("</code></pre>")
+		return nil
+	case "panel":
+		typ, _ := node.Attrs["panelType"].(string)
+		if typ == "" {
+			typ = "info"
+		}
+		return s.wrap(node, "div", ` class="panel panel-`+html.EscapeString(typ)+`"`)
+	case "table":
+		return s.wrap(node, "table", "")
+	case "tableRow":
+		return s.wrap(node, "tr", "")
+	case "tableHeader":
+		return s.wrap(node, "th", cellHTMLAttributes(node))
+	case "tableCell":
+		return s.wrap(node, "td", cellHTMLAttributes(node))
+	case "mediaSingle":
+		return s.wrap(node, "figure", "")
+	case "media":
+		src, _ := node.Attrs["url"].(string)
+		alt, _ := node.Attrs["alt"].(string)
+		s.buf.WriteString(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `">`)
+		return nil
+	case "status":
+		txt, _ := node.Attrs["text"].(string)
+		color, _ := node.Attrs["color"].(string)
+		s.buf.WriteString(`<span class="status status-` + html.EscapeString(color) + `">`)
+		s.buf.WriteString(html.EscapeString(txt))
+		s.buf.WriteString("</span>")
+		return nil
+	case "mention":
+		txt, _ := node.Attrs["text"].(string)
+		s.buf.WriteString(`<span class="mention">` + html.EscapeString(txt) + "</span>")
+		return nil
+	case "date":
+		if ts, ok := node.Attrs["timestamp"].(string); ok {
+			if ms, err := strconv.ParseInt(ts, 10, 64); err == nil {
+				date := time.Unix(ms/1000, 0).Format("2006-01-02")
+				s.buf.WriteString(`<time datetime="` + date + `">` + date + "</time>")
+			}
+		}
+		return nil
+	default:
+		// The unsupported nodes are rendered as their content
+		return s.renderContent(node)
+	}
+}
+
+func (s *htmlSerializer) renderText(node *model.Node) {
+	var closing []string
+	for _, mark := range node.Marks {
+		open, close := markHTML(mark)
+		if open == "" {
+			continue
+		}
+		s.buf.WriteString(open)
+		closing = append(closing, close)
+	}
+	s.buf.WriteString(html.EscapeString(*node.Text))
+	for i := len(closing) - 1; i >= 0; i-- {
+		s.buf.WriteString(closing[i])
+	}
+}
+
+// markHTML returns the opening and closing tags for a mark, or empty strings
+// if the mark has no HTML rendering.
+func markHTML(mark *model.Mark) (string, string) {
+	switch mark.Type.Name {
+	case "em":
+		return "<em>", "</em>"
+	case "strong":
+		return "<strong>", "</strong>"
+	case "code":
+		return "<code>", "</code>"
+	case "strike":
+		return "<s>", "</s>"
+	case "underline":
+		return "<u>", "</u>"
+	case "highlight":
+		return "<mark>", "</mark>"
+	case "subsup":
+		if mark.Attrs["type"] == "sup" {
+			return "<sup>", "</sup>"
+		}
+		return "<sub>", "</sub>"
+	case "textColor":
+		if color, ok := mark.Attrs["color"].(string); ok && htmlColorRegexp.MatchString(color) {
+			return `<span style="color: ` + color + `">`, "</span>"
+		}
+	case "link":
+		if href, ok := mark.Attrs["href"].(string); ok && isSafeHref(href) {
+			if title, ok := mark.Attrs["title"].(string); ok && title != "" {
+				return `<a href="` + html.EscapeString(href) + `" title="` + html.EscapeString(title) + `">`, "</a>"
+			}
+			return `<a href="` + html.EscapeString(href) + `">`, "</a>"
+		}
+	}
+	return "", ""
+}
+
+func isSafeHref(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+func cellHTMLAttributes(node *model.Node) string {
+	var attrs string
+	if span := intAttr(node.Attrs, "colspan", 1); span > 1 {
+		attrs += fmt.Sprintf(` colspan="%d"`, span)
+	}
+	if span := intAttr(node.Attrs, "rowspan", 1); span > 1 {
+		attrs += fmt.Sprintf(` rowspan="%d"`, span)
+	}
+	if color, ok := node.Attrs["background"].(string); ok && htmlColorRegexp.MatchString(color) {
+		attrs += ` style="background-color: ` + color + `"`
+	}
+	return attrs
+}
+
+func intAttr(attrs map[string]interface{}, name string, defaultValue int) int {
+	switch v := attrs[name].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+// htmlBlockTags are the tags that start a new block when an HTML content is
+// parsed. The other tags are inline.
+var htmlBlockTags = map[atom.Atom]bool{
+	atom.Html:       true,
+	atom.Body:       true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.P:          true,
+	atom.Ul:         true,
+	atom.Ol:         true,
+	atom.Li:         true,
+	atom.Blockquote: true,
+	atom.Pre:        true,
+	atom.Hr:         true,
+	atom.Div:        true,
+	atom.Section:    true,
+	atom.Article:    true,
+	atom.Header:     true,
+	atom.Footer:     true,
+	atom.Main:       true,
+	atom.Nav:        true,
+	atom.Aside:      true,
+	atom.Figure:     true,
+	atom.Address:    true,
+	atom.Dl:         true,
+	atom.Dt:         true,
+	atom.Dd:         true,
+	atom.Table:      true,
+	atom.Tr:         true,
+	atom.Td:         true,
+	atom.Th:         true,
+}
+
+var htmlSpacesRegexp = regexp.MustCompile(`[\t\n\f\r ]+`)
+
+// parseHTML returns the document of a note for an HTML content, like the one
+// pasted from a web page. The HTML is sanitized, and then the common tags are
+// mapped to the nodes and marks of the schema.
+func parseHTML(r io.Reader, schema *model.Schema) (*model.Node, error) {
+	root, err := html.Parse(io.LimitReader(r, MaxMarkdownSize))
+	if err != nil {
+		return nil, err
+	}
+	sanitizeHTML(root)
+	p := &htmlParser{schema: schema}
+	blocks, err := p.blocks(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		para, err := schema.Node("paragraph", nil)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, para)
+	}
+	return schema.Node("doc", nil, blocks)
+}
+
+type htmlParser struct {
+	schema *model.Schema
+	marks  []*model.Mark
+}
+
+func isHTMLInline(n *html.Node) bool {
+	switch n.Type {
+	case html.TextNode:
+		return true
+	case html.ElementNode:
+		return !htmlBlockTags[n.DataAtom]
+	}
+	return false
+}
+
+// blocks returns the block nodes for the children of an HTML node. The inline
+// children are grouped in paragraphs.
+func (p *htmlParser) blocks(parent *html.Node) ([]*model.Node, error) {
+	var blocks, inline []*model.Node
+	flush := func() error {
+		inline = normalizeInline(inline)
+		if len(inline) == 0 {
+			return nil
+		}
+		para, err := p.schema.Node("paragraph", nil, inline)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, para)
+		inline = nil
+		return nil
+	}
+
+	for child := parent.FirstChild; child != nil; child = child.NextSibling {
+		if isHTMLInline(child) {
+			inline = append(inline, p.inline(child)...)
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		nodes, err := p.block(child)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, nodes...)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+func (p *htmlParser) block(n *html.Node) ([]*model.Node, error) {
+	if n.Type != html.ElementNode {
+		return nil, nil
+	}
+
+	var node *model.Node
+	var err error
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		attrs := map[string]interface{}{"level": int(n.Data[1] - '0')}
+		node, err = p.schema.Node("heading", attrs, p.inlineContent(n))
+	case atom.P:
+		node, err = p.schema.Node("paragraph", nil, p.inlineContent(n))
+	case atom.Ul, atom.Ol:
+		var items []*model.Node
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode || child.DataAtom != atom.Li {
+				continue
+			}
+			item, err := p.listItem(child)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if len(items) == 0 {
+			return nil, nil
+		}
+		typ := "bulletList"
+		if n.DataAtom == atom.Ol {
+			typ = "orderedList"
+		}
+		node, err = p.schema.Node(typ, nil, items)
+	case atom.Li:
+		// A list item outside of a list
+		item, err := p.listItem(n)
+		if err != nil {
+			return nil, err
+		}
+		node, err = p.schema.Node("bulletList", nil, []*model.Node{item})
+		if err != nil {
+			return nil, err
+		}
+	case atom.Blockquote:
+		blocks, err := p.blocks(n)
+		if err != nil {
+			return nil, err
+		}
+		paragraphs, err := p.toParagraphs(blocks)
+		if err != nil {
+			return nil, err
+		}
+		node, err = p.schema.Node("blockquote", nil, paragraphs)
+		if err != nil {
+			return nil, err
+		}
+	case atom.Pre:
+		node, err = p.codeBlock(n)
+	case atom.Hr:
+		node, err = p.schema.Node("rule", nil)
+	default:
+		return p.blocks(n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*model.Node{node}, nil
+}
+
+// listItem returns a listItem node. Its content must start with a paragraph
+// or a code block, and it can only have paragraphs, code blocks and lists.
+func (p *htmlParser) listItem(li *html.Node) (*model.Node, error) {
+	blocks, err := p.blocks(li)
+	if err != nil {
+		return nil, err
+	}
+	var content []*model.Node
+	for _, block := range blocks {
+		switch block.Type.Name {
+		case "paragraph", "codeBlock", "bulletList", "orderedList":
+			content = append(content, block)
+		default:
+			paragraphs, err := p.toParagraphs([]*model.Node{block})
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, paragraphs...)
+		}
+	}
+	if len(content) == 0 || (content[0].Type.Name != "paragraph" && content[0].Type.Name != "codeBlock") {
+		para, err := p.schema.Node("paragraph", nil)
+		if err != nil {
+			return nil, err
+		}
+		content = append([]*model.Node{para}, content...)
+	}
+	return p.schema.Node("listItem", nil, content)
+}
+
+// toParagraphs converts the blocks to paragraphs, for the nodes that can only
+// have paragraphs as children.
+func (p *htmlParser) toParagraphs(blocks []*model.Node) ([]*model.Node, error) {
+	var paragraphs []*model.Node
+	for _, block := range blocks {
+		switch {
+		case block.Type.Name == "paragraph":
+			paragraphs = append(paragraphs, block)
+		case block.Type.InlineContent:
+			para, err := p.schema.Node("paragraph", nil, block.Content)
+			if err != nil {
+				return nil, err
+			}
+			paragraphs = append(paragraphs, para)
+		default:
+			children, err := p.toParagraphs(block.Content.Content)
+			if err != nil {
+				return nil, err
+			}
+			paragraphs = append(paragraphs, children...)
+		}
+	}
+	if len(paragraphs) == 0 {
+		para, err := p.schema.Node("paragraph", nil)
+		if err != nil {
+			return nil, err
+		}
+		paragraphs = append(paragraphs, para)
+	}
+	return paragraphs, nil
+}
+
+func (p *htmlParser) codeBlock(pre *html.Node) (*model.Node, error) {
+	var attrs map[string]interface{}
+	for child := pre.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.DataAtom != atom.Code {
+			continue
+		}
+		for _, class := range strings.Fields(htmlAttr(child, "class")) {
+			if lang := strings.TrimPrefix(class, "language-"); lang != class && lang != "" {
+				attrs = map[string]interface{}{"language": lang}
+			}
+		}
+	}
+	var content []*model.Node
+	if text := strings.TrimSuffix(htmlText(pre), "\n"); text != "" {
+		content = append(content, p.schema.Text(text))
+	}
+	return p.schema.Node("codeBlock", attrs, content)
+}
+
+func (p *htmlParser) inlineContent(n *html.Node) []*model.Node {
+	var nodes []*model.Node
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		nodes = append(nodes, p.inline(child)...)
+	}
+	return normalizeInline(nodes)
+}
+
+// inline returns the inline nodes for an HTML node. The block tags inside an
+// inline context are replaced by their content.
+func (p *htmlParser) inline(n *html.Node) []*model.Node {
+	switch n.Type {
+	case html.TextNode:
+		text := htmlSpacesRegexp.ReplaceAllString(n.Data, " ")
+		if text == "" {
+			return nil
+		}
+		return []*model.Node{p.schema.Text(text, p.marks)}
+	case html.ElementNode:
+	default:
+		return nil
+	}
+
+	if n.DataAtom == atom.Br {
+		if br, err := p.schema.Node("hardBreak", nil); err == nil {
+			return []*model.Node{br}
+		}
+		return nil
+	}
+
+	saved := p.marks
+	defer func() { p.marks = saved }()
+	if mark := p.mark(n); mark != nil {
+		p.marks = mark.AddToSet(p.marks)
+	}
+	var nodes []*model.Node
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		nodes = append(nodes, p.inline(child)...)
+	}
+	return nodes
+}
+
+func (p *htmlParser) mark(n *html.Node) *model.Mark {
+	var name string
+	var attrs map[string]interface{}
+	switch n.DataAtom {
+	case atom.Strong, atom.B:
+		name = "strong"
+	case atom.Em, atom.I:
+		name = "em"
+	case atom.Code, atom.Kbd, atom.Samp:
+		name = "code"
+	case atom.S, atom.Del, atom.Strike:
+		name = "strike"
+	case atom.U, atom.Ins:
+		name = "underline"
+	case atom.Mark:
+		return highlightMark(p.schema)
+	case atom.Sub, atom.Sup:
+		name = "subsup"
+		attrs = map[string]interface{}{"type": n.Data}
+	case atom.A:
+		href := htmlAttr(n, "href")
+		if href == "" {
+			return nil
+		}
+		name = "link"
+		attrs = map[string]interface{}{"href": href}
+		if title := htmlAttr(n, "title"); title != "" {
+			attrs["title"] = title
+		}
+	default:
+		return nil
+	}
+	return p.schema.Mark(name, attrs)
+}
+
+// normalizeInline collapses the spaces between the inline nodes, trims the
+// spaces at the boundaries, and joins the adjacent text nodes with the same
+// marks.
+func normalizeInline(nodes []*model.Node) []*model.Node {
+	var result []*model.Node
+	for _, node := range nodes {
+		if node.IsText() {
+			text := *node.Text
+			if len(result) == 0 || endsWithSpace(result[len(result)-1]) {
+				text = strings.TrimLeft(text, " ")
+			}
+			if text == "" {
+				continue
+			}
+			node = node.WithText(text)
+			if len(result) > 0 {
+				last := result[len(result)-1]
+				if last.IsText() && last.SameMarkup(node) {
+					result[len(result)-1] = last.WithText(*last.Text + text)
+					continue
+				}
+			}
+		}
+		result = append(result, node)
+	}
+
+	for len(result) > 0 {
+		last := result[len(result)-1]
+		if !last.IsText() {
+			break
+		}
+		if text := strings.TrimRight(*last.Text, " "); text != "" {
+			result[len(result)-1] = last.WithText(text)
+			break
+		}
+		result = result[:len(result)-1]
+	}
+	return result
+}
+
+func endsWithSpace(node *model.Node) bool {
+	if node.IsText() {
+		return strings.HasSuffix(*node.Text, " ")
+	}
+	return node.Type.Name == "hardBreak"
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Namespace == "" && attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// htmlText returns the raw text of an HTML node, with its spaces preserved.
+func htmlText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var buf strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		buf.WriteString(htmlText(child))
+	}
+	return buf.String()
+}
@@ -6,21 +6,73 @@ import (
 	"errors"
 	"io"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/filetype"
 	"github.com/cozy/prosemirror-go/markdown"
 	"github.com/cozy/prosemirror-go/model"
 	"github.com/gofrs/uuid/v5"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
 )
 
-// MaxMarkdownSize is the maximal size of a markdown that can be parsed.
+// MaxMarkdownSize is the maximal size of a markdown that can be parsed. It is
+// a hard upper bound: the configured limit can lower it, but not raise it.
 const MaxMarkdownSize = 2 * 1024 * 1024
 
+// Limits are the maximal sizes of a note that can be parsed, to avoid using
+// too much memory for a pathologically large note.
+type Limits struct {
+	// MaxSize is the maximal size of the markdown, in bytes. 0 means
+	// MaxMarkdownSize, and a larger value is capped to MaxMarkdownSize.
+	MaxSize int64
+	// MaxNodes is the maximal number of nodes in the markdown, counted while
+	// parsing. 0 means no limit.
+	MaxNodes int
+}
+
+// ParseOptions are the options for parsing the markdown of a note.
+type ParseOptions struct {
+	Limits
+	// Linkify converts the bare URLs and email addresses of the texts to
+	// links. It is disabled by default, to not change the existing notes, and
+	// can be enabled for the imports with notes.linkify in the config.
+	Linkify bool
+	// Emojis is the table from the shortcodes, like smile, to the emojis.
+	// The shortcodes of the texts, like :smile:, are converted to their
+	// emojis. It is nil by default, to not change the existing notes, and
+	// DefaultEmojis is used for the imports with notes.emojis in the config.
+	Emojis map[string]string
+}
+
+// getLimits returns the limits for the notes from the configuration.
+func getLimits() Limits {
+	cfg := config.GetConfig()
+	if cfg == nil {
+		return Limits{MaxSize: MaxMarkdownSize}
+	}
+	return Limits{MaxSize: cfg.Notes.MaxSize, MaxNodes: cfg.Notes.MaxNodes}
+}
+
+// getParseOptions returns the options for parsing the imported notes from
+// the configuration.
+func getParseOptions() ParseOptions {
+	opts := ParseOptions{Limits: getLimits()}
+	if cfg := config.GetConfig(); cfg != nil {
+		opts.Linkify = cfg.Notes.Linkify
+		if cfg.Notes.Emojis {
+			opts.Emojis = DefaultEmojis
+		}
+	}
+	return opts
+}
+
 func ImportFile(inst *instance.Instance, newdoc, olddoc *vfs.FileDoc, body io.ReadCloser) error {
 	schemaSpecs := DefaultSchemaSpecs()
 	specs := model.SchemaSpecFromJSON(schemaSpecs)
@@ -43,10 +95,18 @@ func ImportFile(inst *instance.Instance, newdoc, olddoc *vfs.FileDoc, body io.Re
 	}
 
 	reader := io.TeeReader(body, file)
-	content, err := importReader(inst, newdoc, reader, schema)
+	content, frontmatter, err := importReader(inst, newdoc, reader, schema)
 
+	if errors.Is(err, ErrNoteTooLarge) {
+		// The note is rejected, and not saved as a plain file
+		if f, ok := file.(vfs.AbortableFile); ok {
+			f.Abort(err)
+		}
+		_ = file.Close()
+		return err
+	}
 	if content != nil {
-		fillMetadata(newdoc, olddoc, schemaSpecs, content)
+		fillMetadata(newdoc, olddoc, schemaSpecs, content, frontmatter)
 	} else {
 		_, _ = io.Copy(io.Discard, reader)
 		inst.Logger().WithNamespace("notes").
@@ -67,12 +127,12 @@ func ImportFile(inst *instance.Instance, newdoc, olddoc *vfs.FileDoc, body io.Re
 	return nil
 }
 
-func importReader(inst *instance.Instance, doc *vfs.FileDoc, reader io.Reader, schema *model.Schema) (*model.Node, error) {
+func importReader(inst *instance.Instance, doc *vfs.FileDoc, reader io.Reader, schema *model.Schema) (*model.Node, map[string]interface{}, error) {
 	buf := &bytes.Buffer{}
 	var hasImages bool
 	if _, err := io.CopyN(buf, reader, 512); err != nil {
 		if !errors.Is(err, io.EOF) {
-			return nil, err
+			return nil, nil, err
 		}
 		hasImages = false
 	} else {
@@ -81,12 +141,13 @@ func importReader(inst *instance.Instance, doc *vfs.FileDoc, reader io.Reader, s
 
 	if !hasImages {
 		if _, err := buf.ReadFrom(reader); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return parseFile(buf, schema)
+		return parseFileWithMetadata(buf, schema, getParseOptions())
 	}
 
 	var content *model.Node
+	var frontmatter map[string]interface{}
 	var err error
 	var images []*Image
 	defer func() {
@@ -99,15 +160,15 @@ func importReader(inst *instance.Instance, doc *vfs.FileDoc, reader io.Reader, s
 	for {
 		header, errh := tr.Next()
 		if errh != nil {
-			return content, err
+			return content, frontmatter, err
 		}
 		if header.Typeflag != tar.TypeReg {
 			continue
 		}
 		if header.Name == "index.md" {
-			content, err = parseFile(tr, schema)
+			content, frontmatter, err = parseFileWithMetadata(tr, schema, getParseOptions())
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 		} else {
 			ext := path.Ext(header.Name)
@@ -145,7 +206,7 @@ func fixURLForProsemirrorImages(node *model.Node, images []*Image) {
 	})
 }
 
-func fillMetadata(newdoc, olddoc *vfs.FileDoc, schemaSpecs map[string]interface{}, content *model.Node) {
+func fillMetadata(newdoc, olddoc *vfs.FileDoc, schemaSpecs map[string]interface{}, content *model.Node, frontmatter map[string]interface{}) {
 	version := 1
 	if olddoc != nil {
 		rev := strings.Split(olddoc.DocRev, "-")[0]
@@ -161,18 +222,227 @@ func fillMetadata(newdoc, olddoc *vfs.FileDoc, schemaSpecs map[string]interface{
 		"version": version,
 		"schema":  schemaSpecs,
 	}
+	if len(frontmatter) > 0 {
+		newdoc.Metadata["frontmatter"] = frontmatter
+	}
 }
 
 func parseFile(r io.Reader, schema *model.Schema) (*model.Node, error) {
-	buf, err := io.ReadAll(io.LimitReader(r, MaxMarkdownSize))
+	return parseFileWithOptions(r, schema, getParseOptions())
+}
+
+// parseFileWithOptions parses a markdown content like parseFile, but with the
+// given options. It returns ErrNoteTooLarge if the content exceeds the limits.
+func parseFileWithOptions(r io.Reader, schema *model.Schema, opts ParseOptions) (*model.Node, error) {
+	doc, _, err := parseFileWithMetadata(r, schema, opts)
+	return doc, err
+}
+
+// parseFileWithMetadata parses a markdown content like parseFileWithOptions,
+// and returns the metadata of its YAML frontmatter too. The metadata is nil
+// if the markdown has no frontmatter.
+func parseFileWithMetadata(r io.Reader, schema *model.Schema, opts ParseOptions) (*model.Node, map[string]interface{}, error) {
+	buf, err := readMarkdown(r, opts.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata, buf := splitFrontmatter(buf)
+	doc, err := parseMarkdown(buf, schema, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, metadata, nil
+}
+
+// readMarkdown reads a markdown content, and returns ErrNoteTooLarge if it is
+// larger than the limit.
+func readMarkdown(r io.Reader, limits Limits) ([]byte, error) {
+	maxSize := limits.MaxSize
+	if maxSize <= 0 || maxSize > MaxMarkdownSize {
+		maxSize = MaxMarkdownSize
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, maxSize+1))
 	if err != nil {
 		return nil, err
 	}
-	parser := markdownParser()
-	funcs := markdownNodeMapper()
+	if int64(len(buf)) > maxSize {
+		return nil, ErrNoteTooLarge
+	}
+	return buf, nil
+}
+
+// parseMarkdown builds the document for a markdown content, with the given
+// options.
+func parseMarkdown(buf []byte, schema *model.Schema, opts ParseOptions) (*model.Node, error) {
+	parser, funcs := markdownParserWithOptions(opts)
 	return markdown.ParseMarkdown(parser, funcs, buf, schema)
 }
 
+// markdownParserWithOptions returns the markdown parser and the node mapper
+// for the given options. The nodes are counted by the node mapper, so it must
+// be used for a single note.
+func markdownParserWithOptions(opts ParseOptions) (parser.Parser, markdown.NodeMapper) {
+	mdParser := markdownParser()
+	if opts.Linkify {
+		mdParser.AddOptions(withLinkify())
+	}
+	if opts.Emojis != nil {
+		mdParser.AddOptions(withEmojis(opts.Emojis))
+	}
+	funcs := markdownNodeMapper()
+	if opts.MaxNodes > 0 {
+		funcs = limitNodes(funcs, opts.MaxNodes)
+	}
+	return mdParser, funcs
+}
+
+// limitNodes wraps the funcs of a node mapper to count the markdown nodes as
+// they are parsed, and to stop the parsing with ErrNoteTooLarge as soon as
+// there are more than max nodes, including the document itself.
+func limitNodes(funcs markdown.NodeMapper, max int) markdown.NodeMapper {
+	count := 0
+	limited := make(markdown.NodeMapper, len(funcs))
+	for kind, fn := range funcs {
+		fn := fn
+		limited[kind] = func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			if entering {
+				count++
+				if count > max {
+					return ErrNoteTooLarge
+				}
+			}
+			return fn(state, node, entering)
+		}
+	}
+	return limited
+}
+
+// parseFileBlocks parses a markdown content like parseFileWithOptions, but
+// without building the whole document, for the large notes: the content is
+// split in chunks at the blank lines between the top-level blocks, and fn is
+// called for each block of a chunk as soon as the chunk is parsed. The limits
+// apply to the whole content, and ErrNoteTooLarge is returned if it exceeds
+// them.
+//
+// The link reference definitions apply to the whole document, and a link can
+// use a definition that comes after it. So, the content is parsed in a single
+// chunk when it has such a definition.
+func parseFileBlocks(r io.Reader, schema *model.Schema, opts ParseOptions, fn func(block *model.Node) error) error {
+	buf, err := readMarkdown(r, opts.Limits)
+	if err != nil {
+		return err
+	}
+
+	// The nodes of all the chunks are counted together
+	parser, funcs := markdownParserWithOptions(opts)
+	parse := func(chunk []byte) error {
+		if len(bytes.TrimSpace(chunk)) == 0 {
+			return nil
+		}
+		doc, err := markdown.ParseMarkdown(parser, funcs, chunk, schema)
+		if err != nil {
+			return err
+		}
+		for _, block := range doc.Content.Content {
+			if err := fn(block); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var splitter chunkSplitter
+	var boundaries []int
+	for pos := 0; pos < len(buf); {
+		end := len(buf)
+		if i := bytes.IndexByte(buf[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		line := buf[pos:end]
+		if splitter.isBoundary(line) {
+			boundaries = append(boundaries, pos)
+		}
+		if splitter.fenceLen == 0 && linkDefinitionRegexp.Match(line) {
+			return parse(buf)
+		}
+		pos = end
+	}
+
+	start := 0
+	for _, boundary := range boundaries {
+		if err := parse(buf[start:boundary]); err != nil {
+			return err
+		}
+		start = boundary
+	}
+	return parse(buf[start:])
+}
+
+// linkDefinitionRegexp matches the lines that can be a link reference
+// definition, like `[label]: https://example.org/`, including in a quote or a
+// list item. A few other lines can match, but it only prevents the split.
+var linkDefinitionRegexp = regexp.MustCompile(`^[ \t>]*\[(?:[^\]\\]|\\.)+\]:`)
+
+// chunkSplitter finds the lines of a markdown content that start a new
+// top-level block, and where the content can be split without changing how
+// the blocks are parsed.
+type chunkSplitter struct {
+	afterBlank bool
+	inTable    bool
+	fenceChar  byte
+	fenceLen   int
+}
+
+func (s *chunkSplitter) isBoundary(line []byte) bool {
+	blank := len(bytes.TrimSpace(line)) == 0
+	boundary := s.afterBlank && !blank && !s.inTable && s.fenceLen == 0 &&
+		line[0] != ' ' && line[0] != '\t' && !isListMarker(line)
+	if !blank {
+		s.afterBlank = false
+	} else if s.fenceLen == 0 {
+		s.afterBlank = true
+	}
+
+	trimmed := bytes.TrimLeft(line, " \t")
+	if s.fenceLen == 0 {
+		switch {
+		case bytes.Contains(trimmed, []byte("{.tableEnd}")) && bytes.HasPrefix(trimmed, []byte("__________")):
+			s.inTable = false
+		case bytes.Contains(trimmed, []byte("{.table")) && bytes.HasPrefix(trimmed, []byte("__________")):
+			s.inTable = true
+		case bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")):
+			s.fenceChar = trimmed[0]
+			s.fenceLen = fenceLength(trimmed)
+		}
+	} else if trimmed := bytes.TrimSpace(trimmed); len(trimmed) > 0 && trimmed[0] == s.fenceChar &&
+		fenceLength(trimmed) >= s.fenceLen && fenceLength(trimmed) == len(trimmed) {
+		s.fenceLen = 0
+	}
+	return boundary
+}
+
+func fenceLength(line []byte) int {
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	return n
+}
+
+// isListMarker returns true if the line starts with the marker of an item of
+// a list, like "- " or "1. ".
+func isListMarker(line []byte) bool {
+	if len(line) >= 2 && (line[0] == '-' || line[0] == '*' || line[0] == '+') && (line[1] == ' ' || line[1] == '\t' || line[1] == '\n') {
+		return true
+	}
+	i := 0
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	return i > 0 && i+1 < len(line) && (line[i] == '.' || line[i] == ')') &&
+		(line[i+1] == ' ' || line[i+1] == '\t' || line[i+1] == '\n')
+}
+
 func isTar(buf []byte) bool {
 	if len(buf) < 263 {
 		return false
@@ -1,8 +1,12 @@
 package note
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/model/note/custom"
@@ -15,7 +19,17 @@ import (
 	"github.com/yuin/goldmark/util"
 )
 
-func markdownSerializer(images []*Image) *markdown.Serializer {
+// SerializerOverrides are the serializers for some node and mark types that
+// replace the default serializers of the markdown export, or complete them
+// for new types.
+type SerializerOverrides struct {
+	Nodes map[string]markdown.NodeSerializerFunc
+	Marks map[string]markdown.MarkSerializerSpec
+}
+
+// markdownSerializer returns the serializer for the markdown export of the
+// notes. The overrides can be nil to use only the default serializers.
+func markdownSerializer(images []*Image, overrides *SerializerOverrides) *markdown.Serializer {
 	vanilla := markdown.DefaultSerializer
 	nodes := map[string]markdown.NodeSerializerFunc{
 		"paragraph": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
@@ -32,7 +46,7 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 			state.RenderInline(node)
 			state.CloseBlock(node)
 		},
-		"text":        vanilla.Nodes["text"],
+		"text":        serializeText,
 		"bulletList":  vanilla.Nodes["bullet_list"],
 		"orderedList": vanilla.Nodes["ordered_list"],
 		"listItem":    vanilla.Nodes["list_item"],
@@ -45,7 +59,13 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 		},
 		"decisionItem": vanilla.Nodes["list_item"],
 		"taskList": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
-			state.RenderList(node, "  ", func(_ int) string { return "- " })
+			state.RenderList(node, "  ", func(i int) string {
+				// A nested taskList is a sibling of the taskItem it belongs to
+				if child, err := node.Child(i); err == nil && child.Type.Name == "taskList" {
+					return "  "
+				}
+				return "- "
+			})
 		},
 		"taskItem": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			if node.Attrs["state"] == "DONE" {
@@ -62,10 +82,12 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 		"image":      vanilla.Nodes["image"],
 		"codeBlock": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			lang, _ := node.Attrs["language"].(string)
-			state.Write("```" + lang + "\n")
-			state.Text(node.TextContent(), false)
+			content := node.TextContent()
+			fence := codeFence(content)
+			state.Write(fence + lang + "\n")
+			state.Text(content, false)
 			state.EnsureNewLine()
-			state.Write("```")
+			state.Write(fence)
 			state.CloseBlock(node)
 		},
 		"panel": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
@@ -75,6 +97,11 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 			state.RenderContent(node)
 		},
 		"table": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+			if rows, aligns, ok := pipeTable(state, node); ok {
+				writePipeTable(state, rows, aligns)
+				state.CloseBlock(node)
+				return
+			}
 			var attrs string
 			if node.Attrs["layout"] == "wide" {
 				attrs += ` layout="wide"`
@@ -127,11 +154,26 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 				}
 			}
 		},
+		"mention": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+			txt, _ := node.Attrs["text"].(string)
+			if !strings.HasPrefix(txt, "@") {
+				txt = "@" + txt
+			}
+			// The id is kept only if the mention has been resolved
+			if id, _ := node.Attrs["id"].(string); id != "" {
+				state.Write("[")
+				state.Text(txt)
+				state.Write("]")
+				state.Text(fmt.Sprintf(`{.mention id="%s"}`, escapeAttribute(id)), false)
+				return
+			}
+			state.Text(txt, false)
+		},
 		"mediaSingle": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			state.RenderContent(node)
 		},
 		"media": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
-			var alt string
+			alt, _ := node.Attrs["alt"].(string)
 			src, _ := node.Attrs["url"].(string)
 			for _, img := range images {
 				if img.DocID == src {
@@ -145,18 +187,46 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 	marks := map[string]markdown.MarkSerializerSpec{
 		"em":          vanilla.Marks["em"],
 		"strong":      vanilla.Marks["strong"],
-		"link":        vanilla.Marks["link"],
-		"code":        vanilla.Marks["code"],
-		"strike":      {Open: "~~", Close: "~~", ExpelEnclosingWhitespace: true},
+		"strike":      {Open: "~~", Close: "~~", Mixable: true, ExpelEnclosingWhitespace: true},
 		"indentation": {Open: "    ", Close: "", ExpelEnclosingWhitespace: true},
 		"breakout":    {Open: "", Close: "", ExpelEnclosingWhitespace: true},
 		"underline":   {Open: "[", Close: "]{.underlined}", ExpelEnclosingWhitespace: true},
-		"subsup": {
-			Open: "[",
+		"highlight":   {Open: "==", Close: "==", Mixable: true, ExpelEnclosingWhitespace: true},
+		"code": {
+			Open: func(state *markdown.SerializerState, mark *model.Mark, parent *model.Node, index int) string {
+				child, err := parent.Child(index)
+				if err != nil || !child.IsText() {
+					return "`"
+				}
+				ticks, padding := codeSpanDelimiters(*child.Text)
+				return ticks + padding
+			},
 			Close: func(state *markdown.SerializerState, mark *model.Mark, parent *model.Node, index int) string {
-				typ, _ := mark.Attrs["type"].(string)
-				return fmt.Sprintf("]{.%s}", typ)
+				child, err := parent.Child(index - 1)
+				if err != nil || !child.IsText() {
+					return "`"
+				}
+				ticks, padding := codeSpanDelimiters(*child.Text)
+				return padding + ticks
+			},
+			NoEscape: true,
+		},
+		"link": {
+			Open: func(state *markdown.SerializerState, mark *model.Mark, parent *model.Node, index int) string {
+				state.InAutoLink = isAutolink(mark, parent, index)
+				if state.InAutoLink {
+					return "<"
+				}
+				return "["
 			},
+			Close:   vanilla.Marks["link"].Close,
+			Mixable: true,
+		},
+		"subsup": {
+			Open:                     subSupDelimiter,
+			Close:                    subSupDelimiter,
+			Mixable:                  true,
+			ExpelEnclosingWhitespace: true,
 		},
 		"textColor": {
 			Open: "[",
@@ -166,9 +236,218 @@ func markdownSerializer(images []*Image) *markdown.Serializer {
 			},
 		},
 	}
+	if overrides != nil {
+		for name, fn := range overrides.Nodes {
+			nodes[name] = fn
+		}
+		for name, spec := range overrides.Marks {
+			marks[name] = spec
+		}
+	}
 	return markdown.NewSerializer(nodes, marks)
 }
 
+// isAutolink returns true if a link can be written as an autolink, like
+// <https://cozy.io/> or <contact@cozy.io>: its text is its URL, or its email
+// address for a mailto: link.
+func isAutolink(link *model.Mark, parent *model.Node, index int) bool {
+	if title, ok := link.Attrs["title"].(string); ok && title != "" {
+		return false
+	}
+	href, _ := link.Attrs["href"].(string)
+	content, err := parent.Child(index)
+	if err != nil || !content.IsText() || content.Marks[len(content.Marks)-1] != link {
+		return false
+	}
+	text := *content.Text
+	switch {
+	case strings.HasPrefix(href, "mailto:"):
+		if href != "mailto:"+text || !strings.Contains(text, "@") {
+			return false
+		}
+	case !strings.Contains(href, ":") || href != text:
+		return false
+	}
+	next := parent.MaybeChild(index + 1)
+	return next == nil || !link.IsInSet(next.Marks)
+}
+
+func subSupDelimiter(state *markdown.SerializerState, mark *model.Mark, parent *model.Node, index int) string {
+	if mark.Attrs["type"] == "sup" {
+		return "^"
+	}
+	return "~"
+}
+
+func serializeText(state *markdown.SerializerState, node, parent *model.Node, index int) {
+	// The markers of panels and decisions are escaped at the start of a
+	// block, as they are not escaped by state.Text
+	if index == 0 && len(node.Marks) == 0 && blockMarkerRegexp.MatchString(*node.Text) {
+		state.Write("\\")
+	}
+	if !state.InAutoLink {
+		_, err := node.Type.Schema.NodeType("mention")
+		writeEscapedText(state, *node.Text, err == nil)
+		return
+	}
+	markdown.DefaultSerializer.Nodes["text"](state, node, parent, index)
+}
+
+// writeEscapedText writes a text like state.Text, but it also escapes the
+// carets, as they are used for the superscripts, the == that would start or
+// end a highlight, and with mentions, the @ that would start a mention. The
+// schemas without the mention node import the mentions as texts, so their @
+// are not escaped.
+func writeEscapedText(state *markdown.SerializerState, text string, mentions bool) {
+	start := 0
+	before := ' '
+	for i, c := range text {
+		if c == '^' || (mentions && c == '@' && custom.MentionLength(before, []byte(text[i:])) > 0) ||
+			(c == '=' && isHighlightDelimiter(text, i)) {
+			state.Text(text[start:i])
+			state.Write("\\" + string(c))
+			start = i + 1
+		}
+		before = c
+	}
+	state.Text(text[start:])
+}
+
+// isHighlightDelimiter returns true if the = at index i of the text is in a
+// run of at least two = that can open or close a highlight, ie that is not
+// surrounded by spaces (the text can be next to another node or mark, so its
+// boundaries are not spaces). Every = of the run is escaped, so that no run
+// of two = is left.
+func isHighlightDelimiter(text string, i int) bool {
+	first := i
+	for first > 0 && text[first-1] == '=' {
+		first--
+	}
+	last := i
+	for last < len(text)-1 && text[last+1] == '=' {
+		last++
+	}
+	if last == first {
+		return false
+	}
+	spaceBefore := first > 0 && isSpaceByte(text[first-1])
+	spaceAfter := last < len(text)-1 && isSpaceByte(text[last+1])
+	return !spaceBefore || !spaceAfter
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// highlightColor is the color of the highlighted texts for the schemas that
+// don't have the highlight mark, like the ones of the notes created before
+// it: they have no background color for the texts, so the highlighted texts
+// are written in the orange of the palette of the editor.
+const highlightColor = "#ff991f"
+
+// highlightMark returns the mark for a highlighted text (==text== in
+// markdown, or <mark> in HTML): the highlight mark if the schema has it, or
+// else a text color.
+func highlightMark(schema *model.Schema) *model.Mark {
+	if typ, err := schema.MarkType("highlight"); err == nil {
+		return typ.Create(nil)
+	}
+	return schema.Mark("textColor", map[string]interface{}{"color": highlightColor})
+}
+
+// blockMarkerRegexp matches the texts that start like a panel or a decision.
+var blockMarkerRegexp = regexp.MustCompile(`^(:[a-z]+:|✍) `)
+
+// preserveUnknownTypes completes the serializer for the node and mark types of
+// the schema that it doesn't know, like the types added by a newer version of
+// the editor. The unknown marks are written as spans with their name and
+// attributes, so that they can be parsed back, and the content of the unknown
+// nodes is kept.
+func preserveUnknownTypes(serializer *markdown.Serializer, schema *model.Schema) *markdown.Serializer {
+	for _, typ := range schema.Marks {
+		if _, ok := serializer.Marks[typ.Name]; ok {
+			continue
+		}
+		serializer.Marks[typ.Name] = markdown.MarkSerializerSpec{
+			Open:                     "[",
+			Close:                    unknownMarkClose,
+			ExpelEnclosingWhitespace: true,
+		}
+	}
+	for _, typ := range schema.Nodes {
+		if _, ok := serializer.Nodes[typ.Name]; ok {
+			continue
+		}
+		serializer.Nodes[typ.Name] = func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+			switch {
+			case node.Type.InlineContent:
+				state.RenderInline(node)
+				if node.IsBlock() {
+					state.CloseBlock(node)
+				}
+			case node.IsBlock():
+				state.RenderContent(node)
+			}
+		}
+	}
+	return serializer
+}
+
+func unknownMarkClose(state *markdown.SerializerState, mark *model.Mark, parent *model.Node, index int) string {
+	close := fmt.Sprintf(`]{.mark name="%s"`, escapeAttribute(mark.Type.Name))
+	if len(mark.Attrs) > 0 {
+		if attrs, err := json.Marshal(mark.Attrs); err == nil {
+			close += fmt.Sprintf(` attrs="%s"`, escapeAttribute(string(attrs)))
+		}
+	}
+	return close + "}"
+}
+
+// escapeAttribute escapes a value for the attributes of a span.
+func escapeAttribute(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+// codeFence returns the fence for a code block: it must be longer than the
+// sequences of backticks inside the code.
+func codeFence(content string) string {
+	longest := longestBackticks(content)
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// codeSpanDelimiters returns the backticks and the padding around an inline
+// code. The backticks must be longer than the sequences of backticks inside
+// the code, and a space is added on each side when the code has a backtick or
+// starts and ends with a space, as the parser strips them.
+func codeSpanDelimiters(code string) (string, string) {
+	longest := longestBackticks(code)
+	padding := ""
+	if longest > 0 || (len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "") {
+		padding = " "
+	}
+	return strings.Repeat("`", longest+1), padding
+}
+
+func longestBackticks(content string) int {
+	longest, current := 0, 0
+	for _, c := range content {
+		if c == '`' {
+			current++
+			if current > longest {
+				longest = current
+			}
+		} else {
+			current = 0
+		}
+	}
+	return longest
+}
+
 func cellMarkup(node *model.Node) string {
 	var attrs string
 	if color, ok := node.Attrs["background"].(string); ok && color[0] == '#' {
@@ -183,6 +462,122 @@ func cellMarkup(node *model.Node) string {
 	return attrs
 }
 
+// pipeTable returns the content of the cells and the alignments of the
+// columns of a table that can be written as a GFM pipe table: a row of headers
+// followed by rows of cells, where each cell has a single paragraph and no
+// background or span. The other tables are written with our own syntax.
+func pipeTable(state *markdown.SerializerState, node *model.Node) ([][]string, []string, bool) {
+	if layout, ok := node.Attrs["layout"].(string); ok && layout != "default" {
+		return nil, nil, false
+	}
+	if node.Attrs["isNumberColumnEnabled"] == true {
+		return nil, nil, false
+	}
+
+	var rows [][]string
+	var aligns []string
+	for i, row := range node.Content.Content {
+		if i > 0 && row.ChildCount() != len(aligns) {
+			return nil, nil, false
+		}
+		cells := make([]string, 0, row.ChildCount())
+		for j, cell := range row.Content.Content {
+			isHeader := cell.Type.Name == "tableHeader"
+			if isHeader != (i == 0) || !isSimpleCell(cell) {
+				return nil, nil, false
+			}
+			paragraph := cell.Content.Content[0]
+			align := paragraphAlignment(paragraph)
+			if i == 0 {
+				aligns = append(aligns, align)
+			} else if align != aligns[j] {
+				return nil, nil, false
+			}
+			inline := markdown.NewSerializerState(state.Nodes, state.Marks, nil)
+			inline.RenderInline(paragraph)
+			if strings.Contains(inline.Out, "\n") {
+				return nil, nil, false
+			}
+			cells = append(cells, strings.ReplaceAll(inline.Out, "|", "\\|"))
+		}
+		rows = append(rows, cells)
+	}
+	return rows, aligns, len(rows) > 0
+}
+
+func isSimpleCell(cell *model.Node) bool {
+	if cell.Attrs["background"] != nil {
+		return false
+	}
+	for _, span := range []string{"colspan", "rowspan"} {
+		switch n := cell.Attrs[span].(type) {
+		case nil:
+		case int:
+			if n > 1 {
+				return false
+			}
+		case float64:
+			if n > 1 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return cell.ChildCount() == 1 && cell.Content.Content[0].Type.Name == "paragraph"
+}
+
+func paragraphAlignment(paragraph *model.Node) string {
+	for _, mark := range paragraph.Marks {
+		if mark.Type.Name == "alignment" {
+			align, _ := mark.Attrs["align"].(string)
+			return align
+		}
+	}
+	return ""
+}
+
+func writePipeTable(state *markdown.SerializerState, rows [][]string, aligns []string) {
+	delimiters := make([]string, len(aligns))
+	for i, align := range aligns {
+		switch align {
+		case "center":
+			delimiters[i] = ":---:"
+		case "end":
+			delimiters[i] = "---:"
+		default:
+			delimiters[i] = "---"
+		}
+	}
+	lines := make([][]string, 0, len(rows)+1)
+	lines = append(lines, rows[0], delimiters)
+	lines = append(lines, rows[1:]...)
+	for i, cells := range lines {
+		if i > 0 {
+			state.EnsureNewLine()
+		}
+		state.Write("| " + strings.Join(cells, " | ") + " |")
+	}
+}
+
+func hasCodeMark(node *model.Node) bool {
+	for _, mark := range node.Marks {
+		if mark.Type.Name == "code" {
+			return true
+		}
+	}
+	return false
+}
+
+func isInBlockquote(node ast.Node) bool {
+	for parent := node.Parent(); parent != nil; parent = parent.Parent() {
+		if parent.Kind() == ast.KindBlockquote {
+			return true
+		}
+	}
+	return false
+}
+
 func isTableCell(item *markdown.StackItem) bool {
 	name := item.Type.Name
 	return name == "tableHeader" || name == "tableCell"
@@ -264,24 +659,43 @@ func markdownNodeMapper() markdown.NodeMapper {
 					state.OpenNode(typ, nil)
 					return nil
 				} else {
-					// taskItem have their content directly inside them, no paragraphs
+					// taskItem have their content directly inside them, no
+					// paragraphs, and the nested taskList are put after them
 					item := state.Top()
-					paragraphs := item.Content
+					children := item.Content
 					item.Content = nil
-					for _, paragraph := range paragraphs {
-						item.Content = append(item.Content, paragraph.Content.Content...)
+					var nested []*model.Node
+					for _, child := range children {
+						switch child.Type.Name {
+						case "paragraph":
+							item.Content = append(item.Content, child.Content.Content...)
+						case "taskList":
+							nested = append(nested, child)
+						}
 					}
-					_, err := state.CloseNode()
-					return err
+					if _, err := state.CloseNode(); err != nil {
+						return err
+					}
+					for _, list := range nested {
+						state.Push(list)
+					}
+					return nil
 				}
 			}
 			return vanilla[ast.KindListItem](state, node, entering)
 		},
 		ast.KindTextBlock:       vanilla[ast.KindTextBlock],
-		ast.KindBlockquote:      vanilla[ast.KindBlockquote],
 		ast.KindCodeBlock:       vanilla[ast.KindCodeBlock],
 		ast.KindFencedCodeBlock: vanilla[ast.KindFencedCodeBlock],
 		ast.KindThematicBreak:   vanilla[ast.KindThematicBreak],
+		ast.KindBlockquote: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			// The schema doesn't allow nested blockquotes: their paragraphs
+			// are kept in the outer blockquote.
+			if isInBlockquote(node) {
+				return nil
+			}
+			return vanilla[ast.KindBlockquote](state, node, entering)
+		},
 		custom.KindDecisionList: markdown.GenericBlockHandler("decisionList"),
 		custom.KindDecisionItem: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
 			if entering {
@@ -390,11 +804,115 @@ func markdownNodeMapper() markdown.NodeMapper {
 			return nil
 		},
 
+		extensionast.KindTable:       markdown.GenericBlockHandler("table"),
+		extensionast.KindTableHeader: markdown.GenericBlockHandler("tableRow"),
+		extensionast.KindTableRow:    markdown.GenericBlockHandler("tableRow"),
+		extensionast.KindTableCell: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			if !entering {
+				// The pipes are escaped in the cells of a pipe table, even in
+				// the code spans
+				paragraph := state.Top()
+				for i, child := range paragraph.Content {
+					if child.IsText() && hasCodeMark(child) && strings.Contains(*child.Text, "\\|") {
+						paragraph.Content[i] = child.WithText(strings.ReplaceAll(*child.Text, "\\|", "|"))
+					}
+				}
+				if _, err := state.CloseNode(); err != nil { // Paragraph
+					return err
+				}
+				_, err := state.CloseNode() // Cell
+				return err
+			}
+			cellType := "tableCell"
+			if node.Parent().Kind() == extensionast.KindTableHeader {
+				cellType = "tableHeader"
+			}
+			typ, err := state.Schema.NodeType(cellType)
+			if err != nil {
+				return err
+			}
+			state.OpenNode(typ, nil)
+			// The alignment mark is put on the paragraph, via the marks of
+			// the cell that are used for its children.
+			var align string
+			switch node.(*extensionast.TableCell).Alignment {
+			case extensionast.AlignCenter:
+				align = "center"
+			case extensionast.AlignRight:
+				align = "end"
+			}
+			if align != "" {
+				markType, err := state.Schema.MarkType("alignment")
+				if err != nil {
+					return err
+				}
+				state.OpenMark(markType.Create(map[string]interface{}{"align": align}))
+			}
+			typ, err = state.Schema.NodeType("paragraph")
+			if err != nil {
+				return err
+			}
+			state.OpenNode(typ, nil)
+			return nil
+		},
+
 		// Inlines
-		ast.KindText:     vanilla[ast.KindText],
-		ast.KindString:   vanilla[ast.KindString],
-		ast.KindAutoLink: vanilla[ast.KindAutoLink],
-		ast.KindLink:     vanilla[ast.KindLink],
+		ast.KindText: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			if !entering {
+				return nil
+			}
+			n := node.(*ast.Text)
+			content := n.Segment.Value(state.Source)
+			// The backslash escapes are kept by goldmark in the text, except
+			// for the raw texts of the code spans
+			if !n.IsRaw() {
+				if n.PreviousSibling() == nil && bytes.HasPrefix(content, []byte(`\✍`)) {
+					content = content[1:]
+				}
+				content = util.UnescapePunctuations(content)
+			}
+			if len(content) > 0 {
+				state.AddText(string(content))
+			}
+			if n.HardLineBreak() {
+				typ, err := state.Schema.NodeType("hardBreak")
+				if err != nil {
+					return err
+				}
+				if _, err := state.AddNode(typ, nil, nil); err != nil {
+					return err
+				}
+			} else if n.SoftLineBreak() {
+				// Keep the soft line breaks, for the paragraphs and the quotes
+				// written on several lines
+				state.AddText("\n")
+			}
+			return nil
+		},
+		ast.KindString: vanilla[ast.KindString],
+		ast.KindLink:   vanilla[ast.KindLink],
+		ast.KindAutoLink: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			typ, err := state.Schema.MarkType("link")
+			if err != nil {
+				return err
+			}
+			n := node.(*ast.AutoLink)
+			// The label is the text, and it can be different of the URL for
+			// the emails (mailto:) and the www. links (http://)
+			label := string(n.Label(state.Source))
+			href := string(n.URL(state.Source))
+			if n.AutoLinkType == ast.AutoLinkEmail && !strings.HasPrefix(href, "mailto:") {
+				href = "mailto:" + href
+			}
+			mark := typ.Create(map[string]interface{}{"href": href})
+			if entering {
+				state.OpenMark(mark)
+				state.AddText(label)
+			} else {
+				state.CloseMark(mark)
+			}
+			return nil
+		},
 		ast.KindImage: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
 			if entering {
 				return nil
@@ -435,6 +953,52 @@ func markdownNodeMapper() markdown.NodeMapper {
 		ast.KindCodeSpan:               vanilla[ast.KindCodeSpan],
 		ast.KindEmphasis:               vanilla[ast.KindEmphasis],
 		extensionast.KindStrikethrough: vanilla[extensionast.KindStrikethrough],
+		custom.KindHighlight: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			mark := highlightMark(state.Schema)
+			if entering {
+				state.OpenMark(mark)
+			} else {
+				state.CloseMark(mark)
+			}
+			return nil
+		},
+		custom.KindEmoji: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			if entering {
+				state.AddText(node.(*custom.Emoji).Value)
+			}
+			return nil
+		},
+		custom.KindMention: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			if !entering {
+				return nil
+			}
+			text := "@" + node.(*custom.Mention).Handle
+			// The mentions are kept as texts for the schemas without them
+			typ, err := state.Schema.NodeType("mention")
+			if err != nil {
+				state.AddText(text)
+				return nil
+			}
+			state.OpenNode(typ, map[string]interface{}{
+				"id":   "",
+				"text": text,
+			})
+			_, err = state.CloseNode()
+			return err
+		},
+		custom.KindSubSup: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
+			typ, err := state.Schema.MarkType("subsup")
+			if err != nil {
+				return err
+			}
+			mark := typ.Create(map[string]interface{}{"type": node.(*custom.SubSup).Position})
+			if entering {
+				state.OpenMark(mark)
+			} else {
+				state.CloseMark(mark)
+			}
+			return nil
+		},
 		extensionast.KindTaskCheckBox: func(state *markdown.MarkdownParseState, node ast.Node, entering bool) error {
 			if entering {
 				if len(state.Stack) <= 2 {
@@ -489,6 +1053,12 @@ func markdownNodeMapper() markdown.NodeMapper {
 					nodeType = "date"
 					ts, _ := node.AttributeString("ts")
 					attrs = map[string]interface{}{"timestamp": ts}
+				case "mention":
+					if _, err := state.Schema.NodeType("mention"); err == nil {
+						nodeType = "mention"
+						id, _ := node.AttributeString("id")
+						attrs = map[string]interface{}{"id": id, "text": text}
+					}
 				case "center", "right":
 					markType = "alignment"
 					align := "center"
@@ -496,6 +1066,19 @@ func markdownNodeMapper() markdown.NodeMapper {
 						align = "end"
 					}
 					attrs = map[string]interface{}{"align": align}
+				case "mark":
+					// A mark unknown to the serializer, see preserveUnknownTypes
+					name, _ := node.AttributeString("name")
+					if name, ok := name.(string); ok {
+						if _, err := state.Schema.MarkType(name); err == nil {
+							markType = name
+							if raw, ok := node.AttributeString("attrs"); ok {
+								if raw, ok := raw.(string); ok {
+									_ = json.Unmarshal([]byte(raw), &attrs)
+								}
+							}
+						}
+					}
 				}
 			}
 
@@ -534,6 +1117,19 @@ func markdownNodeMapper() markdown.NodeMapper {
 	}
 }
 
+// withLinkify returns the option for the markdown parser to convert the bare
+// URLs and email addresses to links.
+func withLinkify() parser.Option {
+	return parser.WithInlineParsers(
+		util.Prioritized(extension.NewLinkifyParser(
+			extension.WithLinkifyAllowedProtocols([][]byte{
+				[]byte("http:"),
+				[]byte("https:"),
+			}),
+		), 999),
+	)
+}
+
 func markdownParser() parser.Parser {
 	return parser.NewParser(
 		parser.WithBlockParsers(
@@ -558,10 +1154,17 @@ func markdownParser() parser.Parser {
 			util.Prioritized(parser.NewLinkParser(), 200),
 			util.Prioritized(parser.NewAutoLinkParser(), 300),
 			util.Prioritized(parser.NewEmphasisParser(), 400),
-			util.Prioritized(extension.NewStrikethroughParser(), 500),
+			util.Prioritized(custom.NewSubscriptParser(), 500),
+			util.Prioritized(custom.NewSuperscriptParser(), 550),
+			util.Prioritized(custom.NewHighlightParser(), 600),
+			util.Prioritized(custom.NewMentionParser(), 700),
 		),
 		parser.WithParagraphTransformers(
 			util.Prioritized(parser.LinkReferenceParagraphTransformer, 100),
+			util.Prioritized(extension.NewTableParagraphTransformer(), 200),
+		),
+		parser.WithASTTransformers(
+			util.Prioritized(extension.NewTableASTTransformer(), 0),
 		),
 	)
 }
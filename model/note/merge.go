@@ -0,0 +1,109 @@
+package note
+
+import "github.com/cozy/prosemirror-go/model"
+
+// Conflict is a conflict of a three-way merge: the same blocks have been
+// changed on both sides.
+type Conflict struct {
+	// Index is the position of the conflicting blocks in the merged document.
+	Index int `json:"index"`
+	// Base are the blocks in the common ancestor, A and B are the blocks on
+	// each side. The merged document has the blocks of A.
+	Base []*model.Node `json:"base"`
+	A    []*model.Node `json:"a"`
+	B    []*model.Node `json:"b"`
+}
+
+// Merge does a three-way merge of two versions, a and b, of the document of a
+// note, edited from the same base version. The top-level blocks (paragraphs,
+// headings, lists, etc.) changed on only one side are merged automatically.
+// When the same blocks have been changed on both sides, a conflict is
+// returned, and the merged document keeps the blocks of a.
+func Merge(base, a, b *model.Node) (*model.Node, []Conflict, error) {
+	if a.Type != base.Type || b.Type != base.Type {
+		return nil, nil, ErrInvalidSchema
+	}
+	bases := base.Content.Content
+	as := a.Content.Content
+	bs := b.Content.Content
+	inA := matchBlocks(bases, as)
+	inB := matchBlocks(bases, bs)
+
+	var blocks []*model.Node
+	var conflicts []Conflict
+	i, j, k := 0, 0, 0
+	for {
+		// Find the next base block that is unchanged on both sides
+		next := i
+		for next < len(bases) && (inA[next] < 0 || inB[next] < 0) {
+			next++
+		}
+		endA, endB := len(as), len(bs)
+		if next < len(bases) {
+			endA, endB = inA[next], inB[next]
+		}
+
+		chunkBase, chunkA, chunkB := bases[i:next], as[j:endA], bs[k:endB]
+		switch {
+		case sameBlocks(chunkA, chunkBase):
+			blocks = append(blocks, chunkB...)
+		case sameBlocks(chunkB, chunkBase), sameBlocks(chunkA, chunkB):
+			blocks = append(blocks, chunkA...)
+		default:
+			conflicts = append(conflicts, Conflict{
+				Index: len(blocks),
+				Base:  chunkBase,
+				A:     chunkA,
+				B:     chunkB,
+			})
+			blocks = append(blocks, chunkA...)
+		}
+
+		if next == len(bases) {
+			break
+		}
+		blocks = append(blocks, as[endA])
+		i, j, k = next+1, endA+1, endB+1
+	}
+
+	doc := base.Copy(model.NewFragment(blocks))
+	if !doc.Type.ValidContent(doc.Content) {
+		return nil, nil, ErrCannotMerge
+	}
+	return doc, conflicts, nil
+}
+
+// matchBlocks returns, for each block of olds, the index of the same block in
+// news, or -1 if it has been changed or removed. It uses the same longest
+// common subsequence as Diff.
+func matchBlocks(olds, news []*model.Node) []int {
+	lcs := lcsTable(olds, news)
+	matches := make([]int, len(olds))
+	i, j := 0, 0
+	for i < len(olds) {
+		switch {
+		case j < len(news) && sameNode(olds[i], news[j]):
+			matches[i] = j
+			i++
+			j++
+		case j == len(news) || lcs[i+1][j] >= lcs[i][j+1]:
+			matches[i] = -1
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+func sameBlocks(a, b []*model.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameNode(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
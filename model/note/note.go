@@ -43,6 +43,8 @@ type Document struct {
 	Version    int64                  `json:"version"`
 	SchemaSpec map[string]interface{} `json:"schema"`
 	RawContent map[string]interface{} `json:"content"`
+	// Frontmatter is the metadata of the YAML frontmatter of the markdown.
+	Frontmatter map[string]interface{} `json:"frontmatter,omitempty"`
 
 	// Use cache for some computed properties
 	schema  *model.Schema
@@ -74,12 +76,16 @@ func (d *Document) SetRev(rev string) { d.DocRev = rev }
 
 // Metadata returns the file metadata for this note.
 func (d *Document) Metadata() map[string]interface{} {
-	return map[string]interface{}{
+	metadata := map[string]interface{}{
 		"title":   d.Title,
 		"content": d.RawContent,
 		"version": d.Version,
 		"schema":  d.SchemaSpec,
 	}
+	if len(d.Frontmatter) > 0 {
+		metadata["frontmatter"] = d.Frontmatter
+	}
+	return metadata
 }
 
 // Schema returns the prosemirror schema for this note
@@ -122,11 +128,22 @@ func (d *Document) Content() (*model.Node, error) {
 
 // Markdown returns a markdown serialization of the content.
 func (d *Document) Markdown(images []*Image) ([]byte, error) {
+	return d.MarkdownWithOverrides(images, nil)
+}
+
+// MarkdownWithOverrides returns a markdown serialization of the content, like
+// Markdown, but with the given serializers for some node and mark types. The
+// overrides can be nil to use only the default serializers.
+func (d *Document) MarkdownWithOverrides(images []*Image, overrides *SerializerOverrides) ([]byte, error) {
 	content, err := d.Content()
 	if err != nil {
 		return nil, err
 	}
-	md := markdownSerializer(images).Serialize(content)
+	serializer := preserveUnknownTypes(markdownSerializer(images, overrides), content.Type.Schema)
+	md, err := writeFrontmatter(d.Frontmatter, serializer.Serialize(content))
+	if err != nil {
+		return nil, err
+	}
 	return []byte(md), nil
 }
 
@@ -135,8 +152,7 @@ func (d *Document) Text() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	text := textSerializer().Serialize(content)
-	return text, nil
+	return SerializeToText(content), nil
 }
 
 // GetDirID returns the ID of the directory where the note will be created.
@@ -627,12 +643,14 @@ func fromMetadata(file *vfs.FileDoc) (*Document, error) {
 	if !ok {
 		return nil, ErrInvalidFile
 	}
+	frontmatter, _ := file.Metadata["frontmatter"].(map[string]interface{})
 	return &Document{
-		DocID:      file.ID(),
-		Title:      title,
-		Version:    version,
-		SchemaSpec: schema,
-		RawContent: content,
+		DocID:       file.ID(),
+		Title:       title,
+		Version:     version,
+		SchemaSpec:  schema,
+		RawContent:  content,
+		Frontmatter: frontmatter,
 	}, nil
 }
 
@@ -4,11 +4,22 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/prosemirror-go/markdown"
 	"github.com/cozy/prosemirror-go/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/html"
 )
 
+// testSchema returns a new schema for the notes, with the default specs.
+func testSchema(t testing.TB) *model.Schema {
+	specs := model.SchemaSpecFromJSON(DefaultSchemaSpecs())
+	schema, err := model.NewSchema(&specs)
+	require.NoError(t, err)
+	return schema
+}
+
 func TestMarkdown(t *testing.T) {
 	initial := `# My title
 
@@ -23,18 +34,1283 @@ foobar **bold**
 
 - [X] a done task`
 
-	schemaSpecs := DefaultSchemaSpecs()
-	specs := model.SchemaSpecFromJSON(schemaSpecs)
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+}
+
+func TestMarkdownTaskList(t *testing.T) {
+	initial := `- [X] a done task
+
+- [ ] a todo task
+
+  - [X] a nested done task
+
+  - [ ] a nested todo task`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	reparsed, err := parseFile(strings.NewReader(md), schema)
+	require.NoError(t, err)
+	list, err := reparsed.Child(0)
+	require.NoError(t, err)
+	require.Equal(t, 3, list.ChildCount())
+	done, _ := list.Child(0)
+	assert.Equal(t, "DONE", done.Attrs["state"])
+	todo, _ := list.Child(1)
+	assert.Equal(t, "TODO", todo.Attrs["state"])
+	nested, _ := list.Child(2)
+	assert.Equal(t, "taskList", nested.Type.Name)
+	done, _ = nested.Child(0)
+	assert.Equal(t, "DONE", done.Attrs["state"])
+	todo, _ = nested.Child(1)
+	assert.Equal(t, "TODO", todo.Attrs["state"])
+
+	// The lowercase x of GFM is also a checked item
+	node, err = parseFile(strings.NewReader("- [x] done"), schema)
+	require.NoError(t, err)
+	assert.Equal(t, "- [X] done", markdownSerializer(nil, nil).Serialize(node))
+}
+
+func TestMarkdownTable(t *testing.T) {
+	initial := `# A table
+
+| Name | Score |
+| :---: | ---: |
+| **Alice** | 4\|2 |
+
+after the table`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	table, err := node.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "table", table.Type.Name)
+	require.Equal(t, 2, table.ChildCount())
+	header, err := table.Child(0)
+	require.NoError(t, err)
+	cell, err := header.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "tableHeader", cell.Type.Name)
+	row, err := table.Child(1)
+	require.NoError(t, err)
+	cell, err = row.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "tableCell", cell.Type.Name)
+	assert.Equal(t, "4|2", cell.TextContent())
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	reparsed, err := parseFile(strings.NewReader(md), schema)
+	require.NoError(t, err)
+	assert.True(t, node.Eq(reparsed))
+}
+
+func TestMarkdownCodeBlock(t *testing.T) {
+	initial := "# Code\n\n```go\nfunc main() {\n\tif true {\n\t\tfmt.Println(\"  *not bold*\")\n\t}\n}\n```\n\n````md\n```\nnested fence\n```\n````"
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	code, err := node.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "codeBlock", code.Type.Name)
+	assert.Equal(t, "go", code.Attrs["language"])
+	assert.Equal(t, "func main() {\n\tif true {\n\t\tfmt.Println(\"  *not bold*\")\n\t}\n}", code.TextContent())
+	fence, err := node.Child(2)
+	require.NoError(t, err)
+	assert.Equal(t, "md", fence.Attrs["language"])
+	assert.Equal(t, "```\nnested fence\n```", fence.TextContent())
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+}
+
+func TestMarkdownStrikethrough(t *testing.T) {
+	initial := `foo ~~struck~~ **~~bold and struck~~** *~~italic and struck~~* ~~struck and **bold**~~`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	struck, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "struck", *struck.Text)
+	require.Len(t, struck.Marks, 1)
+	assert.Equal(t, "strike", struck.Marks[0].Type.Name)
+	both, err := para.Child(3)
+	require.NoError(t, err)
+	assert.Equal(t, "bold and struck", *both.Text)
+	assert.Len(t, both.Marks, 2)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+}
+
+// schemaWithout returns a schema with the default specs, but without the
+// given mark and node types, like the schemas of the notes created before
+// them.
+func schemaWithout(t *testing.T, names ...string) *model.Schema {
+	specs := model.SchemaSpecFromJSON(DefaultSchemaSpecs())
+	for _, name := range names {
+		for i, mark := range specs.Marks {
+			if mark.Key == name {
+				specs.Marks = append(specs.Marks[:i], specs.Marks[i+1:]...)
+				break
+			}
+		}
+		for i, node := range specs.Nodes {
+			if node.Key == name {
+				specs.Nodes = append(specs.Nodes[:i], specs.Nodes[i+1:]...)
+				break
+			}
+		}
+		for _, node := range specs.Nodes {
+			if node.Marks != nil {
+				allowed := strings.Join(strings.Fields(strings.ReplaceAll(" "+*node.Marks+" ", " "+name+" ", " ")), " ")
+				node.Marks = &allowed
+			}
+		}
+	}
+	schema, err := model.NewSchema(&specs)
+	require.NoError(t, err)
+	return schema
+}
+
+func TestMarkdownHighlight(t *testing.T) {
+	initial := `foo ==highlighted== **==bold and highlighted==** ==highlighted and **bold**== a == b`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	highlighted, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "highlighted", *highlighted.Text)
+	require.Len(t, highlighted.Marks, 1)
+	assert.Equal(t, "highlight", highlighted.Marks[0].Type.Name)
+	both, err := para.Child(3)
+	require.NoError(t, err)
+	assert.Equal(t, "bold and highlighted", *both.Text)
+	assert.Len(t, both.Marks, 2)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	// The == of the texts are escaped
+	text := "a==b==c, x ==y, ==, a == b"
+	para, err = schema.Node("paragraph", nil, []*model.Node{schema.Text(text)})
+	require.NoError(t, err)
+	node, err = schema.Node("doc", nil, []*model.Node{para})
+	require.NoError(t, err)
+	md = markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, `a\=\=b\=\=c, x \=\=y, \=\=, a == b`, md)
+	node, err = parseFile(strings.NewReader(md), schema)
+	require.NoError(t, err)
+	para, err = node.Child(0)
+	require.NoError(t, err)
+	require.Equal(t, 1, para.ChildCount())
+	child, err := para.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, text, *child.Text)
+	assert.Empty(t, child.Marks)
+
+	// The schemas of the older notes have no highlight mark, so a text color
+	// is used
+	node, err = parseFile(strings.NewReader(initial), schemaWithout(t, "highlight"))
+	require.NoError(t, err)
+	para, err = node.Child(0)
+	require.NoError(t, err)
+	highlighted, err = para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "highlighted", *highlighted.Text)
+	require.Len(t, highlighted.Marks, 1)
+	assert.Equal(t, "textColor", highlighted.Marks[0].Type.Name)
+	assert.Equal(t, highlightColor, highlighted.Marks[0].Attrs["color"])
+}
+
+func TestMarkdownSubSup(t *testing.T) {
+	initial := `H~2~O and x^2^ are not ~~struck~~, but **^n+1^** is, and 2\^3 too`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	sub, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "2", *sub.Text)
+	require.Len(t, sub.Marks, 1)
+	assert.Equal(t, "subsup", sub.Marks[0].Type.Name)
+	assert.Equal(t, "sub", sub.Marks[0].Attrs["type"])
+	sup, err := para.Child(3)
+	require.NoError(t, err)
+	assert.Equal(t, "2", *sup.Text)
+	require.Len(t, sup.Marks, 1)
+	assert.Equal(t, "subsup", sup.Marks[0].Type.Name)
+	assert.Equal(t, "sup", sup.Marks[0].Attrs["type"])
+	struck, err := para.Child(5)
+	require.NoError(t, err)
+	assert.Equal(t, "struck", *struck.Text)
+	require.Len(t, struck.Marks, 1)
+	assert.Equal(t, "strike", struck.Marks[0].Type.Name)
+	both, err := para.Child(7)
+	require.NoError(t, err)
+	assert.Equal(t, "n+1", *both.Text)
+	assert.Len(t, both.Marks, 2)
+	assert.Contains(t, para.TextContent(), "2^3")
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	// The old syntax with spans can still be parsed
+	node, err = parseFile(strings.NewReader("H[2]{.sub}O"), schema)
+	require.NoError(t, err)
+	assert.Equal(t, "H~2~O", markdownSerializer(nil, nil).Serialize(node))
+}
+
+func TestMarkdownLink(t *testing.T) {
+	initial := `a [link](https://cozy.io/ "The \"Cozy\" website"), a [link without title](https://cozy.io/) and <https://docs.cozy.io/>`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	link, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "link", *link.Text)
+	require.Len(t, link.Marks, 1)
+	assert.Equal(t, "https://cozy.io/", link.Marks[0].Attrs["href"])
+	assert.Equal(t, `The "Cozy" website`, link.Marks[0].Attrs["title"])
+	untitled, err := para.Child(3)
+	require.NoError(t, err)
+	require.Len(t, untitled.Marks, 1)
+	assert.Nil(t, untitled.Marks[0].Attrs["title"])
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+}
+
+func TestParseFileLimits(t *testing.T) {
+	content := "# A title\n\nsome text"
+
+	schema := testSchema(t)
+
+	// The document has 5 nodes: doc, heading, text, paragraph, text
+	size := int64(len(content))
+	node, err := parseFileWithOptions(strings.NewReader(content), schema, ParseOptions{Limits: Limits{MaxSize: size, MaxNodes: 5}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, node.ChildCount())
+
+	_, err = parseFileWithOptions(strings.NewReader(content), schema, ParseOptions{Limits: Limits{MaxSize: size - 1, MaxNodes: 5}})
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+
+	_, err = parseFileWithOptions(strings.NewReader(content), schema, ParseOptions{Limits: Limits{MaxSize: size, MaxNodes: 4}})
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+
+	_, err = parseFileWithOptions(strings.NewReader(content), schema, ParseOptions{Limits: Limits{}})
+	assert.NoError(t, err)
+
+	// The nodes are counted while parsing, and the parsing stops early
+	deep := strings.Repeat("> ", 100) + "text"
+	_, err = parseFileWithOptions(strings.NewReader(deep), schema, ParseOptions{Limits: Limits{MaxNodes: 50}})
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+
+	// MaxMarkdownSize is a hard upper bound
+	large := strings.Repeat("a", MaxMarkdownSize+1)
+	_, err = parseFileWithOptions(strings.NewReader(large), schema, ParseOptions{Limits: Limits{}})
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+	_, err = parseFileWithOptions(strings.NewReader(large), schema, ParseOptions{Limits: Limits{MaxSize: 2 * MaxMarkdownSize}})
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+}
+
+func TestMarkdownLinkify(t *testing.T) {
+	initial := `see https://cozy.io/ or write to contact@cozy.io, and not foo.bar`
+
+	schema := testSchema(t)
+
+	// Disabled by default
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, para.ChildCount())
+
+	node, err = parseFileWithOptions(strings.NewReader(initial), schema, ParseOptions{Linkify: true})
+	require.NoError(t, err)
+	para, err = node.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, initial, para.TextContent())
+	url, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "https://cozy.io/", *url.Text)
+	require.Len(t, url.Marks, 1)
+	assert.Equal(t, "link", url.Marks[0].Type.Name)
+	assert.Equal(t, "https://cozy.io/", url.Marks[0].Attrs["href"])
+	email, err := para.Child(3)
+	require.NoError(t, err)
+	assert.Equal(t, "contact@cozy.io", *email.Text)
+	require.Len(t, email.Marks, 1)
+	assert.Equal(t, "mailto:contact@cozy.io", email.Marks[0].Attrs["href"])
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	expected := `see <https://cozy.io/> or write to <contact@cozy.io>, and not foo.bar`
+	assert.Equal(t, expected, md)
+
+	// The autolinks can be parsed back without the option
+	node, err = parseFile(strings.NewReader(md), schema)
+	require.NoError(t, err)
+	assert.Equal(t, expected, markdownSerializer(nil, nil).Serialize(node))
+}
+
+func TestMarkdownMention(t *testing.T) {
+	initial := `thanks @alice.martin for the review (and [@bob]{.mention id="42"}), write to contact@cozy.io or \@admin`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	require.Equal(t, 5, para.ChildCount())
+	alice, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "mention", alice.Type.Name)
+	assert.Equal(t, "@alice.martin", alice.Attrs["text"])
+	assert.Equal(t, "", alice.Attrs["id"])
+	bob, err := para.Child(3)
+	require.NoError(t, err)
+	assert.Equal(t, "mention", bob.Type.Name)
+	assert.Equal(t, "@bob", bob.Attrs["text"])
+	assert.Equal(t, "42", bob.Attrs["id"])
+	last, err := para.Child(4)
+	require.NoError(t, err)
+	assert.Equal(t, "), write to contact@cozy.io or @admin", *last.Text)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	// The schemas of the older notes have no mention node, so the mentions
+	// are kept as texts, and their @ are not escaped
+	node, err = parseFile(strings.NewReader(initial), schemaWithout(t, "mention"))
+	require.NoError(t, err)
+	para, err = node.Child(0)
+	require.NoError(t, err)
+	require.Equal(t, 1, para.ChildCount())
+	text, err := para.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "thanks @alice.martin for the review (and @bob), write to contact@cozy.io or @admin", *text.Text)
+	md = markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, "thanks @alice.martin for the review (and @bob), write to contact@cozy.io or @admin", md)
+}
+
+func TestMarkdownFrontmatter(t *testing.T) {
+	initial := `---
+created: "2023-11-02"
+tags:
+    - work
+    - draft
+title: Meeting notes
+---
+
+# Meeting notes
+
+some text`
+
+	schema := testSchema(t)
+
+	node, metadata, err := parseFileWithMetadata(strings.NewReader(initial), schema, ParseOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "Meeting notes", metadata["title"])
+	assert.Equal(t, []interface{}{"work", "draft"}, metadata["tags"])
+	assert.Equal(t, "2023-11-02", metadata["created"])
+	require.Equal(t, 2, node.ChildCount())
+	heading, err := node.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "heading", heading.Type.Name)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	md, err = writeFrontmatter(metadata, md)
+	require.NoError(t, err)
+	assert.Equal(t, initial, md)
+
+	// Without a frontmatter, or with a title between two rules
+	for _, content := range []string{"# A title\n\nsome text", "---\nA title\n---\n\nsome text"} {
+		node, metadata, err = parseFileWithMetadata(strings.NewReader(content), schema, ParseOptions{})
+		require.NoError(t, err)
+		assert.Nil(t, metadata)
+		expected, err := markdown.ParseMarkdown(markdownParser(), markdownNodeMapper(), []byte(content), schema)
+		require.NoError(t, err)
+		assert.True(t, sameNode(expected, node))
+		md = markdownSerializer(nil, nil).Serialize(node)
+		withFrontmatter, err := writeFrontmatter(metadata, md)
+		require.NoError(t, err)
+		assert.Equal(t, md, withFrontmatter)
+	}
+
+	// The frontmatter is kept in the metadata of the file of an imported
+	// note, and written back on export
+	node, metadata, err = parseFileWithMetadata(strings.NewReader(initial), schema, ParseOptions{})
+	require.NoError(t, err)
+	file := &vfs.FileDoc{DocName: "Meeting notes.cozy-note"}
+	fillMetadata(file, nil, DefaultSchemaSpecs(), node, metadata)
+	assert.Equal(t, metadata, file.Metadata["frontmatter"])
+	file.Metadata["version"] = float64(1)
+	doc, err := fromMetadata(file)
+	require.NoError(t, err)
+	assert.Equal(t, metadata, doc.Frontmatter)
+	assert.Equal(t, metadata, doc.Metadata()["frontmatter"])
+	raw, err := doc.Markdown(nil)
+	require.NoError(t, err)
+	assert.Equal(t, initial, string(raw))
+}
+
+func TestMarkdownCodeSpan(t *testing.T) {
+	initial := "use `x := y` or `` a`b `` or `  spaced  `, but not `**bold** and \\*` or ``` ``x`` ```"
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	expected := []string{"x := y", "a`b", " spaced ", "**bold** and \\*", "``x``"}
+	var codes []string
+	for _, child := range para.Content.Content {
+		if hasCodeMark(child) {
+			require.Len(t, child.Marks, 1)
+			codes = append(codes, *child.Text)
+		}
+	}
+	assert.Equal(t, expected, codes)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+}
+
+func TestMarkdownEmoji(t *testing.T) {
+	initial := "hello :smile:, :unknown: and :info: are not emojis, nor `:smile:`"
+
+	schema := testSchema(t)
+
+	// Disabled by default
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello :smile:, :unknown: and :info: are not emojis, nor :smile:", para.TextContent())
+
+	opts := ParseOptions{Emojis: DefaultEmojis}
+	node, err = parseFileWithOptions(strings.NewReader(initial), schema, opts)
+	require.NoError(t, err)
+	para, err = node.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "hello 😄, :unknown: and :info: are not emojis, nor :smile:", para.TextContent())
+
+	md := markdownSerializer(nil, emojiShortcodes(DefaultEmojis)).Serialize(node)
+	assert.Equal(t, initial, md)
+	md = markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, "hello 😄, :unknown: and :info: are not emojis, nor `:smile:`", md)
+
+	// An emoji at the start of a paragraph is not written as a shortcode, as
+	// it would be read as the marker of a panel
+	initial = ":info: a panel\n\n🎉 :tada: not a panel"
+	node, err = parseFileWithOptions(strings.NewReader(initial), schema, opts)
+	require.NoError(t, err)
+	panel, err := node.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "panel", panel.Type.Name)
+	assert.Equal(t, "info", panel.Attrs["panelType"])
+	para, err = node.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "paragraph", para.Type.Name)
+	assert.Equal(t, "🎉 🎉 not a panel", para.TextContent())
+	md = markdownSerializer(nil, emojiShortcodes(DefaultEmojis)).Serialize(node)
+	assert.Equal(t, initial, md)
+}
+
+func TestMarkdownBlockquote(t *testing.T) {
+	initial := `# A quote
+
+> the first paragraph
+> written on two lines
+>
+> the **second** paragraph
+
+after the quote`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	quote, err := node.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "blockquote", quote.Type.Name)
+	assert.Equal(t, 2, quote.ChildCount())
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	// The nested blockquotes are flattened, as the schema doesn't allow them
+	node, err = parseFile(strings.NewReader("> a\n>\n> > nested\n>\n> b"), schema)
+	require.NoError(t, err)
+	require.Equal(t, 1, node.ChildCount())
+	quote, _ = node.Child(0)
+	assert.Equal(t, 3, quote.ChildCount())
+	assert.Equal(t, "> a\n>\n> nested\n>\n> b", markdownSerializer(nil, nil).Serialize(node))
+}
+
+func TestMarkdownUnknownTypes(t *testing.T) {
+	// A schema from a newer editor, with a mark and a node unknown to the
+	// serializer
+	specs := model.SchemaSpecFromJSON(DefaultSchemaSpecs())
+	specs.Marks = append(specs.Marks, &model.MarkSpec{
+		Key:   "backgroundColor",
+		Attrs: map[string]*model.AttributeSpec{"color": {}},
+	})
+	specs.Nodes = append(specs.Nodes, &model.NodeSpec{
+		Key:     "callout",
+		Content: "paragraph+",
+		Group:   "block",
+	})
+	for _, node := range specs.Nodes {
+		if node.Key == "paragraph" {
+			marks := *node.Marks + " backgroundColor"
+			node.Marks = &marks
+		}
+	}
+	schema, err := model.NewSchema(&specs)
+	require.NoError(t, err)
+
+	background := schema.Mark("backgroundColor", map[string]interface{}{"color": "yellow"})
+	para, err := schema.Node("paragraph", nil, []*model.Node{
+		schema.Text("some "),
+		schema.Text("highlighted", []*model.Mark{background}),
+		schema.Text(" text"),
+	})
+	require.NoError(t, err)
+	inside, err := schema.Node("paragraph", nil, []*model.Node{schema.Text("inside a callout")})
+	require.NoError(t, err)
+	callout, err := schema.Node("callout", nil, []*model.Node{inside})
+	require.NoError(t, err)
+	doc, err := schema.Node("doc", nil, []*model.Node{para, callout})
+	require.NoError(t, err)
+
+	serializer := preserveUnknownTypes(markdownSerializer(nil, nil), schema)
+	md := serializer.Serialize(doc)
+	expected := `some [highlighted]{.mark name="backgroundColor" attrs="{\"color\":\"yellow\"}"} text
+
+inside a callout`
+	assert.Equal(t, expected, md)
+
+	node, err := parseFile(strings.NewReader(md), schema)
+	require.NoError(t, err)
+	para, err = node.Child(0)
+	require.NoError(t, err)
+	text, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "highlighted", *text.Text)
+	require.Len(t, text.Marks, 1)
+	assert.Equal(t, "backgroundColor", text.Marks[0].Type.Name)
+	assert.Equal(t, "yellow", text.Marks[0].Attrs["color"])
+}
+
+func TestMarkdownSerializerOverrides(t *testing.T) {
+	specs := model.SchemaSpecFromJSON(DefaultSchemaSpecs())
+	specs.Nodes = append(specs.Nodes, &model.NodeSpec{
+		Key:     "callout",
+		Content: "paragraph+",
+		Group:   "block",
+	})
 	schema, err := model.NewSchema(&specs)
 	require.NoError(t, err)
 
+	inside, err := schema.Node("paragraph", nil, []*model.Node{schema.Text("inside a callout")})
+	require.NoError(t, err)
+	callout, err := schema.Node("callout", nil, []*model.Node{inside})
+	require.NoError(t, err)
+	rule, err := schema.Node("rule", nil, nil)
+	require.NoError(t, err)
+	doc, err := schema.Node("doc", nil, []*model.Node{callout, rule})
+	require.NoError(t, err)
+
+	var called int
+	overrides := &SerializerOverrides{
+		Nodes: map[string]markdown.NodeSerializerFunc{
+			"callout": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+				called++
+				state.WrapBlock("! ", nil, node, func() { state.RenderContent(node) })
+			},
+			"rule": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+				state.Write("***")
+				state.CloseBlock(node)
+			},
+		},
+	}
+	md := markdownSerializer(nil, overrides).Serialize(doc)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, "! inside a callout\n\n***", md)
+
+	// The overrides are not kept for the other serializers
+	md = markdownSerializer(nil, nil).Serialize(doc)
+	assert.Equal(t, "---", md)
+
+	// The overrides can be given to the export of a note
+	note := &Document{schema: schema}
+	note.SetContent(doc)
+	raw, err := note.MarkdownWithOverrides(nil, overrides)
+	require.NoError(t, err)
+	assert.Equal(t, 2, called)
+	assert.Equal(t, "! inside a callout\n\n***", string(raw))
+}
+
+func TestMarkdownImage(t *testing.T) {
+	initial := `# An image
+
+![A cat on a sofa](6d2c1e3a5c0a4e2b9e6a2f1b3c4d5e6f)
+
+after the image`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	single, err := node.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "mediaSingle", single.Type.Name)
+	media, err := single.Child(0)
+	require.NoError(t, err)
+	assert.Equal(t, "6d2c1e3a5c0a4e2b9e6a2f1b3c4d5e6f", media.Attrs["url"])
+	assert.Equal(t, "A cat on a sofa", media.Attrs["alt"])
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	// When the note is exported with its images, the name of the image is
+	// used for the alternative text
+	images := []*Image{{DocID: "6d2c1e3a5c0a4e2b9e6a2f1b3c4d5e6f", Name: "cat.jpg"}}
+	md = markdownSerializer(images, nil).Serialize(node)
+	assert.Contains(t, md, "![cat.jpg](6d2c1e3a5c0a4e2b9e6a2f1b3c4d5e6f)")
+	assert.True(t, images[0].seen)
+}
+
+func TestMarkdownHardBreak(t *testing.T) {
+	initial := `first line\
+second line
+third line, after a soft line break
+
+**bold\
+on two lines**`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	require.Equal(t, 2, node.ChildCount())
+	para, err := node.Child(0)
+	require.NoError(t, err)
+	br, err := para.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "hardBreak", br.Type.Name)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, initial, md)
+
+	// Two trailing spaces are also a hard line break
+	node, err = parseFile(strings.NewReader("first line  \nsecond line"), schema)
+	require.NoError(t, err)
+	md = markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, "first line\\\nsecond line", md)
+}
+
+func TestMarkdownEscape(t *testing.T) {
+	texts := []string{
+		"a*b*c and _under_ and `ticks` and ~~tildes~~",
+		"[not a link](https://cozy.io/) and a \\ backslash\\",
+		"# not a heading",
+		"- not a list",
+		"1. not a list",
+		"> not a quote",
+		":info: not a panel",
+		"✍ not a decision",
+		"\\✍ a backslash",
+		"***",
+	}
+
+	schema := testSchema(t)
+
+	for _, text := range texts {
+		para, err := schema.Node("paragraph", nil, []*model.Node{schema.Text(text)})
+		require.NoError(t, err)
+		doc, err := schema.Node("doc", nil, []*model.Node{para})
+		require.NoError(t, err)
+
+		md := markdownSerializer(nil, nil).Serialize(doc)
+		node, err := parseFile(strings.NewReader(md), schema)
+		require.NoError(t, err)
+		assert.Equal(t, "paragraph", node.FirstChild().Type.Name, md)
+		assert.Equal(t, text, node.TextContent(), md)
+	}
+
+	// No escaping in the code spans
+	initial := "some `*code*` with \\*stars\\*"
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	assert.Equal(t, "some *code* with *stars*", node.TextContent())
+	assert.Equal(t, initial, markdownSerializer(nil, nil).Serialize(node))
+}
+
+func TestMarkdownRule(t *testing.T) {
+	initial := `a first paragraph
+
+---
+
+a second paragraph
+
+***
+
+___
+
+* * *`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	require.Equal(t, 6, node.ChildCount())
+	for _, i := range []int{1, 3, 4, 5} {
+		rule, _ := node.Child(i)
+		assert.Equal(t, "rule", rule.Type.Name)
+	}
+
+	expected := `a first paragraph
+
+---
+
+a second paragraph
+
+---
+
+---
+
+---`
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.Equal(t, expected, md)
+
+	// Without a blank line, it is the underline of a setext heading
+	node, err = parseFile(strings.NewReader("a heading\n---\n\nafter"), schema)
+	require.NoError(t, err)
+	assert.Equal(t, "heading", node.FirstChild().Type.Name)
+	assert.Equal(t, "## a heading\n\nafter", markdownSerializer(nil, nil).Serialize(node))
+}
+
+func TestMarkdownOrderedList(t *testing.T) {
+	initial := `3. third
+
+4. fourth
+
+   * a nested item
+
+   * another nested item
+
+     1. deeply nested
+
+5. fifth`
+
+	schema := testSchema(t)
+
 	node, err := parseFile(strings.NewReader(initial), schema)
 	require.NoError(t, err)
+	list := node.FirstChild()
+	assert.Equal(t, "orderedList", list.Type.Name)
+	assert.EqualValues(t, 3, list.Attrs["order"])
+	require.Equal(t, 3, list.ChildCount())
+	item, _ := list.Child(1)
+	nested, err := item.Child(1)
+	require.NoError(t, err)
+	assert.Equal(t, "bulletList", nested.Type.Name)
+	assert.Equal(t, 2, nested.ChildCount())
 
-	md := markdownSerializer(nil).Serialize(node)
+	md := markdownSerializer(nil, nil).Serialize(node)
 	assert.Equal(t, initial, md)
 }
 
+func TestMarkdownPanel(t *testing.T) {
+	initial := `:warning: be careful
+
+:error: it has failed
+
+:foo: an unknown panel`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	require.Equal(t, 3, node.ChildCount())
+	warning, _ := node.Child(0)
+	assert.Equal(t, "panel", warning.Type.Name)
+	assert.Equal(t, "warning", warning.Attrs["panelType"])
+	failure, _ := node.Child(1)
+	assert.Equal(t, "error", failure.Attrs["panelType"])
+	unknown, _ := node.Child(2)
+	assert.Equal(t, "panel", unknown.Type.Name)
+	assert.Equal(t, "info", unknown.Attrs["panelType"])
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	expected := `:warning: be careful
+
+:error: it has failed
+
+:info: an unknown panel`
+	assert.Equal(t, expected, md)
+}
+
+func TestSerializeToText(t *testing.T) {
+	initial := `# My title
+
+foobar **bold** and 2 * 3 # 4
+
+:info: this is a panel
+
+✍ this is a decision
+✍ and another decision
+
+- [ ] a todo task
+
+- [X] a done task`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	text := SerializeToText(node)
+	assert.True(t, strings.HasPrefix(text, "My title\n\nfoobar bold and 2 * 3 # 4\n\nthis is a panel\n\n"))
+	assert.Contains(t, text, "this is a decision")
+	assert.Contains(t, text, "a done task")
+	assert.NotContains(t, text, "# My")
+	assert.NotContains(t, text, "**")
+	assert.NotContains(t, text, ":info:")
+	assert.NotContains(t, text, "\\")
+}
+
+func TestStats(t *testing.T) {
+	initial := `# My title
+
+foobar   **bold**
+
+:info: this is a panel
+
+✍ this is a decision
+✍ and another decision
+
+- [ ] a todo task
+
+- [X] a done task`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	stats := Stats(node)
+	assert.Equal(t, 21, stats.Words)
+	assert.Equal(t, 7, stats.Paragraphs)
+	assert.Equal(t, 96, stats.Characters)
+
+	node, err = parseFile(strings.NewReader("**bold**"), schema)
+	require.NoError(t, err)
+	stats = Stats(node)
+	assert.Equal(t, NoteStats{Words: 1, Characters: 4, Paragraphs: 1}, stats)
+}
+
+func TestDiff(t *testing.T) {
+	initial := `# My title
+
+first paragraph
+
+second paragraph
+
+third paragraph`
+
+	schema := testSchema(t)
+
+	oldNode, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+	assert.Empty(t, Diff(oldNode, oldNode))
+
+	edited := strings.Replace(initial, "second paragraph", "second **edited** paragraph", 1)
+	newNode, err := parseFile(strings.NewReader(edited), schema)
+	require.NoError(t, err)
+	changes := Diff(oldNode, newNode)
+	require.Len(t, changes, 1)
+	assert.Equal(t, BlockModified, changes[0].Kind)
+	assert.Equal(t, 2, changes[0].OldIndex)
+	assert.Equal(t, 2, changes[0].NewIndex)
+	assert.Equal(t, "second paragraph", changes[0].Old.TextContent())
+	assert.Equal(t, "second edited paragraph", changes[0].New.TextContent())
+
+	moved := "# A new title\n\n## A subtitle\n\nfirst paragraph\n\nthird paragraph"
+	newNode, err = parseFile(strings.NewReader(moved), schema)
+	require.NoError(t, err)
+	changes = Diff(oldNode, newNode)
+	require.Len(t, changes, 3)
+	assert.Equal(t, BlockModified, changes[0].Kind)
+	assert.Equal(t, "A new title", changes[0].New.TextContent())
+	assert.Equal(t, BlockAdded, changes[1].Kind)
+	assert.Equal(t, 1, changes[1].NewIndex)
+	assert.Equal(t, -1, changes[1].OldIndex)
+	assert.Equal(t, BlockRemoved, changes[2].Kind)
+	assert.Equal(t, 2, changes[2].OldIndex)
+	assert.Equal(t, "second paragraph", changes[2].Old.TextContent())
+}
+
+func TestMerge(t *testing.T) {
+	initial := `# My title
+
+first paragraph
+
+second paragraph
+
+third paragraph`
+
+	schema := testSchema(t)
+	parse := func(content string) *model.Node {
+		node, err := parseFile(strings.NewReader(content), schema)
+		require.NoError(t, err)
+		return node
+	}
+	base := parse(initial)
+
+	// Different paragraphs edited, and a paragraph added on one side
+	a := parse(strings.Replace(initial, "first paragraph", "first paragraph edited by A", 1))
+	b := parse(strings.Replace(initial, "third paragraph", "third paragraph edited by B\n\nfourth paragraph", 1))
+	merged, conflicts, err := Merge(base, a, b)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	expected := `# My title
+
+first paragraph edited by A
+
+second paragraph
+
+third paragraph edited by B
+
+fourth paragraph`
+	assert.Equal(t, expected, markdownSerializer(nil, nil).Serialize(merged))
+
+	// The same paragraph edited on both sides
+	a = parse(strings.Replace(initial, "second paragraph", "second paragraph edited by A", 1))
+	b = parse(strings.Replace(initial, "second paragraph", "second paragraph edited by B", 1))
+	merged, conflicts, err = Merge(base, a, b)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, 2, conflicts[0].Index)
+	require.Len(t, conflicts[0].Base, 1)
+	assert.Equal(t, "second paragraph", conflicts[0].Base[0].TextContent())
+	require.Len(t, conflicts[0].A, 1)
+	assert.Equal(t, "second paragraph edited by A", conflicts[0].A[0].TextContent())
+	require.Len(t, conflicts[0].B, 1)
+	assert.Equal(t, "second paragraph edited by B", conflicts[0].B[0].TextContent())
+	assert.Equal(t, strings.Replace(initial, "second paragraph", "second paragraph edited by A", 1),
+		markdownSerializer(nil, nil).Serialize(merged))
+
+	// The same edit on both sides is not a conflict
+	merged, conflicts, err = Merge(base, a, a)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.True(t, sameNode(a, merged))
+}
+
+const largeNoteSample = "# Title\n\nfoobar **bold**\nwith a second line\n\n" +
+	":info: this is a panel\n\n" +
+	"✍ this is a decision\n✍ and another decision\n\n" +
+	"- [ ] a todo task\n\n- [X] a done task\n\n  - [ ] a nested task\n\n" +
+	"1. first\n\n2. second\n\n   continued\n\n" +
+	"```go\nfunc main() {\n\n}\n```\n\n" +
+	"> a quote\n>\n> on two paragraphs\n\n" +
+	"| a | b |\n| --- | :-: |\n| c | d |\n\n" +
+	"________________________________________{.table}\n\n" +
+	"________________________________________{.tableRow}\n\n" +
+	"____________________{.tableCell}\n\nfirst paragraph\n\nsecond paragraph\n\n" +
+	"____________________{.tableCell}\n\nanother cell\n\n" +
+	"________________________________________{.tableEnd}\n\n" +
+	"---\n\n"
+
+func TestParseFileBlocks(t *testing.T) {
+	schema := testSchema(t)
+
+	content := strings.Repeat(largeNoteSample, 100)
+	node, err := parseFile(strings.NewReader(content), schema)
+	require.NoError(t, err)
+
+	var blocks []*model.Node
+	err = parseFileBlocks(strings.NewReader(content), schema, ParseOptions{}, func(block *model.Node) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, node.ChildCount(), len(blocks))
+	for i, block := range blocks {
+		expected, _ := node.Child(i)
+		require.True(t, sameNode(expected, block), "block %d: %s != %s", i, expected, block)
+	}
+
+	// The limits apply to the whole content, not to each chunk
+	noop := func(block *model.Node) error { return nil }
+	limits := Limits{MaxSize: int64(len(content)) - 1}
+	err = parseFileBlocks(strings.NewReader(content), schema, ParseOptions{Limits: limits}, noop)
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+	limits = Limits{MaxNodes: 1000}
+	err = parseFileBlocks(strings.NewReader(content), schema, ParseOptions{Limits: limits}, noop)
+	assert.ErrorIs(t, err, ErrNoteTooLarge)
+}
+
+func TestParseFileBlocksWithLinkDefinitions(t *testing.T) {
+	schema := testSchema(t)
+
+	// The definition is in a later chunk than the link
+	content := largeNoteSample + "see [the docs][docs]\n\n" + largeNoteSample +
+		"```\n[code]: not a definition\n```\n\n[docs]: https://docs.cozy.io/\n"
+	node, err := parseFile(strings.NewReader(content), schema)
+	require.NoError(t, err)
+
+	var blocks []*model.Node
+	err = parseFileBlocks(strings.NewReader(content), schema, ParseOptions{}, func(block *model.Node) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, node.ChildCount(), len(blocks))
+	for i, block := range blocks {
+		expected, _ := node.Child(i)
+		require.True(t, sameNode(expected, block), "block %d: %s != %s", i, expected, block)
+	}
+	var href interface{}
+	for _, block := range blocks {
+		block.ForEach(func(n *model.Node, _, _ int) {
+			for _, mark := range n.Marks {
+				if mark.Type.Name == "link" {
+					href = mark.Attrs["href"]
+				}
+			}
+		})
+	}
+	assert.Equal(t, "https://docs.cozy.io/", href)
+}
+
+func BenchmarkParseFile(b *testing.B) {
+	schema := testSchema(b)
+	content := strings.Repeat(largeNoteSample, 1000)
+
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := markdown.ParseMarkdown(markdownParser(), markdownNodeMapper(), []byte(content), schema)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("blocks", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := parseFileBlocks(strings.NewReader(content), schema, ParseOptions{}, func(block *model.Node) error {
+				return nil
+			})
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestTableOfContents(t *testing.T) {
+	initial := `# Introduction
+
+## Getting started
+
+### Install the app
+
+## Getting started
+
+:info: ## Getting started
+
+# Café & croissants!
+
+# !!!`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	toc := TableOfContents(node)
+	expected := []TOCEntry{
+		{Level: 1, Text: "Introduction", Anchor: "introduction"},
+		{Level: 2, Text: "Getting started", Anchor: "getting-started"},
+		{Level: 3, Text: "Install the app", Anchor: "install-the-app"},
+		{Level: 2, Text: "Getting started", Anchor: "getting-started-1"},
+		{Level: 2, Text: "Getting started", Anchor: "getting-started-2"},
+		{Level: 1, Text: "Café & croissants!", Anchor: "café-croissants"},
+		{Level: 1, Text: "!!!", Anchor: "section"},
+	}
+	assert.Equal(t, expected, toc)
+
+	html, err := SerializeToHTML(node, schema)
+	require.NoError(t, err)
+	for _, entry := range toc {
+		assert.Contains(t, html, `id="`+entry.Anchor+`"`)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	initial := `# My title
+
+foobar **bold** and <script>alert(1)</script>
+
+:info: this is a panel
+
+- [ ] a todo task
+
+- [X] a done task`
+
+	schema := testSchema(t)
+
+	node, err := parseFile(strings.NewReader(initial), schema)
+	require.NoError(t, err)
+
+	html, err := SerializeToHTML(node, schema)
+	require.NoError(t, err)
+	assert.Contains(t, html, `<h1 id="my-title">My title</h1>`)
+	assert.Contains(t, html, "<strong>bold</strong>")
+	assert.Contains(t, html, `<div class="panel panel-info"><p>this is a panel</p></div>`)
+	assert.Contains(t, html, `<input type="checkbox" disabled checked>`)
+	assert.NotContains(t, html, "<script>")
+	assert.Contains(t, html, "&lt;script&gt;")
+
+	other := testSchema(t)
+	_, err = SerializeToHTML(node, other)
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+}
+
+func TestParseHTML(t *testing.T) {
+	input := `<html><head><title>A page</title><style>h1 { color: red; }</style></head>
+<body>
+  <h1>My <em>title</em></h1>
+  <p>foo <strong>bold</strong>
+     and <code>code</code><script>alert(1)</script></p>
+  <custom-tag>unknown <b>tag</b></custom-tag>
+  <ul>
+    <li>first item</li>
+    <li><h2>second</h2> item</li>
+  </ul>
+  <ol><li>one</li></ol>
+  <blockquote><p>a quote</p></blockquote>
+  <a href="javascript:alert(1)">not a link</a>
+</body></html>`
+
+	schema := testSchema(t)
+
+	node, err := parseHTML(strings.NewReader(input), schema)
+	require.NoError(t, err)
+	require.Equal(t, 7, node.ChildCount())
+
+	heading, _ := node.Child(0)
+	assert.Equal(t, "heading", heading.Type.Name)
+	assert.Equal(t, 1, heading.Attrs["level"])
+	title, _ := heading.Child(1)
+	assert.Equal(t, "title", *title.Text)
+	require.Len(t, title.Marks, 1)
+	assert.Equal(t, "em", title.Marks[0].Type.Name)
+
+	para, _ := node.Child(1)
+	assert.Equal(t, "paragraph", para.Type.Name)
+	assert.Equal(t, "foo bold and code", para.TextContent())
+	bold, _ := para.Child(1)
+	assert.Equal(t, "strong", bold.Marks[0].Type.Name)
+	code, _ := para.Child(3)
+	assert.Equal(t, "code", code.Marks[0].Type.Name)
+
+	unknown, _ := node.Child(2)
+	assert.Equal(t, "paragraph", unknown.Type.Name)
+	assert.Equal(t, "unknown tag", unknown.TextContent())
+
+	list, _ := node.Child(3)
+	assert.Equal(t, "bulletList", list.Type.Name)
+	require.Equal(t, 2, list.ChildCount())
+	item, _ := list.Child(1)
+	assert.Equal(t, "listItem", item.Type.Name)
+	assert.Equal(t, "seconditem", item.TextContent())
+
+	ordered, _ := node.Child(4)
+	assert.Equal(t, "orderedList", ordered.Type.Name)
+	quote, _ := node.Child(5)
+	assert.Equal(t, "blockquote", quote.Type.Name)
+	assert.Equal(t, "a quote", quote.TextContent())
+
+	link, _ := node.Child(6)
+	assert.Equal(t, "not a link", link.TextContent())
+	text, _ := link.Child(0)
+	assert.Empty(t, text.Marks)
+
+	md := markdownSerializer(nil, nil).Serialize(node)
+	assert.NotContains(t, md, "alert")
+	assert.NotContains(t, md, "color")
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	input := `<p onclick="alert(1)">before<script>alert(2)</script> after</p>
+<p><img src="x" onerror="alert(3)">an image</p>
+<p><a href="javascript:alert(4)">a bad link</a>
+<a href=" JavaScript:alert(5)">another bad link</a>
+<a href="java&#x09;script:alert(6)">and another one</a>
+<a href="https://cozy.io/" onmouseover="alert(7)">a good link</a></p>
+<!-- a comment -->
+<form><input value="alert(8)"></form>`
+
+	root, err := html.Parse(strings.NewReader(input))
+	require.NoError(t, err)
+	sanitizeHTML(root)
+	var buf strings.Builder
+	require.NoError(t, html.Render(&buf, root))
+	sanitized := buf.String()
+	assert.NotContains(t, sanitized, "alert")
+	assert.NotContains(t, sanitized, "<script")
+	assert.NotContains(t, sanitized, "<img")
+	assert.NotContains(t, sanitized, "comment")
+	assert.Contains(t, sanitized, `<a>a bad link</a>`)
+	assert.Contains(t, sanitized, `<a href="https://cozy.io/">a good link</a>`)
+
+	schema := testSchema(t)
+
+	node, err := parseHTML(strings.NewReader(input), schema)
+	require.NoError(t, err)
+	md := markdownSerializer(nil, nil).Serialize(node)
+	expected := `before after
+
+an image
+
+a bad link another bad link and another one [a good link](https://cozy.io/)`
+	assert.Equal(t, expected, md)
+}
+
 func TestText(t *testing.T) {
 	initial := `# My title
 
@@ -68,10 +1344,7 @@ and another decision
 
 - a done task`
 
-	schemaSpecs := DefaultSchemaSpecs()
-	specs := model.SchemaSpecFromJSON(schemaSpecs)
-	schema, err := model.NewSchema(&specs)
-	require.NoError(t, err)
+	schema := testSchema(t)
 
 	node, err := parseFile(strings.NewReader(initial), schema)
 	require.NoError(t, err)
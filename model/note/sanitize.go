@@ -0,0 +1,119 @@
+package note
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlStrippedTags are the tags that are dropped with their content when an
+// HTML content is sanitized.
+var htmlStrippedTags = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Template: true,
+	atom.Noscript: true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Form:     true,
+	atom.Input:    true,
+	atom.Textarea: true,
+	atom.Select:   true,
+	atom.Button:   true,
+}
+
+// htmlInlineTags are the inline tags that are kept when an HTML content is
+// sanitized. The block tags that are kept are htmlBlockTags.
+var htmlInlineTags = map[atom.Atom]bool{
+	atom.A:      true,
+	atom.B:      true,
+	atom.Strong: true,
+	atom.I:      true,
+	atom.Em:     true,
+	atom.Code:   true,
+	atom.Kbd:    true,
+	atom.Samp:   true,
+	atom.S:      true,
+	atom.Del:    true,
+	atom.Strike: true,
+	atom.U:      true,
+	atom.Ins:    true,
+	atom.Mark:   true,
+	atom.Sub:    true,
+	atom.Sup:    true,
+	atom.Br:     true,
+}
+
+// htmlAllowedAttributes are the attributes that are kept when an HTML content
+// is sanitized. The other attributes, like the event handlers and the styles,
+// are removed.
+var htmlAllowedAttributes = map[atom.Atom][]string{
+	atom.A:    {"href", "title"},
+	atom.Code: {"class"},
+}
+
+// sanitizeHTML removes from an HTML tree the tags and attributes that are not
+// in the allowlists. The dangerous tags, like scripts, are removed with their
+// content, the other unknown tags are replaced by their content, and the
+// links with an unsafe scheme, like javascript:, are removed.
+func sanitizeHTML(parent *html.Node) {
+	child := parent.FirstChild
+	for child != nil {
+		next := child.NextSibling
+		switch child.Type {
+		case html.TextNode:
+			// Nothing to do
+		case html.ElementNode:
+			switch {
+			case htmlStrippedTags[child.DataAtom]:
+				parent.RemoveChild(child)
+			case htmlBlockTags[child.DataAtom] || htmlInlineTags[child.DataAtom]:
+				child.Attr = sanitizeAttributes(child)
+				sanitizeHTML(child)
+			default:
+				if child.FirstChild != nil {
+					next = child.FirstChild
+				}
+				for c := child.FirstChild; c != nil; c = child.FirstChild {
+					child.RemoveChild(c)
+					parent.InsertBefore(c, child)
+				}
+				parent.RemoveChild(child)
+			}
+		default:
+			// Comments, doctypes, etc.
+			parent.RemoveChild(child)
+		}
+		child = next
+	}
+}
+
+func sanitizeAttributes(n *html.Node) []html.Attribute {
+	var attrs []html.Attribute
+	for _, attr := range n.Attr {
+		if attr.Namespace != "" || !isAllowedAttribute(n.DataAtom, attr.Key) {
+			continue
+		}
+		if attr.Key == "href" && !isSafeHref(strings.TrimSpace(attr.Val)) {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+func isAllowedAttribute(tag atom.Atom, key string) bool {
+	for _, allowed := range htmlAllowedAttributes[tag] {
+		if allowed == key {
+			return true
+		}
+	}
+	return false
+}
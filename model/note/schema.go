@@ -29,7 +29,10 @@ const defaultSchemaString = `
           "__confluenceMetadata": {
             "default": null
           },
-          "href": {}
+          "href": {},
+          "title": {
+            "default": null
+          }
         },
         "excludes": "link color",
         "group": "link",
@@ -169,6 +172,18 @@ const defaultSchemaString = `
         ]
       }
     ],
+    [
+      "highlight",
+      {
+        "group": "fontStyle",
+        "inclusive": true,
+        "parseDOM": [
+          {
+            "tag": "mark"
+          }
+        ]
+      }
+    ],
     [
       "code",
       {
@@ -322,6 +337,30 @@ const defaultSchemaString = `
         "selectable": true
       }
     ],
+    [
+      "mention",
+      {
+        "attrs": {
+          "accessLevel": {
+            "default": ""
+          },
+          "id": {
+            "default": ""
+          },
+          "text": {
+            "default": ""
+          }
+        },
+        "group": "inline",
+        "inline": true,
+        "parseDOM": [
+          {
+            "tag": "span[data-mention-id]"
+          }
+        ],
+        "selectable": true
+      }
+    ],
     [
       "doc",
       {
@@ -334,7 +373,7 @@ const defaultSchemaString = `
       {
         "content": "inline*",
         "group": "block",
-        "marks": "strong code em link strike subsup textColor typeAheadQuery underline unsupportedMark unsupportedNodeAttribute",
+        "marks": "strong code em link strike subsup textColor typeAheadQuery underline highlight unsupportedMark unsupportedNodeAttribute",
         "parseDOM": [
           {
             "tag": "p"
@@ -366,6 +405,11 @@ const defaultSchemaString = `
     [
       "orderedList",
       {
+        "attrs": {
+          "order": {
+            "default": 1
+          }
+        },
         "content": "listItem+",
         "group": "block",
         "marks": "unsupportedMark unsupportedNodeAttribute",
@@ -0,0 +1,48 @@
+package note
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cozy/prosemirror-go/model"
+)
+
+// NoteStats are the counters for the text of a note.
+type NoteStats struct {
+	Words      int `json:"words"`
+	Characters int `json:"characters"`
+	Paragraphs int `json:"paragraphs"`
+}
+
+// Stats returns the number of words, characters and paragraphs in a document
+// of a note. Only the text is counted: the markup (marks, panel types, etc.)
+// is ignored, and the blocks without text are not counted as paragraphs.
+func Stats(node *model.Node) NoteStats {
+	var stats NoteStats
+	countStats(node, &stats)
+	return stats
+}
+
+func countStats(node *model.Node, stats *NoteStats) {
+	if !node.Type.InlineContent {
+		for _, child := range node.Content.Content {
+			countStats(child, stats)
+		}
+		return
+	}
+
+	var buf strings.Builder
+	for _, child := range node.Content.Content {
+		if child.IsText() {
+			buf.WriteString(*child.Text)
+			stats.Characters += utf8.RuneCountInString(*child.Text)
+		} else {
+			buf.WriteString(" ")
+		}
+	}
+	words := len(strings.Fields(buf.String()))
+	if words > 0 {
+		stats.Words += words
+		stats.Paragraphs++
+	}
+}
@@ -9,6 +9,12 @@ import (
 	"github.com/cozy/prosemirror-go/model"
 )
 
+// SerializeToText returns the text content of a document of a note, without
+// the formatting, for indexing and previews.
+func SerializeToText(node *model.Node) string {
+	return textSerializer().Serialize(node)
+}
+
 func textSerializer() *markdown.Serializer {
 	nodes := map[string]markdown.NodeSerializerFunc{
 		"paragraph": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
@@ -16,7 +22,7 @@ func textSerializer() *markdown.Serializer {
 			state.CloseBlock(node)
 		},
 		"text": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
-			state.Text(*node.Text)
+			state.Text(*node.Text, false)
 		},
 		"bulletList": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			state.RenderList(node, "", func(_ int) string { return "- " })
@@ -28,7 +34,12 @@ func textSerializer() *markdown.Serializer {
 			state.RenderContent(node)
 		},
 		"taskList": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
-			state.RenderList(node, "", func(_ int) string { return "- " })
+			state.RenderList(node, "", func(i int) string {
+				if child, err := node.Child(i); err == nil && child.Type.Name == "taskList" {
+					return "  "
+				}
+				return "- "
+			})
 		},
 		"taskItem": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			state.RenderContent(node)
@@ -82,14 +93,19 @@ func textSerializer() *markdown.Serializer {
 		},
 		"status": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			if txt, ok := node.Attrs["text"].(string); ok {
-				state.Text(txt)
+				state.Text(txt, false)
+			}
+		},
+		"mention": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+			if txt, ok := node.Attrs["text"].(string); ok {
+				state.Text(txt, false)
 			}
 		},
 		"date": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			if ts, ok := node.Attrs["timestamp"].(string); ok {
 				if seconds, err := strconv.ParseInt(ts, 10, 64); err == nil {
 					txt := time.Unix(seconds/1000, 0).Format("2006-01-02")
-					state.Text(txt)
+					state.Text(txt, false)
 				}
 			}
 		},
@@ -109,6 +125,7 @@ func textSerializer() *markdown.Serializer {
 		"indentation": {},
 		"breakout":    {},
 		"underline":   {},
+		"highlight":   {},
 		"subsup":      {},
 		"textColor":   {},
 	}
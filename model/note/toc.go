@@ -0,0 +1,83 @@
+package note
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/cozy/prosemirror-go/model"
+)
+
+// TOCEntry is an entry in the table of contents of a note, for a heading.
+type TOCEntry struct {
+	Level  int    `json:"level"`
+	Text   string `json:"text"`
+	Anchor string `json:"anchor"`
+}
+
+// TableOfContents returns the entries for the headings of a document of a
+// note, in the order of the document. The anchors are the same as the ids of
+// the headings in the HTML export.
+func TableOfContents(node *model.Node) []TOCEntry {
+	var entries []TOCEntry
+	var anchors anchorSlugger
+	var walk func(n *model.Node)
+	walk = func(n *model.Node) {
+		if n.Type.Name == "heading" {
+			text := n.TextContent()
+			entries = append(entries, TOCEntry{
+				Level:  intAttr(n.Attrs, "level", 1),
+				Text:   text,
+				Anchor: anchors.anchor(text),
+			})
+			return
+		}
+		for _, child := range n.Content.Content {
+			walk(child)
+		}
+	}
+	walk(node)
+	return entries
+}
+
+// anchorSlugger computes the anchors for the headings of a document. The
+// anchors are unique: a suffix like -1 is added for the duplicates.
+type anchorSlugger struct {
+	seen map[string]bool
+}
+
+func (s *anchorSlugger) anchor(text string) string {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	base := slugify(text)
+	anchor := base
+	for i := 1; s.seen[anchor]; i++ {
+		anchor = fmt.Sprintf("%s-%d", base, i)
+	}
+	s.seen[anchor] = true
+	return anchor
+}
+
+// slugify returns a lowercase version of the text, with only the letters and
+// digits, and dashes for the spaces.
+func slugify(text string) string {
+	var buf strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			if dash && buf.Len() > 0 {
+				buf.WriteByte('-')
+			}
+			dash = false
+			buf.WriteRune(c)
+		case unicode.IsSpace(c) || c == '-' || c == '_':
+			dash = true
+		}
+	}
+	if buf.Len() == 0 {
+		return "section"
+	}
+	return buf.String()
+}
@@ -141,6 +141,13 @@ type File interface {
 	io.Closer
 }
 
+// AbortableFile is implemented by the files opened for writing that can be
+// aborted: the content is discarded, and Close returns the given error.
+type AbortableFile interface {
+	File
+	Abort(err error)
+}
+
 // FilePather is an interface for computing the fullpath of a filedoc
 type FilePather interface {
 	FilePath(doc *FileDoc) (string, error)
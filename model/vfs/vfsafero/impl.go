@@ -769,6 +769,13 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// Abort discards the content of the file: Close will return the given error.
+func (f *aferoFileCreation) Abort(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
 func (f *aferoFileCreation) Close() (err error) {
 	defer func() {
 		if err != nil {
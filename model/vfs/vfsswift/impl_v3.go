@@ -755,6 +755,13 @@ func (f *swiftFileCreationV3) Write(p []byte) (int, error) {
 	return n, nil
 }
 
+// Abort discards the content of the file: Close will return the given error.
+func (f *swiftFileCreationV3) Abort(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
 func (f *swiftFileCreationV3) Close() (err error) {
 	defer func() {
 		if err != nil {
@@ -1,10 +1,14 @@
 package build
 
+import "fmt"
+
 const (
 	// ModeDev is the development release value
 	ModeDev = "development"
 	// ModeProd is the production release value
 	ModeProd = "production"
+	// ModeTest is the value for a release used to run the tests
+	ModeTest = "test"
 )
 
 var (
@@ -14,10 +18,44 @@ var (
 	// the build
 	BuildTime string
 	// BuildMode is the build mode of the release. Should be either
-	// production or development.
+	// production, development or test.
 	BuildMode = ModeDev
 )
 
+// Mode is the build mode of a release.
+type Mode string
+
+// IsProduction returns true for the production mode.
+func (m Mode) IsProduction() bool {
+	return m == ModeProd
+}
+
+// IsDevelopment returns true for the development mode.
+func (m Mode) IsDevelopment() bool {
+	return m == ModeDev
+}
+
+// IsTest returns true for the test mode.
+func (m Mode) IsTest() bool {
+	return m == ModeTest
+}
+
+// CurrentMode returns the build mode of the release. If BuildMode is not a
+// known mode, an error is returned with the development mode.
+func CurrentMode() (Mode, error) {
+	return parseMode(BuildMode)
+}
+
+// parseMode returns the mode for the given value, or the development mode
+// and an error if the value is unknown.
+func parseMode(value string) (Mode, error) {
+	switch value {
+	case ModeDev, ModeProd, ModeTest:
+		return Mode(value), nil
+	}
+	return ModeDev, fmt.Errorf("unknown build mode %q, %s is used", value, ModeDev)
+}
+
 // IsDevRelease returns whether or not the binary is a development
 // release
 func IsDevRelease() bool {
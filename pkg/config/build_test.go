@@ -0,0 +1,42 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMode(t *testing.T) {
+	mode, err := parseMode("production")
+	require.NoError(t, err)
+	assert.True(t, mode.IsProduction())
+	assert.False(t, mode.IsDevelopment())
+	assert.False(t, mode.IsTest())
+
+	mode, err = parseMode("development")
+	require.NoError(t, err)
+	assert.False(t, mode.IsProduction())
+	assert.True(t, mode.IsDevelopment())
+	assert.False(t, mode.IsTest())
+
+	mode, err = parseMode("test")
+	require.NoError(t, err)
+	assert.False(t, mode.IsProduction())
+	assert.False(t, mode.IsDevelopment())
+	assert.True(t, mode.IsTest())
+
+	mode, err = parseMode("prod")
+	assert.EqualError(t, err, `unknown build mode "prod", development is used`)
+	assert.True(t, mode.IsDevelopment())
+}
+
+func TestCurrentMode(t *testing.T) {
+	defer func(mode string) { BuildMode = mode }(BuildMode)
+
+	BuildMode = ModeTest
+	mode, err := CurrentMode()
+	require.NoError(t, err)
+	assert.True(t, mode.IsTest())
+	assert.False(t, IsDevRelease())
+}
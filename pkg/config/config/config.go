@@ -2,19 +2,24 @@ package config
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"text/template"
 	"time"
@@ -29,7 +34,9 @@ import (
 	"github.com/cozy/cozy-stack/pkg/tlsclient"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/gomail"
+	"github.com/hashicorp/go-multierror"
 	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -79,13 +86,26 @@ const (
 	SchemeSwiftSecure = "swift+https"
 )
 
+// The default values for a minimal configuration, the same as the defaults of
+// the flags of the command line.
+const (
+	defaultHost     = "localhost"
+	defaultPort     = 8080
+	defaultLogLevel = "info"
+)
+
 // defaultAdminSecretFileName is the default name of the file containing the
 // administration hashed passphrase.
 const defaultAdminSecretFileName = "cozy-admin-passphrase"
 
-var (
-	config *Config
-)
+// defaultShutdownGraceTimeout is the delay to wait for the servers and the
+// jobs when the stack is stopped, if shutdown.grace_timeout is not set or is 0.
+const defaultShutdownGraceTimeout = 30 * time.Second
+
+// current is the configuration in use. It is replaced as a whole by UseViper
+// and Reload, so that the callers of GetConfig always see a consistent
+// snapshot.
+var current atomic.Pointer[Config]
 
 var log = logger.WithNamespace("config")
 
@@ -120,10 +140,15 @@ type Config struct {
 	Mail           *gomail.DialerOptions
 	MailPerContext map[string]interface{}
 	Move           Move
+	Notes          Notes
 	Notifications  Notifications
 	Flagship       Flagship
+	TLS            TLS
+	Logger         Logger
 
+	Redis             Redis
 	Lock              lock.Getter
+	LockTTL           time.Duration
 	Limiter           *limits.RateLimiter
 	SessionStorage    redis.UniversalClient
 	DownloadStorage   redis.UniversalClient
@@ -146,6 +171,17 @@ type Config struct {
 
 	AssetsPollingDisabled bool
 	AssetsPollingInterval time.Duration
+
+	Shutdown Shutdown
+
+	// Features are the flags of the stack for the experimental behaviors.
+	// They are not the feature flags of the instances, that are configured
+	// in the contexts.
+	Features map[string]bool
+
+	// invalid contains the errors for the values that could not be parsed,
+	// they are reported by Validate.
+	invalid []error
 }
 
 // ClouderyConfig for [cloudery.ClouderyService].
@@ -178,9 +214,27 @@ type FsVersioning struct {
 
 // CouchDBCluster contains the configuration values for a cluster of CouchDB.
 type CouchDBCluster struct {
-	Auth     *url.Userinfo
-	URL      *url.URL
+	Auth *url.Userinfo
+	// URL is the URL used for writing
+	URL *url.URL
+	// ReadURLs are the URLs of the replicas used for reading. When no
+	// replicas are configured, it contains only URL.
+	ReadURLs []*url.URL
 	Creation bool
+
+	next *uint32 // the index of the next read URL
+}
+
+// PickRead returns the URL to use for reading, by round-robin on ReadURLs.
+func (c CouchDBCluster) PickRead() *url.URL {
+	switch {
+	case len(c.ReadURLs) == 0:
+		return c.URL
+	case c.next == nil || len(c.ReadURLs) == 1:
+		return c.ReadURLs[0]
+	}
+	n := atomic.AddUint32(c.next, 1) - 1
+	return c.ReadURLs[n%uint32(len(c.ReadURLs))]
 }
 
 // CouchDB contains the configuration for the CouchDB clusters.
@@ -201,6 +255,22 @@ type Jobs struct {
 	// XXX for retro-compatibility
 	NbWorkers             int
 	DefaultDurationToKeep string
+	// AtGrace is the maximal delay after which an @at trigger that has not
+	// been fired at its time (the stack was down) is discarded.
+	AtGrace time.Duration
+	// PriorityAging is the time a job must wait in its queue to gain one
+	// level of priority. 0 (the default) disables the aging.
+	PriorityAging time.Duration
+	// Timeout is the maximal duration of a job for the workers that don't
+	// have their own timeout. 0 means the default timeout of the workers.
+	Timeout time.Duration
+}
+
+// Shutdown contains the configuration values for stopping the stack
+type Shutdown struct {
+	// GraceTimeout is the maximal delay to wait for the servers and the jobs
+	// to finish when the stack is stopped. It is never 0.
+	GraceTimeout time.Duration
 }
 
 // Konnectors contains the configuration values for the konnectors
@@ -213,6 +283,23 @@ type Move struct {
 	URL string
 }
 
+// Notes contains the configuration for the notes, to reject the notes that
+// are too large to be parsed, and for the options of their import.
+type Notes struct {
+	// MaxSize is the maximal size in bytes of the markdown of a note. It is
+	// capped by note.MaxMarkdownSize, and 0 means this hard limit.
+	MaxSize int64
+	// MaxNodes is the maximal number of nodes in the document of a note. 0
+	// means no limit.
+	MaxNodes int
+	// Linkify converts the bare URLs and email addresses of the imported
+	// notes to links.
+	Linkify bool
+	// Emojis converts the shortcodes of the imported notes, like :smile:, to
+	// their emojis.
+	Emojis bool
+}
+
 // Office contains the configuration for collaborative edition of office
 // documents
 type Office struct {
@@ -221,6 +308,136 @@ type Office struct {
 	OutboxSecret  string
 }
 
+// Redis contains the main configuration of redis, from the redis section. The
+// parts of the stack use their own database of this redis (see GetRedis).
+type Redis struct {
+	// URL is used for a single node, like redis://localhost:6379/0
+	URL string
+	// Addrs is a seed list of host:port addresses of cluster/sentinel nodes
+	Addrs    []string
+	Password string
+	// DB is the database used by the parts of the stack that have no number
+	// in redis.databases. When it is not set, the database of the URL is
+	// used.
+	DB       int
+	PoolSize int
+	// ClusterMode forces a cluster client, even with a single address. The
+	// cluster nodes have only one database, so the DB numbers are ignored.
+	ClusterMode bool
+}
+
+// Enabled returns true if redis has been configured.
+func (r Redis) Enabled() bool {
+	return r.URL != "" || len(r.Addrs) > 0
+}
+
+// options returns the options of the redis clients for this configuration, or
+// nil if redis is not configured.
+func (r Redis) options() (*redis.UniversalOptions, error) {
+	if r.URL != "" && len(r.Addrs) > 0 {
+		return nil, errors.New("config: redis.url and redis.addrs can't be used together")
+	}
+	if r.URL != "" {
+		opts, err := redis.ParseURL(r.URL)
+		if err != nil {
+			return nil, fmt.Errorf("config: can't parse redis URL(%s): %s", r.URL, err)
+		}
+		password := opts.Password
+		if r.Password != "" {
+			password = r.Password
+		}
+		return &redis.UniversalOptions{
+			Addrs:     []string{opts.Addr},
+			Username:  opts.Username,
+			Password:  password,
+			DB:        r.DB,
+			PoolSize:  r.PoolSize,
+			TLSConfig: opts.TLSConfig,
+		}, nil
+	}
+	if len(r.Addrs) == 0 {
+		return nil, nil
+	}
+	return &redis.UniversalOptions{
+		Addrs:    r.Addrs,
+		Password: r.Password,
+		DB:       r.DB,
+		PoolSize: r.PoolSize,
+	}, nil
+}
+
+// NewClient returns a redis client for this configuration, or nil if redis
+// is not configured.
+func (r Redis) NewClient() (redis.UniversalClient, error) {
+	opts, err := r.options()
+	if err != nil || opts == nil {
+		return nil, err
+	}
+	return newRedisClient(opts, r.ClusterMode), nil
+}
+
+func newRedisClient(opts *redis.UniversalOptions, clusterMode bool) redis.UniversalClient {
+	if clusterMode {
+		return redis.NewClusterClient(opts.Cluster())
+	}
+	return redis.NewUniversalClient(opts)
+}
+
+// TLS contains the configuration for serving HTTPS directly from the stack.
+// When CertFile is empty, TLS is disabled.
+type TLS struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion uint16
+	// ClientCAFile is optional, and when it is set, the clients must present
+	// a certificate signed by this CA (mTLS).
+	ClientCAFile string
+}
+
+// Enabled returns true if the stack must serve HTTPS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// ServerConfig loads the certificates and returns the TLS configuration for
+// an HTTPS server.
+func (t TLS) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   t.MinVersion,
+	}
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: no certificate found in %q", t.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// Logger contains the configuration values of the logs
+type Logger struct {
+	Level string
+	// Format is the format of the logs: text or json.
+	Format string
+	// Output is where the logs are written: stderr, stdout, or the path of a
+	// file.
+	Output string
+
+	file  *os.File
+	redis redis.UniversalClient
+}
+
 // Notifications contains the configuration for the mobile push-notification
 // center, for Android and iOS
 type Notifications struct {
@@ -278,6 +495,7 @@ type Worker struct {
 	WorkerType   string
 	Concurrency  *int
 	MaxExecCount *int
+	MaxRetries   *int
 	Timeout      *time.Duration
 }
 
@@ -307,11 +525,19 @@ func GetRedis(v *viper.Viper, mainOpt *redis.UniversalOptions, key, ptr string)
 		return redis.NewClient(localOpt), nil
 	}
 
-	redisKey := fmt.Sprintf("redis.databases.%s", key)
-
 	opts := *mainOpt
+	clusterMode := v.GetBool("redis.cluster_mode")
+	if clusterMode {
+		return newRedisClient(&opts, clusterMode), nil
+	}
+
+	redisKey := fmt.Sprintf("redis.databases.%s", key)
 	dbNumber := v.GetString(redisKey)
 	if dbNumber == "" {
+		// The default database is used only when it has been configured
+		if v.IsSet("redis.db") || v.GetString("redis.url") != "" {
+			return newRedisClient(&opts, clusterMode), nil
+		}
 		return nil, fmt.Errorf("config: missing DB number for database %q "+"in the field %q", key, redisKey)
 	}
 	opts.DB, err = strconv.Atoi(dbNumber)
@@ -319,61 +545,64 @@ func GetRedis(v *viper.Viper, mainOpt *redis.UniversalOptions, key, ptr string)
 		return nil, fmt.Errorf("config: could not parse key %q: %s", redisKey, err)
 	}
 
-	return redis.NewUniversalClient(&opts), nil
+	return newRedisClient(&opts, clusterMode), nil
 }
 
 // FsURL returns a copy of the filesystem URL
 func FsURL() *url.URL {
-	return config.Fs.URL
+	return GetConfig().Fs.URL
 }
 
 // ServerAddr returns the address on which the stack is run
 func ServerAddr() string {
-	return net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	c := GetConfig()
+	return net.JoinHostPort(c.HostOrDefault(), strconv.Itoa(c.PortOrDefault()))
 }
 
 // AdminServerAddr returns the address on which the administration is listening
 func AdminServerAddr() string {
-	return net.JoinHostPort(config.AdminHost, strconv.Itoa(config.AdminPort))
+	c := GetConfig()
+	return net.JoinHostPort(c.AdminHost, strconv.Itoa(c.AdminPort))
 }
 
 // CouchCluster returns the CouchDB configuration for the given cluster.
 func CouchCluster(n int) CouchDBCluster {
-	if 0 <= n && n < len(config.CouchDB.Clusters) {
-		return config.CouchDB.Clusters[n]
+	couch := GetConfig().CouchDB
+	if 0 <= n && n < len(couch.Clusters) {
+		return couch.Clusters[n]
 	}
-	return config.CouchDB.Global
+	return couch.Global
 }
 
 // CouchClient returns the http client to use when making requests to a CouchDB
 // cluster.
 func CouchClient() *http.Client {
-	return config.CouchDB.Client
+	return GetConfig().CouchDB.Client
 }
 
 // Lock return the lock getter.
 func Lock() lock.Getter {
-	return config.Lock
+	return GetConfig().Lock
 }
 
 // GetConfig returns the configured instance of Config
 func GetConfig() *Config {
-	return config
+	return current.Load()
 }
 
 // Avatars return the configured initials service.
 func Avatars() *avatar.Service {
-	return config.Avatars
+	return GetConfig().Avatars
 }
 
 // GetKeyring returns the configured instance of [keyring.Keyring]
 func GetKeyring() keyring.Keyring {
-	return config.Keyring
+	return GetConfig().Keyring
 }
 
 // GetRateLimiter return the setup rate limiter.
 func GetRateLimiter() *limits.RateLimiter {
-	return config.Limiter
+	return GetConfig().Limiter
 }
 
 // GetOIDC returns the OIDC config for the given context (with a boolean to say
@@ -382,7 +611,7 @@ func GetOIDC(contextName string) (map[string]interface{}, bool) {
 	if contextName == "" {
 		return nil, false
 	}
-	auth, ok := config.Authentication[contextName].(map[string]interface{})
+	auth, ok := GetConfig().Authentication[contextName].(map[string]interface{})
 	if !ok {
 		return nil, false
 	}
@@ -396,7 +625,7 @@ func GetFranceConnect(contextName string) (map[string]interface{}, bool) {
 	if contextName == "" {
 		return nil, false
 	}
-	auth, ok := config.Authentication[contextName].(map[string]interface{})
+	auth, ok := GetConfig().Authentication[contextName].(map[string]interface{})
 	if !ok {
 		return nil, false
 	}
@@ -408,16 +637,44 @@ var defaultPasswordResetInterval = 15 * time.Minute
 
 // PasswordResetInterval returns the minimal delay between two password reset
 func PasswordResetInterval() time.Duration {
-	return config.PasswordResetInterval
+	return GetConfig().PasswordResetInterval
 }
 
 // Setup Viper to read the environment and the optional config file
-func Setup(cfgFile string) (err error) {
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.SetEnvPrefix("cozy")
-	viper.AutomaticEnv()
+func Setup(cfgFile string) error {
+	bindEnv(viper.GetViper())
 	applyDefaults(viper.GetViper())
+	if err := readConfigFiles(viper.GetViper(), cfgFile); err != nil {
+		return err
+	}
+	return UseViper(viper.GetViper())
+}
+
+// ReloadFiles reads again the config files, and reloads the configuration
+// with them. It can be called when the stack receives a SIGHUP signal.
+//
+// The files are read in a new viper, so that a key removed from the files
+// doesn't keep its old value, and that the configuration is left untouched if
+// a file is invalid. Then, the values from the files replace the ones of the
+// global viper, which keeps the flags of the command line bound to it.
+func ReloadFiles(cfgFile string) error {
+	files := viper.New()
+	if err := readConfigFiles(files, cfgFile); err != nil {
+		return err
+	}
+	v := viper.GetViper()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(nil)); err != nil {
+		return err
+	}
+	if err := v.MergeConfigMap(files.AllSettings()); err != nil {
+		return err
+	}
+	return Reload(v)
+}
 
+// readConfigFiles merges the config files in the given viper.
+func readConfigFiles(v *viper.Viper, cfgFile string) (err error) {
 	var cfgFiles []string
 	if cfgFile == "" {
 		cfgFiles, err = findConfigFiles(Filename)
@@ -429,7 +686,7 @@ func Setup(cfgFile string) (err error) {
 	}
 
 	if len(cfgFiles) == 0 {
-		return UseViper(viper.GetViper())
+		return nil
 	}
 
 	log.Debugf("Using config files: %s", cfgFiles)
@@ -459,9 +716,9 @@ func Setup(cfgFile string) (err error) {
 
 		cfgFile = regexp.MustCompile(`\.local$`).ReplaceAllString(cfgFile, "")
 		if ext := filepath.Ext(cfgFile); len(ext) > 0 {
-			viper.SetConfigType(ext[1:])
+			v.SetConfigType(ext[1:])
 		}
-		if err := viper.MergeConfig(dest); err != nil {
+		if err := v.MergeConfig(dest); err != nil {
 			if _, isParseErr := err.(viper.ConfigParseError); isParseErr {
 				log.Errorf("Failed to read cozy-stack configurations from %s", cfgFile)
 				log.Errorf(dest.String())
@@ -470,19 +727,76 @@ func Setup(cfgFile string) (err error) {
 		}
 	}
 
-	return UseViper(viper.GetViper())
+	return nil
+}
+
+// bindEnv makes the COZY_* environment variables override the values of the
+// configuration, like COZY_COUCHDB_URL for couchdb.url.
+func bindEnv(v *viper.Viper) {
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.SetEnvPrefix("cozy")
+	v.AutomaticEnv()
+}
+
+// applyModeOverrides merges the section named after the build mode
+// (development or production) on top of the rest of the configuration. The
+// merge is deep: a key of this section replaces only the same key of the
+// configuration, not the whole parent section.
+func applyModeOverrides(v *viper.Viper) error {
+	overrides := v.GetStringMap(build.BuildMode)
+	if len(overrides) == 0 {
+		return nil
+	}
+	if err := v.MergeConfigMap(overrides); err != nil {
+		return fmt.Errorf("failed to apply the %s section: %w", build.BuildMode, err)
+	}
+	return nil
 }
 
 func applyDefaults(v *viper.Viper) {
+	v.SetDefault("host", defaultHost)
+	v.SetDefault("port", defaultPort)
+	v.SetDefault("log.level", defaultLogLevel)
+	v.SetDefault("couchdb.url", "http://localhost:5984/")
 	v.SetDefault("password_reset_interval", defaultPasswordResetInterval)
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
 	v.SetDefault("jobs.defaultDurationToKeep", "2W")
+	v.SetDefault("jobs.at_grace", 24*time.Hour)
 	v.SetDefault("assets_polling_disabled", false)
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
+	v.SetDefault("shutdown.grace_timeout", defaultShutdownGraceTimeout)
+	v.SetDefault("notes.max_size", 2*1024*1024)
+	v.SetDefault("notes.max_nodes", 100000)
+	v.SetDefault("log.format", "text")
+	v.SetDefault("log.output", "stderr")
 	v.SetDefault("fs.versioning.max_number_of_versions_to_keep", 20)
 	v.SetDefault("fs.versioning.min_delay_between_two_versions", 15*time.Minute)
 }
 
+// parseDuration returns the duration for the given key. Contrary to
+// viper.GetDuration, it returns an error if the value is not a valid duration.
+func parseDuration(v *viper.Viper, key string) (time.Duration, error) {
+	switch val := v.Get(key).(type) {
+	case nil:
+		return 0, nil
+	case time.Duration:
+		return val, nil
+	case int:
+		return time.Duration(val), nil
+	case string:
+		if val == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return 0, fmt.Errorf("%s should be a duration, was: %q", key, val)
+		}
+		return d, nil
+	default:
+		return 0, fmt.Errorf("%s should be a duration, was: %v", key, val)
+	}
+}
+
 func envMap() map[string]string {
 	env := make(map[string]string)
 	for _, i := range os.Environ() {
@@ -500,8 +814,52 @@ func max(a, b int) int {
 	return b
 }
 
-// UseViper sets the configured instance of Config
+// UseViper sets the configured instance of Config. The environment variables
+// with the COZY_ prefix take precedence over the values of the config file.
 func UseViper(v *viper.Viper) error {
+	return useViper(v, false)
+}
+
+// Reload replaces the configuration by a new one built from viper, like
+// UseViper. The readers of GetConfig see either the old or the new
+// configuration, never a mix of them. The parts of the configuration that are
+// used when the stack starts (listening addresses, file system, CouchDB,
+// redis, jobs, etc.) are kept from the current configuration, as they require
+// a restart to be changed, and their clients are reused.
+func Reload(v *viper.Viper) error {
+	return useViper(v, true)
+}
+
+func useViper(v *viper.Viper, reload bool) error {
+	bindEnv(v)
+	applyDefaults(v)
+	if _, err := build.CurrentMode(); err != nil {
+		log.Warnf("%s", err)
+	}
+	if err := applyModeOverrides(v); err != nil {
+		return err
+	}
+
+	var invalid []error
+	duration := func(key string) time.Duration {
+		d, err := parseDuration(v, key)
+		if err != nil {
+			invalid = append(invalid, err)
+		}
+		return d
+	}
+	lockTTL := duration("lock.ttl")
+	shutdownGraceTimeout := duration("shutdown.grace_timeout")
+	if shutdownGraceTimeout == 0 {
+		shutdownGraceTimeout = defaultShutdownGraceTimeout
+	}
+	features := makeFeatures(v, &invalid)
+
+	// On reload, the clients of the old configuration are kept (see
+	// keepRestartRequired), and new ones are not created.
+	old := GetConfig()
+	reuse := reload && old != nil
+
 	fsURL, err := url.Parse(v.GetString("fs.url"))
 	if err != nil {
 		return err
@@ -516,24 +874,34 @@ func UseViper(v *viper.Viper) error {
 		}
 	}
 
-	couch, err := makeCouch(v)
+	var couchClient *http.Client
+	if reuse {
+		couchClient = old.CouchDB.Client
+	}
+	couch, err := makeCouch(v, couchClient)
 	if err != nil {
 		return err
 	}
 
-	fsClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
-		RootCAFile: v.GetString("fs.root_ca"),
-		ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
-			CertificateFile: v.GetString("fs.client_cert"),
-			KeyFile:         v.GetString("fs.client_key"),
-		},
-		PinnedKey:              v.GetString("fs.pinned_key"),
-		InsecureSkipValidation: v.GetBool("fs.insecure_skip_validation"),
-		MaxIdleConnsPerHost:    128,
-		DisableCompression:     true,
-	})
-	if err != nil {
-		return err
+	var fsTransport http.RoundTripper
+	if reuse {
+		fsTransport = old.Fs.Transport
+	} else {
+		fsClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+			RootCAFile: v.GetString("fs.root_ca"),
+			ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
+				CertificateFile: v.GetString("fs.client_cert"),
+				KeyFile:         v.GetString("fs.client_key"),
+			},
+			PinnedKey:              v.GetString("fs.pinned_key"),
+			InsecureSkipValidation: v.GetBool("fs.insecure_skip_validation"),
+			MaxIdleConnsPerHost:    128,
+			DisableCompression:     true,
+		})
+		if err != nil {
+			return err
+		}
+		fsTransport = fsClient.Transport
 	}
 
 	regs, err := makeRegistries(v)
@@ -546,6 +914,11 @@ func UseViper(v *viper.Viper) error {
 		return err
 	}
 
+	tlsConf, err := makeTLS(v)
+	if err != nil {
+		return err
+	}
+
 	var subdomains SubdomainType
 	if subs := v.GetString("subdomains"); subs != "" {
 		switch subs {
@@ -560,78 +933,32 @@ func UseViper(v *viper.Viper) error {
 		subdomains = NestedSubdomains
 	}
 
-	var redisOptions *redis.UniversalOptions
-	if v.GetString("redis.addrs") != "" {
-		// Default go-redis pool size is 10 * runtime.NumCPU() which is
-		// too short on a single-cpu server, we consume at leat 19 connections,
-		// so we enforce a minimum of 25, keeping the default 10 * runtime*NumCPU()
-		// if larger
-		redisPoolSize := v.GetInt("redis.pool_size")
-		if redisPoolSize < 25 {
-			if redisPoolSize != 0 {
-				log.Warnf("Redis pool size set smaller than 25. Using default value.")
-			}
-			redisPoolSize = max(25, 10*runtime.NumCPU())
-		}
-
-		redisOptions = &redis.UniversalOptions{
-			// Either a single address or a seed list of host:port addresses
-			// of cluster/sentinel nodes.
-			Addrs: v.GetStringSlice("redis.addrs"),
-
-			// The sentinel master name.
-			// Only failover clients.
-			MasterName: v.GetString("redis.master"),
-
-			// Enables read only queries on slave nodes.
-			ReadOnly: v.GetBool("redis.read_only_slave"),
-
-			MaxRetries:      v.GetInt("redis.max_retries"),
-			Password:        v.GetString("redis.password"),
-			DialTimeout:     v.GetDuration("redis.dial_timeout"),
-			ReadTimeout:     v.GetDuration("redis.read_timeout"),
-			WriteTimeout:    v.GetDuration("redis.write_timeout"),
-			PoolSize:        redisPoolSize,
-			PoolTimeout:     v.GetDuration("redis.pool_timeout"),
-			ConnMaxIdleTime: v.GetDuration("redis.idle_timeout"),
-		}
-	}
-
-	jobsRedis, err := GetRedis(v, redisOptions, "jobs", "url")
-	if err != nil {
-		return err
-	}
-	lockRedis, err := GetRedis(v, redisOptions, "lock", "url")
-	if err != nil {
-		return err
-	}
-	sessionsRedis, err := GetRedis(v, redisOptions, "sessions", "url")
-	if err != nil {
-		return err
-	}
-	downloadRedis, err := GetRedis(v, redisOptions, "downloads", "url")
-	if err != nil {
-		return err
-	}
-	rateLimitingRedis, err := GetRedis(v, redisOptions, "rate_limiting", "url")
+	redisConf, err := makeRedis(v)
 	if err != nil {
 		return err
 	}
-	oauthStateRedis, err := GetRedis(v, redisOptions, "konnectors", "oauthstate")
-	if err != nil {
-		return err
-	}
-	realtimeRedis, err := GetRedis(v, redisOptions, "realtime", "url")
-	if err != nil {
-		return err
-	}
-	loggerRedis, err := GetRedis(v, redisOptions, "log", "redis")
+	// The addresses, password, database and pool size come from the Redis
+	// struct, with either a single address for redis.url, or a seed list of
+	// host:port addresses of cluster/sentinel nodes for redis.addrs.
+	redisOptions, err := redisConf.options()
 	if err != nil {
 		return err
 	}
+	if redisOptions != nil {
+		// The sentinel master name.
+		// Only failover clients.
+		redisOptions.MasterName = v.GetString("redis.master")
 
-	// cache entry is optional
-	cacheRedis, _ := GetRedis(v, redisOptions, "cache", "url")
+		// Enables read only queries on slave nodes.
+		redisOptions.ReadOnly = v.GetBool("redis.read_only_slave")
+
+		redisOptions.MaxRetries = v.GetInt("redis.max_retries")
+		redisOptions.DialTimeout = v.GetDuration("redis.dial_timeout")
+		redisOptions.ReadTimeout = v.GetDuration("redis.read_timeout")
+		redisOptions.WriteTimeout = v.GetDuration("redis.write_timeout")
+		redisOptions.PoolTimeout = v.GetDuration("redis.pool_timeout")
+		redisOptions.ConnMaxIdleTime = v.GetDuration("redis.idle_timeout")
+	}
 
 	adminSecretFile := v.GetString("admin.secret_filename")
 	if adminSecretFile == "" {
@@ -639,9 +966,11 @@ func UseViper(v *viper.Viper) error {
 	}
 
 	jobs := Jobs{
-		Client:                jobsRedis,
 		ImageMagickConvertCmd: v.GetString("jobs.imagemagick_convert_cmd"),
 		DefaultDurationToKeep: v.GetString("jobs.defaultDurationToKeep"),
+		AtGrace:               duration("jobs.at_grace"),
+		PriorityAging:         duration("jobs.priority_aging"),
+		Timeout:               duration("jobs.timeout"),
 	}
 	{
 		if allow := v.GetBool("jobs.allowlist"); allow {
@@ -675,6 +1004,10 @@ func UseViper(v *viper.Viper) error {
 							if maxExecCount, ok := v.(int); ok {
 								w.MaxExecCount = &maxExecCount
 							}
+						case "max_retries":
+							if maxRetries, ok := v.(int); ok {
+								w.MaxRetries = &maxRetries
+							}
 						case "timeout":
 							if timeout, ok := v.(string); ok {
 								var d time.Duration
@@ -731,9 +1064,6 @@ func UseViper(v *viper.Viper) error {
 		}
 	}
 
-	cacheStorage := cache.New(cacheRedis)
-	avatars := avatar.NewService(cacheStorage, v.GetString("jobs.imagemagick_convert_cmd"))
-
 	// Setup keyring
 	var keyringCfg keyring.Config
 	err = v.UnmarshalKey("vault", &keyringCfg)
@@ -745,7 +1075,7 @@ func UseViper(v *viper.Viper) error {
 		return fmt.Errorf("failed to setup the keyring: %w", err)
 	}
 
-	config = &Config{
+	config := &Config{
 		Host: v.GetString("host"),
 		Port: v.GetInt("port"),
 
@@ -765,11 +1095,10 @@ func UseViper(v *viper.Viper) error {
 
 		RemoteAssets: v.GetStringMapString("remote_assets"),
 
-		Avatars: avatars,
 		Keyring: keyring,
 		Fs: Fs{
 			URL:                   fsURL,
-			Transport:             fsClient.Transport,
+			Transport:             fsTransport,
 			DefaultLayout:         defaultLayout,
 			CanQueryInfo:          v.GetBool("fs.can_query_info"),
 			AutoCleanTrashedAfter: v.GetStringMapString("fs.auto_clean_trashed_after"),
@@ -787,6 +1116,12 @@ func UseViper(v *viper.Viper) error {
 		Move: Move{
 			URL: v.GetString("move.url"),
 		},
+		Notes: Notes{
+			MaxSize:  v.GetInt64("notes.max_size"),
+			MaxNodes: v.GetInt("notes.max_nodes"),
+			Linkify:  v.GetBool("notes.linkify"),
+			Emojis:   v.GetBool("notes.emojis"),
+		},
 		Notifications: Notifications{
 			Development: v.GetBool("notifications.development"),
 
@@ -809,13 +1144,14 @@ func UseViper(v *viper.Viper) error {
 			APKCertificateDigests: v.GetStringSlice("flagship.apk_certificate_digests"),
 			AppleAppIDs:           v.GetStringSlice("flagship.apple_app_ids"),
 		},
-		Lock:              lock.New(lockRedis),
-		SessionStorage:    sessionsRedis,
-		DownloadStorage:   downloadRedis,
-		Limiter:           limits.NewRateLimiter(rateLimitingRedis),
-		OauthStateStorage: oauthStateRedis,
-		Realtime:          realtimeRedis,
-		CacheStorage:      cacheStorage,
+		Logger: Logger{
+			Level:  v.GetString("log.level"),
+			Format: v.GetString("log.format"),
+			Output: v.GetString("log.output"),
+		},
+		TLS:     tlsConf,
+		Redis:   redisConf,
+		LockTTL: lockTTL,
 		Mail: &gomail.DialerOptions{
 			Host:                      v.GetString("mail.host"),
 			Port:                      v.GetInt("mail.port"),
@@ -837,6 +1173,14 @@ func UseViper(v *viper.Viper) error {
 
 		AssetsPollingDisabled: v.GetBool("assets_polling_disabled"),
 		AssetsPollingInterval: v.GetDuration("assets_polling_interval"),
+
+		Shutdown: Shutdown{
+			GraceTimeout: shutdownGraceTimeout,
+		},
+
+		Features: features,
+
+		invalid: invalid,
 	}
 
 	err = v.UnmarshalKey("deprecated_apps", &config.DeprecatedApps)
@@ -862,9 +1206,16 @@ func UseViper(v *viper.Viper) error {
 		config.RemoteAllowCustomPort = true
 	}
 
+	if reuse {
+		keepRestartRequired(old, config)
+	} else if err = config.connectRedis(v, redisOptions); err != nil {
+		return err
+	}
+
 	loggerOpts := logger.Options{
-		Level: v.GetString("log.level"),
-		Redis: loggerRedis,
+		Level:  config.Logger.Level,
+		Format: config.Logger.Format,
+		Redis:  config.Logger.redis,
 	}
 
 	if v.GetBool("log.syslog") {
@@ -878,28 +1229,260 @@ func UseViper(v *viper.Viper) error {
 		loggerOpts.Output = io.Discard
 	}
 
+	if err = config.Validate(); err != nil {
+		return err
+	}
+	if loggerOpts.Output == nil {
+		loggerOpts.Output, config.Logger.file, err = openLogOutput(config.Logger.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	current.Store(config)
+
 	if err = logger.Init(loggerOpts); err != nil {
 		return err
 	}
+	if old != nil && old.Logger.file != nil && old.Logger.file != config.Logger.file {
+		old.Logger.file.Close()
+	}
 
 	return nil
 }
 
-func makeCouch(v *viper.Viper) (CouchDB, error) {
-	var couch CouchDB
-	couchClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
-		Timeout:             10 * time.Second,
-		MaxIdleConnsPerHost: 20,
-		RootCAFile:          v.GetString("couchdb.root_ca"),
-		ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
-			CertificateFile: v.GetString("couchdb.client_cert"),
-			KeyFile:         v.GetString("couchdb.client_key"),
-		},
-		PinnedKey:              v.GetString("couchdb.pinned_key"),
-		InsecureSkipValidation: v.GetBool("couchdb.insecure_skip_validation"),
-	})
+// HostOrDefault returns the host of the server, or localhost if it is not set.
+func (c *Config) HostOrDefault() string {
+	if c.Host == "" {
+		return defaultHost
+	}
+	return c.Host
+}
+
+// PortOrDefault returns the port of the server, or 8080 if it is not set.
+func (c *Config) PortOrDefault() int {
+	if c.Port == 0 {
+		return defaultPort
+	}
+	return c.Port
+}
+
+// LogLevelOrDefault returns the level of the logs, or info if it is not set.
+func (c *Config) LogLevelOrDefault() string {
+	if c.Logger.Level == "" {
+		return defaultLogLevel
+	}
+	return c.Logger.Level
+}
+
+// FeatureEnabled returns true if the flag with the given name is enabled in
+// the features section of the configuration. The unknown flags are disabled.
+func (c *Config) FeatureEnabled(name string) bool {
+	return c.Features[strings.ToLower(name)]
+}
+
+// Validate checks the values of the configuration, and returns an error that
+// lists all the problems.
+func (c *Config) Validate() error {
+	var errm error
+	if c.Port < 1 || c.Port > 65535 {
+		errm = multierror.Append(errm,
+			fmt.Errorf("port should be between 1 and 65535, was: %d", c.Port))
+	}
+	if u := c.Fs.URL; u != nil && u.String() != "" {
+		switch u.Scheme {
+		case SchemeFile, SchemeMem, SchemeSwift, SchemeSwiftSecure:
+		default:
+			errm = multierror.Append(errm,
+				fmt.Errorf("fs.url should use a file, mem, swift or swift+https scheme, was: %q", u))
+		}
+	}
+	if u := c.CouchDB.Global.URL; u == nil || u.Scheme == "" || u.Host == "" {
+		errm = multierror.Append(errm,
+			fmt.Errorf("couchdb.url should be an absolute URL, was: %q", u))
+	}
+	if c.Logger.Level != "" {
+		if _, err := logrus.ParseLevel(c.Logger.Level); err != nil {
+			errm = multierror.Append(errm,
+				fmt.Errorf("log.level should be a known level, was: %q", c.Logger.Level))
+		}
+	}
+	switch c.Logger.Format {
+	case "", "text", "json":
+	default:
+		errm = multierror.Append(errm,
+			fmt.Errorf("log.format should be text or json, was: %q", c.Logger.Format))
+	}
+	if m := c.Mail; m != nil && m.Host == "" && (m.Port != 0 || m.Username != "" || m.Password != "") {
+		errm = multierror.Append(errm,
+			errors.New("mail.host should be set when the mail server is configured"))
+	}
+	if c.NoReplyAddr != "" {
+		if _, err := mail.ParseAddress(c.NoReplyAddr); err != nil {
+			errm = multierror.Append(errm,
+				fmt.Errorf("mail.noreply_address should be an email address, was: %q", c.NoReplyAddr))
+		}
+	}
+	if c.Shutdown.GraceTimeout < 0 {
+		errm = multierror.Append(errm,
+			fmt.Errorf("shutdown.grace_timeout should not be negative, was: %s", c.Shutdown.GraceTimeout))
+	}
+	if c.Notes.MaxSize < 0 {
+		errm = multierror.Append(errm,
+			fmt.Errorf("notes.max_size should not be negative, was: %d", c.Notes.MaxSize))
+	}
+	if c.Notes.MaxNodes < 0 {
+		errm = multierror.Append(errm,
+			fmt.Errorf("notes.max_nodes should not be negative, was: %d", c.Notes.MaxNodes))
+	}
+	for _, err := range c.invalid {
+		errm = multierror.Append(errm, err)
+	}
+	if errm != nil {
+		return fmt.Errorf("Invalid configuration: %w", errm)
+	}
+	return nil
+}
+
+// openLogOutput returns the writer for the output of the logs. For a path, the
+// file is opened in append mode, and must be closed when it is no longer used.
+func openLogOutput(output string) (io.Writer, *os.File, error) {
+	switch output {
+	case "", "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
 	if err != nil {
-		return couch, err
+		return nil, nil, fmt.Errorf("log.output cannot be opened: %w", err)
+	}
+	return f, f, nil
+}
+
+// connectRedis creates the redis clients used by the parts of the stack, and
+// the services that depend on them.
+func (c *Config) connectRedis(v *viper.Viper, opts *redis.UniversalOptions) error {
+	jobsRedis, err := GetRedis(v, opts, "jobs", "url")
+	if err != nil {
+		return err
+	}
+	lockRedis, err := GetRedis(v, opts, "lock", "url")
+	if err != nil {
+		return err
+	}
+	sessionsRedis, err := GetRedis(v, opts, "sessions", "url")
+	if err != nil {
+		return err
+	}
+	downloadRedis, err := GetRedis(v, opts, "downloads", "url")
+	if err != nil {
+		return err
+	}
+	rateLimitingRedis, err := GetRedis(v, opts, "rate_limiting", "url")
+	if err != nil {
+		return err
+	}
+	oauthStateRedis, err := GetRedis(v, opts, "konnectors", "oauthstate")
+	if err != nil {
+		return err
+	}
+	realtimeRedis, err := GetRedis(v, opts, "realtime", "url")
+	if err != nil {
+		return err
+	}
+	loggerRedis, err := GetRedis(v, opts, "log", "redis")
+	if err != nil {
+		return err
+	}
+
+	// cache entry is optional
+	cacheRedis, _ := GetRedis(v, opts, "cache", "url")
+
+	c.Jobs.Client = jobsRedis
+	c.Lock = lock.New(lockRedis, lock.WithTTL(c.LockTTL))
+	c.SessionStorage = sessionsRedis
+	c.DownloadStorage = downloadRedis
+	c.Limiter = limits.NewRateLimiter(rateLimitingRedis)
+	c.OauthStateStorage = oauthStateRedis
+	c.Realtime = realtimeRedis
+	c.CacheStorage = cache.New(cacheRedis)
+	c.Avatars = avatar.NewService(c.CacheStorage, c.Jobs.ImageMagickConvertCmd)
+	c.Logger.redis = loggerRedis
+	return nil
+}
+
+// keepRestartRequired copies to the new configuration the parts of the old
+// configuration that can't be reloaded, and warns if they have been changed.
+func keepRestartRequired(old, config *Config) {
+	if old == nil {
+		return
+	}
+	var changed []string
+	check := func(name string, before, after interface{}) {
+		if !reflect.DeepEqual(before, after) {
+			changed = append(changed, name)
+		}
+	}
+	check("host", old.Host, config.Host)
+	check("port", old.Port, config.Port)
+	check("admin.host", old.AdminHost, config.AdminHost)
+	check("admin.port", old.AdminPort, config.AdminPort)
+	check("subdomains", old.Subdomains, config.Subdomains)
+	check("fs.url", old.Fs.URL, config.Fs.URL)
+	check("couchdb.url", old.CouchDB.Global.URL, config.CouchDB.Global.URL)
+	jobs := config.Jobs
+	jobs.Client = old.Jobs.Client
+	check("jobs", old.Jobs, jobs)
+	check("redis", old.Redis, config.Redis)
+	check("tls", old.TLS, config.TLS)
+	check("lock.ttl", old.LockTTL, config.LockTTL)
+	if len(changed) > 0 {
+		log.Warnf("Reload: %s cannot be changed without a restart",
+			strings.Join(changed, ", "))
+	}
+
+	config.Host, config.Port = old.Host, old.Port
+	config.AdminHost, config.AdminPort = old.AdminHost, old.AdminPort
+	config.Subdomains = old.Subdomains
+	config.Fs = old.Fs
+	config.Keyring = old.Keyring
+	config.CouchDB = old.CouchDB
+	config.Jobs = old.Jobs
+	config.Redis = old.Redis
+	config.TLS = old.TLS
+	config.Lock = old.Lock
+	config.LockTTL = old.LockTTL
+	config.Limiter = old.Limiter
+	config.SessionStorage = old.SessionStorage
+	config.DownloadStorage = old.DownloadStorage
+	config.OauthStateStorage = old.OauthStateStorage
+	config.Realtime = old.Realtime
+	config.CacheStorage = old.CacheStorage
+	config.Avatars = old.Avatars
+	config.Logger.redis = old.Logger.redis
+}
+
+// makeCouch returns the CouchDB configuration. The HTTP client is created only
+// when couchClient is nil.
+func makeCouch(v *viper.Viper, couchClient *http.Client) (CouchDB, error) {
+	var couch CouchDB
+	if couchClient == nil {
+		var err error
+		couchClient, _, err = tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+			Timeout:             10 * time.Second,
+			MaxIdleConnsPerHost: 20,
+			RootCAFile:          v.GetString("couchdb.root_ca"),
+			ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
+				CertificateFile: v.GetString("couchdb.client_cert"),
+				KeyFile:         v.GetString("couchdb.client_key"),
+			},
+			PinnedKey:              v.GetString("couchdb.pinned_key"),
+			InsecureSkipValidation: v.GetBool("couchdb.insecure_skip_validation"),
+		})
+		if err != nil {
+			return couch, err
+		}
 	}
 	couch.Client = couchClient
 
@@ -910,10 +1493,16 @@ func makeCouch(v *viper.Viper) (CouchDB, error) {
 	if couchURL.Path == "" {
 		couchURL.Path = "/"
 	}
+	readURLs, err := makeReadURLs(couchURL, v.GetStringSlice("couchdb.read_urls"))
+	if err != nil {
+		return couch, err
+	}
 	couch.Global = CouchDBCluster{
 		Auth:     couchAuth,
 		URL:      couchURL,
+		ReadURLs: readURLs,
 		Creation: true,
+		next:     new(uint32),
 	}
 
 	if clusters, ok := v.Get("couchdb.clusters").([]interface{}); ok {
@@ -927,6 +1516,18 @@ func makeCouch(v *viper.Viper) (CouchDB, error) {
 			if couchURL.Path == "" {
 				couchURL.Path = "/"
 			}
+			var reads []string
+			if list, ok := cluster["read_urls"].([]interface{}); ok {
+				for _, r := range list {
+					if r, ok := r.(string); ok {
+						reads = append(reads, r)
+					}
+				}
+			}
+			readURLs, err := makeReadURLs(couchURL, reads)
+			if err != nil {
+				return couch, err
+			}
 			creation := true
 			if c, ok := cluster["instance_creation"].(bool); ok {
 				creation = c
@@ -934,7 +1535,9 @@ func makeCouch(v *viper.Viper) (CouchDB, error) {
 			couch.Clusters = append(couch.Clusters, CouchDBCluster{
 				Auth:     couchAuth,
 				URL:      couchURL,
+				ReadURLs: readURLs,
 				Creation: creation,
+				next:     new(uint32),
 			})
 		}
 	}
@@ -994,6 +1597,89 @@ func makeRegistries(v *viper.Viper) (map[string][]*url.URL, error) {
 	return regs, nil
 }
 
+func makeRedis(v *viper.Viper) (Redis, error) {
+	r := Redis{
+		URL:         v.GetString("redis.url"),
+		Password:    v.GetString("redis.password"),
+		DB:          v.GetInt("redis.db"),
+		PoolSize:    v.GetInt("redis.pool_size"),
+		ClusterMode: v.GetBool("redis.cluster_mode"),
+	}
+	if r.URL != "" && !v.IsSet("redis.db") {
+		opts, err := redis.ParseURL(r.URL)
+		if err != nil {
+			return r, fmt.Errorf("config: can't parse redis URL(%s): %s", r.URL, err)
+		}
+		r.DB = opts.DB
+	}
+	if v.GetString("redis.addrs") != "" {
+		r.Addrs = v.GetStringSlice("redis.addrs")
+	}
+	if r.Enabled() {
+		// Default go-redis pool size is 10 * runtime.NumCPU() which is
+		// too short on a single-cpu server, we consume at leat 19 connections,
+		// so we enforce a minimum of 25, keeping the default 10 * runtime*NumCPU()
+		// if larger
+		if r.PoolSize < 25 {
+			if r.PoolSize != 0 {
+				log.Warnf("Redis pool size set smaller than 25. Using default value.")
+			}
+			r.PoolSize = max(25, 10*runtime.NumCPU())
+		}
+	}
+	return r, nil
+}
+
+func makeFeatures(v *viper.Viper, invalid *[]error) map[string]bool {
+	features := make(map[string]bool)
+	for name, value := range v.GetStringMap("features") {
+		switch value := value.(type) {
+		case bool:
+			features[name] = value
+		case string:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				*invalid = append(*invalid,
+					fmt.Errorf("features.%s should be a boolean, was: %q", name, value))
+				continue
+			}
+			features[name] = enabled
+		default:
+			*invalid = append(*invalid,
+				fmt.Errorf("features.%s should be a boolean, was: %v", name, value))
+		}
+	}
+	return features
+}
+
+func makeTLS(v *viper.Viper) (TLS, error) {
+	t := TLS{
+		CertFile:     v.GetString("tls.cert_file"),
+		KeyFile:      v.GetString("tls.key_file"),
+		ClientCAFile: v.GetString("tls.client_ca_file"),
+		MinVersion:   tls.VersionTLS12,
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return t, errors.New("config: tls.cert_file and tls.key_file must be set together")
+	}
+	if t.ClientCAFile != "" && t.CertFile == "" {
+		return t, errors.New("config: tls.client_ca_file requires tls.cert_file and tls.key_file")
+	}
+	switch version := v.GetString("tls.min_version"); version {
+	case "", "1.2":
+		// Default
+	case "1", "1.0": // YAML parses 1.0 as a number
+		t.MinVersion = tls.VersionTLS10
+	case "1.1":
+		t.MinVersion = tls.VersionTLS11
+	case "1.3":
+		t.MinVersion = tls.VersionTLS13
+	default:
+		return t, fmt.Errorf("config: invalid tls.min_version %q", version)
+	}
+	return t, nil
+}
+
 func makeOffice(v *viper.Viper) (map[string]Office, error) {
 	office := make(map[string]Office)
 	for k, v := range v.GetStringMap("office") {
@@ -1047,9 +1733,7 @@ func createTestViper() *viper.Viper {
 	v := viper.New()
 	v.SetConfigName("cozy.test")
 	v.AddConfigPath("$HOME/.cozy")
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	v.SetEnvPrefix("cozy")
-	v.AutomaticEnv()
+	bindEnv(v)
 	v.SetDefault("host", "localhost")
 	v.SetDefault("port", 8080)
 	v.SetDefault("assets", "./assets")
@@ -1129,6 +1813,27 @@ func findConfigFiles(name string) ([]string, error) {
 	return configFiles, nil
 }
 
+// makeReadURLs parses the URLs of the CouchDB replicas used for reading. The
+// credentials are the same as the ones of the write URL. Without replicas, the
+// write URL is also used for reading.
+func makeReadURLs(writeURL *url.URL, reads []string) ([]*url.URL, error) {
+	if len(reads) == 0 {
+		return []*url.URL{writeURL}, nil
+	}
+	readURLs := make([]*url.URL, 0, len(reads))
+	for _, r := range reads {
+		u, _, err := parseURL(r)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		readURLs = append(readURLs, u)
+	}
+	return readURLs, nil
+}
+
 func parseURL(u string) (*url.URL, *url.Userinfo, error) {
 	parsedURL, err := url.Parse(u)
 	if err != nil {
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// redactedMask is the value that replaces the secrets in Redacted.
+const redactedMask = "***"
+
+// sensitiveNames are the substrings that identify the fields, the map keys
+// and the query parameters whose values are secrets. The free-form sections
+// (contexts, authentication, etc.) are dumped too, so the list errs on the
+// side of masking too much: "key" also masks the paths of the key files.
+var sensitiveNames = []string{
+	"password", "passwd", "passphrase", "secret", "token", "key", "credential", "private",
+}
+
+// Redacted returns the configuration as a map, for diagnostics. The secrets
+// are masked: the credentials of the URLs, and the values of the passwords,
+// tokens, etc. The clients (redis, HTTP transports, locks) are omitted.
+func (c *Config) Redacted() map[string]interface{} {
+	m, _ := redactValue(reflect.ValueOf(*c)).(map[string]interface{})
+	return m
+}
+
+func redactValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	switch val := v.Interface().(type) {
+	case *url.URL:
+		if val == nil {
+			return nil
+		}
+		return redactURL(val)
+	case *url.Userinfo:
+		if val == nil {
+			return nil
+		}
+		return redactedMask
+	case time.Duration:
+		return val.String()
+	case string:
+		return redactString(val)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redactValue(v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		m := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || isClient(f.Type) {
+				continue
+			}
+			m[f.Name] = redactEntry(f.Name, v.Field(i))
+		}
+		return m
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			m[key] = redactEntry(key, iter.Value())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = redactValue(v.Index(i))
+		}
+		return list
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v.Interface()
+	}
+	return nil
+}
+
+// redactEntry returns the redacted value of a field or a map entry. The
+// strings, and the maps and lists (like a map of credentials), are masked if
+// the name is sensitive.
+func redactEntry(name string, v reflect.Value) interface{} {
+	if isSensitive(name) {
+		s := v
+		for (s.Kind() == reflect.Interface || s.Kind() == reflect.Ptr) && !s.IsNil() {
+			s = s.Elem()
+		}
+		switch s.Kind() {
+		case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+			if s.Len() > 0 {
+				return redactedMask
+			}
+		}
+	}
+	return redactValue(v)
+}
+
+// isClient returns true for the types that are not configuration values, but
+// clients built from them (redis, HTTP transports, locks, etc.).
+func isClient(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return t.NumMethod() > 0
+	case reflect.Func, reflect.Chan:
+		return true
+	case reflect.Ptr:
+		t = t.Elem()
+		if t.Kind() != reflect.Struct || t == reflect.TypeOf(url.Userinfo{}) {
+			return false
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, sensitive := range sensitiveNames {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactString masks the credentials if the string is a URL.
+func redactString(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return redactURL(u)
+}
+
+// redactURL returns the URL with its userinfo and the sensitive parameters of
+// its query string masked.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	if redacted.RawQuery != "" {
+		params := strings.Split(redacted.RawQuery, "&")
+		for i, param := range params {
+			key, _, _ := strings.Cut(param, "=")
+			if isSensitive(key) {
+				params[i] = key + "=" + redactedMask
+			}
+		}
+		redacted.RawQuery = strings.Join(params, "&")
+	}
+	s := redacted.String()
+	if u.User != nil {
+		s = strings.Replace(s, "//", "//"+redactedMask+"@", 1)
+	}
+	return s
+}
@@ -13,7 +13,7 @@ var swiftConn *swift.Connection
 
 // InitDefaultSwiftConnection initializes the default swift handler.
 func InitDefaultSwiftConnection() error {
-	return InitSwiftConnection(config.Fs)
+	return InitSwiftConnection(GetConfig().Fs)
 }
 
 // InitSwiftConnection initialize the global swift handler connection. This is
@@ -233,9 +233,13 @@ func buildCouchRequest(db prefixer.Prefixer, doctype, method, path string, reqjs
 	if doctype != "" {
 		path = makeDBName(db, doctype) + "/" + path
 	}
+	u := couch.URL
+	if isReadMethod(method) {
+		u = couch.PickRead()
+	}
 	req, err := http.NewRequest(
 		method,
-		couch.URL.String()+path,
+		u.String()+path,
 		bytes.NewReader(reqjson),
 	)
 	// Possible err = wrong method, unparsable url
@@ -257,6 +261,12 @@ func buildCouchRequest(db prefixer.Prefixer, doctype, method, path string, reqjs
 	return req, nil
 }
 
+// isReadMethod returns true for the requests that can be sent to a replica of
+// the CouchDB cluster.
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
 func handleResponseError(db prefixer.Prefixer, resp *http.Response) error {
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		return nil
@@ -3,6 +3,7 @@ package couchdb
 import (
 	"context"
 	"encoding/json"
+	"net/http"
 	"reflect"
 	"strings"
 	"sync"
@@ -14,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -524,3 +526,26 @@ func assertGotEvent(t *testing.T, eventType, id string) *realtime.Event {
 	assert.True(t, ok, "Expected event %s:%s", eventType, id)
 	return event
 }
+
+func TestBuildCouchRequestWithReplicas(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("couchdb.url", "http://primary:5984/")
+	cfg.Set("couchdb.read_urls", []string{"http://replica1:5984/", "http://replica2:5984/"})
+	require.NoError(t, config.UseViper(cfg))
+
+	var reads []string
+	for i := 0; i < 4; i++ {
+		req, err := buildCouchRequest(TestPrefix, TestDoctype, http.MethodGet, "doc", nil, nil)
+		require.NoError(t, err)
+		reads = append(reads, req.URL.Host)
+	}
+	assert.ElementsMatch(t, []string{"replica1:5984", "replica1:5984", "replica2:5984", "replica2:5984"}, reads)
+
+	// The writes are sent to the primary
+	req, err := buildCouchRequest(TestPrefix, TestDoctype, http.MethodPut, "doc", []byte("{}"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "primary:5984", req.URL.Host)
+	req, err = buildCouchRequest(TestPrefix, TestDoctype, http.MethodPost, "_find", []byte("{}"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "primary:5984", req.URL.Host)
+}
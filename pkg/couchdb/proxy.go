@@ -22,8 +22,12 @@ func Proxy(db prefixer.Prefixer, doctype, path string) *httputil.ReverseProxy {
 	transport := config.CouchClient().Transport
 
 	director := func(req *http.Request) {
-		req.URL.Scheme = couch.URL.Scheme
-		req.URL.Host = couch.URL.Host
+		u := couch.URL
+		if isReadMethod(req.Method) {
+			u = couch.PickRead()
+		}
+		req.URL.Scheme = u.Scheme
+		req.URL.Host = u.Host
 		req.Header.Del(echo.HeaderAuthorization) // drop stack auth
 		req.Header.Del(echo.HeaderCookie)
 		req.Header.Del("Host")
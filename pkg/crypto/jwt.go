@@ -1,6 +1,8 @@
 package crypto
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 
@@ -34,3 +36,14 @@ func ParseJWT(tokenString string, keyFunc jwt.Keyfunc, claims jwt.Claims) error
 	}
 	return nil
 }
+
+// fingerprintSize is the number of bytes of the SHA-256 hash kept for a token
+// fingerprint (it gives 16 hexadecimal characters).
+const fingerprintSize = 8
+
+// TokenFingerprint returns a short fingerprint of the given token, that can be
+// logged to correlate the usages of a token without leaking the token itself.
+func TokenFingerprint(tokenString string) string {
+	sum := sha256.Sum256([]byte(tokenString))
+	return hex.EncodeToString(sum[:fingerprintSize])
+}
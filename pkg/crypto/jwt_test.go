@@ -86,3 +86,17 @@ func TestParseInvalidJWT(t *testing.T) {
 	}, &Claims{})
 	assert.Error(t, err)
 }
+
+func TestTokenFingerprint(t *testing.T) {
+	secret := GenerateRandomBytes(64)
+	first, err := NewJWT(secret, jwt.RegisteredClaims{Subject: "alice"})
+	assert.NoError(t, err)
+	second, err := NewJWT(secret, jwt.RegisteredClaims{Subject: "bob"})
+	assert.NoError(t, err)
+
+	fingerprint := TokenFingerprint(first)
+	assert.Len(t, fingerprint, 16)
+	assert.Equal(t, fingerprint, TokenFingerprint(first))
+	assert.NotEqual(t, fingerprint, TokenFingerprint(second))
+	assert.NotContains(t, first, fingerprint)
+}
@@ -279,6 +279,22 @@ func (r *RateLimiter) CheckRateLimitKey(customKey string, ct CounterType) error
 	return nil
 }
 
+// CheckCustomRateLimit works like CheckRateLimitKey, but for a limit and a
+// period that are not known in advance, like the ones configured on a trigger.
+func (r *RateLimiter) CheckCustomRateLimit(key string, limit int64, period time.Duration) error {
+	val, err := r.counter.Increment("custom:"+key, period)
+	if err != nil {
+		return err
+	}
+	if val == limit+1 {
+		return ErrRateLimitReached
+	}
+	if val > limit {
+		return ErrRateLimitExceeded
+	}
+	return nil
+}
+
 // ResetCounter sets again to zero the counter for the given type and instance.
 func (r *RateLimiter) ResetCounter(p prefixer.Prefixer, ct CounterType) {
 	cfg := configs[ct]
@@ -2,6 +2,7 @@ package limits
 
 import (
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/redis/go-redis/v9"
@@ -81,6 +82,16 @@ func TestRate(t *testing.T) {
 				err := limiter.CheckRateLimit(testInstance, TwoFactorType)
 				require.Error(t, err)
 			})
+
+			t.Run("CustomRateLimit", func(t *testing.T) {
+				for i := 0; i < 3; i++ {
+					require.NoError(t, limiter.CheckCustomRateLimit("custom-key", 3, time.Minute))
+				}
+				err := limiter.CheckCustomRateLimit("custom-key", 3, time.Minute)
+				require.ErrorIs(t, err, ErrRateLimitReached)
+				err = limiter.CheckCustomRateLimit("custom-key", 3, time.Minute)
+				require.ErrorIs(t, err, ErrRateLimitExceeded)
+			})
 		})
 	}
 }
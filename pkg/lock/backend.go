@@ -0,0 +1,44 @@
+package lock
+
+import (
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend is used by New to create the lock getter. Redis and in-memory are
+// the two built-in backends, but other backends (etcd, Consul, etc.) can be
+// added with RegisterBackend.
+type Backend interface {
+	// Getter returns the lock getter for this backend, or nil if the backend
+	// can't be used (not configured for example).
+	Getter(client redis.UniversalClient) Getter
+}
+
+type redisBackend struct{}
+
+func (redisBackend) Getter(client redis.UniversalClient) Getter {
+	if client == nil {
+		return nil
+	}
+	return NewRedisLockGetter(client)
+}
+
+type memBackend struct{}
+
+func (memBackend) Getter(_ redis.UniversalClient) Getter {
+	return NewInMemory()
+}
+
+var (
+	backendsMu sync.Mutex
+	backends   = []Backend{redisBackend{}, memBackend{}}
+)
+
+// RegisterBackend adds a backend for the locks. The registered backends are
+// tried by New before the built-in ones, the last registered first.
+func RegisterBackend(backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends = append([]Backend{backend}, backends...)
+}
@@ -0,0 +1,32 @@
+package lock
+
+import (
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackend struct {
+	getter Getter
+}
+
+func (b *fakeBackend) Getter(_ redis.UniversalClient) Getter {
+	return b.getter
+}
+
+func TestBackend(t *testing.T) {
+	assert.IsType(t, &InMemoryLockGetter{}, New(nil))
+
+	defer func(builtins []Backend) { backends = builtins }(backends)
+	fake := &fakeBackend{}
+	RegisterBackend(fake)
+
+	// The registered backend is skipped when it returns no getter
+	assert.IsType(t, &InMemoryLockGetter{}, New(nil))
+
+	getter := NewInMemory()
+	fake.getter = getter
+	assert.Same(t, getter, New(nil))
+	assert.Same(t, getter, New(redis.NewClient(&redis.Options{})))
+}
@@ -0,0 +1,125 @@
+package lock
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// Backoff is the policy for waiting between two attempts to acquire a lock
+// in redis. The delay starts at Initial, is multiplied by Multiplier after
+// each attempt, and can't be more than Max. Jitter is a fraction of the delay
+// (between 0 and 1) that is randomly added or removed to it, but the delay
+// still can't be more than Max.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// DefaultBackoff is the backoff used when no other policy is given: it waits
+// WaitRetry between two attempts.
+var DefaultBackoff = Backoff{
+	Initial:    WaitRetry,
+	Max:        WaitRetry,
+	Multiplier: 1,
+}
+
+// RedisOption can be used to configure the redis lock getter.
+type RedisOption func(*RedisLockGetter)
+
+// WithBackoff sets the backoff policy for the redis locks.
+func WithBackoff(backoff Backoff) RedisOption {
+	return func(r *RedisLockGetter) {
+		if backoff.Initial <= 0 {
+			backoff.Initial = WaitRetry
+		}
+		if backoff.Max < backoff.Initial {
+			backoff.Max = backoff.Initial
+		}
+		if backoff.Multiplier < 1 {
+			backoff.Multiplier = 1
+		}
+		if backoff.Jitter < 0 {
+			backoff.Jitter = 0
+		} else if backoff.Jitter > 1 {
+			backoff.Jitter = 1
+		}
+		r.backoff = backoff
+	}
+}
+
+// clock can be replaced in tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// retrier is used by the redis locks to retry the acquisition of a lock.
+type retrier struct {
+	waitRetry time.Duration // the first delay
+	backoff   Backoff
+	clock     clock
+}
+
+func newRetrier(backoff Backoff) retrier {
+	return retrier{
+		waitRetry: backoff.Initial,
+		backoff:   backoff,
+		clock:     realClock{},
+	}
+}
+
+// delay returns the time to wait after the given attempt (starting at 0).
+func (r *retrier) delay(attempt int) time.Duration {
+	max := r.backoff.Max
+	if max < r.waitRetry {
+		max = r.waitRetry
+	}
+	d := float64(r.waitRetry) * math.Pow(r.backoff.Multiplier, float64(attempt))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if jitter := math.Min(r.backoff.Jitter, 1); jitter > 0 {
+		redislocksMu.Lock()
+		d += d * jitter * (2*redisRng.Float64() - 1)
+		redislocksMu.Unlock()
+		d = math.Min(d, float64(max))
+	}
+	return time.Duration(d)
+}
+
+// retry calls the obtain function with a new token until it succeeds, or
+// until the timeout has been reached, or the context is done.
+func (r *retrier) retry(ctx context.Context, timeout time.Duration, obtain func(token string) (bool, error)) (bool, error) {
+	// Calculate the timestamp we are willing to wait for.
+	stop := r.clock.Now().Add(timeout)
+
+	redislocksMu.Lock()
+	token := utils.RandomStringFast(redisRng, lockTokenSize)
+	redislocksMu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		ok, err := obtain(token)
+		if err != nil || ok {
+			return ok, err
+		}
+		wait := r.delay(attempt)
+		if r.clock.Now().Add(wait).After(stop) {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-r.clock.After(wait):
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package lock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock records the waits instead of sleeping.
+type fakeClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestBackoff(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	holder := newFakeRedisGetter(fake).ReadWrite(db, "backoff")
+	require.NoError(t, holder.Lock())
+	defer holder.Unlock()
+
+	getter := newFakeRedisGetter(fake)
+	WithBackoff(Backoff{
+		Initial:    10 * time.Millisecond,
+		Max:        80 * time.Millisecond,
+		Multiplier: 2,
+	})(getter)
+	l := getter.ReadWrite(db, "backoff").(*redisLock)
+	clock := &fakeClock{now: time.Now()}
+	l.clock = clock
+
+	ok, err := l.TryLock(time.Second)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	require.Greater(t, len(clock.waits), 6)
+	assert.Equal(t, []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		80 * time.Millisecond,
+	}, clock.waits[:5])
+
+	t.Run("Jitter", func(t *testing.T) {
+		r := newRetrier(Backoff{
+			Initial:    100 * time.Millisecond,
+			Max:        200 * time.Millisecond,
+			Multiplier: 1,
+			Jitter:     0.5,
+		})
+		for i := 0; i < 10; i++ {
+			d := r.delay(i)
+			assert.GreaterOrEqual(t, d, 50*time.Millisecond)
+			assert.LessOrEqual(t, d, 150*time.Millisecond)
+		}
+
+		// The delay is never negative, nor more than the max
+		r = newRetrier(Backoff{
+			Initial:    100 * time.Millisecond,
+			Max:        100 * time.Millisecond,
+			Multiplier: 1,
+			Jitter:     3,
+		})
+		for i := 0; i < 10; i++ {
+			d := r.delay(i)
+			assert.GreaterOrEqual(t, d, time.Duration(0))
+			assert.LessOrEqual(t, d, 100*time.Millisecond)
+		}
+	})
+
+	t.Run("New", func(t *testing.T) {
+		// The options of the redis locks can be given to New
+		backoff := Backoff{Initial: 10 * time.Millisecond, Max: 80 * time.Millisecond, Multiplier: 2}
+		getter := New(redis.NewClient(&redis.Options{}), WithRedisOptions(WithBackoff(backoff)))
+		l := getter.ReadWrite(db, "backoff").(*redisLock)
+		assert.Equal(t, 10*time.Millisecond, l.waitRetry)
+		assert.Equal(t, backoff, l.backoff)
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		r := newRetrier(DefaultBackoff)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, WaitRetry, r.delay(i))
+		}
+	})
+}
@@ -1,9 +1,13 @@
 package lock
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/redis/go-redis/v9"
 )
@@ -15,23 +19,70 @@ type Getter interface {
 	// it applies, then a slash and the package name (ie alice.example.net/vfs).
 	ReadWrite(db prefixer.Prefixer, name string) ErrorRWLocker
 
+	// ReadWriteTTL is like ReadWrite, but the lock will expire in redis after
+	// the given TTL instead of LockTimeout. The lock is not refreshed, so the
+	// TTL must be longer than the operation. When the duration of the
+	// operation is unknown, LongOperation should be used instead, as it
+	// extends automatically the lock (with the default TTL). The in-memory
+	// locks don't expire and ignore the TTL.
+	ReadWriteTTL(db prefixer.Prefixer, name string, ttl time.Duration) ErrorRWLocker
+
 	// LongOperation returns a lock suitable for long operations. It will refresh
 	// the lock in redis to avoid its automatic expiration.
-	LongOperation(db prefixer.Prefixer, name string) ErrorLocker
+	LongOperation(db prefixer.Prefixer, name string, opts ...LongOperationOption) ErrorLocker
+
+	// Semaphore returns a lock that can be held by at most n holders at the
+	// same time. Each call returns a new holder, that can take one of the n
+	// slots with Lock, and release it with Unlock.
+	Semaphore(db prefixer.Prefixer, name string, n int) ErrorLocker
 }
 
-func New(client redis.UniversalClient) Getter {
-	if client == nil {
-		return NewInMemory()
+// New returns the lock getter of the first backend that can be used: the
+// registered backends, then redis if a client is given, and else the
+// in-memory locks.
+func New(client redis.UniversalClient, opts ...Option) Getter {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	return NewRedisLockGetter(client)
+	getter := newGetter(client)
+	if observed, ok := getter.(observedGetter); ok && o.observer != nil {
+		observed.setObserver(o.observer)
+	}
+	if expiring, ok := getter.(ttlGetter); ok && o.ttl > 0 {
+		expiring.setTTL(o.ttl)
+	}
+	if r, ok := getter.(*RedisLockGetter); ok {
+		for _, opt := range o.redisOpts {
+			opt(r)
+		}
+	}
+	return getter
+}
+
+func newGetter(client redis.UniversalClient) Getter {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	for _, backend := range backends {
+		if getter := backend.Getter(client); getter != nil {
+			return getter
+		}
+	}
+	return NewInMemory()
 }
 
 // An ErrorLocker is a locker which can fail (returns an error)
 type ErrorLocker interface {
 	Lock() error
 	Unlock()
+	// TryLock tries to acquire the lock, but gives up after the given timeout.
+	// It returns false and no error if the lock is still held by someone else
+	// at the end of the timeout, and an error only on a backend failure.
+	TryLock(timeout time.Duration) (bool, error)
+	// LockContext acquires the lock, but aborts and returns ctx.Err() if the
+	// context is canceled or times out before the lock can be acquired.
+	LockContext(ctx context.Context) error
 }
 
 // ErrorRWLocker is the interface for a RWLock as inspired by RWMutex
@@ -39,44 +90,261 @@ type ErrorRWLocker interface {
 	ErrorLocker
 	RLock() error
 	RUnlock()
+	// TryRLock is like TryLock, but for reading.
+	TryRLock(timeout time.Duration) (bool, error)
+}
+
+// LockKind tells if a lock is held for reading or writing.
+type LockKind string
+
+const (
+	// ReadLock is the kind of a lock held for reading.
+	ReadLock LockKind = "read"
+	// WriteLock is the kind of a lock held for writing.
+	WriteLock LockKind = "write"
+)
+
+// LockInfo gives some information about a lock that is held, for debugging
+// purpose.
+type LockInfo struct {
+	Name  string        `json:"name"`
+	Kind  LockKind      `json:"kind,omitempty"`
+	Since time.Time     `json:"since,omitempty"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+}
+
+// namedLocker is implemented by the lockers of this package, to give a stable
+// key for sorting them.
+type namedLocker interface {
+	lockName() string
+}
+
+func lockName(l ErrorLocker) string {
+	if named, ok := l.(namedLocker); ok {
+		return named.lockName()
+	}
+	return fmt.Sprintf("%p", l)
+}
+
+// LockMany acquires all the given locks. To avoid deadlocks between two
+// operations that need the same locks, they are always acquired in the same
+// order (sorted by their names). If a lock can't be acquired, the locks
+// already held are released and the error is returned. The returned unlock
+// function releases the locks in the reverse order.
+func LockMany(locks ...ErrorLocker) (unlock func(), err error) {
+	sorted := make([]ErrorLocker, 0, len(locks))
+	seen := make(map[ErrorLocker]bool, len(locks))
+	for _, l := range locks {
+		if !seen[l] {
+			seen[l] = true
+			sorted = append(sorted, l)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return lockName(sorted[i]) < lockName(sorted[j])
+	})
+
+	held := make([]ErrorLocker, 0, len(sorted))
+	unlock = func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+	}
+	for _, l := range sorted {
+		if err := l.Lock(); err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return unlock, nil
 }
 
 type longOperationLocker interface {
 	ErrorLocker
-	Extend()
+	// Extend refreshes the expiration of the lock. It returns false if the lock
+	// is no longer held, for example if it has expired and been taken by
+	// another client.
+	Extend() (bool, error)
+}
+
+// LongOperationOption can be used to configure the lock returned by
+// LongOperation.
+type LongOperationOption func(*longOperation)
+
+// OnLostLock sets a callback that is called when the lock can't be extended
+// because it is no longer held (it has expired and may have been taken by
+// someone else). It allows the long operation to abort.
+func OnLostLock(fn func()) LongOperationOption {
+	return func(l *longOperation) {
+		l.onLost = fn
+	}
+}
+
+// LongOperationReacquire makes the long operation try to acquire again the
+// lock when it has been lost, up to maxAttempts times, before calling the
+// OnLostLock callback. It should be used only for idempotent operations, as
+// another holder may have taken the lock in the meantime.
+func LongOperationReacquire(maxAttempts int) LongOperationOption {
+	return func(l *longOperation) {
+		l.maxReacquire = maxAttempts
+	}
+}
+
+// OnReacquiredLock sets a callback that is called when the lock has been lost
+// and then reacquired with LongOperationReacquire. It tells the long operation
+// that another holder may have run while the lock was lost.
+func OnReacquiredLock(fn func()) LongOperationOption {
+	return func(l *longOperation) {
+		l.onReacquired = fn
+	}
 }
 
 type longOperation struct {
-	lock    longOperationLocker
-	mu      sync.Mutex
-	tick    *time.Ticker
-	timeout time.Duration
+	lock         longOperationLocker
+	mu           sync.Mutex
+	tick         *time.Ticker
+	timeout      time.Duration
+	onLost       func()
+	onReacquired func()
+	maxReacquire int
+	// reacquiring is true while the lock is lost and the long operation tries
+	// to acquire it again. Unlock must not release it in that case.
+	reacquiring bool
+}
+
+func newLongOperation(lock longOperationLocker, opts []LongOperationOption) *longOperation {
+	l := &longOperation{
+		lock:    lock,
+		timeout: LockTimeout,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
 }
 
 func (l *longOperation) Lock() error {
 	if err := l.lock.Lock(); err != nil {
 		return err
 	}
+	l.refresh()
+	return nil
+}
+
+func (l *longOperation) LockContext(ctx context.Context) error {
+	if err := l.lock.LockContext(ctx); err != nil {
+		return err
+	}
+	l.refresh()
+	return nil
+}
+
+func (l *longOperation) TryLock(timeout time.Duration) (bool, error) {
+	ok, err := l.lock.TryLock(timeout)
+	if ok {
+		l.refresh()
+	}
+	return ok, err
+}
+
+// refresh starts a goroutine that will extend the lock regularly, until it
+// is unlocked.
+func (l *longOperation) refresh() {
 	l.tick = time.NewTicker(l.timeout / 3)
 	go func() {
-		defer l.mu.Unlock()
 		for {
 			l.mu.Lock()
 			if l.tick == nil {
+				l.mu.Unlock()
 				return
 			}
 			ch := l.tick.C
 			l.mu.Unlock()
 			<-ch
-			l.mu.Lock()
-			if l.tick == nil {
+			if !l.extend() {
 				return
 			}
-			l.lock.Extend()
-			l.mu.Unlock()
 		}
 	}()
-	return nil
+}
+
+// extend refreshes the lock, and returns false when the lock should no
+// longer be refreshed.
+func (l *longOperation) extend() bool {
+	l.mu.Lock()
+	if l.tick == nil {
+		l.mu.Unlock()
+		return false
+	}
+	if ok, err := l.lock.Extend(); err != nil || ok {
+		l.mu.Unlock()
+		return true
+	}
+	l.reacquiring = l.maxReacquire > 0
+	l.mu.Unlock()
+
+	// The mutex is not held while trying to reacquire the lock, so that Unlock
+	// is not blocked
+	if l.reacquiring && l.reacquire() {
+		return true
+	}
+
+	l.mu.Lock()
+	l.reacquiring = false
+	if l.tick == nil {
+		// Unlock has been called in the meantime
+		l.mu.Unlock()
+		return false
+	}
+	// The lock has been lost, there is no need to refresh it
+	l.tick.Stop()
+	l.tick = nil
+	l.mu.Unlock()
+
+	// The callback is called outside of the mutex, as it may call Unlock
+	if l.onLost != nil {
+		l.onLost()
+	}
+	return false
+}
+
+// reacquire tries to acquire again a lost lock. It returns true if the lock
+// has been reacquired, and the long operation has not been unlocked in the
+// meantime.
+func (l *longOperation) reacquire() bool {
+	for i := 0; i < l.maxReacquire; i++ {
+		ok, err := l.lock.TryLock(l.timeout / 3)
+		if err != nil {
+			logger.WithNamespace("lock").Warnf("Cannot reacquire %s: %s", lockName(l.lock), err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		l.mu.Lock()
+		l.reacquiring = false
+		if l.tick == nil {
+			// Unlock has been called while the lock was reacquired
+			l.lock.Unlock()
+			l.mu.Unlock()
+			return false
+		}
+		l.mu.Unlock()
+
+		// Another holder may have run while the lock was lost
+		logger.WithNamespace("lock").Warnf("Lock %s lost and reacquired", lockName(l.lock))
+		if l.onReacquired != nil {
+			l.onReacquired()
+		}
+		return true
+	}
+	return false
+}
+
+func (l *longOperation) lockName() string {
+	return lockName(l.lock)
 }
 
 func (l *longOperation) Unlock() {
@@ -86,5 +354,10 @@ func (l *longOperation) Unlock() {
 		l.tick.Stop()
 		l.tick = nil
 	}
+	if l.reacquiring {
+		// The lock is not held, and it will be released by reacquire if it
+		// is acquired again
+		return
+	}
 	l.lock.Unlock()
 }
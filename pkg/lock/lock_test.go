@@ -113,6 +113,176 @@ func TestLock(t *testing.T) {
 	})
 }
 
+// lostLocker is a locker that fails to extend the lock.
+type lostLocker struct {
+	memLock
+}
+
+func (l *lostLocker) Extend() (bool, error) { return false, nil }
+
+func TestLongOperationLostLock(t *testing.T) {
+	var lost int32
+	long := newLongOperation(&lostLocker{}, []LongOperationOption{
+		OnLostLock(func() { atomic.AddInt32(&lost, 1) }),
+	})
+	long.timeout = 30 * time.Millisecond
+
+	require.NoError(t, long.Lock())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lost))
+	long.Unlock()
+
+	// The callback can release the lock without a deadlock
+	long.onLost = func() {
+		atomic.AddInt32(&lost, 1)
+		long.Unlock()
+	}
+	require.NoError(t, long.Lock())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lost))
+	ok, err := long.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	long.Unlock()
+}
+
+// flakyLocker is a locker that loses the lock on the first extend.
+type flakyLocker struct {
+	memLock
+	extends int32
+}
+
+func (l *flakyLocker) Extend() (bool, error) {
+	if atomic.AddInt32(&l.extends, 1) > 1 {
+		return true, nil
+	}
+	l.memLock.Unlock()
+	return false, nil
+}
+
+// stolenLocker is a locker that is taken by someone else on the first extend.
+type stolenLocker struct {
+	memLock
+	extends int32
+}
+
+func (l *stolenLocker) Extend() (bool, error) {
+	if atomic.AddInt32(&l.extends, 1) > 1 {
+		return true, nil
+	}
+	l.memLock.release()
+	_ = l.memLock.Lock()
+	return false, nil
+}
+
+func TestLongOperationReacquire(t *testing.T) {
+	var lost, reacquired int32
+	onLost := OnLostLock(func() { atomic.AddInt32(&lost, 1) })
+	onReacquired := OnReacquiredLock(func() { atomic.AddInt32(&reacquired, 1) })
+
+	flaky := &flakyLocker{}
+	long := newLongOperation(flaky, []LongOperationOption{onLost, onReacquired, LongOperationReacquire(3)})
+	long.timeout = 30 * time.Millisecond
+	require.NoError(t, long.Lock())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&lost))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reacquired))
+	assert.Greater(t, atomic.LoadInt32(&flaky.extends), int32(1))
+	ok, err := flaky.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	long.Unlock()
+
+	// The callback is called when the lock can't be reacquired
+	long = newLongOperation(&lostLocker{}, []LongOperationOption{onLost, LongOperationReacquire(2)})
+	long.timeout = 30 * time.Millisecond
+	require.NoError(t, long.Lock())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lost))
+	long.Unlock()
+
+	// Unlock is not blocked while the lock is reacquired, and the lock is
+	// released if it is reacquired after Unlock
+	stolen := &stolenLocker{}
+	long = newLongOperation(stolen, []LongOperationOption{onLost, LongOperationReacquire(100)})
+	long.timeout = 30 * time.Millisecond
+	require.NoError(t, long.Lock())
+	time.Sleep(30 * time.Millisecond)
+	unlocked := make(chan struct{})
+	go func() {
+		long.Unlock()
+		close(unlocked)
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(time.Second):
+		t.Fatal("Unlock is blocked while the lock is reacquired")
+	}
+	stolen.memLock.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	ok, err = stolen.memLock.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	stolen.memLock.Unlock()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lost))
+}
+
+// failingLocker is a locker that can't be acquired.
+type failingLocker struct {
+	memLock
+}
+
+func (l *failingLocker) Lock() error { return ErrTooManyRetries }
+
+func TestLockMany(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	getter := NewInMemory()
+	alice := getter.ReadWrite(db, "alice.example.net/sharing")
+	bob := getter.ReadWrite(db, "bob.example.net/sharing")
+
+	done := make(chan bool)
+	hammer := func(locks ...ErrorLocker) {
+		for i := 0; i < 100; i++ {
+			unlock, err := LockMany(locks...)
+			if err != nil {
+				panic(err)
+			}
+			unlock()
+		}
+		done <- true
+	}
+	go hammer(alice, bob)
+	go hammer(bob, alice)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock")
+		}
+	}
+
+	// The same lock can be given twice
+	unlock, err := LockMany(alice, bob, alice)
+	require.NoError(t, err)
+	ok, err := bob.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	unlock()
+	ok, err = alice.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	alice.Unlock()
+
+	// The locks already held are released on failure
+	failing := &failingLocker{memLock{name: "zoe.example.net/sharing"}}
+	_, err = LockMany(failing, bob, alice)
+	assert.Equal(t, ErrTooManyRetries, err)
+	ok, err = bob.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	bob.Unlock()
+}
+
 func reader(rwm ErrorRWLocker, iterations int, activity *int32, cdone chan bool) {
 	for i := 0; i < iterations; i++ {
 		err := rwm.RLock()
@@ -0,0 +1,65 @@
+package lock
+
+import "time"
+
+// Observer can be given to New to collect metrics on the locks, like the time
+// spent waiting to acquire them, or the time they are held.
+type Observer interface {
+	// ObserveWait is called when a lock has been acquired, with the time spent
+	// waiting for it.
+	ObserveWait(name string, d time.Duration)
+	// ObserveHeld is called when a lock acquired for writing is released, with
+	// the time it has been held.
+	ObserveHeld(name string, d time.Duration)
+}
+
+// Option can be used to configure the getter returned by New.
+type Option func(*options)
+
+type options struct {
+	observer  Observer
+	ttl       time.Duration
+	redisOpts []RedisOption
+}
+
+// WithObserver sets an observer for the locks of the built-in backends.
+func WithObserver(observer Observer) Option {
+	return func(opts *options) {
+		opts.observer = observer
+	}
+}
+
+// WithTTL sets the expiration in redis of the locks returned by ReadWrite,
+// instead of LockTimeout. It is ignored by the in-memory locks.
+func WithTTL(ttl time.Duration) Option {
+	return func(opts *options) {
+		opts.ttl = ttl
+	}
+}
+
+// WithRedisOptions gives some options for the redis locks, like WithBackoff.
+// They are ignored when redis is not used.
+func WithRedisOptions(redisOpts ...RedisOption) Option {
+	return func(opts *options) {
+		opts.redisOpts = append(opts.redisOpts, redisOpts...)
+	}
+}
+
+// observedGetter is implemented by the getters that can use an observer.
+type observedGetter interface {
+	setObserver(observer Observer)
+}
+
+// ttlGetter is implemented by the getters whose locks can expire.
+type ttlGetter interface {
+	setTTL(ttl time.Duration)
+}
+
+// startWait returns the time when a lock starts to be acquired, or the zero
+// time when there is no observer.
+func startWait(observer Observer) time.Time {
+	if observer == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
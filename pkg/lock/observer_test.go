@@ -0,0 +1,75 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingObserver struct {
+	mu    sync.Mutex
+	waits map[string][]time.Duration
+	helds map[string][]time.Duration
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{
+		waits: make(map[string][]time.Duration),
+		helds: make(map[string][]time.Duration),
+	}
+}
+
+func (o *recordingObserver) ObserveWait(name string, d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.waits[name] = append(o.waits[name], d)
+}
+
+func (o *recordingObserver) ObserveHeld(name string, d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.helds[name] = append(o.helds[name], d)
+}
+
+func TestObserver(t *testing.T) {
+	t.Run("MemObserver", func(t *testing.T) {
+		observer := newRecordingObserver()
+		testObserver(t, New(nil, WithObserver(observer)), observer)
+	})
+
+	t.Run("RedisObserver", func(t *testing.T) {
+		// The same name is reported by both backends
+		observer := newRecordingObserver()
+		getter := newFakeRedisGetter(newFakeRedis())
+		getter.setObserver(observer)
+		testObserver(t, getter, observer)
+	})
+}
+
+func testObserver(t *testing.T, getter Getter, observer *recordingObserver) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := getter.ReadWrite(db, "observed")
+	if rl, ok := l.(*redisLock); ok {
+		rl.waitRetry = 10 * time.Millisecond
+	}
+
+	require.NoError(t, l.Lock())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		l.Unlock()
+	}()
+	require.NoError(t, l.Lock())
+	l.Unlock()
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	require.Len(t, observer.waits["observed"], 2)
+	assert.Less(t, observer.waits["observed"][0], 30*time.Millisecond)
+	assert.GreaterOrEqual(t, observer.waits["observed"][1], 30*time.Millisecond)
+	require.Len(t, observer.helds["observed"], 2)
+	assert.GreaterOrEqual(t, observer.helds["observed"][0], 30*time.Millisecond)
+}
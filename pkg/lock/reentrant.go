@@ -0,0 +1,147 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// reentrantStates are the states of the underlying locks held by a reentrant
+// lock. An entry is removed when its lock is fully released, so that the map
+// doesn't grow with all the locks that have been used.
+var (
+	reentrantMu     sync.Mutex
+	reentrantStates = make(map[ErrorRWLocker]*reentrantState)
+)
+
+// Reentrant returns a variant of the given read/write lock that can be
+// acquired several times by the same owner without deadlocking. The owner is a
+// token chosen by the caller (a request or job identifier for example), and
+// each call to Lock must be balanced by a call to Unlock. Another owner will
+// still block until the lock has been fully released.
+//
+// It must be used explicitly, and not by default, as it can hide real
+// lock-ordering bugs.
+func Reentrant(l ErrorRWLocker, owner string) ErrorRWLocker {
+	key := l
+	if withTTL, ok := l.(*redisLockTTL); ok {
+		// The locks for the same name share their state, whatever their TTLs
+		key = withTTL.redisLock
+	}
+	return &reentrantLock{lock: l, key: key, owner: owner}
+}
+
+// reentrantState is shared by all the reentrant locks for the same underlying
+// lock, while it is held for writing.
+type reentrantState struct {
+	owner string
+	depth int
+}
+
+type reentrantLock struct {
+	lock  ErrorRWLocker
+	key   ErrorRWLocker // the key of the state in reentrantStates
+	owner string
+}
+
+// nested returns true if the lock is already held for writing by the same
+// owner, and increments the depth in that case.
+func (r *reentrantLock) nested() bool {
+	reentrantMu.Lock()
+	defer reentrantMu.Unlock()
+	if state, ok := reentrantStates[r.key]; ok && state.owner == r.owner {
+		state.depth++
+		return true
+	}
+	return false
+}
+
+func (r *reentrantLock) acquired() {
+	reentrantMu.Lock()
+	defer reentrantMu.Unlock()
+	reentrantStates[r.key] = &reentrantState{owner: r.owner, depth: 1}
+}
+
+// released decrements the depth if the lock is held for writing by the same
+// owner. It returns false if the lock is held by this owner at a deeper level,
+// and true if the underlying lock must be released. In that case, the state is
+// removed, and writing tells if the underlying lock was held for writing.
+func (r *reentrantLock) released() (release, writing bool) {
+	reentrantMu.Lock()
+	defer reentrantMu.Unlock()
+	state, ok := reentrantStates[r.key]
+	if !ok || state.owner != r.owner {
+		return true, false
+	}
+	state.depth--
+	if state.depth > 0 {
+		return false, true
+	}
+	delete(reentrantStates, r.key)
+	return true, true
+}
+
+func (r *reentrantLock) lockName() string {
+	return lockName(r.lock)
+}
+
+func (r *reentrantLock) Lock() error {
+	return r.LockContext(context.Background())
+}
+
+func (r *reentrantLock) LockContext(ctx context.Context) error {
+	if r.nested() {
+		return nil
+	}
+	if err := r.lock.LockContext(ctx); err != nil {
+		return err
+	}
+	r.acquired()
+	return nil
+}
+
+func (r *reentrantLock) TryLock(timeout time.Duration) (bool, error) {
+	if r.nested() {
+		return true, nil
+	}
+	ok, err := r.lock.TryLock(timeout)
+	if ok {
+		r.acquired()
+	}
+	return ok, err
+}
+
+func (r *reentrantLock) Unlock() {
+	if release, _ := r.released(); release {
+		r.lock.Unlock()
+	}
+}
+
+// RLock acquires the lock for reading. If the owner already holds the lock for
+// writing, it is counted as a nested acquisition and must be balanced by
+// RUnlock.
+func (r *reentrantLock) RLock() error {
+	if r.nested() {
+		return nil
+	}
+	return r.lock.RLock()
+}
+
+func (r *reentrantLock) TryRLock(timeout time.Duration) (bool, error) {
+	if r.nested() {
+		return true, nil
+	}
+	return r.lock.TryRLock(timeout)
+}
+
+func (r *reentrantLock) RUnlock() {
+	release, writing := r.released()
+	switch {
+	case !release:
+		// Nested in a lock held for writing
+	case writing:
+		r.lock.Unlock()
+	default:
+		r.lock.RUnlock()
+	}
+}
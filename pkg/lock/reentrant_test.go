@@ -0,0 +1,47 @@
+package lock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReentrant(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "reentrant")
+	alice := Reentrant(l, "alice")
+	bob := Reentrant(l, "bob")
+
+	require.NoError(t, alice.Lock())
+	require.NoError(t, alice.Lock())
+	require.NoError(t, alice.RLock())
+
+	ok, err := bob.TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	alice.RUnlock()
+	alice.Unlock()
+	ok, err = bob.TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The lock is released only when the calls are balanced
+	alice.Unlock()
+	ok, err = bob.TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = alice.TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	bob.Unlock()
+
+	// The state is forgotten when the lock is fully released
+	reentrantMu.Lock()
+	assert.NotContains(t, reentrantStates, l)
+	reentrantMu.Unlock()
+}
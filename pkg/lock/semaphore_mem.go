@@ -0,0 +1,118 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// Semaphore returns a holder for the semaphore with the given name. The
+// semaphore is created with n slots on the first call, and n is ignored on the
+// next calls for the same name.
+func (i *InMemoryLockGetter) Semaphore(_ prefixer.Prefixer, name string, n int) ErrorLocker {
+	if n <= 0 {
+		return &invalidSemaphore{name: name}
+	}
+	slots, _ := i.semaphores.LoadOrStore(name, make(chan struct{}, n))
+	return &memSemaphore{name: name, slots: slots.(chan struct{})}
+}
+
+// invalidSemaphore is the holder returned for a semaphore without slot: it
+// can't be locked, and its methods return ErrInvalidSemaphore.
+type invalidSemaphore struct {
+	name string
+}
+
+func (is *invalidSemaphore) lockName() string { return is.name }
+
+func (is *invalidSemaphore) Lock() error { return ErrInvalidSemaphore }
+
+func (is *invalidSemaphore) LockContext(_ context.Context) error { return ErrInvalidSemaphore }
+
+func (is *invalidSemaphore) TryLock(_ time.Duration) (bool, error) {
+	return false, ErrInvalidSemaphore
+}
+
+func (is *invalidSemaphore) Unlock() {
+	logger.WithNamespace("lock").Errorf("Invalid unlocking: %s has no slot", is.name)
+}
+
+// memSemaphore uses a buffered channel: a slot is taken by sending a value on
+// the channel, and released by receiving a value from it. A holder takes at
+// most one slot, and can only release the slot it has taken.
+type memSemaphore struct {
+	name  string
+	slots chan struct{}
+	mu    sync.Mutex
+	held  bool
+}
+
+func (ms *memSemaphore) lockName() string { return ms.name }
+
+// holds returns true if the holder has already taken a slot.
+func (ms *memSemaphore) holds() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.held
+}
+
+func (ms *memSemaphore) taken() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.held = true
+}
+
+func (ms *memSemaphore) Lock() error {
+	if ms.holds() {
+		return nil
+	}
+	ms.slots <- struct{}{}
+	ms.taken()
+	return nil
+}
+
+func (ms *memSemaphore) LockContext(ctx context.Context) error {
+	if ms.holds() {
+		return nil
+	}
+	select {
+	case ms.slots <- struct{}{}:
+		ms.taken()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ms *memSemaphore) TryLock(timeout time.Duration) (bool, error) {
+	if ms.holds() {
+		return true, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ms.slots <- struct{}{}:
+		ms.taken()
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+func (ms *memSemaphore) Unlock() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.held {
+		logger.WithNamespace("lock").Errorf("Invalid unlocking: no slot of %s is held", ms.name)
+		return
+	}
+	ms.held = false
+	// The slot may have been released by ReleaseAll
+	select {
+	case <-ms.slots:
+	default:
+	}
+}
@@ -0,0 +1,158 @@
+package lock
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// The holders of a semaphore are stored in a sorted set, with the time of
+// expiration of their slot as score. It allows to free the slots of a
+// cozy-stack that has crashed without releasing them.
+const luaSemAcquire = `redis.call("zremrangebyscore", KEYS[1], "-inf", ARGV[1])
+if redis.call("zcard", KEYS[1]) < tonumber(ARGV[2]) then
+  redis.call("zadd", KEYS[1], ARGV[3], ARGV[4])
+  redis.call("pexpire", KEYS[1], ARGV[5])
+  return 1
+end
+return 0`
+const luaSemRefresh = `if redis.call("zscore", KEYS[1], ARGV[1]) then
+  redis.call("zadd", KEYS[1], ARGV[2], ARGV[1])
+  redis.call("pexpire", KEYS[1], ARGV[3])
+  return 1
+end
+return 0`
+const luaSemRelease = `return redis.call("zrem", KEYS[1], ARGV[1])`
+
+const semaphoreNS = "semaphores:"
+
+// Semaphore returns a holder for the semaphore with the given name. A holder
+// takes at most one slot. The slot is refreshed while it is held, and it
+// expires after LockTimeout if the cozy-stack has crashed without releasing
+// it.
+func (r *RedisLockGetter) Semaphore(db prefixer.Prefixer, name string, n int) ErrorLocker {
+	if n <= 0 {
+		return &invalidSemaphore{name: r.redisKey(semaphoreNS, db.DBPrefix()+"/"+name)}
+	}
+	return &redisSemaphore{
+		retrier: newRetrier(r.backoff),
+		client:  r.client,
+		ctx:     context.Background(),
+		n:       n,
+		timeout: LockTimeout,
+		ttl:     LockTimeout,
+		key:     r.redisKey(semaphoreNS, db.DBPrefix()+"/"+name),
+	}
+}
+
+type redisSemaphore struct {
+	retrier
+	client  subRedisInterface
+	ctx     context.Context
+	mu      sync.Mutex
+	n       int
+	timeout time.Duration // the maximal time to wait for a slot
+	ttl     time.Duration // the expiration of a slot
+	key     string
+	token   string
+	stop    chan struct{} // closed to stop the refresh of the slot
+}
+
+func (rs *redisSemaphore) lockName() string { return rs.key }
+
+func (rs *redisSemaphore) Lock() error {
+	return rs.LockContext(context.Background())
+}
+
+func (rs *redisSemaphore) LockContext(ctx context.Context) error {
+	ok, err := rs.retry(ctx, rs.timeout, rs.obtains)
+	if err == nil && !ok {
+		return ErrTooManyRetries
+	}
+	return err
+}
+
+func (rs *redisSemaphore) TryLock(timeout time.Duration) (bool, error) {
+	return rs.retry(context.Background(), timeout, rs.obtains)
+}
+
+func (rs *redisSemaphore) obtains(token string) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.token != "" {
+		return true, nil
+	}
+	now := time.Now()
+	nowMs := strconv.FormatInt(now.UnixMilli(), 10)
+	expireMs := strconv.FormatInt(now.Add(rs.ttl).UnixMilli(), 10)
+	ttl := strconv.FormatInt(int64(rs.ttl/time.Millisecond), 10)
+	ret, err := rs.client.Eval(rs.ctx, luaSemAcquire, []string{rs.key},
+		nowMs, rs.n, expireMs, token, ttl).Result()
+	if err != nil {
+		return false, err // most probably redis connectivity error
+	}
+	if ret != int64(1) {
+		return false, nil
+	}
+	rs.token = token
+	rs.stop = make(chan struct{})
+	go rs.refresh(rs.stop)
+	return true, nil
+}
+
+// refresh extends regularly the expiration of the slot, until it is released.
+func (rs *redisSemaphore) refresh(stop chan struct{}) {
+	ticker := time.NewTicker(rs.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !rs.extend() {
+				return
+			}
+		}
+	}
+}
+
+// extend refreshes the expiration of the slot, and returns false when the slot
+// has been lost and should no longer be refreshed.
+func (rs *redisSemaphore) extend() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.token == "" {
+		return false
+	}
+	expireMs := strconv.FormatInt(time.Now().Add(rs.ttl).UnixMilli(), 10)
+	ttl := strconv.FormatInt(int64(rs.ttl/time.Millisecond), 10)
+	ret, err := rs.client.Eval(rs.ctx, luaSemRefresh, []string{rs.key},
+		rs.token, expireMs, ttl).Result()
+	if err != nil {
+		redisLogger.Warnf("Failed to extend semaphore: %s (%s)", err.Error(), rs.key)
+		return true
+	}
+	if ret != int64(1) {
+		redisLogger.Warnf("Semaphore slot lost: %s", rs.key)
+		rs.token = ""
+		return false
+	}
+	return true
+}
+
+func (rs *redisSemaphore) Unlock() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.token == "" {
+		return
+	}
+	close(rs.stop)
+	_, err := rs.client.Eval(rs.ctx, luaSemRelease, []string{rs.key}, rs.token).Result()
+	if err != nil {
+		redisLogger.Warnf("Failed to release semaphore: %s (%s)", err.Error(), rs.key)
+	}
+	rs.token = ""
+}
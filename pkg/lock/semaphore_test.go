@@ -0,0 +1,119 @@
+package lock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemaphore(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+
+	t.Run("MemSemaphore", func(t *testing.T) {
+		testSemaphore(t, NewInMemory(), db)
+	})
+
+	t.Run("RedisSemaphore", func(t *testing.T) {
+		testSemaphore(t, newFakeRedisGetter(newFakeRedis()), db)
+	})
+
+	t.Run("InvalidSemaphore", func(t *testing.T) {
+		for _, getter := range []Getter{NewInMemory(), newFakeRedisGetter(newFakeRedis())} {
+			for _, n := range []int{0, -1} {
+				sem := getter.Semaphore(db, "invalid", n)
+				assert.ErrorIs(t, sem.Lock(), ErrInvalidSemaphore)
+				ok, err := sem.TryLock(10 * time.Millisecond)
+				assert.ErrorIs(t, err, ErrInvalidSemaphore)
+				assert.False(t, ok)
+			}
+		}
+	})
+
+	t.Run("RedisSemaphoreExpiration", func(t *testing.T) {
+		getter := newFakeRedisGetter(newFakeRedis())
+		crashed := getter.Semaphore(db, "expiration", 1)
+		crashed.(*redisSemaphore).ttl = 20 * time.Millisecond
+		require.NoError(t, crashed.Lock())
+		// The cozy-stack has crashed and no longer refreshes its slot
+		close(crashed.(*redisSemaphore).stop)
+
+		// The slot is freed when it expires, even if it was not released
+		other := getter.Semaphore(db, "expiration", 1)
+		other.(*redisSemaphore).waitRetry = 10 * time.Millisecond
+		ok, err := other.TryLock(100 * time.Millisecond)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		other.Unlock()
+	})
+
+	t.Run("RedisSemaphoreRefresh", func(t *testing.T) {
+		getter := newFakeRedisGetter(newFakeRedis())
+		long := getter.Semaphore(db, "refresh", 1)
+		long.(*redisSemaphore).ttl = 30 * time.Millisecond
+		require.NoError(t, long.Lock())
+
+		// The slot is kept while it is held, even after its TTL
+		time.Sleep(100 * time.Millisecond)
+		other := getter.Semaphore(db, "refresh", 1)
+		other.(*redisSemaphore).waitRetry = 10 * time.Millisecond
+		ok, err := other.TryLock(20 * time.Millisecond)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		long.Unlock()
+		ok, err = other.TryLock(20 * time.Millisecond)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		other.Unlock()
+	})
+}
+
+func testSemaphore(t *testing.T, getter Getter, db prefixer.Prefixer) {
+	holders := make([]ErrorLocker, 3)
+	for i := range holders {
+		holders[i] = getter.Semaphore(db, "konnectors", 2)
+		if sem, ok := holders[i].(*redisSemaphore); ok {
+			sem.waitRetry = 10 * time.Millisecond
+		}
+	}
+
+	// A holder takes only one slot, even if it calls Lock twice
+	require.NoError(t, holders[0].Lock())
+	require.NoError(t, holders[0].Lock())
+	require.NoError(t, holders[1].Lock())
+
+	ok, err := holders[2].TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A holder can't release a slot that it has not taken
+	holders[2].Unlock()
+	ok, err = holders[2].TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The third holder blocks until a slot is released
+	locked := make(chan struct{})
+	go func() {
+		assert.NoError(t, holders[2].Lock())
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the third holder should wait for a slot")
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	holders[0].Unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the third holder should have a slot")
+	}
+
+	holders[1].Unlock()
+	holders[2].Unlock()
+}
@@ -1,40 +1,275 @@
 package lock
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
 type InMemoryLockGetter struct {
-	locks *sync.Map
+	locks      *sync.Map
+	semaphores *sync.Map
+	observer   Observer
 }
 
 func NewInMemory() *InMemoryLockGetter {
-	return &InMemoryLockGetter{locks: new(sync.Map)}
+	return &InMemoryLockGetter{
+		locks:      new(sync.Map),
+		semaphores: new(sync.Map),
+	}
 }
 
 func (i *InMemoryLockGetter) ReadWrite(_ prefixer.Prefixer, name string) ErrorRWLocker {
-	lock, _ := i.locks.LoadOrStore(name, &memLock{})
+	lock, _ := i.locks.LoadOrStore(name, &memLock{name: name, observer: i.observer})
 
 	return lock.(*memLock)
 }
 
+// Held returns the locks that are currently held.
+func (i *InMemoryLockGetter) Held() []LockInfo {
+	var held []LockInfo
+	i.locks.Range(func(_, value interface{}) bool {
+		if info, ok := value.(*memLock).info(); ok {
+			held = append(held, info)
+		}
+		return true
+	})
+	sort.Slice(held, func(a, b int) bool { return held[a].Name < held[b].Name })
+	return held
+}
+
+// ReleaseAll releases all the locks and semaphores that are still held. It is
+// meant to be used on shutdown and in tests, and it logs the locks that were
+// held, as it may be the sign of a leak.
+func (i *InMemoryLockGetter) ReleaseAll() {
+	log := logger.WithNamespace("lock")
+	i.locks.Range(func(_, value interface{}) bool {
+		ml := value.(*memLock)
+		if ml.release() {
+			log.Warnf("Lock %s was still held", ml.name)
+		}
+		return true
+	})
+	i.semaphores.Range(func(name, value interface{}) bool {
+		slots := value.(chan struct{})
+		for held := len(slots); held > 0; held-- {
+			<-slots
+			log.Warnf("Semaphore %s was still held", name)
+		}
+		return true
+	})
+}
+
+func (i *InMemoryLockGetter) setObserver(observer Observer) {
+	i.observer = observer
+}
+
+// ReadWriteTTL returns the same lock as ReadWrite, as in-memory locks don't
+// expire.
+func (i *InMemoryLockGetter) ReadWriteTTL(db prefixer.Prefixer, name string, _ time.Duration) ErrorRWLocker {
+	return i.ReadWrite(db, name)
+}
+
 // LongOperation returns a lock suitable for long operations. It will refresh
 // the lock in redis to avoid its automatic expiration.
-func (i *InMemoryLockGetter) LongOperation(db prefixer.Prefixer, name string) ErrorLocker {
-	return &longOperation{
-		lock:    i.ReadWrite(db, name).(*memLock),
-		timeout: LockTimeout,
-	}
+func (i *InMemoryLockGetter) LongOperation(db prefixer.Prefixer, name string, opts ...LongOperationOption) ErrorLocker {
+	return newLongOperation(i.ReadWrite(db, name).(*memLock), opts)
 }
 
+// memLock is an in-memory read/write lock: several goroutines can hold the
+// lock for reading at the same time, while a writer waits for them to release
+// it. A writer that waits blocks the new readers, so that it is not starved by
+// a steady flow of readers. The goroutines that wait for the lock are woken up
+// by closing the released channel when the lock is released.
 type memLock struct {
-	sync.RWMutex
+	name     string
+	observer Observer
+
+	// mu protects the fields below, that track who holds the lock
+	mu       sync.Mutex
+	writing  bool
+	readers  int
+	waiting  int           // the number of writers waiting for the lock
+	since    time.Time     // when the lock was acquired
+	released chan struct{} // closed (and replaced) when the lock is released
+}
+
+func (ml *memLock) Extend() (bool, error) { return true, nil }
+func (ml *memLock) lockName() string      { return ml.name }
+
+func (ml *memLock) Lock() error {
+	return ml.LockContext(context.Background())
 }
 
-func (ml *memLock) Lock() error  { ml.RWMutex.Lock(); return nil }
-func (ml *memLock) RLock() error { ml.RWMutex.RLock(); return nil }
-func (ml *memLock) Extend()      {}
-func (ml *memLock) Unlock()      { ml.RWMutex.Unlock() }
-func (ml *memLock) RUnlock()     { ml.RWMutex.RUnlock() }
+func (ml *memLock) LockContext(ctx context.Context) error {
+	start := startWait(ml.observer)
+	if err := ml.wait(ctx, ml.tryWrite, true); err != nil {
+		return err
+	}
+	ml.observeWait(start)
+	return nil
+}
+
+func (ml *memLock) TryLock(timeout time.Duration) (bool, error) {
+	start := startWait(ml.observer)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ml.wait(ctx, ml.tryWrite, true); err != nil {
+		return false, nil
+	}
+	ml.observeWait(start)
+	return true, nil
+}
+
+func (ml *memLock) RLock() error {
+	start := startWait(ml.observer)
+	_ = ml.wait(context.Background(), ml.tryRead, false)
+	ml.observeWait(start)
+	return nil
+}
+
+func (ml *memLock) TryRLock(timeout time.Duration) (bool, error) {
+	start := startWait(ml.observer)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ml.wait(ctx, ml.tryRead, false); err != nil {
+		return false, nil
+	}
+	ml.observeWait(start)
+	return true, nil
+}
+
+// Unlock releases the lock acquired for writing. If the lock is not held for
+// writing (double unlock for example), the error is logged instead of making
+// the process panic.
+func (ml *memLock) Unlock() {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if !ml.writing {
+		logger.WithNamespace("lock").Errorf("Invalid unlocking: %s is not locked for writing", ml.name)
+		return
+	}
+	if ml.observer != nil {
+		ml.observer.ObserveHeld(ml.name, time.Since(ml.since))
+	}
+	ml.writing = false
+	ml.notify()
+}
+
+// RUnlock releases the lock acquired for reading. Like Unlock, an invalid call
+// is logged.
+func (ml *memLock) RUnlock() {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if ml.readers <= 0 {
+		logger.WithNamespace("lock").Errorf("Invalid unlocking: %s is not locked for reading", ml.name)
+		return
+	}
+	ml.readers--
+	if ml.readers == 0 {
+		ml.notify()
+	}
+}
+
+// wait calls the try function each time the lock is released, until it
+// succeeds or the context is done. The try function is called with ml.mu
+// held. A writer is counted as waiting, to block the new readers.
+func (ml *memLock) wait(ctx context.Context, try func() bool, writer bool) error {
+	ml.mu.Lock()
+	if writer {
+		ml.waiting++
+		defer func() {
+			ml.mu.Lock()
+			ml.waiting--
+			// The readers blocked by this writer can go on
+			ml.notify()
+			ml.mu.Unlock()
+		}()
+	}
+	for {
+		if try() {
+			ml.mu.Unlock()
+			return nil
+		}
+		if ml.released == nil {
+			ml.released = make(chan struct{})
+		}
+		released := ml.released
+		ml.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		ml.mu.Lock()
+	}
+}
+
+// notify wakes up the goroutines waiting for the lock. It must be called with
+// ml.mu held.
+func (ml *memLock) notify() {
+	if ml.released != nil {
+		close(ml.released)
+		ml.released = nil
+	}
+}
+
+// tryWrite acquires the lock for writing if it is free. It must be called
+// with ml.mu held.
+func (ml *memLock) tryWrite() bool {
+	if ml.writing || ml.readers > 0 {
+		return false
+	}
+	ml.writing = true
+	ml.since = time.Now()
+	return true
+}
+
+// tryRead acquires the lock for reading if no writer holds it or waits for
+// it. It must be called with ml.mu held.
+func (ml *memLock) tryRead() bool {
+	if ml.writing || ml.waiting > 0 {
+		return false
+	}
+	ml.readers++
+	if ml.readers == 1 {
+		ml.since = time.Now()
+	}
+	return true
+}
+
+func (ml *memLock) observeWait(start time.Time) {
+	if ml.observer != nil {
+		ml.observer.ObserveWait(ml.name, time.Since(start))
+	}
+}
+
+// info returns the information about the lock if it is held.
+func (ml *memLock) info() (LockInfo, bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	switch {
+	case ml.writing:
+		return LockInfo{Name: ml.name, Kind: WriteLock, Since: ml.since}, true
+	case ml.readers > 0:
+		return LockInfo{Name: ml.name, Kind: ReadLock, Since: ml.since}, true
+	}
+	return LockInfo{}, false
+}
+
+// release unlocks the lock if it is held, and returns true in that case.
+func (ml *memLock) release() bool {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	held := ml.writing || ml.readers > 0
+	ml.writing = false
+	ml.readers = 0
+	if held {
+		ml.notify()
+	}
+	return held
+}
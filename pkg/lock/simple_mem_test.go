@@ -0,0 +1,266 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemTryLock(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "try-lock")
+	require.NoError(t, l.Lock())
+
+	start := time.Now()
+	ok, err := l.TryLock(50 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Unlock()
+	}()
+	ok, err = l.TryLock(time.Second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l.Unlock()
+}
+
+func TestMemLockContext(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "lock-context")
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		assert.NoError(t, l.Lock())
+		close(held)
+		<-release
+		l.Unlock()
+	}()
+	<-held
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	err := l.LockContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = l.LockContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, l.LockContext(context.Background()))
+	l.Unlock()
+}
+
+func TestMemConcurrentReaders(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "readers")
+
+	const n = 5
+	var readers int32
+	var all sync.WaitGroup
+	all.Add(n)
+	release := make(chan struct{})
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			assert.NoError(t, l.RLock())
+			atomic.AddInt32(&readers, 1)
+			all.Done()
+			<-release
+			atomic.AddInt32(&readers, -1)
+			l.RUnlock()
+			done <- struct{}{}
+		}()
+	}
+
+	// All the readers hold the lock at the same time
+	all.Wait()
+	assert.Equal(t, int32(n), atomic.LoadInt32(&readers))
+
+	// A writer is blocked until they release it
+	locked := make(chan struct{})
+	go func() {
+		assert.NoError(t, l.Lock())
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the writer should wait for the readers")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < n; i++ {
+		<-done
+	}
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the writer should have the lock")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&readers))
+	l.Unlock()
+}
+
+func TestMemWriterNotStarved(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "starvation")
+
+	// A steady flow of readers, that overlap, holds the lock for reading
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if ok, _ := l.TryRLock(10 * time.Millisecond); ok {
+					time.Sleep(2 * time.Millisecond)
+					l.RUnlock()
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	// The waiting writer blocks the new readers, and gets the lock
+	time.Sleep(10 * time.Millisecond)
+	ok, err := l.TryLock(time.Second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// And a reader that waits gets it as soon as the writer releases it
+	locked := make(chan struct{})
+	go func() {
+		ok, _ := l.TryRLock(time.Second)
+		assert.True(t, ok)
+		close(locked)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Unlock()
+	select {
+	case <-locked:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the reader should have the lock")
+	}
+	l.RUnlock()
+}
+
+func TestMemTryRLock(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "try-rlock")
+	require.NoError(t, l.Lock())
+
+	ok, err := l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	l.Unlock()
+	ok, err = l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l.RUnlock()
+	l.RUnlock()
+}
+
+func TestMemReleaseAll(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	getter := NewInMemory()
+	writing := getter.ReadWrite(db, "alice.example.net/vfs")
+	reading := getter.ReadWrite(db, "bob.example.net/vfs")
+	sem := getter.Semaphore(db, "konnectors", 1)
+
+	require.NoError(t, writing.Lock())
+	require.NoError(t, reading.RLock())
+	require.NoError(t, reading.RLock())
+	require.NoError(t, sem.Lock())
+
+	getter.ReleaseAll()
+
+	ok, err := writing.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = reading.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = getter.Semaphore(db, "konnectors", 1).TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	getter.ReleaseAll()
+}
+
+func TestMemDoubleUnlock(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := NewInMemory().ReadWrite(db, "double-unlock")
+
+	require.NoError(t, l.Lock())
+	l.Unlock()
+	assert.NotPanics(t, l.Unlock)
+	assert.NotPanics(t, l.RUnlock)
+
+	// A reader can't release the lock of a writer
+	require.NoError(t, l.RLock())
+	assert.NotPanics(t, l.Unlock)
+	ok, err := l.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	l.RUnlock()
+	assert.NotPanics(t, l.RUnlock)
+
+	ok, err = l.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l.Unlock()
+}
+
+func TestMemHeld(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	getter := NewInMemory()
+	reading := getter.ReadWrite(db, "alice.example.net/notes")
+	writing := getter.ReadWrite(db, "bob.example.net/vfs")
+	getter.ReadWrite(db, "free")
+
+	assert.Empty(t, getter.Held())
+	require.NoError(t, reading.RLock())
+	require.NoError(t, writing.Lock())
+
+	held := getter.Held()
+	require.Len(t, held, 2)
+	assert.Equal(t, "alice.example.net/notes", held[0].Name)
+	assert.Equal(t, ReadLock, held[0].Kind)
+	assert.WithinDuration(t, time.Now(), held[0].Since, time.Second)
+	assert.Equal(t, "bob.example.net/vfs", held[1].Name)
+	assert.Equal(t, WriteLock, held[1].Kind)
+
+	reading.RUnlock()
+	held = getter.Held()
+	require.Len(t, held, 1)
+	assert.Equal(t, "bob.example.net/vfs", held[0].Name)
+	writing.Unlock()
+	assert.Empty(t, getter.Held())
+}
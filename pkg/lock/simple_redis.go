@@ -4,13 +4,14 @@ import (
 	"context"
 	"errors"
 	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
-	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -20,6 +21,8 @@ const luaRelease = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.c
 type subRedisInterface interface {
 	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
 	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+	PTTL(ctx context.Context, key string) *redis.DurationCmd
 }
 
 const (
@@ -36,7 +39,8 @@ const (
 	// WaitTimeout is the maximum time to wait before returning control to caller.
 	WaitTimeout = 1 * time.Minute
 
-	// WaitRetry is the time to wait between retries.
+	// WaitRetry is the time to wait between retries (with the default
+	// backoff).
 	WaitRetry = 100 * time.Millisecond
 )
 
@@ -44,6 +48,9 @@ var (
 	// ErrTooManyRetries is the error returned when despite several tries
 	// we never managed to get a lock
 	ErrTooManyRetries = errors.New("abort after too many failures without getting the lock")
+	// ErrInvalidSemaphore is the error returned by the holders of a semaphore
+	// that has no slot
+	ErrInvalidSemaphore = errors.New("a semaphore must have at least one slot")
 )
 
 var redislocksMu sync.Mutex
@@ -51,79 +58,256 @@ var redisRng *rand.Rand
 var redisLogger logger.Logger
 
 type RedisLockGetter struct {
-	client redis.UniversalClient
-	locks  *sync.Map
+	client   subRedisInterface
+	locks    *sync.Map
+	observer Observer
+	backoff  Backoff
+	ttl      time.Duration
+	hashTags bool
 }
 
-func NewRedisLockGetter(client redis.UniversalClient) *RedisLockGetter {
+func NewRedisLockGetter(client redis.UniversalClient, opts ...RedisOption) *RedisLockGetter {
 	redisRng = rand.New(rand.NewSource(time.Now().UnixNano()))
 	redisLogger = logger.WithNamespace("redis-lock")
 
-	return &RedisLockGetter{
-		client: client,
-		locks:  new(sync.Map),
+	r := &RedisLockGetter{
+		client:  client,
+		locks:   new(sync.Map),
+		backoff: DefaultBackoff,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 func (r *RedisLockGetter) ReadWrite(db prefixer.Prefixer, name string) ErrorRWLocker {
+	return r.lock(db, name)
+}
+
+// ReadWriteTTL returns a lock that will expire in redis after the given TTL.
+// It shares its state with the other locks for the same name, whatever their
+// TTLs, so that the readers of a cozy-stack and the reentrant locks still work
+// together.
+func (r *RedisLockGetter) ReadWriteTTL(db prefixer.Prefixer, name string, ttl time.Duration) ErrorRWLocker {
+	return &redisLockTTL{redisLock: r.lock(db, name), ttl: ttl}
+}
+
+// lock returns the cached lock for the given name, or creates it.
+func (r *RedisLockGetter) lock(db prefixer.Prefixer, name string) *redisLock {
 	ns := db.DBPrefix() + "/" + name
-	lock, _ := r.locks.LoadOrStore(ns, &redisLock{
-		client:    r.client,
-		ctx:       context.Background(),
-		timeout:   LockTimeout,
-		waitRetry: WaitRetry,
-		key:       basicLockNS + ns,
-	})
+	ttl := r.ttl
+	if ttl == 0 {
+		ttl = LockTimeout
+	}
+	rl := &redisLock{
+		retrier:    newRetrier(r.backoff),
+		client:     r.client,
+		ctx:        context.Background(),
+		timeout:    LockTimeout,
+		defaultTTL: ttl,
+		key:        r.redisKey(basicLockNS, ns),
+		name:       name,
+		observer:   r.observer,
+	}
+	rl.forget = func() { r.forget(ns, rl) }
+	lock, _ := r.locks.LoadOrStore(ns, rl)
 
 	return lock.(*redisLock)
 }
 
+// forget removes a lock that is no longer held from the cache, so that the
+// cache doesn't keep all the names that have been used. The exclusion is made
+// by redis, so it is safe to create a new lock later for the same name, even
+// if the old one is still used by a goroutine.
+func (r *RedisLockGetter) forget(ns string, rl *redisLock) {
+	if cached, ok := r.locks.Load(ns); ok && cached == rl {
+		r.locks.Delete(ns)
+	}
+}
+
+func (r *RedisLockGetter) setObserver(observer Observer) {
+	r.observer = observer
+}
+
+func (r *RedisLockGetter) setTTL(ttl time.Duration) {
+	r.ttl = ttl
+}
+
+// Held returns the locks that are currently held in redis, with their TTL. It
+// is a best-effort: the locks taken by another cozy-stack have no kind and no
+// date of acquisition, and the errors are only logged.
+func (r *RedisLockGetter) Held() []LockInfo {
+	ctx := context.Background()
+	local := make(map[string]*redisLock)
+	r.locks.Range(func(_, value interface{}) bool {
+		rl := value.(*redisLock)
+		local[rl.key] = rl
+		return true
+	})
+
+	var mu sync.Mutex
+	var held []LockInfo
+	collect := func(ctx context.Context, client subRedisInterface) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(ctx, cursor, basicLockNS+"*", 100).Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				ttl, err := client.PTTL(ctx, key).Result()
+				if err != nil || ttl == -2*time.Nanosecond {
+					continue // the lock has been released in the meantime
+				}
+				name := strings.TrimPrefix(key, basicLockNS)
+				if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+					name = name[1 : len(name)-1]
+				}
+				info := LockInfo{Name: name, TTL: ttl}
+				if rl, ok := local[key]; ok {
+					info.Kind, info.Since = rl.info()
+				}
+				mu.Lock()
+				held = append(held, info)
+				mu.Unlock()
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+
+	var err error
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		// SCAN works on a single node, so each master node of the cluster
+		// must be scanned
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return collect(ctx, node)
+		})
+	} else {
+		err = collect(ctx, r.client)
+	}
+	if err != nil {
+		redisLogger.Warnf("Failed to list the locks: %s", err)
+	}
+	sort.Slice(held, func(a, b int) bool { return held[a].Name < held[b].Name })
+	return held
+}
+
+// WithHashTags makes the redis keys of the locks wrap their names in a hash tag
+// ({...}), like locks:{alice.example.net/vfs}, so that all the keys for a lock
+// would be in the same slot on a redis cluster if a lua script had to use
+// several keys. The current scripts use a single key, and work on a redis
+// cluster without this option.
+//
+// It changes the keys of the locks: during a rolling upgrade, two cozy-stacks
+// with and without this option would not exclude each other. It must be
+// enabled only after all the cozy-stacks have been stopped.
+func WithHashTags() RedisOption {
+	return func(r *RedisLockGetter) {
+		r.hashTags = true
+	}
+}
+
+// redisKey returns the key in redis for a lock.
+func (r *RedisLockGetter) redisKey(prefix, ns string) string {
+	if r.hashTags {
+		return prefix + "{" + ns + "}"
+	}
+	return prefix + ns
+}
+
 // LongOperation returns a lock suitable for long operations. It will refresh
 // the lock in redis to avoid its automatic expiration.
-func (r *RedisLockGetter) LongOperation(db prefixer.Prefixer, name string) ErrorLocker {
-	return &longOperation{
-		lock:    r.ReadWrite(db, name).(*redisLock),
-		timeout: LockTimeout,
-	}
+func (r *RedisLockGetter) LongOperation(db prefixer.Prefixer, name string, opts ...LongOperationOption) ErrorLocker {
+	return newLongOperation(r.ReadWrite(db, name).(*redisLock), opts)
 }
 
 type redisLock struct {
-	client    subRedisInterface
-	ctx       context.Context
-	mu        sync.Mutex
-	timeout   time.Duration
-	waitRetry time.Duration
-	key       string
-	token     string
+	retrier
+	client     subRedisInterface
+	ctx        context.Context
+	mu         sync.Mutex
+	timeout    time.Duration // the maximal time to wait for the lock
+	defaultTTL time.Duration // the expiration of the key when no TTL is given
+	ttl        time.Duration // the expiration of the key for the current holders
+	key        string
+	token      string
+	name       string // the name given to the getter, used for the observer
+	observer   Observer
+	forget     func()    // removes the lock from the cache of the getter
+	since      time.Time // when the lock was acquired for writing
 	// readers is the number of readers when the lock is acquired for reading
 	// or -1 when it is locked for writing. 0 means that the lock is free.
 	readers int
 }
 
 func (rl *redisLock) Lock() error {
-	// Calculate the timestamp we are willing to wait for.
-	stop := time.Now().Add(rl.timeout)
+	return rl.LockContext(context.Background())
+}
 
-	redislocksMu.Lock()
-	token := utils.RandomStringFast(redisRng, lockTokenSize)
-	redislocksMu.Unlock()
+func (rl *redisLock) LockContext(ctx context.Context) error {
+	return rl.lockContext(ctx, rl.defaultTTL)
+}
 
-	for {
-		ok, err := rl.obtainsWriting(token)
-		if err != nil || ok {
-			return err
-		}
-		if time.Now().Add(rl.waitRetry).After(stop) {
-			return ErrTooManyRetries
-		}
-		time.Sleep(rl.waitRetry)
+func (rl *redisLock) lockContext(ctx context.Context, ttl time.Duration) error {
+	ok, err := rl.acquire(ctx, rl.timeout, rl.obtainsWriting(ttl))
+	if err == nil && !ok {
+		return ErrTooManyRetries
+	}
+	return err
+}
+
+func (rl *redisLock) TryLock(timeout time.Duration) (bool, error) {
+	return rl.acquire(context.Background(), timeout, rl.obtainsWriting(rl.defaultTTL))
+}
+
+// acquire calls the obtain function with a new token until it succeeds, or
+// until the timeout has been reached, or the context is done.
+func (rl *redisLock) acquire(ctx context.Context, timeout time.Duration, obtain func(token string) (bool, error)) (bool, error) {
+	start := startWait(rl.observer)
+	ok, err := rl.retry(ctx, timeout, obtain)
+	if ok && rl.observer != nil {
+		rl.observer.ObserveWait(rl.name, time.Since(start))
+	}
+	return ok, err
+}
+
+// Extend refreshes the TTL of the lock in redis, but only if the lock is still
+// ours (a Lua script checks the token), to avoid extending a lock that has
+// expired and been taken by another client.
+func (rl *redisLock) Extend() (bool, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	ok, err := rl.extends(rl.ttl)
+	if err != nil {
+		redisLogger.Warnf("Failed to extend: %s (%s)", err.Error(), rl.key)
+	} else if !ok {
+		redisLogger.Warnf("Lock lost: %s", rl.key)
+		// Forget the lock, so that it can be acquired again
+		rl.readers = 0
+		rl.token = ""
+		rl.forget()
 	}
+	return ok, err
 }
 
-func (rl *redisLock) Extend() {
+func (rl *redisLock) lockName() string { return rl.key }
+
+// info returns the kind of the lock, and since when it is held, if it has
+// been acquired by this cozy-stack.
+func (rl *redisLock) info() (LockKind, time.Time) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-	_, _ = rl.extends()
+	switch {
+	case rl.readers < 0:
+		return WriteLock, rl.since
+	case rl.readers > 0:
+		return ReadLock, rl.since
+	}
+	return "", time.Time{}
 }
 
 func (rl *redisLock) RLock() error {
@@ -133,54 +317,64 @@ func (rl *redisLock) RLock() error {
 	// released before being able to give a lock for reading on the same name.
 	// It may be improved, but I prefer to err on the safe side for now. And it
 	// still allows to have two readers on the same cozy-stack.
+	return rl.rlock(rl.defaultTTL)
+}
 
-	stop := time.Now().Add(rl.timeout)
-
-	redislocksMu.Lock()
-	token := utils.RandomStringFast(redisRng, lockTokenSize)
-	redislocksMu.Unlock()
-
-	for {
-		ok, err := rl.extendsOrObtainsReading(token)
-		if err != nil || ok {
-			return err
-		}
-		if time.Now().Add(rl.waitRetry).After(stop) {
-			return ErrTooManyRetries
-		}
-		time.Sleep(rl.waitRetry)
+func (rl *redisLock) rlock(ttl time.Duration) error {
+	ok, err := rl.acquire(context.Background(), rl.timeout, rl.extendsOrObtainsReading(ttl))
+	if err == nil && !ok {
+		return ErrTooManyRetries
 	}
+	return err
 }
 
-func (rl *redisLock) obtainsWriting(token string) (bool, error) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	if rl.readers != 0 {
-		return false, nil
-	}
-	return rl.obtains(true, token)
+func (rl *redisLock) TryRLock(timeout time.Duration) (bool, error) {
+	return rl.acquire(context.Background(), timeout, rl.extendsOrObtainsReading(rl.defaultTTL))
 }
 
-func (rl *redisLock) extendsOrObtainsReading(token string) (bool, error) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	if rl.readers < 0 {
-		return false, nil
-	}
-	ok, err := rl.extends()
-	if ok {
-		rl.readers++
-		return true, nil
+// obtainsWriting returns a function that tries to obtain the lock for writing
+// with the given TTL.
+func (rl *redisLock) obtainsWriting(ttl time.Duration) func(token string) (bool, error) {
+	return func(token string) (bool, error) {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		if rl.readers != 0 {
+			return false, nil
+		}
+		return rl.obtains(true, token, ttl)
 	}
-	if err != nil {
-		return false, err
+}
+
+// extendsOrObtainsReading returns a function that tries to obtain the lock for
+// reading with the given TTL. If the lock is already held for reading, its TTL
+// is extended, but never shortened, as other readers may rely on it.
+func (rl *redisLock) extendsOrObtainsReading(ttl time.Duration) func(token string) (bool, error) {
+	return func(token string) (bool, error) {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		if rl.readers < 0 {
+			return false, nil
+		}
+		extended := ttl
+		if extended < rl.ttl {
+			extended = rl.ttl
+		}
+		ok, err := rl.extends(extended)
+		if ok {
+			rl.ttl = extended
+			rl.readers++
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return rl.obtains(false, token, ttl)
 	}
-	return rl.obtains(false, token)
 }
 
-func (rl *redisLock) obtains(writing bool, token string) (bool, error) {
+func (rl *redisLock) obtains(writing bool, token string, ttl time.Duration) (bool, error) {
 	// Try to obtain a lock
-	ok, err := rl.client.SetNX(rl.ctx, rl.key, token, rl.timeout).Result()
+	ok, err := rl.client.SetNX(rl.ctx, rl.key, token, ttl).Result()
 	if err != nil {
 		return false, err // most probably redis connectivity error
 	}
@@ -189,6 +383,8 @@ func (rl *redisLock) obtains(writing bool, token string) (bool, error) {
 	}
 
 	rl.token = token
+	rl.ttl = ttl
+	rl.since = time.Now()
 	if writing {
 		rl.readers = -1
 	} else {
@@ -197,14 +393,14 @@ func (rl *redisLock) obtains(writing bool, token string) (bool, error) {
 	return true, nil
 }
 
-func (rl *redisLock) extends() (bool, error) {
+func (rl *redisLock) extends(ttl time.Duration) (bool, error) {
 	if rl.token == "" {
 		return false, nil
 	}
 
 	// we already have a lock, attempts to extends it
-	ttl := strconv.FormatInt(int64(LockTimeout/time.Millisecond), 10)
-	ret, err := rl.client.Eval(rl.ctx, luaRefresh, []string{rl.key}, rl.token, ttl).Result()
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	ret, err := rl.client.Eval(rl.ctx, luaRefresh, []string{rl.key}, rl.token, ms).Result()
 	if err != nil {
 		return false, err // most probably redis connectivity error
 	}
@@ -233,11 +429,48 @@ func (rl *redisLock) unlock(writing bool) {
 		return
 	}
 
-	_, err := rl.client.Eval(rl.ctx, luaRelease, []string{rl.key}, rl.token).Result()
+	// The lua script deletes the key only if it still has our token as value,
+	// so that we don't release a lock that has expired and has been taken by
+	// another client.
+	ret, err := rl.client.Eval(rl.ctx, luaRelease, []string{rl.key}, rl.token).Result()
 	if err != nil {
 		redisLogger.Warnf("Failed to unlock: %s (%s)", err.Error(), rl.key)
+	} else if ret != int64(1) {
+		redisLogger.Infof("Lock expired before unlock: %s", rl.key)
+	}
+
+	if writing && rl.observer != nil {
+		rl.observer.ObserveHeld(rl.name, time.Since(rl.since))
 	}
 
 	rl.readers = 0
 	rl.token = ""
+	rl.forget()
+}
+
+// redisLockTTL is the lock returned by ReadWriteTTL: it is the cached lock for
+// the name, but acquired with its own TTL.
+type redisLockTTL struct {
+	*redisLock
+	ttl time.Duration
+}
+
+func (l *redisLockTTL) Lock() error {
+	return l.LockContext(context.Background())
+}
+
+func (l *redisLockTTL) LockContext(ctx context.Context) error {
+	return l.lockContext(ctx, l.ttl)
+}
+
+func (l *redisLockTTL) TryLock(timeout time.Duration) (bool, error) {
+	return l.acquire(context.Background(), timeout, l.obtainsWriting(l.ttl))
+}
+
+func (l *redisLockTTL) RLock() error {
+	return l.rlock(l.ttl)
+}
+
+func (l *redisLockTTL) TryRLock(timeout time.Duration) (bool, error) {
+	return l.acquire(context.Background(), timeout, l.extendsOrObtainsReading(l.ttl))
 }
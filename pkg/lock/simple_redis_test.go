@@ -0,0 +1,471 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is an in-memory implementation of the few redis commands used by
+// the locks. It allows to test them without a redis server.
+type fakeRedis struct {
+	mu    sync.Mutex
+	keys  map[string]fakeRedisKey
+	zsets map[string]map[string]int64
+}
+
+type fakeRedisKey struct {
+	value    string
+	expireAt time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		keys:  make(map[string]fakeRedisKey),
+		zsets: make(map[string]map[string]int64),
+	}
+}
+
+// newFakeRedisGetter returns a redis lock getter that uses a fake redis. Two
+// getters sharing the same fake redis act like two cozy-stacks.
+func newFakeRedisGetter(fake *fakeRedis, opts ...RedisOption) *RedisLockGetter {
+	getter := NewRedisLockGetter(nil, opts...)
+	getter.client = fake
+	return getter
+}
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	k, ok := f.keys[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(k.expireAt) {
+		delete(f.keys, key)
+		return "", false
+	}
+	return k.value, true
+}
+
+// expire simulates the expiration of a key by redis.
+func (f *fakeRedis) expire(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, key)
+}
+
+func (f *fakeRedis) value(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	val, _ := f.get(key)
+	return val
+}
+
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.get(key); !ok {
+		return 0
+	}
+	return time.Until(f.keys[key].expireAt)
+}
+
+func (f *fakeRedis) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.get(key); ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	f.keys[key] = fakeRedisKey{
+		value:    value.(string),
+		expireAt: time.Now().Add(expiration),
+	}
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeRedis) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.keys {
+		if _, ok := f.get(key); ok && strings.HasPrefix(key, strings.TrimSuffix(match, "*")) {
+			keys = append(keys, key)
+		}
+	}
+	return redis.NewScanCmdResult(keys, 0, nil)
+}
+
+func (f *fakeRedis) PTTL(ctx context.Context, key string) *redis.DurationCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.get(key); !ok {
+		return redis.NewDurationResult(-2, nil)
+	}
+	return redis.NewDurationResult(time.Until(f.keys[key].expireAt), nil)
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	val, ok := f.get(keys[0])
+	switch script {
+	case luaSemAcquire:
+		zset := f.zsets[keys[0]]
+		if zset == nil {
+			zset = make(map[string]int64)
+			f.zsets[keys[0]] = zset
+		}
+		now, _ := strconv.ParseInt(args[0].(string), 10, 64)
+		for member, score := range zset {
+			if score <= now {
+				delete(zset, member)
+			}
+		}
+		if len(zset) >= args[1].(int) {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		zset[args[3].(string)], _ = strconv.ParseInt(args[2].(string), 10, 64)
+		return redis.NewCmdResult(int64(1), nil)
+	case luaSemRefresh:
+		zset := f.zsets[keys[0]]
+		if _, ok := zset[args[0].(string)]; !ok {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		zset[args[0].(string)], _ = strconv.ParseInt(args[1].(string), 10, 64)
+		return redis.NewCmdResult(int64(1), nil)
+	case luaSemRelease:
+		zset := f.zsets[keys[0]]
+		if _, ok := zset[args[0].(string)]; !ok {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		delete(zset, args[0].(string))
+		return redis.NewCmdResult(int64(1), nil)
+	case luaRefresh:
+		if !ok || val != args[0] {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		ms, err := strconv.ParseInt(args[1].(string), 10, 64)
+		if err != nil {
+			return redis.NewCmdResult(nil, err)
+		}
+		f.keys[keys[0]] = fakeRedisKey{
+			value:    val,
+			expireAt: time.Now().Add(time.Duration(ms) * time.Millisecond),
+		}
+		return redis.NewCmdResult(int64(1), nil)
+	case luaRelease:
+		if !ok || val != args[0] {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		delete(f.keys, keys[0])
+		return redis.NewCmdResult(int64(1), nil)
+	}
+	return redis.NewCmdResult(nil, errors.New("unknown script"))
+}
+
+func TestRedisTryLock(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := newFakeRedisGetter(fake).ReadWrite(db, "try-lock")
+	l.(*redisLock).waitRetry = 10 * time.Millisecond
+	other := newFakeRedisGetter(fake).ReadWrite(db, "try-lock")
+	other.(*redisLock).waitRetry = 10 * time.Millisecond
+
+	require.NoError(t, l.Lock())
+
+	start := time.Now()
+	ok, err := other.TryLock(50 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.WithinDuration(t, start.Add(50*time.Millisecond), time.Now(), 20*time.Millisecond)
+
+	ok, err = l.TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	l.Unlock()
+	ok, err = other.TryLock(50 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	other.Unlock()
+}
+
+func TestRedisLockContext(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := newFakeRedisGetter(fake).ReadWrite(db, "lock-context")
+	other := newFakeRedisGetter(fake).ReadWrite(db, "lock-context")
+	other.(*redisLock).waitRetry = 10 * time.Millisecond
+
+	require.NoError(t, l.Lock())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err := other.LockContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+
+	l.Unlock()
+	require.NoError(t, other.LockContext(context.Background()))
+	other.Unlock()
+}
+
+func TestRedisLockTTL(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	short := newFakeRedisGetter(fake).ReadWriteTTL(db, "lock-ttl", 50*time.Millisecond)
+	other := newFakeRedisGetter(fake).ReadWrite(db, "lock-ttl")
+	other.(*redisLock).waitRetry = 10 * time.Millisecond
+
+	require.NoError(t, short.Lock())
+	ok, err := other.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The short lock has expired, even if it was not released
+	time.Sleep(60 * time.Millisecond)
+	ok, err = other.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	other.Unlock()
+}
+
+func TestRedisLockCache(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	getter := newFakeRedisGetter(newFakeRedis())
+	cached := func() int {
+		n := 0
+		getter.locks.Range(func(_, _ interface{}) bool { n++; return true })
+		return n
+	}
+
+	l := getter.ReadWriteTTL(db, "cache", time.Second).(*redisLockTTL)
+	require.NoError(t, l.Lock())
+	assert.Same(t, l.redisLock, getter.ReadWriteTTL(db, "cache", time.Second).(*redisLockTTL).redisLock)
+	// The locks for the same name share the cache, whatever their TTLs
+	assert.Same(t, l.redisLock, getter.ReadWriteTTL(db, "cache", time.Minute).(*redisLockTTL).redisLock)
+	assert.Same(t, l.redisLock, getter.ReadWrite(db, "cache"))
+	assert.Equal(t, 1, cached())
+
+	// The lock is removed from the cache when it is released
+	l.Unlock()
+	assert.Equal(t, 0, cached())
+	other := getter.ReadWriteTTL(db, "cache", time.Second).(*redisLockTTL)
+	assert.NotSame(t, l.redisLock, other.redisLock)
+	require.NoError(t, other.Lock())
+	other.Unlock()
+}
+
+func TestRedisLockSharedTTLs(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	getter := newFakeRedisGetter(fake)
+	short := getter.ReadWriteTTL(db, "shared", time.Second)
+	long := getter.ReadWriteTTL(db, "shared", time.Minute)
+	key := short.(*redisLockTTL).key
+
+	// The readers with different TTLs share the lock, and the TTL in redis
+	// is never shortened
+	require.NoError(t, long.RLock())
+	assert.Greater(t, fake.ttl(key), 30*time.Second)
+	require.NoError(t, short.RLock())
+	assert.Greater(t, fake.ttl(key), 30*time.Second)
+	short.RUnlock()
+	long.RUnlock()
+	assert.Equal(t, "", fake.value(key))
+
+	// Each acquisition uses the TTL of its caller
+	require.NoError(t, short.Lock())
+	assert.LessOrEqual(t, fake.ttl(key), time.Second)
+	short.Unlock()
+
+	// The reentrant locks work with different TTLs for the same name
+	alice := Reentrant(long, "alice")
+	require.NoError(t, alice.Lock())
+	nested := Reentrant(short, "alice")
+	ok, err := nested.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	nested.Unlock()
+	alice.Unlock()
+	assert.Equal(t, "", fake.value(key))
+}
+
+func TestRedisExtendAfterSteal(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := newFakeRedisGetter(fake).ReadWrite(db, "extend").(*redisLock)
+	other := newFakeRedisGetter(fake).ReadWriteTTL(db, "extend", time.Second).(*redisLockTTL)
+
+	require.NoError(t, l.Lock())
+	ok, err := l.Extend()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The lock expires and is taken by another client
+	fake.expire(l.key)
+	require.NoError(t, other.Lock())
+	token := fake.value(other.key)
+	ttl := fake.ttl(other.key)
+
+	ok, err = l.Extend()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, token, fake.value(other.key))
+	assert.LessOrEqual(t, fake.ttl(other.key), ttl)
+	other.Unlock()
+}
+
+func TestRedisUnlockAfterExpiration(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	expired := newFakeRedisGetter(fake).ReadWrite(db, "unlock").(*redisLock)
+	holder := newFakeRedisGetter(fake).ReadWrite(db, "unlock").(*redisLock)
+	other := newFakeRedisGetter(fake).ReadWrite(db, "unlock")
+
+	require.NoError(t, expired.Lock())
+	fake.expire(expired.key)
+	require.NoError(t, holder.Lock())
+	token := fake.value(holder.key)
+
+	// The expired holder must not release the lock of the new holder
+	expired.Unlock()
+	assert.Equal(t, token, fake.value(holder.key))
+	ok, err := other.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	holder.Unlock()
+	assert.Empty(t, fake.value(holder.key))
+	ok, err = other.TryLock(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	other.Unlock()
+}
+
+func TestRedisTryRLock(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := newFakeRedisGetter(fake).ReadWrite(db, "try-rlock")
+	l.(*redisLock).waitRetry = 10 * time.Millisecond
+	other := newFakeRedisGetter(fake).ReadWrite(db, "try-rlock")
+	other.(*redisLock).waitRetry = 10 * time.Millisecond
+
+	require.NoError(t, l.Lock())
+	ok, err := l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = other.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	l.Unlock()
+	ok, err = l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l.RUnlock()
+	l.RUnlock()
+}
+
+func TestRedisHashTag(t *testing.T) {
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+
+	// The keys are not changed by default, to stay compatible with the
+	// cozy-stacks that are still running during an upgrade
+	getter := newFakeRedisGetter(newFakeRedis())
+	l := getter.ReadWrite(db, "vfs").(*redisLock)
+	assert.Equal(t, "locks:cozy.local/vfs", l.key)
+	sem := getter.Semaphore(db, "konnectors", 2).(*redisSemaphore)
+	assert.Equal(t, "semaphores:cozy.local/konnectors", sem.key)
+
+	getter = newFakeRedisGetter(newFakeRedis(), WithHashTags())
+	l = getter.ReadWrite(db, "vfs").(*redisLock)
+	assert.Equal(t, "locks:{cozy.local/vfs}", l.key)
+	sem = getter.Semaphore(db, "konnectors", 2).(*redisSemaphore)
+	assert.Equal(t, "semaphores:{cozy.local/konnectors}", sem.key)
+
+	// The names of the held locks are the same with both formats
+	require.NoError(t, l.Lock())
+	held := getter.Held()
+	require.Len(t, held, 1)
+	assert.Equal(t, "cozy.local/vfs", held[0].Name)
+	l.Unlock()
+}
+
+func TestRedisCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("a redis cluster is required for this test: test skipped due to the use of --short flag")
+	}
+	addrs := os.Getenv("COZY_REDIS_CLUSTER")
+	if addrs == "" {
+		t.Skip("COZY_REDIS_CLUSTER must be set with the addresses of the cluster nodes")
+	}
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: strings.Split(addrs, ","),
+	})
+	getter := NewRedisLockGetter(client)
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	l := getter.ReadWrite(db, "test-cluster").(*redisLock)
+	l.waitRetry = 10 * time.Millisecond
+
+	require.NoError(t, l.Lock())
+	var names []string
+	for _, info := range getter.Held() {
+		names = append(names, info.Name)
+	}
+	assert.Contains(t, names, "cozy.local/test-cluster")
+	ok, err := l.Extend()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.TryRLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	l.Unlock()
+
+	ok, err = l.TryLock(20 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l.Unlock()
+}
+
+func TestRedisHeld(t *testing.T) {
+	fake := newFakeRedis()
+	db := prefixer.NewPrefixer(0, "cozy.local", "cozy.local")
+	getter := newFakeRedisGetter(fake)
+	l := getter.ReadWrite(db, "held")
+	other := newFakeRedisGetter(fake).ReadWrite(db, "other")
+
+	assert.Empty(t, getter.Held())
+	require.NoError(t, l.RLock())
+	require.NoError(t, other.Lock())
+
+	held := getter.Held()
+	require.Len(t, held, 2)
+	assert.Equal(t, "cozy.local/held", held[0].Name)
+	assert.Equal(t, ReadLock, held[0].Kind)
+	assert.WithinDuration(t, time.Now(), held[0].Since, time.Second)
+	assert.Greater(t, held[0].TTL, time.Duration(0))
+	assert.Equal(t, "cozy.local/other", held[1].Name)
+	assert.Empty(t, held[1].Kind)
+
+	l.RUnlock()
+	other.Unlock()
+	assert.Empty(t, getter.Held())
+}
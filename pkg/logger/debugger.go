@@ -24,6 +24,19 @@ type Debugger interface {
 func initDebugger(client redis.UniversalClient) error {
 	var err error
 
+	// The debugger is kept when the logger is initialized again with the same
+	// client, like when the configuration is reloaded.
+	switch d := debugger.(type) {
+	case *MemDebugger:
+		if client == nil {
+			return nil
+		}
+	case *RedisDebugger:
+		if d.client == client {
+			return nil
+		}
+	}
+
 	if client == nil {
 		debugger = NewMemDebugger()
 		return nil
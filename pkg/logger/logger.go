@@ -45,6 +45,7 @@ type Options struct {
 	Hooks  []logrus.Hook
 	Output io.Writer
 	Level  string
+	Format string
 	Redis  redis.UniversalClient
 }
 
@@ -229,11 +230,25 @@ func setupLogger(logger *logrus.Logger, lvl logrus.Level, opt Options) {
 		logger.AddHook(hook)
 	}
 
-	formatter := logger.Formatter.(*logrus.TextFormatter)
+	timestampFormat := "2006-01-02T15:04:05.000Z07:00" // Milliseconds formatter
 	if build.IsDevRelease() && lvl == logrus.DebugLevel {
-		formatter.TimestampFormat = time.RFC3339Nano // Nanoseconds formatter
+		timestampFormat = time.RFC3339Nano // Nanoseconds formatter
+	}
+
+	// The formatter is kept if it has the right format, to keep its other
+	// settings.
+	if opt.Format == "json" {
+		if formatter, ok := logger.Formatter.(*logrus.JSONFormatter); ok {
+			formatter.TimestampFormat = timestampFormat
+		} else {
+			logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: timestampFormat})
+		}
 	} else {
-		formatter.TimestampFormat = "2006-01-02T15:04:05.000Z07:00" // Milliseconds formatter
+		if formatter, ok := logger.Formatter.(*logrus.TextFormatter); ok {
+			formatter.TimestampFormat = timestampFormat
+		} else {
+			logger.SetFormatter(&logrus.TextFormatter{TimestampFormat: timestampFormat})
+		}
 	}
 }
 
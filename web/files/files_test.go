@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/note"
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/config/config"
@@ -2312,6 +2313,28 @@ func TestFiles(t *testing.T) {
 		meta.NotContainsKey("electronicSafe")
 	})
 
+	t.Run("UploadNoteTooLarge", func(t *testing.T) {
+		e := testutils.CreateTestClient(t, ts.URL)
+
+		maxNodes := config.GetConfig().Notes.MaxNodes
+		config.GetConfig().Notes.MaxNodes = 3
+		defer func() { config.GetConfig().Notes.MaxNodes = maxNodes }()
+
+		e.POST("/files/").
+			WithQuery("Name", "too-large.cozy-note").
+			WithQuery("Type", "file").
+			WithHeader("Content-Type", consts.NoteMimeType).
+			WithHeader("Authorization", "Bearer "+token).
+			WithBytes([]byte("# Title\n\n* foo\n* bar\n")).
+			Expect().
+			Status(413).
+			Body().Contains(note.ErrNoteTooLarge.Error())
+
+		storage := testInstance.VFS()
+		_, err := readFile(storage, "/too-large.cozy-note")
+		assert.Error(t, err)
+	})
+
 	t.Run("CopyVersionWorksForNotes", func(t *testing.T) {
 		e := testutils.CreateTestClient(t, ts.URL)
 
@@ -73,13 +73,18 @@ type (
 		s *job.TriggerState
 	}
 	apiTriggerRequest struct {
-		Type            string          `json:"type"`
-		Arguments       string          `json:"arguments"`
-		WorkerType      string          `json:"worker"`
-		Message         json.RawMessage `json:"message"`
-		WorkerArguments json.RawMessage `json:"worker_arguments"`
-		Debounce        string          `json:"debounce"`
-		Options         *job.JobOptions `json:"options"`
+		Type            string                 `json:"type"`
+		Arguments       string                 `json:"arguments"`
+		WorkerType      string                 `json:"worker"`
+		Message         json.RawMessage        `json:"message"`
+		WorkerArguments json.RawMessage        `json:"worker_arguments"`
+		Debounce        string                 `json:"debounce"`
+		DebounceReset   bool                   `json:"debounce_reset"`
+		RateLimit       string                 `json:"rate_limit"`
+		Secret          string                 `json:"secret"`
+		Selector        map[string]interface{} `json:"selector"`
+		Jitter          float64                `json:"jitter"`
+		Options         *job.JobOptions        `json:"options"`
 	}
 )
 
@@ -132,6 +137,12 @@ func (t apiTrigger) Links() *jsonapi.LinksList {
 }
 
 func (t apiTrigger) MarshalJSON() ([]byte, error) {
+	// The secret of a webhook is never sent back to the clients
+	if t.t.Secret != "" {
+		infos := *t.t
+		infos.Secret = ""
+		return json.Marshal(&infos)
+	}
 	return json.Marshal(t.t)
 }
 
@@ -196,6 +207,8 @@ func pushJob(c echo.Context) error {
 		Manual:      req.Manual,
 		ForwardLogs: req.ForwardLogs,
 		Message:     job.Message(req.Arguments),
+
+		IdempotencyKey: c.Request().Header.Get("Idempotency-Key"),
 	}
 
 	if err := middlewares.Allow(c, permission.POST, jr); err != nil {
@@ -271,6 +284,22 @@ func newTrigger(c echo.Context) error {
 		if _, err := time.ParseDuration(req.Debounce); err != nil {
 			return jsonapi.InvalidAttribute("debounce", err)
 		}
+	} else if req.DebounceReset {
+		return jsonapi.InvalidAttribute("debounce_reset", errors.New("Only with a debounce"))
+	}
+	if req.RateLimit != "" {
+		if _, _, err := job.ParseRateLimit(req.RateLimit); err != nil {
+			return jsonapi.InvalidAttribute("rate_limit", err)
+		}
+	}
+	if req.Secret != "" && req.Type != "@webhook" {
+		return jsonapi.InvalidAttribute("secret", errors.New("Only for @webhook triggers"))
+	}
+	if len(req.Selector) > 0 && req.Type != "@event" {
+		return jsonapi.InvalidAttribute("selector", errors.New("Only for @event triggers"))
+	}
+	if req.Jitter != 0 && req.Type != "@every" {
+		return jsonapi.InvalidAttribute("jitter", errors.New("Only for @every triggers"))
 	}
 
 	// Handle metadata
@@ -288,13 +317,18 @@ func newTrigger(c echo.Context) error {
 		msg = req.WorkerArguments
 	}
 	t, err := job.NewTrigger(instance, job.TriggerInfos{
-		Type:       req.Type,
-		WorkerType: req.WorkerType,
-		Domain:     instance.Domain,
-		Arguments:  req.Arguments,
-		Debounce:   req.Debounce,
-		Options:    req.Options,
-		Metadata:   md,
+		Type:          req.Type,
+		WorkerType:    req.WorkerType,
+		Domain:        instance.Domain,
+		Arguments:     req.Arguments,
+		Debounce:      req.Debounce,
+		DebounceReset: req.DebounceReset,
+		RateLimit:     req.RateLimit,
+		Secret:        req.Secret,
+		Selector:      req.Selector,
+		Jitter:        req.Jitter,
+		Options:       req.Options,
+		Metadata:      md,
 	}, msg)
 	if err != nil {
 		return wrapJobsError(err)
@@ -359,6 +393,35 @@ func getTriggerState(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiTriggerState{t: infos, s: state}, nil)
 }
 
+func getTriggerNextRuns(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	n := 5
+	if queryN := c.QueryParam("n"); queryN != "" {
+		var err error
+		n, err = strconv.Atoi(queryN)
+		if err != nil || n < 1 {
+			return jsonapi.InvalidParameter("n", errors.New("Invalid number"))
+		}
+	}
+
+	sched := job.System()
+	t, err := sched.GetTrigger(instance, c.Param("trigger-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = middlewares.Allow(c, permission.GET, t); err != nil {
+		if !allowKonnectorForItsOwnTrigger(c, t.Infos()) {
+			return err
+		}
+	}
+
+	runs, err := sched.NextRuns(instance, t.ID(), n)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"next_runs": runs})
+}
+
 func getTriggerJobs(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -431,6 +494,44 @@ func patchTrigger(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiTrigger{infos, inst}, nil)
 }
 
+func pauseTrigger(c echo.Context) error {
+	return setTriggerPaused(c, true)
+}
+
+func resumeTrigger(c echo.Context) error {
+	return setTriggerPaused(c, false)
+}
+
+func setTriggerPaused(c echo.Context, paused bool) error {
+	inst := middlewares.GetInstance(c)
+	sched := job.System()
+	t, err := sched.GetTrigger(inst, c.Param("trigger-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.PATCH, t); err != nil {
+		if !allowKonnectorForItsOwnTrigger(c, t.Infos()) {
+			return err
+		}
+	}
+
+	if paused {
+		err = sched.PauseTrigger(inst, t.ID())
+	} else {
+		backfill, _ := strconv.ParseBool(c.QueryParam("backfill"))
+		err = sched.ResumeTrigger(inst, t.ID(), backfill)
+	}
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	t, err = sched.GetTrigger(inst, t.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, apiTrigger{t.Infos(), inst}, nil)
+}
+
 func launchTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	t, err := job.System().GetTrigger(instance, c.Param("trigger-id"))
@@ -440,17 +541,11 @@ func launchTrigger(c echo.Context) error {
 	if err = middlewares.Allow(c, permission.POST, t); err != nil {
 		return err
 	}
-	req := t.Infos().JobRequest()
-	req.Manual = true
-	j, err := job.System().PushJob(instance, req)
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+	j, err := job.System().FireTrigger(instance, t.ID(), force)
 	if err != nil {
 		return wrapJobsError(err)
 	}
-	if j.WorkerType == "client" {
-		if err := j.AckConsumed(); err != nil {
-			return wrapJobsError(err)
-		}
-	}
 	return jsonapi.Data(c, http.StatusCreated, apiJob{j}, nil)
 }
 
@@ -537,6 +632,10 @@ func fireWebhook(c echo.Context) error {
 	if err != nil {
 		return wrapJobsError(err)
 	}
+	signature := c.Request().Header.Get(job.WebhookSignatureHeader)
+	if !webhook.CheckSignature(payload, signature) {
+		return jsonapi.NewError(http.StatusUnauthorized, "Invalid signature")
+	}
 
 	manual := false
 	if c.QueryParam("Manual") == "true" {
@@ -624,6 +723,21 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{j}, nil)
 }
 
+func cancelJob(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	j, err := job.Get(inst, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.PATCH, j); err != nil {
+		return err
+	}
+	if err := job.System().CancelJob(inst, j.ID()); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func patchJob(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
 	j, err := job.Get(inst, c.Param("job-id"))
@@ -819,7 +933,10 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers/:trigger-id/state", getTriggerState)
 	router.GET("/triggers/:trigger-id/jobs", getTriggerJobs)
 	router.PATCH("/triggers/:trigger-id", patchTrigger)
+	router.GET("/triggers/:trigger-id/next-runs", getTriggerNextRuns)
 	router.POST("/triggers/:trigger-id/launch", launchTrigger)
+	router.POST("/triggers/:trigger-id/pause", pauseTrigger)
+	router.POST("/triggers/:trigger-id/resume", resumeTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
 	router.POST("/webhooks/bi", fireBIWebhook)
@@ -829,21 +946,24 @@ func Routes(router *echo.Group) {
 	router.DELETE("/purge", purgeJobs)
 	router.GET("/:job-id", getJob)
 	router.PATCH("/:job-id", patchJob)
+	router.POST("/:job-id/cancel", cancelJob)
 }
 
 func wrapJobsError(err error) error {
 	switch err {
-	case job.ErrNotFoundTrigger,
-		job.ErrNotFoundJob,
-		job.ErrUnknownWorker:
-		return jsonapi.NotFound(err)
-	case job.ErrUnknownTrigger,
-		job.ErrNotCronTrigger:
-		return jsonapi.InvalidAttribute("Type", err)
 	case limits.ErrRateLimitReached,
 		limits.ErrRateLimitExceeded:
 		return jsonapi.BadRequest(err)
 	}
+	if he := job.HTTPError(err); he != nil {
+		msg := he.Message.(*job.HTTPErrorMessage)
+		return &jsonapi.Error{
+			Status: he.Code,
+			Title:  http.StatusText(he.Code),
+			Code:   msg.Code,
+			Detail: msg.Detail,
+		}
+	}
 	return err
 }
 
@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"encoding/hex"
 	"strings"
 	"testing"
 	"time"
@@ -169,7 +170,7 @@ func TestJobs(t *testing.T) {
 						WithHeader("Authorization", "Bearer "+tokenNone).
 						WithHeader("Content-Type", "application/json").
 						WithBytes([]byte(`{"data": {"attributes": {"arguments": "foobar"}}}`)).
-						Expect().Status(404)
+						Expect().Status(400)
 	})
 
 	t.Run("AddGetAndDeleteTriggerAt", func(t *testing.T) {
@@ -481,6 +482,75 @@ func TestJobs(t *testing.T) {
 		})
 	})
 
+	t.Run("FireSignedWebhook", func(t *testing.T) {
+		var triggerID string
+		secret := "my-webhook-secret"
+		body := []byte(`{"foo":"bar"}`)
+
+		t.Run("AddSuccess", func(t *testing.T) {
+			e := testutils.CreateTestClient(t, ts.URL)
+
+			obj := e.POST("/jobs/triggers").
+				WithHeader("Authorization", "Bearer "+token).
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(`{
+        "data": {
+          "attributes": {
+            "type": "@webhook",
+            "worker": "print",
+            "secret": "` + secret + `"
+          }
+        }
+      }`)).
+				Expect().Status(201).
+				JSON(httpexpect.ContentOpts{MediaType: "application/vnd.api+json"}).
+				Object()
+
+			data := obj.Value("data").Object()
+			triggerID = data.Value("id").String().NotEmpty().Raw()
+			data.Value("attributes").Object().NotContainsKey("secret")
+		})
+
+		t.Run("FireWithoutSignature", func(t *testing.T) {
+			e := testutils.CreateTestClient(t, ts.URL)
+
+			e.POST("/jobs/webhooks/"+triggerID).
+				WithHeader("Content-Type", "application/json").
+				WithBytes(body).
+				Expect().Status(401)
+		})
+
+		t.Run("FireWithInvalidSignature", func(t *testing.T) {
+			e := testutils.CreateTestClient(t, ts.URL)
+
+			signature := hex.EncodeToString(job.SignWebhookBody("wrong-secret", body))
+			e.POST("/jobs/webhooks/"+triggerID).
+				WithHeader("Content-Type", "application/json").
+				WithHeader(job.WebhookSignatureHeader, "sha256="+signature).
+				WithBytes(body).
+				Expect().Status(401)
+		})
+
+		t.Run("FireWithValidSignature", func(t *testing.T) {
+			e := testutils.CreateTestClient(t, ts.URL)
+
+			signature := hex.EncodeToString(job.SignWebhookBody(secret, body))
+			e.POST("/jobs/webhooks/"+triggerID).
+				WithHeader("Content-Type", "application/json").
+				WithHeader(job.WebhookSignatureHeader, "sha256="+signature).
+				WithBytes(body).
+				Expect().Status(204)
+		})
+
+		t.Run("DeleteSuccess", func(t *testing.T) {
+			e := testutils.CreateTestClient(t, ts.URL)
+
+			e.DELETE("/jobs/triggers/"+triggerID).
+				WithHeader("Authorization", "Bearer "+token).
+				Expect().Status(204)
+		})
+	})
+
 	t.Run("GetAllJobs", func(t *testing.T) {
 		tokenTriggers, _ := testInstance.MakeJWT(consts.CLIAudience, "CLI", consts.Triggers, "", time.Now())
 
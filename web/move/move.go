@@ -272,7 +272,7 @@ func wsImporting(c echo.Context) error {
 			if len(worker) != 1 || worker[0] != "import" || len(state) != 1 {
 				continue
 			}
-			if s := job.State(state[0]); s != job.Done && s != job.Errored {
+			if !job.State(state[0]).Ended() {
 				continue
 			}
 			wsDone(ws, inst)
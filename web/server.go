@@ -5,6 +5,7 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -148,7 +149,15 @@ func ListenAndServe(services *stack.Services) (*Servers, error) {
 	}
 
 	servers := NewServers()
-	err = servers.Start(major, "major", config.ServerAddr())
+	if tlsConf := config.GetConfig().TLS; tlsConf.Enabled() {
+		conf, err := tlsConf.ServerConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the TLS configuration: %w", err)
+		}
+		err = servers.StartTLS(major, "major", config.ServerAddr(), conf)
+	} else {
+		err = servers.Start(major, "major", config.ServerAddr())
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to start major server: %w", err)
 	}
@@ -188,6 +197,12 @@ func NewServers() *Servers {
 // is not a valid IPv4/IPv6/hostname or if the port not present an error is
 // returned.
 func (s *Servers) Start(handler http.Handler, name string, addr string) error {
+	return s.StartTLS(handler, name, addr, nil)
+}
+
+// StartTLS works like Start, but the server serves HTTPS with the given TLS
+// configuration. A nil configuration means plain HTTP.
+func (s *Servers) StartTLS(handler http.Handler, name string, addr string, conf *tls.Config) error {
 	addrs := []string{}
 
 	if len(addr) == 0 {
@@ -217,6 +232,9 @@ func (s *Servers) Start(handler http.Handler, name string, addr string) error {
 		if err != nil {
 			return err
 		}
+		if conf != nil {
+			l = tls.NewListener(l, conf)
+		}
 
 		writer := logger.WithNamespace("stack").Writer()
 		logger := log.New(writer, "", 0)
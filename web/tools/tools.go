@@ -1,9 +1,11 @@
 package tools
 
 import (
+	"net/http"
 	"runtime"
 	"runtime/pprof"
 
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/labstack/echo/v4"
 )
 
@@ -15,7 +17,14 @@ func HeapProfiling(c echo.Context) error {
 	return pprof.WriteHeapProfile(res)
 }
 
+// EffectiveConfig returns the configuration used by the stack, with the
+// secrets masked.
+func EffectiveConfig(c echo.Context) error {
+	return c.JSON(http.StatusOK, config.GetConfig().Redacted())
+}
+
 // Routes sets the routing for the tools (like profiling).
 func Routes(router *echo.Group) {
 	router.GET("/pprof/heap", HeapProfiling)
+	router.GET("/config", EffectiveConfig)
 }
@@ -166,7 +166,7 @@ func beforeHookKonnector(j *job.Job) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if state.Status == job.Errored {
+	if state.Status.Failed() {
 		if strings.HasPrefix(state.LastError, konnErrorLoginFailed) ||
 			strings.HasPrefix(state.LastError, konnErrorUserActionNeeded) {
 			j.Logger().